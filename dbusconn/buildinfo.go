@@ -0,0 +1,36 @@
+package dbusconn
+
+import (
+	"runtime"
+
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const propertyBuildInfo = "BuildInfo"
+
+// Build information of the adapter, set at build time with
+// -ldflags "-X github.com/ubiant/pif/dbusconn.Version=... -X github.com/ubiant/pif/dbusconn.GitCommit=... -X github.com/ubiant/pif/dbusconn.BuildTime=..."
+var (
+	Version   = "unknown"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
+)
+
+// buildInfo returns the build information exported in the property BuildInfo
+func buildInfo() map[string]string {
+	return map[string]string{
+		"Version":   Version,
+		"GitCommit": GitCommit,
+		"GoVersion": runtime.Version(),
+		"BuildTime": BuildTime,
+	}
+}
+
+func buildInfoProperty() *prop.Prop {
+	return &prop.Prop{
+		Value:    buildInfo(),
+		Writable: false,
+		Emit:     prop.EmitConst,
+		Callback: nil,
+	}
+}
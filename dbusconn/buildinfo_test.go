@@ -0,0 +1,30 @@
+package dbusconn
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfoProperty(t *testing.T) {
+	// The variables are given with -ldflags -X at build time
+	version := Version
+	t.Cleanup(func() { Version = version })
+	Version = "1.2.3"
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+
+	value, err := c.property(c.root, dbusProtocolInterface, propertyBuildInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := value.Value().(map[string]string)
+	if !ok || len(info) != 4 {
+		t.Fatalf("BuildInfo: %v", value)
+	}
+	for key, want := range map[string]string{"Version": "1.2.3", "GitCommit": GitCommit, "GoVersion": runtime.Version(), "BuildTime": BuildTime} {
+		if info[key] != want {
+			t.Errorf("%s: %q, want %q", key, info[key], want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const propertyCalibration = "Calibration"
+
+// calibration is the format of the calibration data applied to the raw values by GetValueScaled
+// Points is a curve of [raw, calibrated] pairs interpolated linearly, Gain and Offset are used when there is none
+type calibration struct {
+	Points [][2]float64 `json:"points"`
+	Gain   *float64     `json:"gain"`
+	Offset float64      `json:"offset"`
+}
+
+// parseCalibration returns the calibration of the data, nil if the data is empty or not in the calibration format
+func parseCalibration(data []byte) *calibration {
+	if len(data) == 0 {
+		return nil
+	}
+	var c calibration
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil
+	}
+	sort.Slice(c.Points, func(a, b int) bool { return c.Points[a][0] < c.Points[b][0] })
+	return &c
+}
+
+// apply returns the calibrated value, the curve is extended by its first and last segments
+func (c *calibration) apply(raw float64) float64 {
+	if len(c.Points) == 1 {
+		return c.Points[0][1]
+	}
+	if len(c.Points) > 1 {
+		n := sort.Search(len(c.Points)-1, func(k int) bool { return c.Points[k+1][0] >= raw })
+		if n >= len(c.Points)-1 {
+			n = len(c.Points) - 2
+		}
+		x0, y0, x1, y1 := c.Points[n][0], c.Points[n][1], c.Points[n+1][0], c.Points[n+1][1]
+		if x1 == x0 {
+			return y0
+		}
+		return y0 + (raw-x0)*(y1-y0)/(x1-x0)
+	}
+	gain := 1.0
+	if c.Gain != nil {
+		gain = *c.Gain
+	}
+	return raw*gain + c.Offset
+}
+
+// SetCalibration set the value of the property Calibration, kept with the definition of the item
+// The data in the JSON format {"points": [[raw, value], ...]} or {"gain": g, "offset": o} is applied by GetValueScaled
+// before the scaling, other data is only stored
+func (i *Item) SetCalibration(data []byte) {
+	if len(data) > 0 && parseCalibration(data) == nil {
+		i.log.Warning("Calibration of the item", i.ItemID, "stored but not applied, it is not in the calibration format")
+	}
+	i.Lock()
+	i.Calibration = data
+	i.Unlock()
+
+	if i.properties == nil {
+		return
+	}
+
+	i.log.Info("Calibration of the item", i.ItemID, "set to", string(data))
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyCalibration, data)
+}
+
+// GetCalibration is the dbus method to get the calibration data of the item
+func (i *Item) GetCalibration() ([]byte, *dbus.Error) {
+	i.Lock()
+	defer i.Unlock()
+	return i.Calibration, nil
+}
@@ -0,0 +1,91 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCalibratedValues(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+
+	for _, test := range []struct {
+		name        string
+		calibration string
+		raw         string
+		want        float64
+	}{
+		{"none", "", "20", 20},
+		{"gain and offset", `{"gain":2,"offset":1}`, "20", 41},
+		{"offset only", `{"offset":-3}`, "20", 17},
+		{"on the curve", `{"points":[[10,0],[0,100],[20,50]]}`, "5", 50},
+		{"after the curve", `{"points":[[0,100],[10,0]]}`, "20", -100},
+		{"before the curve", `{"points":[[10,20],[20,40]]}`, "0", 0},
+		{"single point", `{"points":[[10,3]]}`, "20", 3},
+		{"not in the format", `raw bytes`, "20", 20},
+	} {
+		i.SetCalibration([]byte(test.calibration))
+		i.SetValue([]byte(test.raw))
+		var value float64
+		if err := c.call(c.root+"/D1/I1", dbusItemInterface+".GetValueScaled").Store(&value); err != nil || value != test.want {
+			t.Errorf("%s: %v %v, want %v", test.name, value, err, test.want)
+		}
+	}
+
+	// The calibration applies before the scaling
+	i.SetCalibration([]byte(`{"gain":2}`))
+	i.SetUnit("°C", 0.5, 1)
+	i.SetValue([]byte("20"))
+	var value float64
+	if err := c.call(c.root+"/D1/I1", dbusItemInterface+".GetValueScaled").Store(&value); err != nil || value != 21 {
+		t.Errorf("calibrated and scaled value: %v %v", value, err)
+	}
+}
+
+func TestCalibrationSavedAndRestored(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	addTestItem(t, d, "I1", "T").SetCalibration([]byte(`{"gain":3}`))
+	addTestItem(t, d, "I2", "T")
+
+	saved, err := json.Marshal(ProtocolJson{Protocols: map[string][]DeviceJson{dc.ProtocolName: p.snapshot()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc ProtocolJson
+	if err := json.Unmarshal(saved, &doc); err != nil {
+		t.Fatal(err)
+	}
+	restored := &Dbus{}
+	r := newTestAdapter(t, restored, nil)
+	doc.Protocols = map[string][]DeviceJson{restored.ProtocolName: doc.Protocols[dc.ProtocolName]}
+	if failures := restored.restoreProtocols(doc); len(failures) != 0 {
+		t.Fatal(failures)
+	}
+
+	c := newTestClient(t, restored)
+	var calibration []byte
+	if err := c.call(c.root+"/D1/I1", dbusItemInterface+".GetCalibration").Store(&calibration); err != nil || string(calibration) != `{"gain":3}` {
+		t.Errorf("restored calibration: %s %v", calibration, err)
+	}
+	if value, err := c.property(c.root+"/D1/I1", dbusItemInterface, propertyCalibration); err != nil || string(value.Value().([]byte)) != `{"gain":3}` {
+		t.Errorf("restored property %s: %v %v", propertyCalibration, value, err)
+	}
+	var none []byte
+	if err := c.call(c.root+"/D1/I2", dbusItemInterface+".GetCalibration").Store(&none); err != nil || len(none) != 0 {
+		t.Errorf("calibration of an item saved without one: %s %v", none, err)
+	}
+
+	d = testDevice(t, r, "D1")
+	d.Lock()
+	i := d.Items["I1"]
+	d.Unlock()
+	i.SetValue([]byte("2"))
+	var value float64
+	if err := c.call(c.root+"/D1/I1", dbusItemInterface+".GetValueScaled").Store(&value); err != nil || value != 6 {
+		t.Errorf("value with the restored calibration: %v %v", value, err)
+	}
+}
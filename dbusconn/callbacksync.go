@@ -0,0 +1,168 @@
+package dbusconn
+
+import (
+	"context"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// ErrCallbackTimeout is returned when the protocol does not answer a Sync callback within SyncCallbackTimeout
+var ErrCallbackTimeout = dbus.NewError(dbusProtocolInterface+".Error.CallbackTimeout", []interface{}{"The protocol did not answer in time"})
+
+func (dc *Dbus) syncCallbackTimeout() time.Duration {
+	if dc.SyncCallbackTimeout > 0 {
+		return dc.SyncCallbackTimeout
+	}
+	return callTimeout
+}
+
+// runSync calls a Sync callback and waits for its result at most SyncCallbackTimeout
+// The context given to the callback is canceled once the wait is over, an error of the callback is returned as is
+// if it is a *dbus.Error, as a CallbackFailed error of the interface otherwise
+func (dc *Dbus) runSync(parent context.Context, iface string, cb func(context.Context) error) *dbus.Error {
+	ctx, cancel := context.WithTimeout(parent, dc.syncCallbackTimeout())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() { result <- cb(ctx) }()
+	select {
+	case err := <-result:
+		if err == nil {
+			return nil
+		}
+		return asDbusError(err, iface+".Error.CallbackFailed")
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrCallbackTimeout
+		}
+		return dbus.MakeFailedError(ctx.Err())
+	}
+}
+
+// asDbusError returns the error as is if it is a *dbus.Error, as an error with the name otherwise
+func asDbusError(err error, name string) *dbus.Error {
+	if dbusErr, ok := err.(*dbus.Error); ok {
+		return dbusErr
+	}
+	return dbus.NewError(name, []interface{}{err.Error()})
+}
+
+// addDeviceSync calls AddDeviceSync for the device and removes it if the protocol rejects it
+// A new device is given by newDevice and exported with acceptDevice once accepted, so that the clients never see a
+// rejected device. The device can be canceled with CancelAdd meanwhile, the protocol is not told about the removal
+// of a device it rejected.
+func (p *Protocol) addDeviceSync(d *Device) *dbus.Error {
+	err := p.callAddDeviceSync(d)
+	if err == nil {
+		return nil
+	}
+
+	p.Lock()
+	if p.Devices[d.DevID] == d {
+		d.Lock()
+		d.removalHandled = true
+		d.Unlock()
+		removeDevice(d)
+	}
+	p.Unlock()
+	return err
+}
+
+// callAddDeviceSync calls AddDeviceSync for the device, the device is in the adding state until it returns
+func (p *Protocol) callAddDeviceSync(d *Device) *dbus.Error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.Lock()
+	d.adding = true
+	d.cancelAdd = cancel
+	d.Unlock()
+
+	err := p.dc.runSync(ctx, dbusProtocolInterface, func(ctx context.Context) error { return p.addDeviceSyncCB.AddDeviceSync(ctx, d) })
+	d.Lock()
+	d.adding = false
+	d.Unlock()
+	if err != nil {
+		p.log.Warning("Device", d.DevID, "rejected by the protocol:", err.Error())
+	}
+	return err
+}
+
+// acceptDevice exports the device accepted by AddDeviceSync and emits DeviceAdded, unless it was removed meanwhile
+func (p *Protocol) acceptDevice(d *Device) {
+	p.Lock()
+	defer p.Unlock()
+	if p.Devices[d.DevID] != d {
+		return
+	}
+	d.Lock()
+	d.accepting = false
+	d.Unlock()
+	d.export(false)
+}
+
+// removeDeviceSync calls RemoveDeviceSync and removes the device only if the protocol accepts it
+func (p *Protocol) removeDeviceSync(d *Device) *dbus.Error {
+	err := p.dc.runSync(context.Background(), dbusProtocolInterface, func(ctx context.Context) error { return p.removeDeviceSyncCB.RemoveDeviceSync(ctx, d) })
+	if err != nil {
+		p.log.Warning("Removal of the device", d.DevID, "rejected by the protocol:", err.Error())
+		return err
+	}
+
+	p.Lock()
+	if p.Devices[d.DevID] == d {
+		d.Lock()
+		d.removalHandled = true
+		d.Unlock()
+		removeDevice(d)
+	}
+	p.Unlock()
+	return nil
+}
+
+// addItemSync calls AddItemSync for the item just added and removes it if the protocol rejects it
+// A new item is given by newItem and exported with acceptItem once accepted, so that the clients never see a
+// rejected item.
+func (d *Device) addItemSync(i *Item) *dbus.Error {
+	err := d.dc.runSync(context.Background(), dbusDeviceInterface, func(ctx context.Context) error { return d.addItemSyncCB.AddItemSync(ctx, i) })
+	if err == nil {
+		return nil
+	}
+
+	d.log.Warning("Item", i.ItemID, "of the device", d.DevID, "rejected by the protocol:", err.Error())
+	d.Lock()
+	if d.Items[i.ItemID] == i {
+		i.removalHandled = true
+		removeItem(i)
+	}
+	d.Unlock()
+	return err
+}
+
+// acceptItem exports the item accepted by AddItemSync and emits ItemAdded, unless it was removed meanwhile
+func (d *Device) acceptItem(i *Item) {
+	d.Lock()
+	defer d.Unlock()
+	if d.Items[i.ItemID] != i {
+		return
+	}
+	i.accepting = false
+	i.export()
+}
+
+// removeItemSync calls RemoveItemSync and removes the item only if the protocol accepts it
+func (d *Device) removeItemSync(i *Item) *dbus.Error {
+	err := d.dc.runSync(context.Background(), dbusDeviceInterface, func(ctx context.Context) error { return d.removeItemSyncCB.RemoveItemSync(ctx, i) })
+	if err != nil {
+		d.log.Warning("Removal of the item", i.ItemID, "of the device", d.DevID, "rejected by the protocol:", err.Error())
+		return err
+	}
+
+	d.Lock()
+	if d.Items[i.ItemID] == i {
+		i.removalHandled = true
+		removeItem(i)
+	}
+	d.Unlock()
+	return nil
+}
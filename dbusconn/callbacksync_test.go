@@ -0,0 +1,256 @@
+package dbusconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const errorRefused = "com.ubiant.Test.Error.Refused"
+
+// syncDriver answers the Sync callbacks according to the ID: the adds of bad are rejected, the ones of refused are
+// rejected with a dbus error, the ones of slow wait for their context, the removals of keep are rejected
+type syncDriver struct {
+	recorder
+}
+
+func (r *syncDriver) answer(ctx context.Context, call string, id string) error {
+	r.record(call + " " + id)
+	switch {
+	case strings.HasPrefix(id, "bad"):
+		return errors.New("unsupported")
+	case strings.HasPrefix(id, "refused"):
+		return dbus.NewError(errorRefused, []interface{}{"not paired"})
+	case strings.HasPrefix(id, "slow"):
+		<-ctx.Done()
+		r.record(call + " " + id + " canceled")
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (r *syncDriver) AddDeviceSync(ctx context.Context, d *Device) error {
+	return r.answer(ctx, "AddDevice", d.DevID)
+}
+
+func (r *syncDriver) RemoveDeviceSync(ctx context.Context, d *Device) error {
+	if strings.HasPrefix(d.DevID, "keep") {
+		return errors.New("still paired")
+	}
+	return nil
+}
+
+func (r *syncDriver) AddItemSync(ctx context.Context, i *Item) error {
+	return r.answer(ctx, "AddItem", i.ItemID)
+}
+
+func (r *syncDriver) RemoveItemSync(ctx context.Context, i *Item) error {
+	if strings.HasPrefix(i.ItemID, "keep") {
+		return errors.New("still used")
+	}
+	return nil
+}
+
+func TestSyncAddErrorsReturned(t *testing.T) {
+	dc := &Dbus{SyncCallbackTimeout: 50 * time.Millisecond}
+	driver := &syncDriver{}
+	p := newTestAdapter(t, dc, driver)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	for devID, want := range map[string]string{
+		"bad1":     dbusProtocolInterface + ".Error.CallbackFailed",
+		"refused1": errorRefused,
+		"slow1":    ErrCallbackTimeout.Name,
+	} {
+		err := c.call(c.root, dbusProtocolInterface+".AddDevice", devID, "", "T", "1", []byte("{}")).Err
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != want {
+			t.Errorf("AddDevice %s: %v, want %s", devID, err, want)
+		}
+		if hasDevice(p, devID) {
+			t.Errorf("rejected device %s added", devID)
+		}
+	}
+	waitFor(t, "the cancel of the callback", func() bool {
+		return strings.Contains(strings.Join(driver.recorded(), ","), "AddDevice slow1 canceled")
+	})
+
+	// The rejected devices are never seen by the clients, not even for a while
+	if signals := c.flush(); count(signals, signalDeviceAdded) != 0 || count(signals, signalDeviceRemoved) != 0 || count(signals, signalInterfacesAdded) != 0 {
+		t.Errorf("signals of the rejected devices: %v", names(signals))
+	}
+	if devices := dc.Metrics()[metricDevices]; devices != 0 {
+		t.Errorf("%d devices counted once rejected", devices)
+	}
+
+	d := addTestDevice(t, p, "D1", "T")
+	path := c.root + "/D1"
+	err := c.call(path, dbusDeviceInterface+".AddItem", "bad1", "T", "1", []byte("{}")).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != dbusDeviceInterface+".Error.CallbackFailed" || dbusErr.Body[0] != "unsupported" {
+		t.Errorf("AddItem rejected: %v", err)
+	}
+	addTestItem(t, d, "I1", "T")
+	if hasItem(d, "bad1") || !hasItem(d, "I1") {
+		t.Error("items of the device once one is rejected")
+	}
+	signals := underPath(c.flush(), path)
+	if want := []string{path + " DeviceAdded", path + "/I1 ItemAdded"}; strings.Join(names(withoutInterfaces(signals)), ",") != strings.Join(want, ",") {
+		t.Errorf("signals of the accepted device and item: %v, want %v", names(signals), want)
+	}
+}
+
+// withoutInterfaces returns the signals other than the ones of the ObjectManager
+func withoutInterfaces(signals []*dbus.Signal) []*dbus.Signal {
+	var list []*dbus.Signal
+	for _, s := range signals {
+		if !strings.HasPrefix(s.Name, dbusObjectManagerInterface+".") {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func TestSyncRemoveErrorsReturned(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &syncDriver{})
+	d := addTestDevice(t, p, "keep1", "T")
+	addTestItem(t, d, "keepI", "T")
+	addTestItem(t, d, "I1", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/keep1"
+	c.flush()
+
+	err := c.call(path, dbusDeviceInterface+".RemoveItem", "keepI").Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != dbusDeviceInterface+".Error.CallbackFailed" || dbusErr.Body[0] != "still used" {
+		t.Errorf("RemoveItem rejected: %v", err)
+	}
+	if err := c.call(path, dbusDeviceInterface+".RemoveItem", "I1").Err; err != nil {
+		t.Error(err)
+	}
+	err = c.call(c.root, dbusProtocolInterface+".RemoveDevice", "keep1").Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != dbusProtocolInterface+".Error.CallbackFailed" {
+		t.Errorf("RemoveDevice rejected: %v", err)
+	}
+
+	if !hasDevice(p, "keep1") || !hasItem(d, "keepI") || hasItem(d, "I1") {
+		t.Error("tree once the removals are rejected")
+	}
+	if _, err := c.property(path+"/keepI", dbusItemInterface, propertyValue); err != nil {
+		t.Error("item kept no longer exported:", err)
+	}
+	signals := withoutInterfaces(underPath(c.flush(), path))
+	if want := []string{path + "/I1 ItemRemoved"}; strings.Join(names(signals), ",") != strings.Join(want, ",") {
+		t.Errorf("signals of the removals: %v, want %v", names(signals), want)
+	}
+}
+
+func TestRemoveBridgeKeepsABridgeNotEmpty(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, &syncDriver{})
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	addTestDevice(t, bridge.Protocol, "D1", "T")
+	addTestDevice(t, bridge.Protocol, "keep1", "T")
+	c := newTestClient(t, dc)
+	c.flush()
+
+	err := c.call(c.root, dbusProtocolInterface+".RemoveBridge", "b").Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrBridgeNotEmpty.Name {
+		t.Fatalf("RemoveBridge with a device kept: %v", err)
+	}
+	if _, present := testBridge(dc, "b"); !present || hasDevice(bridge.Protocol, "D1") || !hasDevice(bridge.Protocol, "keep1") {
+		t.Error("bridge and devices once the removal is rejected")
+	}
+	if _, err := c.property(c.root+"_b", dbusProtocolInterface, propertyBridgeState); err != nil {
+		t.Error("bridge kept no longer exported:", err)
+	}
+	signals := c.flush()
+	if count(signals, signalBridgeRemoved) != 0 || count(underPath(signals, c.root+"_b/D1"), signalDeviceRemoved) != 1 {
+		t.Errorf("signals of the rejected removal: %v", names(signals))
+	}
+}
+
+func TestImportTreeIncomplete(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &syncDriver{})
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	addTestDevice(t, bridge.Protocol, "keep1", "T")
+	c := newTestClient(t, dc)
+
+	// The rejected device and the bridge which cannot be removed do not stop the rest of the import
+	document := treeDocument(t, map[string]map[string][]string{
+		dc.ProtocolName: {"D1": {"I1", "bad2"}, "bad1": {}, "D2": {}},
+	})
+	err := c.call(c.root, dbusProtocolInterface+".ImportTree", document, true).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrImportIncomplete.Name {
+		t.Fatalf("ImportTree with rejections: %v", err)
+	}
+	if !hasDevice(p, "D1") || !hasDevice(p, "D2") || hasDevice(p, "bad1") {
+		t.Error("devices of the incomplete import")
+	}
+	d := testDevice(t, p, "D1")
+	if !hasItem(d, "I1") || hasItem(d, "bad2") {
+		t.Error("items of the incomplete import")
+	}
+	if _, present := testBridge(dc, "b"); !present {
+		t.Error("bridge whose device is kept removed")
+	}
+}
+
+func TestConcurrentSyncAddsNeverFlicker(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &syncDriver{})
+	c := newTestClient(t, dc)
+	c.flush()
+
+	// The accepted and the rejected devices are added at the same time, the rejected ones are never announced and
+	// the accepted ones once
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for m := 0; m < 10; m++ {
+				devID := fmt.Sprintf("D%d_%d", n, m)
+				if m%2 == 1 {
+					devID = "bad" + devID
+				}
+				_, err := p.AddDevice(devID, "", "T", "1", []byte("{}"))
+				if rejected := strings.HasPrefix(devID, "bad"); (err != nil) != rejected {
+					t.Errorf("AddDevice %s: %v", devID, err)
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	signals := c.flush()
+	for n := 0; n < 4; n++ {
+		for m := 0; m < 10; m++ {
+			devID := fmt.Sprintf("D%d_%d", n, m)
+			if m%2 == 1 {
+				devID = "bad" + devID
+			}
+			want := 1
+			if strings.HasPrefix(devID, "bad") {
+				want = 0
+			}
+			if added := count(onPath(signals, c.root+"/"+devID), signalDeviceAdded); added != want || hasDevice(p, devID) != (want == 1) {
+				t.Errorf("%s announced %d times", devID, added)
+			}
+		}
+	}
+	if count(signals, signalDeviceRemoved) != 0 {
+		t.Errorf("devices removed: %v", names(withMember(signals, signalDeviceRemoved)))
+	}
+}
@@ -0,0 +1,77 @@
+package dbusconn
+
+import (
+	"sort"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// SignalVersionLegacy is the version of the lifecycle signals without the sequence number
+	SignalVersionLegacy uint32 = 1
+	// SignalVersionSequenced is the version of the lifecycle signals ending with their sequence number
+	SignalVersionSequenced uint32 = 2
+)
+
+// lifecycleSignal is the arguments of a lifecycle signal with its sequence number
+type lifecycleSignal struct {
+	args     []interface{}
+	sequence uint64
+}
+
+// NegotiateSignals is the dbus method for a client to announce the latest signal version it supports
+// It returns the version the client receives. The legacy signals are broadcast, the clients supporting
+// SignalVersionSequenced also receive the sequenced ones addressed to them, unless SignalSequence broadcasts them
+func (dc *Dbus) NegotiateSignals(sender dbus.Sender, version uint32) (uint32, *dbus.Error) {
+	if version > SignalVersionSequenced {
+		version = SignalVersionSequenced
+	}
+	if version < SignalVersionLegacy {
+		version = SignalVersionLegacy
+	}
+	dc.Log.Info("NegotiateSignals called - client:", sender, "version:", version)
+
+	dc.clientsLock.Lock()
+	defer dc.clientsLock.Unlock()
+	if dc.capabilities == nil {
+		dc.capabilities = make(map[string]uint32)
+	}
+	if version == SignalVersionLegacy {
+		delete(dc.capabilities, string(sender))
+	} else {
+		dc.capabilities[string(sender)] = version
+	}
+	return version, nil
+}
+
+// sequencedClients returns the bus names of the clients supporting SignalVersionSequenced
+func (dc *Dbus) sequencedClients() []string {
+	dc.clientsLock.Lock()
+	defer dc.clientsLock.Unlock()
+	clients := make([]string, 0, len(dc.capabilities))
+	for name, version := range dc.capabilities {
+		if version >= SignalVersionSequenced {
+			clients = append(clients, name)
+		}
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// emitLifecycle emits a lifecycle signal in the versions expected by the clients
+func (dc *Dbus) emitLifecycle(path dbus.ObjectPath, signal string, s lifecycleSignal) error {
+	return dc.emit(path, func() error {
+		sequenced := append(append([]interface{}{}, s.args...), s.sequence)
+		if dc.SignalSequence {
+			return dc.connection().Emit(path, signal, sequenced...)
+		}
+
+		err := dc.connection().Emit(path, signal, s.args...)
+		for _, client := range dc.sequencedClients() {
+			if sendErr := dc.EmitTo(client, path, signal, sequenced...); sendErr != nil {
+				dc.Log.Warning("Fail to send the signal", signal, "to", client, sendErr)
+			}
+		}
+		return err
+	})
+}
@@ -0,0 +1,52 @@
+package dbusconn
+
+import (
+	"strings"
+	"testing"
+)
+
+// deviceAdded returns, for each DeviceAdded of the device received by the client, if it ends with a sequence number
+func deviceAdded(c *testClient, path string) []bool {
+	var shapes []bool
+	for _, s := range onPath(c.flush(), path) {
+		if strings.HasSuffix(s.Name, "."+signalDeviceAdded) {
+			_, sequenced := s.Body[len(s.Body)-1].(uint64)
+			shapes = append(shapes, sequenced)
+		}
+	}
+	return shapes
+}
+
+func TestNegotiatedSignalVersions(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	legacy := newTestClient(t, dc)
+	capable := newTestClient(t, dc)
+
+	var version uint32
+	if err := capable.call(capable.root, dbusProtocolInterface+".NegotiateSignals", uint32(7)).Store(&version); err != nil || version != SignalVersionSequenced {
+		t.Fatalf("NegotiateSignals: %d %v", version, err)
+	}
+	addTestDevice(t, p, "D1", "T")
+	// The capable client also receives the broadcast legacy signal
+	if shapes := deviceAdded(capable, capable.root+"/D1"); len(shapes) != 2 || shapes[0] == shapes[1] {
+		t.Errorf("signals of the capable client, sequenced: %v", shapes)
+	}
+
+	if err := capable.call(capable.root, dbusProtocolInterface+".NegotiateSignals", SignalVersionLegacy).Store(&version); err != nil || version != SignalVersionLegacy {
+		t.Fatalf("NegotiateSignals back to legacy: %d %v", version, err)
+	}
+	addTestDevice(t, p, "D2", "T")
+	if shapes := deviceAdded(capable, capable.root+"/D2"); len(shapes) != 1 || shapes[0] {
+		t.Errorf("signals of the client back to legacy, sequenced: %v", shapes)
+	}
+	// The legacy client is flushed last, it stops at the barrier of the first flush of the capable client
+	if shapes := deviceAdded(legacy, legacy.root+"/D1"); len(shapes) != 1 || shapes[0] {
+		t.Errorf("signals of the legacy client, sequenced: %v", shapes)
+	}
+
+	// A capable client leaving the bus is forgotten
+	capable.call(capable.root, dbusProtocolInterface+".NegotiateSignals", SignalVersionSequenced)
+	capable.conn.Close()
+	waitFor(t, "the capable client to be forgotten", func() bool { return len(dc.sequencedClients()) == 0 })
+}
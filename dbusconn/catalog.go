@@ -0,0 +1,35 @@
+package dbusconn
+
+import "github.com/godbus/dbus/v5"
+
+// RegisterSupportedType adds a device or item type to the catalog of the types supported by the adapter
+func (dc *Dbus) RegisterSupportedType(typeID string, version string) {
+	dc.supportedTypesLock.Lock()
+	defer dc.supportedTypesLock.Unlock()
+	if dc.supportedTypes == nil {
+		dc.supportedTypes = make(map[string]string)
+	}
+	dc.supportedTypes[typeID] = version
+}
+
+// GetSupportedTypes is the dbus method to get the catalog of the supported types with their version
+func (r *RootProto) GetSupportedTypes() (map[string]string, *dbus.Error) {
+	r.dc.supportedTypesLock.Lock()
+	defer r.dc.supportedTypesLock.Unlock()
+	types := make(map[string]string, len(r.dc.supportedTypes))
+	for typeID, version := range r.dc.supportedTypes {
+		types[typeID] = version
+	}
+	return types, nil
+}
+
+// isSupportedType checks the type against the catalog when RejectUnsupportedTypes is set
+func (dc *Dbus) isSupportedType(typeID string) bool {
+	if !dc.RejectUnsupportedTypes {
+		return true
+	}
+	dc.supportedTypesLock.Lock()
+	defer dc.supportedTypesLock.Unlock()
+	_, present := dc.supportedTypes[typeID]
+	return present
+}
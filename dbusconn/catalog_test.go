@@ -0,0 +1,43 @@
+package dbusconn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestSupportedTypesCatalog(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	dc.RegisterSupportedType("Light", "1")
+	dc.RegisterSupportedType("Shutter", "2")
+	dc.RegisterSupportedType("Light", "3")
+	c := newTestClient(t, dc)
+
+	var types map[string]string
+	if err := c.call(c.root, dbusProtocolInterface+".GetSupportedTypes").Store(&types); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"Light": "3", "Shutter": "2"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("GetSupportedTypes: %v, want %v", types, want)
+	}
+	// Without RejectUnsupportedTypes the catalog is only informative
+	addTestDevice(t, p, "D1", "Unknown")
+}
+
+func TestRejectUnsupportedTypes(t *testing.T) {
+	dc := &Dbus{RejectUnsupportedTypes: true}
+	p := newTestAdapter(t, dc, nil)
+	dc.RegisterSupportedType("Light", "1")
+	c := newTestClient(t, dc)
+
+	addTestDevice(t, p, "D1", "Light")
+	err := c.call(c.root, dbusProtocolInterface+".AddDevice", "D2", "", "Unknown", "1", []byte("{}")).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrUnsupportedType.Name {
+		t.Errorf("AddDevice of an unsupported type: %v", err)
+	}
+	if hasDevice(p, "D2") {
+		t.Error("device of an unsupported type added")
+	}
+}
@@ -0,0 +1,99 @@
+package dbusconn
+
+import "time"
+
+// delayDeviceAdded delays the emit of DeviceAdded by CoalesceWindow so that a quick removal of the device cancels it
+// The emits of the device and of its items are held back with it and dropped if it is cancelled.
+// It returns false when the coalescing is off, the signal must then be emitted at once
+func (p *Protocol) delayDeviceAdded(d *Device, added func()) bool {
+	if p.dc.CoalesceWindow <= 0 {
+		return false
+	}
+	devID := d.DevID
+	d.muteLock.Lock()
+	d.coalescing = true
+	d.muteLock.Unlock()
+
+	p.churnLock.Lock()
+	defer p.churnLock.Unlock()
+	if p.pendingAdds == nil {
+		p.pendingAdds = make(map[string]*time.Timer)
+	}
+	if timer, pending := p.pendingAdds[devID]; pending {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(p.dc.CoalesceWindow, func() {
+		p.churnLock.Lock()
+		current := p.pendingAdds[devID] == timer
+		if current {
+			delete(p.pendingAdds, devID)
+		}
+		p.churnLock.Unlock()
+		if current {
+			d.endCoalescing(added)
+		}
+	})
+	p.pendingAdds[devID] = timer
+	return true
+}
+
+// endCoalescing emits DeviceAdded then the emits held back with it, after Unmute if the device is muted
+// The emits held back while they are sent follow them, the removal of the device included. Nothing is emitted if the
+// device is removed before.
+func (d *Device) endCoalescing(added func()) {
+	d.muteLock.Lock()
+	if !d.coalescing {
+		d.muteLock.Unlock()
+		return
+	}
+	if d.muted {
+		d.coalescing = false
+		d.pending = append([]*pendingEmit{{signal: added}}, d.pending...)
+		d.muteLock.Unlock()
+		return
+	}
+	d.announcing = true
+	pending := d.pending
+	d.pending = nil
+	d.muteLock.Unlock()
+
+	added()
+	for {
+		d.dc.emitPending(pending)
+		d.muteLock.Lock()
+		if d.muted || len(d.pending) == 0 {
+			d.coalescing = false
+			d.announcing = false
+			d.muteLock.Unlock()
+			return
+		}
+		pending = d.pending
+		d.pending = nil
+		d.muteLock.Unlock()
+	}
+}
+
+// cancelDeviceAdded drops the delayed DeviceAdded of the device, it returns true if there was one
+// The device was added and removed within CoalesceWindow, the clients are told about neither
+func (p *Protocol) cancelDeviceAdded(devID string) bool {
+	p.churnLock.Lock()
+	defer p.churnLock.Unlock()
+	timer, pending := p.pendingAdds[devID]
+	if !pending {
+		return false
+	}
+	timer.Stop()
+	delete(p.pendingAdds, devID)
+	return true
+}
+
+// cancelPendingAdds drops the delayed DeviceAdded of the protocol
+func (p *Protocol) cancelPendingAdds() {
+	p.churnLock.Lock()
+	defer p.churnLock.Unlock()
+	for devID, timer := range p.pendingAdds {
+		timer.Stop()
+		delete(p.pendingAdds, devID)
+	}
+}
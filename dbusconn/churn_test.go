@@ -0,0 +1,166 @@
+package dbusconn
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const coalesceWindow = 20 * time.Millisecond
+
+// addFlapping adds the device with the item I1 and its value
+func addFlapping(t testing.TB, p *Protocol, devID string) {
+	t.Helper()
+	addTestItem(t, addTestDevice(t, p, devID, "T"), "I1", "T").SetValue([]byte("1"))
+}
+
+func TestCoalescedChurn(t *testing.T) {
+	dc := &Dbus{CoalesceWindow: coalesceWindow}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	addFlapping(t, p, "D1")
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * coalesceWindow)
+	if signals := underPath(c.flush(), c.root+"/D1"); len(signals) != 0 {
+		t.Errorf("signals of a device added and removed within the window: %v", names(signals))
+	}
+	if dropped := dc.Metrics()[metricDroppedSignals]; dropped != 0 {
+		t.Errorf("%d signals of the coalesced device counted as dropped", dropped)
+	}
+
+	// The emits of the device and of its items follow DeviceAdded once the window is over
+	addFlapping(t, p, "D2")
+	if signals := underPath(c.flush(), c.root+"/D2"); len(signals) != 0 {
+		t.Errorf("signals within the window: %v", names(signals))
+	}
+	c.wait(c.root+"/D2", dbusDeviceInterface+"."+signalDeviceAdded)
+	path := c.root + "/D2"
+	signals := underPath(c.flush(), path)
+	if want := []string{path + "/I1 ItemAdded", path + "/I1 PropertiesChanged"}; strings.Join(names(signals), ",") != strings.Join(want, ",") {
+		t.Errorf("signals after DeviceAdded: %v, want %v", names(signals), want)
+	}
+	if err := p.RemoveDevice("D2"); err != nil {
+		t.Fatal(err)
+	}
+	if count(underPath(c.flush(), path), signalDeviceRemoved) != 1 {
+		t.Error("DeviceRemoved of an announced device not emitted")
+	}
+
+	// A device added again within the window is announced once
+	addFlapping(t, p, "D3")
+	if err := p.RemoveDevice("D3"); err != nil {
+		t.Fatal(err)
+	}
+	addFlapping(t, p, "D3")
+	time.Sleep(3 * coalesceWindow)
+	signals = underPath(c.flush(), c.root+"/D3")
+	if count(signals, signalDeviceAdded) != 1 || count(signals, signalDeviceRemoved) != 0 || count(signals, signalItemAdded) != 1 {
+		t.Errorf("signals of a device added again: %v", names(signals))
+	}
+}
+
+func TestCoalescedDeviceMuted(t *testing.T) {
+	dc := &Dbus{CoalesceWindow: coalesceWindow}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	d := addTestDevice(t, p, "D1", "T")
+	d.Mute()
+	addTestItem(t, d, "I1", "T").SetValue([]byte("1"))
+	d.Unmute()
+	d.Mute()
+	time.Sleep(3 * coalesceWindow)
+	if signals := underPath(c.flush(), c.root+"/D1"); len(signals) != 0 {
+		t.Errorf("signals of a muted device once the window is over: %v", names(signals))
+	}
+	d.Unmute()
+	signals := names(underPath(c.flush(), c.root+"/D1"))
+	if len(signals) < 2 || signals[0] != c.root+"/D1 DeviceAdded" {
+		t.Errorf("signals once unmuted: %v", signals)
+	}
+}
+
+func TestCloseDropsTheDelayedAdds(t *testing.T) {
+	dc := &Dbus{CoalesceWindow: coalesceWindow}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	addFlapping(t, p, "D1")
+	dc.Close()
+	p.churnLock.Lock()
+	pending := len(p.pendingAdds)
+	p.churnLock.Unlock()
+	if pending != 0 {
+		t.Errorf("%d DeviceAdded delayed once closed", pending)
+	}
+	time.Sleep(3 * coalesceWindow)
+	if signals := underPath(c.flush(), c.root+"/D1"); count(signals, signalDeviceAdded) != 0 {
+		t.Errorf("DeviceAdded emitted after Close: %v", names(signals))
+	}
+}
+
+func TestFlappingDevices(t *testing.T) {
+	dc := &Dbus{CoalesceWindow: coalesceWindow}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	// Each device is removed at once, at the end of the window so that the removal races the emit of DeviceAdded,
+	// or well after the window. The client reads the signals at the end, they fit in its buffer.
+	delays := []time.Duration{0, coalesceWindow, coalesceWindow, 3 * coalesceWindow}
+	const devices, flaps = 8, 8
+	var wg sync.WaitGroup
+	for n := 0; n < devices; n++ {
+		wg.Add(1)
+		go func(devID string) {
+			defer wg.Done()
+			for flap := 0; flap < flaps; flap++ {
+				addFlapping(t, p, devID)
+				time.Sleep(delays[flap%len(delays)])
+				if err := p.RemoveDevice(devID); err != nil {
+					t.Errorf("RemoveDevice %s: %v", devID, err)
+					return
+				}
+			}
+		}(fmt.Sprintf("F%d", n))
+	}
+	wg.Wait()
+	time.Sleep(3 * coalesceWindow)
+	signals := c.flush()
+
+	for n := 0; n < devices; n++ {
+		path := fmt.Sprintf("%s/F%d", c.root, n)
+		announced, adds := false, 0
+		for _, s := range underPath(signals, path) {
+			member := s.Name[strings.LastIndex(s.Name, ".")+1:]
+			switch {
+			case member == signalDeviceAdded && !announced:
+				announced = true
+				adds++
+			case member == signalDeviceRemoved && announced:
+				announced = false
+			case member != signalDeviceAdded && member != signalDeviceRemoved && announced:
+			default:
+				t.Fatalf("%s %s while the device is announced %v: %v", s.Path, member, announced, names(underPath(signals, path)))
+			}
+		}
+		// The devices removed at once are never announced, the ones removed after the window always are
+		if announced || adds < flaps/4 || adds > flaps*3/4 {
+			t.Errorf("%s announced %d times out of %d adds, still announced: %v", path, adds, flaps, announced)
+		}
+	}
+	p.churnLock.Lock()
+	pending := len(p.pendingAdds)
+	p.churnLock.Unlock()
+	if pending != 0 {
+		t.Errorf("%d DeviceAdded still delayed", pending)
+	}
+}
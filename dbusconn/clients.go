@@ -0,0 +1,175 @@
+package dbusconn
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// activeClientWindow is how long a client is considered active after its last call
+	activeClientWindow = 10 * time.Minute
+
+	dbusDaemonInterface = "org.freedesktop.DBus"
+)
+
+// ActiveClients returns the bus names which called a method of the adapter recently or which hold a match rule on
+// its signals, the match rules are only known when the bus daemon gives access to its debug statistics
+func (dc *Dbus) ActiveClients() ([]string, error) {
+	if dc.connection() == nil {
+		return nil, dbus.ErrClosed
+	}
+
+	clients := make(map[string]bool)
+	dc.clientsLock.Lock()
+	for name, lastCall := range dc.clients {
+		if time.Since(lastCall) > activeClientWindow {
+			delete(dc.clients, name)
+			continue
+		}
+		clients[name] = true
+	}
+	dc.clientsLock.Unlock()
+
+	for _, name := range dc.matchRuleOwners() {
+		clients[name] = true
+	}
+
+	for _, own := range dc.connection().Names() {
+		delete(clients, own)
+	}
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// matchRuleOwners returns the bus names with a match rule on the signals of the adapter
+func (dc *Dbus) matchRuleOwners() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+
+	var rules map[string][]string
+	obj := dc.connection().Object(dbusDaemonInterface, "/org/freedesktop/DBus")
+	if err := obj.CallWithContext(ctx, "org.freedesktop.DBus.Debug.Stats.GetAllMatchRules", 0).Store(&rules); err != nil {
+		return nil
+	}
+
+	patterns := []string{"path='" + dbusPathPrefix + dc.ProtocolName, "path_namespace='" + dbusPathPrefix + dc.ProtocolName,
+		"sender='" + dbusNamePrefix + dc.ProtocolName + "'"}
+	for _, own := range dc.connection().Names() {
+		patterns = append(patterns, "sender='"+own+"'")
+	}
+
+	var owners []string
+	for name, nameRules := range rules {
+		for _, rule := range nameRules {
+			if matchesAny(rule, patterns) {
+				owners = append(owners, name)
+				break
+			}
+		}
+	}
+	return owners
+}
+
+func matchesAny(rule string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(rule, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackClients listens to NameOwnerChanged to forget the clients leaving the bus
+func (dc *Dbus) trackClients() {
+	done, started := dc.startWatcher(&dc.clientsDone)
+	if !started {
+		return
+	}
+	rule := newMatchRule("interface", dbusDaemonInterface, "member", "NameOwnerChanged")
+	if err := dc.addMatch(rule); err != nil {
+		dc.Log.Warning("Unable to track the clients of the adapter", err)
+		return
+	}
+	conn := dc.connection()
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	go func() {
+		for {
+			select {
+			case signal, ok := <-signals:
+				if !ok {
+					return
+				}
+				if signal.Name != dbusDaemonInterface+".NameOwnerChanged" || len(signal.Body) != 3 {
+					continue
+				}
+				name, _ := signal.Body[0].(string)
+				newOwner, _ := signal.Body[2].(string)
+				if newOwner == "" {
+					dc.clientsLock.Lock()
+					delete(dc.clients, name)
+					delete(dc.capabilities, name)
+					dc.clientsLock.Unlock()
+				}
+			case <-done:
+				conn.RemoveSignal(signals)
+				dc.removeMatch(rule)
+				return
+			}
+		}
+	}()
+}
+
+func (dc *Dbus) stopTrackingClients() {
+	dc.stopWatcher(&dc.clientsDone)
+}
+
+func (dc *Dbus) recordClient(sender dbus.Sender) {
+	if sender == "" {
+		return
+	}
+	dc.clientsLock.Lock()
+	if dc.clients == nil {
+		dc.clients = make(map[string]time.Time)
+	}
+	dc.clients[string(sender)] = time.Now()
+	dc.clientsLock.Unlock()
+}
+
+// trackedMethods wraps the methods of a method table so that they record the bus name of their caller
+func (dc *Dbus) trackedMethods(methods map[string]interface{}) map[string]interface{} {
+	senderType := reflect.TypeOf((*dbus.Sender)(nil)).Elem()
+	tracked := make(map[string]interface{}, len(methods))
+	for name, method := range methods {
+		mv := reflect.ValueOf(method)
+		mt := mv.Type()
+		if mt.Kind() != reflect.Func || mt.IsVariadic() {
+			tracked[name] = method
+			continue
+		}
+
+		in := []reflect.Type{senderType}
+		for j := 0; j < mt.NumIn(); j++ {
+			in = append(in, mt.In(j))
+		}
+		out := make([]reflect.Type, 0, mt.NumOut())
+		for j := 0; j < mt.NumOut(); j++ {
+			out = append(out, mt.Out(j))
+		}
+		wrapper := reflect.MakeFunc(reflect.FuncOf(in, out, false), func(args []reflect.Value) []reflect.Value {
+			dc.recordClient(args[0].Interface().(dbus.Sender))
+			return mv.Call(args[1:])
+		})
+		tracked[name] = wrapper.Interface()
+	}
+	return tracked
+}
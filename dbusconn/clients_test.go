@@ -0,0 +1,55 @@
+package dbusconn
+
+import (
+	"testing"
+)
+
+// activeClient tells if the name is one of the active clients of the adapter
+func activeClient(t *testing.T, dc *Dbus, name string) bool {
+	t.Helper()
+	clients, err := dc.ActiveClients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range clients {
+		if client == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestActiveClients(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T")
+	subscriber := newTestClient(t, dc)
+	caller := newTestClient(t, dc)
+	callerName := caller.conn.Names()[0]
+
+	if err := caller.call(caller.root+"/D1", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Fatal(err)
+	}
+	if !activeClient(t, dc, callerName) {
+		t.Error("client calling a method not active")
+	}
+	if activeClient(t, dc, dc.connection().Names()[0]) {
+		t.Error("adapter listed as its own client")
+	}
+
+	// The match rules are only known if the bus gives its statistics
+	var rules map[string][]string
+	statsErr := subscriber.conn.Object(dbusDaemonInterface, "/org/freedesktop/DBus").
+		Call("org.freedesktop.DBus.Debug.Stats.GetAllMatchRules", 0).Store(&rules)
+	if subscribed := activeClient(t, dc, subscriber.conn.Names()[0]); subscribed != (statsErr == nil) {
+		t.Errorf("subscribed client active: %v, statistics of the bus: %v", subscribed, statsErr)
+	}
+
+	caller.conn.Close()
+	waitFor(t, "the client leaving the bus to be forgotten", func() bool {
+		dc.clientsLock.Lock()
+		defer dc.clientsLock.Unlock()
+		_, present := dc.clients[callerName]
+		return !present
+	})
+}
@@ -0,0 +1,150 @@
+package dbusconn
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// QueueRejectNewest policy 'reject newest' for QueuePolicy, the received command is rejected
+	QueueRejectNewest QueuePolicy = "REJECT_NEWEST"
+	// QueueDropOldest policy 'drop oldest' for QueuePolicy, the oldest waiting command is dropped
+	QueueDropOldest QueuePolicy = "DROP_OLDEST"
+)
+
+var (
+	// ErrQueueFull is returned when a command is received while the command queue of the device is full
+	ErrQueueFull = dbus.NewError(dbusDeviceInterface+".Error.QueueFull", []interface{}{"The command queue of the device is full"})
+	// ErrCommandDropped is returned to a waiting command dropped to make room for a newer one
+	ErrCommandDropped = dbus.NewError(dbusDeviceInterface+".Error.CommandDropped", []interface{}{"The command has been dropped from the queue"})
+)
+
+// QueuePolicy tells what to do with a command received while the command queue of the device is full
+type QueuePolicy string
+
+type commandResult struct {
+	result []byte
+	err    *dbus.Error
+}
+
+type queuedCommand struct {
+	run    func() ([]byte, *dbus.Error)
+	result chan commandResult
+}
+
+// CommandQueueDepth returns the number of commands waiting in the command queue of the device
+func (d *Device) CommandQueueDepth() int {
+	d.queueLock.Lock()
+	defer d.queueLock.Unlock()
+	return len(d.queue)
+}
+
+// handlerMethod returns the dbus method calling the handler of a command
+func handlerMethod(handler func([]byte) ([]byte, error)) func([]byte) ([]byte, *dbus.Error) {
+	return func(args []byte) ([]byte, *dbus.Error) {
+		result, err := handler(args)
+		if err != nil {
+			return nil, dbus.MakeFailedError(err)
+		}
+		return result, nil
+	}
+}
+
+// commandMethod returns the dbus method of a command, it goes through the command queue when CommandQueueSize is set
+// The device is Busy while the handler runs, so the command is rejected with ErrDeviceBusy during another operation
+// when ExclusiveOperations is set.
+func (d *Device) commandMethod(handler func([]byte) ([]byte, error)) func([]byte) ([]byte, *dbus.Error) {
+	method := handlerMethod(handler)
+	run := func(args []byte) ([]byte, *dbus.Error) {
+		if err := d.startOperation(); err != nil {
+			return nil, err
+		}
+		defer d.OperationDone()
+		d.IncrementCounter(CounterCommandsExecuted, 1)
+		return method(args)
+	}
+	return func(args []byte) ([]byte, *dbus.Error) {
+		if d.CommandQueueSize <= 0 {
+			return run(args)
+		}
+		return d.enqueueCommand(func() ([]byte, *dbus.Error) { return run(args) })
+	}
+}
+
+// enqueueCommand waits for the command to run after the commands received before it
+func (d *Device) enqueueCommand(run func() ([]byte, *dbus.Error)) ([]byte, *dbus.Error) {
+	cmd := &queuedCommand{run: run, result: make(chan commandResult, 1)}
+
+	d.queueLock.Lock()
+	if d.queueClosed {
+		d.queueLock.Unlock()
+		return nil, ErrCommandDropped
+	}
+	if len(d.queue) >= d.CommandQueueSize {
+		if d.CommandQueuePolicy != QueueDropOldest {
+			d.queueLock.Unlock()
+			d.log.Warning("Command queue of the device", d.DevID, "is full, command rejected")
+			return nil, ErrQueueFull
+		}
+		oldest := d.queue[0]
+		d.queue = d.queue[1:]
+		oldest.result <- commandResult{err: ErrCommandDropped}
+		d.log.Warning("Command queue of the device", d.DevID, "is full, oldest command dropped")
+	}
+	d.queue = append(d.queue, cmd)
+	if !d.queueRunning {
+		d.queueRunning = true
+		go d.runCommands()
+	}
+	d.queueLock.Unlock()
+
+	res := <-cmd.result
+	return res.result, res.err
+}
+
+// runCommands runs the queued commands one at a time until the queue is empty
+func (d *Device) runCommands() {
+	for {
+		d.queueLock.Lock()
+		if len(d.queue) == 0 {
+			d.queueRunning = false
+			d.queueLock.Unlock()
+			return
+		}
+		cmd := d.queue[0]
+		d.queue = d.queue[1:]
+		d.queueLock.Unlock()
+
+		result, err := cmd.run()
+		cmd.result <- commandResult{result: result, err: err}
+	}
+}
+
+// dropCommands answers ErrCommandDropped to the queued commands and to the next ones, once the device is removed or
+// the adapter closed
+// The command running is not interrupted, the goroutine of the queue stops once it returns.
+func (d *Device) dropCommands() {
+	d.queueLock.Lock()
+	dropped := d.queue
+	d.queue = nil
+	d.queueClosed = true
+	d.queueLock.Unlock()
+	if len(dropped) > 0 {
+		d.log.Warning(len(dropped), "queued commands of the device", d.DevID, "dropped")
+	}
+	for _, cmd := range dropped {
+		cmd.result <- commandResult{err: ErrCommandDropped}
+	}
+}
+
+// dropCommands drops the queued commands of the devices of the protocol
+func (p *Protocol) dropCommands() {
+	p.Lock()
+	devices := make([]*Device, 0, len(p.Devices))
+	for _, d := range p.Devices {
+		devices = append(devices, d)
+	}
+	p.Unlock()
+	for _, d := range devices {
+		d.dropCommands()
+	}
+}
@@ -0,0 +1,277 @@
+package dbusconn
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// targetDriver records the targets set by the clients without ending the operation
+type targetDriver struct {
+	recorder
+}
+
+func (r *targetDriver) SetItemTarget(i *Item, target []byte) {
+	r.record(string(target))
+}
+
+func TestBusyDeviceRejectsASecondTarget(t *testing.T) {
+	dc := &Dbus{}
+	driver := &targetDriver{}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "D1", "T")
+	addTestItem(t, d, "I1", "T")
+	d.Lock()
+	d.ExclusiveOperations = true
+	d.Unlock()
+	c := newTestClient(t, dc)
+
+	setTarget := func(target string) error {
+		return c.call(c.root+"/D1/I1", dbusPropertiesInterface+".Set", dbusItemInterface, propertyTarget, dbus.MakeVariant([]byte(target))).Err
+	}
+	if err := setTarget("1"); err != nil {
+		t.Fatal(err)
+	}
+	err := setTarget("2")
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrDeviceBusy.Name {
+		t.Fatalf("second target: %v", err)
+	}
+	d.OperationDone()
+	if err := setTarget("3"); err != nil {
+		t.Fatal("target after OperationDone:", err)
+	}
+	waitFor(t, "the targets", func() bool { return len(driver.recorded()) == 2 })
+	if calls := driver.recorded(); calls[0] != "1" || calls[1] != "3" {
+		t.Errorf("targets given to the driver: %v", calls)
+	}
+}
+
+func TestBusyDeviceRejectsAConcurrentCommand(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	d.Lock()
+	d.ExclusiveOperations = true
+	d.Unlock()
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	if err := d.AddCommand("Move", func(args []byte) ([]byte, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return args, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, dc)
+
+	first := make(chan *dbus.Call, 1)
+	go func() { first <- c.call(c.root+"/D1", dbusDeviceInterface+".Move", []byte("a")) }()
+	<-started
+	err := c.call(c.root+"/D1", dbusDeviceInterface+".Move", []byte("b")).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrDeviceBusy.Name {
+		t.Fatalf("concurrent command: %v", err)
+	}
+	close(release)
+	var result []byte
+	if err := (<-first).Store(&result); err != nil || string(result) != "a" {
+		t.Fatalf("first command: %q %v", result, err)
+	}
+	if err := c.call(c.root+"/D1", dbusDeviceInterface+".Move", []byte("c")).Err; err != nil {
+		t.Fatal("command once the device is free:", err)
+	}
+}
+
+func TestAddCommandRejectsABuiltinMethod(t *testing.T) {
+	p := newTestAdapter(t, &Dbus{}, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	if err := d.AddCommand("AddItem", func([]byte) ([]byte, error) { return nil, nil }); err != ErrReservedCommand {
+		t.Fatalf("AddCommand AddItem: %v", err)
+	}
+}
+
+// gatedCommand is a command recording its arguments, the first one waits for the gate
+type gatedCommand struct {
+	recorder
+	started chan struct{}
+	gate    chan struct{}
+	running int32
+	highest int32
+}
+
+func (g *gatedCommand) handler(args []byte) ([]byte, error) {
+	if running := atomic.AddInt32(&g.running, 1); running > atomic.LoadInt32(&g.highest) {
+		atomic.StoreInt32(&g.highest, running)
+	}
+	defer atomic.AddInt32(&g.running, -1)
+	g.record(string(args))
+	if len(g.recorded()) == 1 {
+		close(g.started)
+		<-g.gate
+	}
+	return args, nil
+}
+
+// queueCommands sends the commands one after the other, each one once the previous is queued
+func queueCommands(t *testing.T, c *testClient, d *Device, path string, args ...string) []chan *dbus.Call {
+	t.Helper()
+	calls := make([]chan *dbus.Call, len(args))
+	for n, arg := range args {
+		calls[n] = make(chan *dbus.Call, 1)
+		depth := d.CommandQueueDepth()
+		go func(call chan *dbus.Call, arg string) { call <- c.call(path, dbusDeviceInterface+".Step", []byte(arg)) }(calls[n], arg)
+		waitFor(t, "the command "+arg+" in the queue", func() bool { return d.CommandQueueDepth() > depth })
+	}
+	return calls
+}
+
+func TestCommandQueueRunsInArrivalOrder(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	d.CommandQueueSize = 10
+	command := &gatedCommand{started: make(chan struct{}), gate: make(chan struct{})}
+	if err := d.AddCommand("Step", command.handler); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+
+	first := make(chan *dbus.Call, 1)
+	go func() { first <- c.call(path, dbusDeviceInterface+".Step", []byte("0")) }()
+	<-command.started
+	calls := append([]chan *dbus.Call{first}, queueCommands(t, c, d, path, "1", "2", "3", "4")...)
+	if depth := d.CommandQueueDepth(); depth != 4 {
+		t.Fatalf("%d commands queued", depth)
+	}
+	close(command.gate)
+
+	for n, call := range calls {
+		var result []byte
+		if err := (<-call).Store(&result); err != nil || string(result) != fmt.Sprint(n) {
+			t.Errorf("command %d: %q %v", n, result, err)
+		}
+	}
+	if order := strings.Join(command.recorded(), ","); order != "0,1,2,3,4" {
+		t.Errorf("commands run in the order %s", order)
+	}
+	if highest := atomic.LoadInt32(&command.highest); highest != 1 {
+		t.Errorf("%d commands run at the same time", highest)
+	}
+}
+
+func TestCommandQueueOverflow(t *testing.T) {
+	for _, policy := range []QueuePolicy{QueueRejectNewest, QueueDropOldest} {
+		dc := &Dbus{}
+		p := newTestAdapter(t, dc, nil)
+		d := addTestDevice(t, p, "D1", "T")
+		d.CommandQueueSize = 2
+		d.CommandQueuePolicy = policy
+		command := &gatedCommand{started: make(chan struct{}), gate: make(chan struct{})}
+		if err := d.AddCommand("Step", command.handler); err != nil {
+			t.Fatal(err)
+		}
+		c := newTestClient(t, dc)
+		path := c.root + "/D1"
+
+		first := make(chan *dbus.Call, 1)
+		go func() { first <- c.call(path, dbusDeviceInterface+".Step", []byte("0")) }()
+		<-command.started
+		queued := queueCommands(t, c, d, path, "1", "2")
+
+		third := make(chan *dbus.Call, 1)
+		go func() { third <- c.call(path, dbusDeviceInterface+".Step", []byte("3")) }()
+		if policy == QueueRejectNewest {
+			err := (<-third).Err
+			if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrQueueFull.Name {
+				t.Errorf("command over a full queue: %v", err)
+			}
+			close(command.gate)
+			for _, call := range append(queued, first) {
+				if err := (<-call).Err; err != nil {
+					t.Errorf("queued command: %v", err)
+				}
+			}
+			continue
+		}
+
+		// The oldest waiting command is dropped, the new one waits in the queue
+		err := (<-queued[0]).Err
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrCommandDropped.Name {
+			t.Errorf("oldest command of a full queue: %v", err)
+		}
+		close(command.gate)
+		for _, call := range []chan *dbus.Call{first, queued[1], third} {
+			if err := (<-call).Err; err != nil {
+				t.Errorf("command kept in the queue: %v", err)
+			}
+		}
+		if order := strings.Join(command.recorded(), ","); order != "0,2,3" {
+			t.Errorf("commands run with %s: %s", policy, order)
+		}
+	}
+}
+
+func TestQueuedCommandsDroppedWithTheDevice(t *testing.T) {
+	for _, end := range []string{"RemoveDevice", "Close"} {
+		t.Run(end, func(t *testing.T) {
+			dc := &Dbus{}
+			p := newTestAdapter(t, dc, nil)
+			d := addTestDevice(t, p, "D1", "T")
+			d.CommandQueueSize = 10
+			started := make(chan struct{})
+			gate := make(chan struct{})
+
+			results := make(chan *dbus.Error, 3)
+			go func() {
+				_, err := d.enqueueCommand(func() ([]byte, *dbus.Error) {
+					close(started)
+					<-gate
+					return nil, nil
+				})
+				results <- err
+			}()
+			<-started
+			for n := 0; n < 2; n++ {
+				depth := d.CommandQueueDepth()
+				go func() {
+					_, err := d.enqueueCommand(func() ([]byte, *dbus.Error) { return nil, nil })
+					results <- err
+				}()
+				waitFor(t, "the queued command", func() bool { return d.CommandQueueDepth() > depth })
+			}
+
+			if end == "RemoveDevice" {
+				if err := p.RemoveDevice("D1"); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				dc.Close()
+			}
+			for n := 0; n < 2; n++ {
+				if err := <-results; err != ErrCommandDropped {
+					t.Errorf("queued command: %v", err)
+				}
+			}
+			if _, err := d.enqueueCommand(func() ([]byte, *dbus.Error) { return nil, nil }); err != ErrCommandDropped {
+				t.Errorf("command once dropped: %v", err)
+			}
+
+			// The command running completes and the goroutine of the queue stops
+			close(gate)
+			if err := <-results; err != nil {
+				t.Errorf("running command: %v", err)
+			}
+			waitFor(t, "the end of the queue", func() bool {
+				d.queueLock.Lock()
+				defer d.queueLock.Unlock()
+				return !d.queueRunning
+			})
+		})
+	}
+}
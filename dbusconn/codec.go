@@ -0,0 +1,157 @@
+package dbusconn
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// ValueCodec converts the values of the items of a type to and from the bytes of the property Value
+type ValueCodec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// RawCodec is the default codec, the values are []byte or string and decoded as []byte
+type RawCodec struct{}
+
+// Encode returns the bytes of a []byte or a string
+func (RawCodec) Encode(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("raw value must be []byte or string, got %T", value)
+}
+
+// Decode returns the bytes unchanged
+func (RawCodec) Decode(data []byte) (interface{}, error) {
+	return data, nil
+}
+
+// JSONCodec encodes the values in JSON, numbers are decoded as float64
+type JSONCodec struct{}
+
+// Encode returns the JSON encoding of the value
+func (JSONCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// Decode returns the value of the JSON data
+func (JSONCodec) Decode(data []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// BigEndianCodec encodes integers in big-endian on Size bytes (1, 2, 4 or 8), they are decoded as int64
+type BigEndianCodec struct {
+	Size int
+}
+
+// Encode returns the big-endian bytes of an integer
+func (c BigEndianCodec) Encode(value interface{}) ([]byte, error) {
+	var n uint64
+	switch v := value.(type) {
+	case int:
+		n = uint64(v)
+	case int8:
+		n = uint64(v)
+	case int16:
+		n = uint64(v)
+	case int32:
+		n = uint64(v)
+	case int64:
+		n = uint64(v)
+	case uint:
+		n = uint64(v)
+	case uint8:
+		n = uint64(v)
+	case uint16:
+		n = uint64(v)
+	case uint32:
+		n = uint64(v)
+	case uint64:
+		n = v
+	case uintptr:
+		n = uint64(v)
+	default:
+		return nil, fmt.Errorf("big-endian value must be an integer, got %T", value)
+	}
+
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, n)
+	switch c.Size {
+	case 1, 2, 4, 8:
+		return data[8-c.Size:], nil
+	}
+	return nil, fmt.Errorf("invalid big-endian size %d", c.Size)
+}
+
+// Decode returns the integer of the big-endian bytes, sign-extended from Size bytes
+func (c BigEndianCodec) Decode(data []byte) (interface{}, error) {
+	if len(data) != c.Size {
+		return nil, fmt.Errorf("big-endian value must be %d bytes, got %d", c.Size, len(data))
+	}
+	switch c.Size {
+	case 1:
+		return int64(int8(data[0])), nil
+	case 2:
+		return int64(int16(binary.BigEndian.Uint16(data))), nil
+	case 4:
+		return int64(int32(binary.BigEndian.Uint32(data))), nil
+	case 8:
+		return int64(binary.BigEndian.Uint64(data)), nil
+	}
+	return nil, fmt.Errorf("invalid big-endian size %d", c.Size)
+}
+
+// RegisterValueCodec sets the codec used for the values of the items of the type, RawCodec is used by default
+// SetValue keeps the value decoded with it for GetValue, which returns the error of the codec for the values it cannot
+// decode, SetTypedValue encodes with it. The codec applies to the values set once it is registered.
+func (dc *Dbus) RegisterValueCodec(typeID string, codec ValueCodec) {
+	dc.codecsLock.Lock()
+	defer dc.codecsLock.Unlock()
+	if dc.codecs == nil {
+		dc.codecs = make(map[string]ValueCodec)
+	}
+	dc.codecs[typeID] = codec
+}
+
+func (dc *Dbus) valueCodec(typeID string) ValueCodec {
+	dc.codecsLock.Lock()
+	defer dc.codecsLock.Unlock()
+	if codec, present := dc.codecs[typeID]; present {
+		return codec
+	}
+	return RawCodec{}
+}
+
+// SetTypedValue encodes the value with the codec of the type of the item and set the value of the property Value
+func (i *Item) SetTypedValue(value interface{}) error {
+	data, err := i.dc.valueCodec(i.TypeID).Encode(value)
+	if err != nil {
+		return err
+	}
+	i.SetValue(data)
+	return nil
+}
+
+// GetValue returns the value of the item decoded with the codec of its type when it was set
+// The value comes from the value provider of the item if set, it is decoded on each read and ErrValueUnavailable is
+// returned if it fails.
+func (i *Item) GetValue() (interface{}, error) {
+	i.Lock()
+	typed, provided := i.typedValue, i.valueProvider != nil
+	i.Unlock()
+	if typed != nil && !provided {
+		return typed, nil
+	}
+	value, _, err := i.readValue()
+	if err != nil {
+		return nil, err
+	}
+	return i.dc.valueCodec(i.TypeID).Decode(value)
+}
@@ -0,0 +1,121 @@
+package dbusconn
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCodecRoundTrips(t *testing.T) {
+	for _, round := range []struct {
+		codec ValueCodec
+		value interface{}
+		data  string
+		back  interface{}
+	}{
+		{RawCodec{}, []byte("raw"), "raw", []byte("raw")},
+		{RawCodec{}, "text", "text", []byte("text")},
+		{JSONCodec{}, 21.5, "21.5", 21.5},
+		{JSONCodec{}, true, "true", true},
+		{JSONCodec{}, "on", `"on"`, "on"},
+		{BigEndianCodec{Size: 2}, 258, "\x01\x02", int64(258)},
+		{BigEndianCodec{Size: 1}, -1, "\xff", int64(-1)},
+		{BigEndianCodec{Size: 4}, uint16(0xbeef), "\x00\x00\xbe\xef", int64(0xbeef)},
+		{BigEndianCodec{Size: 8}, int64(-2), "\xff\xff\xff\xff\xff\xff\xff\xfe", int64(-2)},
+	} {
+		data, err := round.codec.Encode(round.value)
+		if err != nil || string(data) != round.data {
+			t.Errorf("%T encodes %v: %q %v, want %q", round.codec, round.value, data, err, round.data)
+			continue
+		}
+		if back, err := round.codec.Decode(data); err != nil || !reflect.DeepEqual(back, round.back) {
+			t.Errorf("%T decodes %q: %v %v, want %v", round.codec, data, back, err, round.back)
+		}
+	}
+
+	if _, err := (RawCodec{}).Encode(1); err == nil {
+		t.Error("raw codec encoded an integer")
+	}
+	if _, err := (BigEndianCodec{Size: 2}).Encode(1.5); err == nil {
+		t.Error("big-endian codec encoded a float")
+	}
+	if _, err := (BigEndianCodec{Size: 3}).Encode(1); err == nil {
+		t.Error("big-endian codec encoded on 3 bytes")
+	}
+	if _, err := (BigEndianCodec{Size: 2}).Decode([]byte{1}); err == nil {
+		t.Error("big-endian codec decoded a short value")
+	}
+}
+
+func TestRegisteredCodecOfAType(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	dc.RegisterValueCodec("Level", BigEndianCodec{Size: 2})
+	d := addTestDevice(t, p, "D1", "T")
+	level := addTestItem(t, d, "I1", "Level")
+	raw := addTestItem(t, d, "I2", "T")
+
+	if err := level.SetTypedValue(300); err != nil {
+		t.Fatal(err)
+	}
+	if string(level.currentValue()) != "\x01\x2c" {
+		t.Errorf("encoded value: %q", level.currentValue())
+	}
+	if value, err := level.GetValue(); err != nil || value != int64(300) {
+		t.Errorf("decoded value: %v %v", value, err)
+	}
+	// SetValue publishes the values the codec of the type cannot decode, GetValue tells the error
+	level.SetValue([]byte{1})
+	if string(level.currentValue()) != "\x01" {
+		t.Errorf("short value not published: %q", level.currentValue())
+	}
+	if value, err := level.GetValue(); err == nil {
+		t.Errorf("short value decoded: %v", value)
+	}
+	if err := level.SetTypedValue("high"); err == nil {
+		t.Error("string encoded by the big-endian codec")
+	}
+
+	// The types without a codec pass the bytes through
+	if err := raw.SetTypedValue("on"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := raw.GetValue(); err != nil || !reflect.DeepEqual(value, []byte("on")) {
+		t.Errorf("value of a type without codec: %v %v", value, err)
+	}
+}
+
+// countingCodec is a JSONCodec counting its calls to Decode
+type countingCodec struct {
+	JSONCodec
+	decoded *int32
+}
+
+func (c countingCodec) Decode(data []byte) (interface{}, error) {
+	atomic.AddInt32(c.decoded, 1)
+	return c.JSONCodec.Decode(data)
+}
+
+func TestSetValueKeepsTheDecodedValue(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	var decoded int32
+	dc.RegisterValueCodec("Temp", countingCodec{decoded: &decoded})
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "Temp")
+
+	i.SetValue([]byte(`{"celsius": 21.5}`))
+	for n := 0; n < 3; n++ {
+		if value, err := i.GetValue(); err != nil || !reflect.DeepEqual(value, map[string]interface{}{"celsius": 21.5}) {
+			t.Fatalf("GetValue: %v %v", value, err)
+		}
+	}
+	if calls := atomic.LoadInt32(&decoded); calls != 1 {
+		t.Errorf("value decoded %d times", calls)
+	}
+
+	// A value the codec cannot decode replaces the last one
+	i.SetValue([]byte("{"))
+	if value, err := i.GetValue(); err == nil {
+		t.Errorf("GetValue once an invalid value is set: %v", value)
+	}
+}
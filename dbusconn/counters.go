@@ -0,0 +1,49 @@
+package dbusconn
+
+import "github.com/godbus/dbus/v5"
+
+const (
+	// CounterValuesReceived counts the values of the items of the device which changed
+	CounterValuesReceived = "ValuesReceived"
+	// CounterCommandsExecuted counts the commands of the device which ran
+	CounterCommandsExecuted = "CommandsExecuted"
+	// CounterErrors counts the errors set on the device
+	CounterErrors = "Errors"
+	// CounterValuesRejected counts the values of the items of the device rejected by their range
+	CounterValuesRejected = "ValuesRejected"
+)
+
+// IncrementCounter adds delta to a diagnostics counter of the device, the counter is created if needed
+func (d *Device) IncrementCounter(name string, delta int64) {
+	d.countersLock.Lock()
+	defer d.countersLock.Unlock()
+	if d.counters == nil {
+		d.counters = make(map[string]int64)
+	}
+	d.counters[name] += delta
+}
+
+// GetCounters is the dbus method to get the diagnostics counters of the device
+func (d *Device) GetCounters() (map[string]int64, *dbus.Error) {
+	d.countersLock.Lock()
+	defer d.countersLock.Unlock()
+	counters := map[string]int64{
+		CounterValuesReceived:   0,
+		CounterCommandsExecuted: 0,
+		CounterErrors:           0,
+		CounterValuesRejected:   0,
+	}
+	for name, value := range d.counters {
+		counters[name] = value
+	}
+	return counters, nil
+}
+
+// ResetCounters is the dbus method to set all the diagnostics counters of the device back to zero
+func (d *Device) ResetCounters() *dbus.Error {
+	d.countersLock.Lock()
+	d.counters = nil
+	d.countersLock.Unlock()
+	d.log.Info("Counters of the device", d.DevID, "reset")
+	return nil
+}
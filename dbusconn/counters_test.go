@@ -0,0 +1,48 @@
+package dbusconn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeviceCounters(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	i := addTestItem(t, d, "I1", "T")
+	if err := d.AddCommand("Move", func(args []byte) ([]byte, error) { return args, nil }); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+	expect := func(step string, want map[string]int64) {
+		t.Helper()
+		var counters map[string]int64
+		if err := c.call(path, dbusDeviceInterface+".GetCounters").Store(&counters); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(counters, want) {
+			t.Errorf("counters %s: %v, want %v", step, counters, want)
+		}
+	}
+	expect("of a new device", map[string]int64{CounterValuesReceived: 0, CounterCommandsExecuted: 0, CounterErrors: 0, CounterValuesRejected: 0})
+
+	i.SetValue([]byte("1"))
+	i.SetValue([]byte("2"))
+	for n := 0; n < 3; n++ {
+		if err := c.call(path, dbusDeviceInterface+".Move", []byte("a")).Err; err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.SetError("timeout")
+	d.IncrementCounter("Retries", 2)
+	d.IncrementCounter("Retries", 1)
+	expect("once used", map[string]int64{CounterValuesReceived: 2, CounterCommandsExecuted: 3, CounterErrors: 1, CounterValuesRejected: 0, "Retries": 3})
+
+	if err := c.call(path, dbusDeviceInterface+".ResetCounters").Err; err != nil {
+		t.Fatal(err)
+	}
+	expect("once reset", map[string]int64{CounterValuesReceived: 0, CounterCommandsExecuted: 0, CounterErrors: 0, CounterValuesRejected: 0})
+	i.SetValue([]byte("3"))
+	expect("after a reset", map[string]int64{CounterValuesReceived: 1, CounterCommandsExecuted: 0, CounterErrors: 0, CounterValuesRejected: 0})
+}
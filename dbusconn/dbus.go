@@ -3,12 +3,17 @@ package dbusconn
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
 	"github.com/op/go-logging"
 )
 
@@ -28,11 +33,180 @@ const (
 
 // Dbus exported structure
 type Dbus struct {
+	// conn is replaced when reconnecting, it is read with connection
 	conn         *dbus.Conn
+	connLock     sync.RWMutex
 	RootProtocol RootProto
 	Bridges      map[string]*BridgeProto
 	ProtocolName string
 	Log          *logging.Logger
+	// RestoreParallelism is the number of devices restored at the same time, their ValidateDevice hooks and Sync
+	// callbacks overlap but the exports are made one at a time, godbus does not lock the exports of a connection
+	RestoreParallelism int
+	// CallbackWorkers is the number of workers handling the callbacks by priority, each callback has its own goroutine
+	// if 0
+	CallbackWorkers int
+	// OrderedCallbacks runs the callbacks of a device one after the other in the order they were dispatched, with or
+	// without CallbackWorkers. The priority then only orders the devices: a high priority callback waits for the
+	// callbacks of its device dispatched before it.
+	OrderedCallbacks bool
+	// InterfaceOptions configures the exported interfaces by name
+	InterfaceOptions map[string]InterfaceOptions
+	// TombstoneRetention is how long the removed devices are remembered, they are not if 0
+	TombstoneRetention time.Duration
+	// CoalesceWindow delays DeviceAdded with the signals of the device and of its items so that a device added and
+	// removed within the window emits no signal, they are not delayed if 0
+	CoalesceWindow time.Duration
+	// MaxBridges is the maximum number of bridges, there is no limit if 0
+	MaxBridges int
+	// TypeQuotas is the maximum number of devices of each typeID across the bridges, the other types have no limit
+	TypeQuotas map[string]int
+	// SharedConn is the connection used instead of the system bus one when several adapters share it
+	SharedConn *SharedConn
+	// BridgePath builds the object path of a bridge from its ID, the default path is the one of the protocol followed by _bridgeID
+	BridgePath func(bridgeID string) dbus.ObjectPath
+	// OptionsMerge is how UpdateOptions combines the options when the call does not give a mode, MergeReplace if empty
+	OptionsMerge MergeMode
+	// SignalSequence appends a sequence number increasing by one to the arguments of every lifecycle signal
+	SignalSequence bool
+	// AllowHandoff lets another instance started with the same protocol name take the bus name over
+	AllowHandoff bool
+	// OnNameLost is called with the snapshot of the tree when another instance takes the bus name, see TreeSnapshot
+	OnNameLost func(snapshot string)
+	// OnReconnected is called once the adapter is connected again to the bus and its tree exported again after the
+	// connection was lost, so that the integrators can resync their state
+	OnReconnected func()
+	// ReconnectMaxDelay is the longest delay between two attempts to reconnect to the bus, 30s if 0
+	ReconnectMaxDelay time.Duration
+	// OnBackpressure is called with true when the queued callbacks, the ones held back by a rate limit included, reach
+	// BackpressureHigh and with false once they are back to BackpressureLow, so that the integrators can slow down
+	// their updates
+	OnBackpressure func(active bool)
+	// BackpressureHigh is the high watermark of the callback queue, 1000 if 0
+	BackpressureHigh int
+	// BackpressureLow is the low watermark of the callback queue, half of BackpressureHigh if 0
+	BackpressureLow int
+	// ReadinessPhases are the phases a protocol goes through with SetPhase, in order, the last one makes it ready
+	ReadinessPhases []string
+	// SyncCallbackTimeout is how long AddDevice, RemoveDevice, AddItem and RemoveItem wait for the Sync callbacks of
+	// the protocol, 12s if 0
+	SyncCallbackTimeout time.Duration
+	// ValidateDevice is called before adding a device with AddDevice, a non nil error rejects the device
+	ValidateDevice func(spec DeviceSpec) error
+	// RejectUnsupportedTypes makes AddDevice reject the types missing from the catalog, see RegisterSupportedType
+	RejectUnsupportedTypes bool
+
+	exports map[dbus.ObjectPath]*exportedObject
+	// exportsLock is shared by the adapters of a SharedConn, godbus does not lock the table of the exports of a
+	// connection
+	exportsLock exportsMutex
+	// propertiesPaths maps the exported properties to the path of their object, aliases excluded
+	propertiesPaths map[*prop.Properties]dbus.ObjectPath
+	streams         map[*changeStream]bool
+	streamsLock     sync.Mutex
+	dispatcher      *dispatcher
+
+	rateLimits     map[string]*rateLimit
+	rateLimitsLock sync.Mutex
+	errorTimes     []time.Time
+	healthLock     sync.Mutex
+	metricValues   map[string]int64
+	metricsLock    sync.Mutex
+	codecs         map[string]ValueCodec
+	codecsLock     sync.Mutex
+	frozen         bool
+	freezeLock     sync.RWMutex
+	diffGate       diffGate
+	held           []heldSignal
+	holding        bool
+	heldLock       sync.Mutex
+	sequence       uint64
+	sequenceLock   sync.Mutex
+	clients        map[string]time.Time
+	clientsLock    sync.Mutex
+	clientsDone    chan struct{}
+	capabilities   map[string]uint32
+	handoffDone    chan struct{}
+	reconnectDone  chan struct{}
+
+	supportedTypes     map[string]string
+	supportedTypesLock sync.Mutex
+
+	typeCounts     map[string]int
+	typeCountsLock sync.Mutex
+
+	lazyItems     map[dbus.ObjectPath]*Device
+	lazyItemsLock sync.Mutex
+
+	matchRules     map[string]int
+	matchRulesLock sync.Mutex
+
+	subscriptions      map[int]*subscription
+	lastSubscriptionID int
+	subscriptionsLock  sync.Mutex
+
+	// lifecycleLock guards closed and the done channels of the watchers, Close races with the reconnection on them
+	lifecycleLock sync.Mutex
+	closed        bool
+}
+
+// Options is the effective configuration of the adapter
+type Options struct {
+	Bus                    string
+	Name                   string
+	PathPrefix             string
+	SharedConn             bool
+	CallTimeout            time.Duration
+	RestoreParallelism     int
+	CallbackWorkers        int
+	OrderedCallbacks       bool
+	MaxBridges             int
+	TypeQuotas             map[string]int
+	TombstoneRetention     time.Duration
+	CoalesceWindow         time.Duration
+	ReconnectMaxDelay      time.Duration
+	SyncCallbackTimeout    time.Duration
+	HiddenInterfaces       []string
+	CustomBridgePath       bool
+	OptionsMerge           MergeMode
+	SignalSequence         bool
+	AllowHandoff           bool
+	RejectUnsupportedTypes bool
+	BackpressureHigh       int
+	BackpressureLow        int
+	ReadinessPhases        []string
+}
+
+// errSharedConnReleased is returned when a shared connection is used or released once all its adapters released it
+var errSharedConnReleased = errors.New("the shared connection is not used by any adapter")
+
+// SharedConn is a system bus connection shared by several Dbus adapters of the same process
+type SharedConn struct {
+	conn  *dbus.Conn
+	users int
+	sync.Mutex
+	exportsLock sync.Mutex
+}
+
+// exportsMutex locks the exports of the adapter, or the ones of all the adapters of its SharedConn once shared is set
+type exportsMutex struct {
+	own    sync.Mutex
+	shared *sync.Mutex
+}
+
+func (m *exportsMutex) mutex() *sync.Mutex {
+	if m.shared != nil {
+		return m.shared
+	}
+	return &m.own
+}
+
+func (m *exportsMutex) Lock() {
+	m.mutex().Lock()
+}
+
+func (m *exportsMutex) Unlock() {
+	m.mutex().Unlock()
 }
 
 type ProtocolJson struct {
@@ -49,6 +223,10 @@ type DeviceJson struct {
 	DevTypeID      string          `json:"devTypeID"`
 	DevTypeVersion string          `json:"typeVersion"`
 	DevOptions     json.RawMessage `json:"devOptions"`
+	Manufacturer   string          `json:"manufacturer,omitempty"`
+	Model          string          `json:"model,omitempty"`
+	SerialNumber   string          `json:"serialNumber,omitempty"`
+	HWVersion      string          `json:"hwVersion,omitempty"`
 	Items          []ItemJson      `json:"items"`
 }
 
@@ -57,28 +235,105 @@ type ItemJson struct {
 	ItemTypeID      string          `json:"itemTypeID"`
 	ItemTypeVersion string          `json:"itemTypeVersion"`
 	ItemOptions     json.RawMessage `json:"itemOptions"`
+	ItemCalibration []byte          `json:"itemCalibration,omitempty"`
+}
+
+// connection returns the connection to the bus, nil before InitDbus
+func (dc *Dbus) connection() *dbus.Conn {
+	dc.connLock.RLock()
+	defer dc.connLock.RUnlock()
+	return dc.conn
+}
+
+// setConnection replaces the connection to the bus
+func (dc *Dbus) setConnection(conn *dbus.Conn) {
+	dc.connLock.Lock()
+	dc.conn = conn
+	dc.connLock.Unlock()
 }
 
 func isNil(i interface{}) bool {
 	return i == nil || reflect.ValueOf(i).IsNil()
 }
 
+// NewSharedConn opens a system bus connection to share between several Dbus adapters
+// The adapters without SharedConn open a connection of their own each, so that one of them losing or closing its
+// connection does not affect the others.
+func NewSharedConn() (*SharedConn, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &SharedConn{conn: conn}, nil
+}
+
+func (s *SharedConn) acquire() *dbus.Conn {
+	s.Lock()
+	s.users++
+	s.Unlock()
+	return s.conn
+}
+
+// release closes the connection once its last adapter released it, a release without an adapter is an error
+func (s *SharedConn) release() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.users <= 0 {
+		return errSharedConnReleased
+	}
+	s.users--
+	if s.users > 0 {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// redial replaces the lost connection by a new one, the adapters of the lost connection share the first one opened
+func (s *SharedConn) redial(lost *dbus.Conn) (*dbus.Conn, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.users <= 0 {
+		return nil, errSharedConnReleased
+	}
+	if s.conn != lost {
+		return s.conn, nil
+	}
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
 // InitDbus initialization dbus connection
 func (dc *Dbus) InitDbus(protocolName string, cbs interface{}) *Protocol {
 	dc.ProtocolName = protocolName
 	if dc.Log == nil {
 		dc.Log = logging.MustGetLogger("dbus-adapter")
 	}
-	conn, err := dbus.SystemBus()
+	var conn *dbus.Conn
+	var err error
+	if dc.SharedConn != nil {
+		conn = dc.SharedConn.acquire()
+		dc.exportsLock.shared = &dc.SharedConn.exportsLock
+	} else {
+		conn, err = dbus.ConnectSystemBus()
+	}
 	if err != nil {
 		dc.Log.Error("Fail to request Dbus systembus", err)
 		return nil
 	}
 
 	dbusName := dbusNamePrefix + dc.ProtocolName
-	reply, err := conn.RequestName(dbusName, dbus.NameFlagReplaceExisting|dbus.NameFlagDoNotQueue)
+	reply, err := conn.RequestName(dbusName, dc.nameRequestFlags())
 	if err != nil {
 		dc.Log.Error("Fail to request Dbus name", err)
+		if dc.SharedConn != nil {
+			dc.SharedConn.release()
+		} else {
+			conn.Close()
+		}
 		return nil
 	}
 
@@ -86,7 +341,13 @@ func (dc *Dbus) InitDbus(protocolName string, cbs interface{}) *Protocol {
 		dc.Log.Warning(os.Stderr, " Dbus name is already taken")
 	}
 
-	dc.conn = conn
+	dc.setConnection(conn)
+	dc.exports = make(map[dbus.ObjectPath]*exportedObject)
+	dc.propertiesPaths = make(map[*prop.Properties]dbus.ObjectPath)
+	dc.startDispatcher()
+	dc.trackClients()
+	dc.watchNameLost(dbusName)
+	dc.watchConnection(dbusName)
 	dc.Log.Info("Connected on DBus")
 
 	dc.Bridges = map[string]*BridgeProto{}
@@ -98,13 +359,150 @@ func (dc *Dbus) InitDbus(protocolName string, cbs interface{}) *Protocol {
 	return protocol
 }
 
+// Config returns the configuration the adapter is running with, defaults included
+func (dc *Dbus) Config() Options {
+	restoreParallelism := dc.RestoreParallelism
+	if restoreParallelism < 1 {
+		restoreParallelism = 1
+	}
+
+	hidden := []string{}
+	for iface, options := range dc.InterfaceOptions {
+		if options.HideFromIntrospection {
+			hidden = append(hidden, iface)
+		}
+	}
+	sort.Strings(hidden)
+
+	typeQuotas := make(map[string]int, len(dc.TypeQuotas))
+	for typeID, quota := range dc.TypeQuotas {
+		typeQuotas[typeID] = quota
+	}
+
+	backpressureHigh, backpressureLow := dc.backpressureWatermarks()
+
+	reconnectMaxDelay := dc.ReconnectMaxDelay
+	if reconnectMaxDelay <= 0 {
+		reconnectMaxDelay = defaultReconnectMaxDelay
+	}
+
+	optionsMerge := dc.OptionsMerge
+	if optionsMerge == "" {
+		optionsMerge = MergeReplace
+	}
+
+	return Options{
+		Bus:                    "system",
+		Name:                   dbusNamePrefix + dc.ProtocolName,
+		PathPrefix:             dbusPathPrefix + dc.ProtocolName,
+		SharedConn:             dc.SharedConn != nil,
+		CallTimeout:            callTimeout,
+		RestoreParallelism:     restoreParallelism,
+		CallbackWorkers:        dc.CallbackWorkers,
+		OrderedCallbacks:       dc.OrderedCallbacks,
+		MaxBridges:             dc.MaxBridges,
+		TypeQuotas:             typeQuotas,
+		TombstoneRetention:     dc.TombstoneRetention,
+		CoalesceWindow:         dc.CoalesceWindow,
+		ReconnectMaxDelay:      reconnectMaxDelay,
+		SyncCallbackTimeout:    dc.syncCallbackTimeout(),
+		HiddenInterfaces:       hidden,
+		CustomBridgePath:       dc.BridgePath != nil,
+		OptionsMerge:           optionsMerge,
+		SignalSequence:         dc.SignalSequence,
+		AllowHandoff:           dc.AllowHandoff,
+		RejectUnsupportedTypes: dc.RejectUnsupportedTypes,
+		BackpressureHigh:       backpressureHigh,
+		BackpressureLow:        backpressureLow,
+		ReadinessPhases:        append([]string{}, dc.ReadinessPhases...),
+	}
+}
+
+// startWatcher gives a watcher of the connection its done channel, it is not started once the adapter is closed
+func (dc *Dbus) startWatcher(done *chan struct{}) (chan struct{}, bool) {
+	dc.lifecycleLock.Lock()
+	defer dc.lifecycleLock.Unlock()
+	if dc.closed {
+		return nil, false
+	}
+	*done = make(chan struct{})
+	return *done, true
+}
+
+// stopWatcher closes the done channel of a watcher to stop it
+func (dc *Dbus) stopWatcher(done *chan struct{}) {
+	dc.lifecycleLock.Lock()
+	ch := *done
+	*done = nil
+	dc.lifecycleLock.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+}
+
+// Close unexports all the objects and releases the Dbus name
+// The connection of the adapter is closed with it, a shared connection is closed when its last adapter is closed
+func (dc *Dbus) Close() error {
+	dc.lifecycleLock.Lock()
+	if dc.connection() == nil || dc.closed {
+		dc.lifecycleLock.Unlock()
+		return nil
+	}
+	dc.closed = true
+	dc.lifecycleLock.Unlock()
+	dc.stopWatchingConnection()
+	dc.CancelAll()
+	for _, p := range dc.protocols() {
+		p.cancelRemovals()
+		p.cancelPendingAdds()
+		p.dropCommands()
+	}
+	if dc.RootProtocol.Protocol != nil {
+		dc.RootProtocol.Protocol.Lock()
+		dc.RootProtocol.commands = nil
+		dc.RootProtocol.Protocol.Unlock()
+	}
+
+	conn := dc.connection()
+	dc.exportsLock.Lock()
+	for path, obj := range dc.exports {
+		for iface := range obj.methods {
+			conn.Export(nil, path, iface)
+		}
+		conn.Export(nil, path, dbusPropertiesInterface)
+		conn.Export(nil, path, dbusIntrospectableInterface)
+	}
+	dc.exports = make(map[dbus.ObjectPath]*exportedObject)
+	dc.propertiesPaths = make(map[*prop.Properties]dbus.ObjectPath)
+	dc.exportsLock.Unlock()
+
+	if dc.dispatcher != nil {
+		dc.dispatcher.stop()
+	}
+	dc.stopTrackingClients()
+	dc.stopWatchingNameLost()
+
+	_, err := conn.ReleaseName(dbusNamePrefix + dc.ProtocolName)
+	if err != nil {
+		dc.Log.Warning("Fail to release the Dbus name", err)
+	}
+
+	if dc.SharedConn != nil {
+		err = dc.SharedConn.release()
+	} else if closeErr := conn.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	dc.Log.Info("Disconnected from DBus")
+	return err
+}
+
 func (dc *Dbus) restoreBridges() {
 	// Get the bridges related to this protocol from the DeviceManager
 	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
 	defer cancel()
 
 	var ret json.RawMessage
-	obj := dc.conn.Object(deviceManagerDestination, deviceManagerPath)
+	obj := dc.connection().Object(deviceManagerDestination, deviceManagerPath)
 	err := obj.CallWithContext(ctx, deviceManagerBridgesMethod, 0).Store(&ret)
 	if err != nil {
 		dc.Log.Warning("Unable to get the bridges from the DeviceManager: ", err)
@@ -130,7 +528,7 @@ func (dc *Dbus) restoreDevices() {
 	defer cancel()
 
 	var ret json.RawMessage
-	obj := dc.conn.Object(deviceManagerDestination, deviceManagerPath)
+	obj := dc.connection().Object(deviceManagerDestination, deviceManagerPath)
 	err := obj.CallWithContext(ctx, deviceManagerDevicesMethod, 0, dc.ProtocolName).Store(&ret)
 	if err != nil {
 		dc.Log.Warning("Unable to get the devices from the DeviceManager: ", err)
@@ -144,7 +542,31 @@ func (dc *Dbus) restoreDevices() {
 		return
 	}
 
-	for name, devices := range protocols.Protocols {
+	for _, err := range dc.restoreProtocols(protocols) {
+		dc.Log.Warning("Unable to restore the device", err)
+	}
+}
+
+// restoreProtocols adds the devices of the protocols with up to RestoreParallelism devices added at the same time
+// Only the checks and the Sync callbacks of the devices run in parallel, their exports wait for exportsLock. The
+// errors are returned in the order of the protocol names then of the devices in the document, whatever the order in
+// which the devices are added.
+func (dc *Dbus) restoreProtocols(protocols ProtocolJson) []error {
+	dc.enterMutation()
+	defer dc.exitMutation()
+	names := make([]string, 0, len(protocols.Protocols))
+	for name := range protocols.Protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type restoreJob struct {
+		protocol *Protocol
+		dev      DeviceJson
+	}
+	var jobs []restoreJob
+	for _, name := range names {
+		devices := protocols.Protocols[name]
 		var protocol *Protocol
 		if name == dc.ProtocolName {
 			// This it root protocol
@@ -152,17 +574,74 @@ func (dc *Dbus) restoreDevices() {
 		} else {
 			// This is bridge protocol
 			bridgeId := strings.ReplaceAll(name, dc.ProtocolName+"_", "")
-			dc.RootProtocol.AddBridge(bridgeId)
+			if _, err := dc.RootProtocol.AddBridge(bridgeId); err != nil {
+				dc.Log.Warning("Unable to restore the devices of the bridge", bridgeId, err)
+				continue
+			}
 			protocol = dc.Bridges[bridgeId].Protocol
 		}
 
 		for _, dev := range devices {
-			protocol.AddDevice(dev.DevID, dev.ComID, dev.DevTypeID, dev.DevTypeVersion, dev.DevOptions)
-			device := protocol.Devices[dev.DevID]
+			jobs = append(jobs, restoreJob{protocol: protocol, dev: dev})
+		}
+	}
 
-			for _, item := range dev.Items {
-				device.AddItem(item.ItemID, item.ItemTypeID, item.ItemTypeVersion, item.ItemOptions)
-			}
+	parallelism := dc.RestoreParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	errs := make([]error, len(jobs))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for index, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(index int, protocol *Protocol, dev DeviceJson) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[index] = restoreDevice(protocol, dev)
+		}(index, job.protocol, job.dev)
+	}
+	wg.Wait()
+
+	var failures []error
+	for index, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", jobs[index].dev.DevID, err))
+		}
+	}
+	return failures
+}
+
+// restoreDevice adds the device with its items, it is called from a mutation or from a diff
+func restoreDevice(protocol *Protocol, dev DeviceJson) error {
+	if _, err := protocol.addDevice(dev.DevID, dev.ComID, dev.DevTypeID, dev.DevTypeVersion, dev.DevOptions); err != nil {
+		return err
+	}
+	protocol.Lock()
+	device, present := protocol.Devices[dev.DevID]
+	protocol.Unlock()
+	if !present {
+		return nil
+	}
+	device.restoreMetadata(dev)
+
+	for _, item := range dev.Items {
+		if _, err := device.addItem(item.ItemID, item.ItemTypeID, item.ItemTypeVersion, item.ItemOptions); err != nil {
+			return err
+		}
+		if len(item.ItemCalibration) == 0 {
+			continue
+		}
+		device.Lock()
+		i, present := device.Items[item.ItemID]
+		device.Unlock()
+		if !present {
+			// The item was removed since its add, there is nothing to calibrate
+			device.log.Warning("Calibration of the item", item.ItemID, "of the device", dev.DevID, "not restored, the item is gone")
+			continue
 		}
+		i.SetCalibration(item.ItemCalibration)
 	}
+	return nil
 }
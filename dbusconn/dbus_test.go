@@ -0,0 +1,696 @@
+package dbusconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/op/go-logging"
+)
+
+const (
+	// signalTimeout is the longest wait for a signal expected by a test
+	signalTimeout = 5 * time.Second
+	// barrierMember is the signal emitted after the signals of a test so that the watcher knows it got them all
+	barrierMember = "com.ubiant.Test.Barrier"
+)
+
+var (
+	// busAvailable tells that the private bus of the tests is running
+	busAvailable bool
+	// adapterCount numbers the protocols of the tests so that each test owns its Dbus name and paths
+	adapterCount int
+)
+
+// TestMain runs the tests on a private bus started with dbus-daemon, the tests needing a bus are skipped without it
+func TestMain(m *testing.M) {
+	os.Exit(runWithBus(m))
+}
+
+func runWithBus(m *testing.M) int {
+	logging.SetLevel(logging.CRITICAL, "dbus-adapter")
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbus-daemon not found, the tests needing a bus are skipped")
+		return m.Run()
+	}
+	dir, err := ioutil.TempDir("", "dbusconn")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to create the directory of the bus:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--nopidfile", "--address=unix:path="+socket)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to start dbus-daemon, the tests needing a bus are skipped:", err)
+		return m.Run()
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	for start := time.Now(); time.Since(start) < signalTimeout; time.Sleep(10 * time.Millisecond) {
+		if busReady("unix:path=" + socket) {
+			busAvailable = true
+			break
+		}
+	}
+	if !busAvailable {
+		fmt.Fprintln(os.Stderr, "dbus-daemon did not start, the tests needing a bus are skipped")
+		return m.Run()
+	}
+	os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "unix:path="+socket)
+	return m.Run()
+}
+
+// busReady tells whether the bus accepts clients, the socket exists before the daemon accepts them
+func busReady(address string) bool {
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	return conn.Auth(nil) == nil && conn.Hello() == nil
+}
+
+// requireBus skips the test when the private bus is not running
+func requireBus(t testing.TB) {
+	t.Helper()
+	if !busAvailable {
+		t.Skip("no bus to run the test")
+	}
+}
+
+// newTestAdapter starts the adapter on the private bus with a protocol name of its own and closes it at the end of
+// the test
+func newTestAdapter(t testing.TB, dc *Dbus, cbs interface{}) *Protocol {
+	t.Helper()
+	requireBus(t)
+	adapterCount++
+	p := dc.InitDbus(fmt.Sprintf("T%03d", adapterCount), cbs)
+	if p == nil {
+		t.Fatal("InitDbus failed")
+	}
+	t.Cleanup(func() { dc.Close() })
+	return p
+}
+
+// addTestDevice adds a device and fails the test if it is not added
+func addTestDevice(t testing.TB, p *Protocol, devID string, typeID string) *Device {
+	t.Helper()
+	if _, err := p.AddDevice(devID, "", typeID, "1", []byte("{}")); err != nil {
+		t.Fatalf("AddDevice %s: %v", devID, err)
+	}
+	return testDevice(t, p, devID)
+}
+
+// addTestItem adds an item and fails the test if it is not added
+func addTestItem(t testing.TB, d *Device, itemID string, typeID string) *Item {
+	t.Helper()
+	if _, err := d.AddItem(itemID, typeID, "1", []byte("{}")); err != nil {
+		t.Fatalf("AddItem %s: %v", itemID, err)
+	}
+	d.Lock()
+	defer d.Unlock()
+	i, present := d.Items[itemID]
+	if !present {
+		t.Fatalf("item %s missing", itemID)
+	}
+	return i
+}
+
+// testDevice returns the device of the protocol and fails the test if it is missing
+func testDevice(t testing.TB, p *Protocol, devID string) *Device {
+	t.Helper()
+	p.Lock()
+	defer p.Unlock()
+	d, present := p.Devices[devID]
+	if !present {
+		t.Fatalf("device %s missing", devID)
+	}
+	return d
+}
+
+// hasDevice tells if the protocol has the device
+func hasDevice(p *Protocol, devID string) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, present := p.Devices[devID]
+	return present
+}
+
+// testBridge returns the bridge, the tree being read under the lock of the root protocol
+func testBridge(dc *Dbus, bridgeID string) (*BridgeProto, bool) {
+	dc.RootProtocol.Protocol.Lock()
+	defer dc.RootProtocol.Protocol.Unlock()
+	bridge, present := dc.Bridges[bridgeID]
+	return bridge, present
+}
+
+// hasItem tells if the device has the item
+func hasItem(d *Device, itemID string) bool {
+	d.Lock()
+	defer d.Unlock()
+	_, present := d.Items[itemID]
+	return present
+}
+
+// testClient is a connection of its own to the private bus, used as a client of the adapter
+type testClient struct {
+	t       testing.TB
+	conn    *dbus.Conn
+	dc      *Dbus
+	signals chan *dbus.Signal
+	root    string
+	// subtrees are the paths of the bridges exported out of the root one, see BridgePath
+	subtrees []string
+}
+
+// newTestClient connects a client to the private bus, it receives the signals of the adapter
+func newTestClient(t testing.TB, dc *Dbus) *testClient {
+	t.Helper()
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		t.Fatal("Unable to connect the client:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, dc: dc, signals: make(chan *dbus.Signal, 1024), root: dbusPathPrefix + dc.ProtocolName}
+	if err := conn.AddMatchSignal(dbus.WithMatchSender(dc.connection().Names()[0])); err != nil {
+		t.Fatal("Unable to subscribe to the signals of the adapter:", err)
+	}
+	conn.Signal(c.signals)
+	return c
+}
+
+// call calls a method of the adapter and returns the call once answered
+func (c *testClient) call(path string, method string, args ...interface{}) *dbus.Call {
+	c.t.Helper()
+	return c.conn.Object(dbusNamePrefix+c.dc.ProtocolName, dbus.ObjectPath(path)).Call(method, 0, args...)
+}
+
+// property reads a property of an object of the adapter
+func (c *testClient) property(path string, iface string, name string) (dbus.Variant, error) {
+	var value dbus.Variant
+	err := c.call(path, dbusPropertiesInterface+".Get", iface, name).Store(&value)
+	return value, err
+}
+
+// owns tells if the path belongs to the root protocol or to one of its bridges, the subtrees included
+func (c *testClient) owns(path dbus.ObjectPath) bool {
+	for _, subtree := range c.subtrees {
+		if string(path) == subtree || strings.HasPrefix(string(path), subtree+"/") {
+			return true
+		}
+	}
+	return string(path) == c.root || strings.HasPrefix(string(path), c.root+"/") || strings.HasPrefix(string(path), c.root+"_")
+}
+
+// unreachable tells if the method cannot be called on the path, the way the tests check that an object is gone
+// godbus reads the parent object without its lock when the path is not exported. The export of a probe takes the
+// lock of its handler, the read is then ordered before the next changes of the tree made by the test.
+func (c *testClient) unreachable(path string, method string, args ...interface{}) bool {
+	c.t.Helper()
+	err := c.call(path, method, args...).Err
+	probe := dbus.ObjectPath(c.root + "/Probe")
+	if err := c.dc.exportMethods(probe, "com.ubiant.Test.Probe", map[string]interface{}{}); err != nil {
+		c.t.Fatal("Unable to export the probe:", err)
+	}
+	c.dc.unexportObject(probe)
+	return err != nil
+}
+
+// flush returns the signals of the adapter received so far, the adapter emits a barrier after them so that none of
+// the signals already emitted is missed
+func (c *testClient) flush() []*dbus.Signal {
+	c.t.Helper()
+	if !c.dc.connection().Connected() {
+		return c.flushClosed()
+	}
+	barrier := dbus.ObjectPath(c.root + "/Barrier")
+	if err := c.dc.connection().Emit(barrier, barrierMember); err != nil {
+		c.t.Fatal("Unable to emit the barrier:", err)
+	}
+	var signals []*dbus.Signal
+	timeout := time.After(signalTimeout)
+	for {
+		select {
+		case s := <-c.signals:
+			if s.Path == barrier && s.Name == barrierMember {
+				return signals
+			}
+			if c.owns(s.Path) {
+				signals = append(signals, s)
+			}
+		case <-timeout:
+			c.t.Fatal("Barrier not received")
+			return nil
+		}
+	}
+}
+
+// flushClosed returns the signals received from an adapter whose connection is closed, it cannot emit the barrier
+// The signals sent before the close reach the bus before the call of the client, which waits for them to be received.
+func (c *testClient) flushClosed() []*dbus.Signal {
+	c.t.Helper()
+	if err := c.conn.BusObject().Call("org.freedesktop.DBus.GetId", 0).Err; err != nil {
+		c.t.Fatal("Unable to call the bus:", err)
+	}
+	var signals []*dbus.Signal
+	for {
+		select {
+		case s := <-c.signals:
+			if c.owns(s.Path) {
+				signals = append(signals, s)
+			}
+		case <-time.After(100 * time.Millisecond):
+			return signals
+		}
+	}
+}
+
+// wait waits for a signal with the name on the path and returns it, the other signals are skipped
+func (c *testClient) wait(path string, name string) *dbus.Signal {
+	c.t.Helper()
+	timeout := time.After(signalTimeout)
+	for {
+		select {
+		case s := <-c.signals:
+			if string(s.Path) == path && s.Name == name {
+				return s
+			}
+		case <-timeout:
+			c.t.Fatalf("Signal %s not received on %s", name, path)
+			return nil
+		}
+	}
+}
+
+// names returns "path member" for each signal, the member is given without its interface
+func names(signals []*dbus.Signal) []string {
+	list := make([]string, 0, len(signals))
+	for _, s := range signals {
+		list = append(list, string(s.Path)+" "+s.Name[strings.LastIndex(s.Name, ".")+1:])
+	}
+	return list
+}
+
+// onPath returns the signals emitted on the path
+func onPath(signals []*dbus.Signal, path string) []*dbus.Signal {
+	var list []*dbus.Signal
+	for _, s := range signals {
+		if string(s.Path) == path {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// count returns how many signals have the member, given without its interface
+func count(signals []*dbus.Signal, member string) int {
+	n := 0
+	for _, s := range signals {
+		if strings.HasSuffix(s.Name, "."+member) {
+			n++
+		}
+	}
+	return n
+}
+
+// recorder records the calls of the callbacks of a test driver
+type recorder struct {
+	sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(call string) {
+	r.Lock()
+	r.calls = append(r.calls, call)
+	r.Unlock()
+}
+
+// recorded returns the calls recorded so far
+func (r *recorder) recorded() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+// waitFor polls the condition until it is true and fails the test after signalTimeout
+func waitFor(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < signalTimeout; time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("Timeout waiting for", what)
+}
+
+// concurrentDriver accepts the devices after a while and keeps the highest number of devices added at the same time
+type concurrentDriver struct {
+	sync.Mutex
+	running int
+	highest int
+}
+
+func (r *concurrentDriver) AddDeviceSync(ctx context.Context, d *Device) error {
+	r.Lock()
+	r.running++
+	if r.running > r.highest {
+		r.highest = r.running
+	}
+	r.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	r.Lock()
+	r.running--
+	r.Unlock()
+	if strings.HasPrefix(d.DevID, "bad") {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+// restoreDocument returns a document with the devices spread on the root protocol and two bridges, the devices
+// whose index is in bad are named to be rejected
+func restoreDocument(dc *Dbus, prefix string, devices int, bad ...int) ProtocolJson {
+	rejected := make(map[int]bool, len(bad))
+	for _, n := range bad {
+		rejected[n] = true
+	}
+	doc := ProtocolJson{Protocols: map[string][]DeviceJson{}}
+	names := []string{dc.ProtocolName + "_b2", dc.ProtocolName, dc.ProtocolName + "_b1"}
+	for n := 0; n < devices; n++ {
+		devID := fmt.Sprintf("%s%03d", prefix, n)
+		if rejected[n] {
+			devID = "bad" + devID
+		}
+		name := names[n%len(names)]
+		doc.Protocols[name] = append(doc.Protocols[name], DeviceJson{DevID: devID, DevTypeID: "T", DevOptions: []byte("{}"),
+			Items: []ItemJson{{ItemID: "I1", ItemTypeID: "T", ItemOptions: []byte("{}")}}})
+	}
+	return doc
+}
+
+func TestRestoreInParallel(t *testing.T) {
+	driver := &concurrentDriver{}
+	dc := &Dbus{RestoreParallelism: 4}
+	newTestAdapter(t, dc, driver)
+	doc := restoreDocument(dc, "D", 30, 4, 11, 27)
+
+	failures := dc.restoreProtocols(doc)
+	if driver.highest < 2 || driver.highest > 4 {
+		t.Errorf("%d devices added at the same time with a parallelism of 4", driver.highest)
+	}
+	var failed []string
+	for _, err := range failures {
+		failed = append(failed, strings.SplitN(err.Error(), ":", 2)[0])
+	}
+	// The root protocol T00x comes before its bridges T00x_b1 and T00x_b2
+	if want := []string{"badD004", "badD011", "badD027"}; strings.Join(failed, " ") != strings.Join(want, " ") {
+		t.Errorf("failures %v, want %v", failed, want)
+	}
+
+	c := newTestClient(t, dc)
+	var objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	if err := c.call(c.root, dbusObjectManagerInterface+".GetManagedObjects").Store(&objects); err != nil {
+		t.Fatal(err)
+	}
+	for name, devices := range doc.Protocols {
+		for _, dev := range devices {
+			path := dbus.ObjectPath(dbusPathPrefix + name + "/" + dev.DevID)
+			_, deviceExported := objects[path]
+			_, itemExported := objects[path+"/I1"]
+			if rejected := strings.HasPrefix(dev.DevID, "bad"); deviceExported == rejected || itemExported == rejected {
+				t.Errorf("%s exported %v, its item %v", path, deviceExported, itemExported)
+			}
+		}
+	}
+}
+
+func TestRestoreFailuresAreDeterministic(t *testing.T) {
+	dc := &Dbus{RestoreParallelism: 8}
+	newTestAdapter(t, dc, &concurrentDriver{})
+
+	var first string
+	for run := 0; run < 5; run++ {
+		failures := dc.restoreProtocols(restoreDocument(dc, fmt.Sprintf("R%d_", run), 24, 1, 2, 3, 13, 20))
+		var failed []string
+		for _, err := range failures {
+			failed = append(failed, strings.TrimPrefix(strings.SplitN(err.Error(), ":", 2)[0], fmt.Sprintf("badR%d_", run)))
+		}
+		if run == 0 {
+			first = strings.Join(failed, " ")
+		} else if strings.Join(failed, " ") != first {
+			t.Fatalf("run %d failed %v, the first run failed %v", run, failed, first)
+		}
+	}
+}
+
+// vanishingDriver removes the items named gone while accepting them, the way a concurrent RemoveItem would
+type vanishingDriver struct{}
+
+func (*vanishingDriver) AddItemSync(ctx context.Context, i *Item) error {
+	if i.ItemID == "gone" {
+		i.Device.RemoveItem(i.ItemID)
+	}
+	return nil
+}
+
+func TestRestoreCalibrationOfAVanishedItem(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &vanishingDriver{})
+	calibration := []byte(`{"points":[[0,0],[10,20]]}`)
+	dev := DeviceJson{DevID: "D1", DevTypeID: "T", DevOptions: []byte("{}"), Items: []ItemJson{
+		{ItemID: "gone", ItemTypeID: "T", ItemOptions: []byte("{}"), ItemCalibration: calibration},
+		{ItemID: "I1", ItemTypeID: "T", ItemOptions: []byte("{}"), ItemCalibration: calibration},
+	}}
+
+	if err := restoreDevice(p, dev); err != nil {
+		t.Fatal(err)
+	}
+	d := testDevice(t, p, "D1")
+	if hasItem(d, "gone") || !hasItem(d, "I1") {
+		t.Fatal("items of the restored device")
+	}
+	d.Lock()
+	i := d.Items["I1"]
+	d.Unlock()
+	if restored, _ := i.GetCalibration(); len(restored) == 0 {
+		t.Error("calibration of the item after the vanished one not restored")
+	}
+}
+
+func BenchmarkRestore(b *testing.B) {
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(fmt.Sprint("parallelism", parallelism), func(b *testing.B) {
+			dc := &Dbus{RestoreParallelism: parallelism}
+			newTestAdapter(b, dc, nil)
+			b.StopTimer()
+			for n := 0; n < b.N; n++ {
+				doc := restoreDocument(dc, fmt.Sprintf("B%d_", n), 60)
+				b.StartTimer()
+				if failures := dc.restoreProtocols(doc); len(failures) > 0 {
+					b.Fatal(failures)
+				}
+				b.StopTimer()
+				for name, devices := range doc.Protocols {
+					p := dc.RootProtocol.Protocol
+					if name != dc.ProtocolName {
+						p = dc.Bridges[strings.TrimPrefix(name, dc.ProtocolName+"_")].Protocol
+					}
+					for _, dev := range devices {
+						p.RemoveDevice(dev.DevID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSharedConnBetweenTwoAdapters(t *testing.T) {
+	requireBus(t)
+	shared, err := NewSharedConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &Dbus{SharedConn: shared}
+	second := &Dbus{SharedConn: shared}
+	addTestDevice(t, newTestAdapter(t, first, nil), "D1", "T")
+	addTestDevice(t, newTestAdapter(t, second, nil), "D2", "T")
+	c := newTestClient(t, first)
+
+	owners := make(map[string]bool)
+	for _, dc := range []*Dbus{first, second} {
+		var owner string
+		if err := c.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, dbusNamePrefix+dc.ProtocolName).Store(&owner); err != nil {
+			t.Fatal(err)
+		}
+		owners[owner] = true
+	}
+	if len(owners) != 1 || !owners[shared.conn.Names()[0]] {
+		t.Fatalf("owners of the names: %v", owners)
+	}
+	callSecond := func() error {
+		return c.conn.Object(dbusNamePrefix+second.ProtocolName, dbus.ObjectPath(dbusPathPrefix+second.ProtocolName+"/D2")).
+			Call(dbusDeviceInterface+".GetItems", 0).Err
+	}
+	if err := callSecond(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !shared.conn.Connected() {
+		t.Fatal("shared connection closed while still used")
+	}
+	if err := callSecond(); err != nil {
+		t.Fatal("second adapter once the first is closed:", err)
+	}
+	if !c.unreachable(c.root+"/D1", dbusDeviceInterface+".GetItems") {
+		t.Error("device of the closed adapter still exported")
+	}
+
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if shared.conn.Connected() {
+		t.Error("shared connection left open by the last adapter")
+	}
+	if err := shared.release(); err == nil || shared.users != 0 {
+		t.Errorf("release once all the adapters are closed: %v, %d users", err, shared.users)
+	}
+}
+
+func TestSharedConnReconnects(t *testing.T) {
+	requireBus(t)
+	shared, err := NewSharedConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &Dbus{SharedConn: shared}
+	second := &Dbus{SharedConn: shared}
+	_, firstReconnected := newReconnectingAdapter(t, first)
+	p, secondReconnected := newReconnectingAdapter(t, second)
+	addTestDevice(t, p, "D2", "T")
+
+	lost := shared.conn
+	lost.Close()
+	for _, reconnected := range []chan struct{}{firstReconnected, secondReconnected} {
+		select {
+		case <-reconnected:
+		case <-time.After(signalTimeout):
+			t.Fatal("Timeout waiting for the reconnection")
+		}
+	}
+	if conn := first.connection(); conn == lost || conn != second.connection() || conn != shared.conn {
+		t.Fatal("adapters not reconnected on the same new connection")
+	}
+	c := newTestClient(t, second)
+	if err := c.call(c.root+"/D2", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Error("device of the second adapter once reconnected:", err)
+	}
+}
+
+func TestConfigHoldsTheDefaults(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+
+	want := Options{
+		Bus:                 "system",
+		Name:                dbusNamePrefix + dc.ProtocolName,
+		PathPrefix:          dbusPathPrefix + dc.ProtocolName,
+		CallTimeout:         callTimeout,
+		RestoreParallelism:  1,
+		TypeQuotas:          map[string]int{},
+		ReconnectMaxDelay:   defaultReconnectMaxDelay,
+		SyncCallbackTimeout: callTimeout,
+		HiddenInterfaces:    []string{},
+		OptionsMerge:        MergeReplace,
+		BackpressureHigh:    defaultBackpressureHigh,
+		BackpressureLow:     defaultBackpressureHigh / 2,
+		ReadinessPhases:     []string{},
+	}
+	if config := dc.Config(); !reflect.DeepEqual(config, want) {
+		t.Errorf("Config:\n%+v\nwant\n%+v", config, want)
+	}
+}
+
+func TestConfigHoldsTheOptions(t *testing.T) {
+	requireBus(t)
+	shared, err := NewSharedConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := &Dbus{
+		SharedConn:             shared,
+		RestoreParallelism:     4,
+		CallbackWorkers:        2,
+		OrderedCallbacks:       true,
+		MaxBridges:             3,
+		TypeQuotas:             map[string]int{"T": 5},
+		TombstoneRetention:     time.Minute,
+		CoalesceWindow:         time.Second,
+		ReconnectMaxDelay:      time.Second,
+		SyncCallbackTimeout:    2 * time.Second,
+		InterfaceOptions:       map[string]InterfaceOptions{dbusItemInterface: {HideFromIntrospection: true}, dbusDeviceInterface: {}},
+		BridgePath:             func(bridgeID string) dbus.ObjectPath { return dbus.ObjectPath("/b/" + bridgeID) },
+		OptionsMerge:           MergeDeep,
+		SignalSequence:         true,
+		AllowHandoff:           true,
+		RejectUnsupportedTypes: true,
+		BackpressureHigh:       100,
+		BackpressureLow:        10,
+		ReadinessPhases:        []string{"restore", "discovery"},
+	}
+	newTestAdapter(t, dc, nil)
+
+	want := Options{
+		Bus:                    "system",
+		Name:                   dbusNamePrefix + dc.ProtocolName,
+		PathPrefix:             dbusPathPrefix + dc.ProtocolName,
+		SharedConn:             true,
+		CallTimeout:            callTimeout,
+		RestoreParallelism:     4,
+		CallbackWorkers:        2,
+		OrderedCallbacks:       true,
+		MaxBridges:             3,
+		TypeQuotas:             map[string]int{"T": 5},
+		TombstoneRetention:     time.Minute,
+		CoalesceWindow:         time.Second,
+		ReconnectMaxDelay:      time.Second,
+		SyncCallbackTimeout:    2 * time.Second,
+		HiddenInterfaces:       []string{dbusItemInterface},
+		CustomBridgePath:       true,
+		OptionsMerge:           MergeDeep,
+		SignalSequence:         true,
+		AllowHandoff:           true,
+		RejectUnsupportedTypes: true,
+		BackpressureHigh:       100,
+		BackpressureLow:        10,
+		ReadinessPhases:        []string{"restore", "discovery"},
+	}
+	config := dc.Config()
+	if !reflect.DeepEqual(config, want) {
+		t.Fatalf("Config:\n%+v\nwant\n%+v", config, want)
+	}
+
+	// The configuration returned is a copy
+	config.TypeQuotas["T"] = 0
+	config.ReadinessPhases[0] = "x"
+	if dc.TypeQuotas["T"] != 5 || dc.ReadinessPhases[0] != "restore" {
+		t.Error("adapter changed through its configuration")
+	}
+}
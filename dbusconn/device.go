@@ -2,6 +2,8 @@ package dbusconn
 
 import (
 	"bytes"
+	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,14 +13,22 @@ import (
 )
 
 const (
-	msgBodyNotValid     = "body not valid"
-	signalDeviceAdded   = "DeviceAdded"
-	signalDeviceRemoved = "DeviceRemoved"
+	msgBodyNotValid       = "body not valid"
+	signalDeviceAdded     = "DeviceAdded"
+	signalDeviceRemoved   = "DeviceRemoved"
+	signalDeviceCompleted = "DeviceCompleted"
+	signalDeviceError     = "DeviceError"
+	signalComIDChanged    = "ComIDChanged"
 
 	propertyOperabilityState = "OperabilityState"
 	propertyPairingState     = "PairingState"
 	propertyVersion          = "Version"
 	propertyOptions          = "Options"
+	propertyManufacturer     = "Manufacturer"
+	propertyModel            = "Model"
+	propertySerialNumber     = "SerialNumber"
+	propertyHWVersion        = "HWVersion"
+	propertyLastError        = "LastError"
 
 	// OperabilityOk state 'ok' for OperabilityState
 	OperabilityOk OperabilityState = "OK"
@@ -41,6 +51,20 @@ const (
 	PairingNotNeeded PairingState = "NOT_NEEDED"
 )
 
+var (
+	// ErrDeviceBusy is returned when a command is received while an operation is in progress on the device
+	ErrDeviceBusy = dbus.NewError(dbusDeviceInterface+".Error.Busy", []interface{}{"An operation is already in progress on the device"})
+	// ErrNoRefreshHandler is returned when a refresh is requested but no callback handles it
+	ErrNoRefreshHandler = dbus.NewError(dbusDeviceInterface+".Error.NoRefreshHandler", []interface{}{"No refresh handler registered"})
+	// ErrNotPlaceholder is returned when completing a device which is not a placeholder
+	ErrNotPlaceholder = dbus.NewError(dbusDeviceInterface+".Error.NotPlaceholder", []interface{}{"The device is not a placeholder"})
+	// ErrNotAdding is returned when canceling the add of a device which is not being added
+	ErrNotAdding = dbus.NewError(dbusDeviceInterface+".Error.NotAdding", []interface{}{"The device is not being added"})
+	// ErrReservedCommand is returned when adding a command with the name of a method of the device interface, or of the
+	// protocol interface for the commands of the root protocol
+	ErrReservedCommand = dbus.NewError(dbusDeviceInterface+".Error.ReservedCommand", []interface{}{"The name of the command is taken by a built-in method"})
+)
+
 // Device object structure
 type Device struct {
 	sync.Mutex
@@ -53,22 +77,117 @@ type Device struct {
 	TypeVersion        string
 	Options            []byte
 	FirmwareVersion    string
+	Manufacturer       string
+	Model              string
+	SerialNumber       string
+	HWVersion          string
+	LastError          string
 	Operability        OperabilityState
 	PairingState       PairingState
 	OperabilityTimeout time.Duration
+	// ExclusiveOperations rejects the commands received while the device is Busy
+	ExclusiveOperations bool
+	Busy                bool
+	// Placeholder informs that the device is known only by its ID until it is completed
+	Placeholder bool
+	// Aggregate computes the value of an item of a virtual device from the values of its sources, see AddVirtualDevice
+	Aggregate func(itemID string, values [][]byte) []byte
+	// CommandQueueSize runs the commands one at a time in arrival order with at most CommandQueueSize waiting ones,
+	// they run concurrently if 0
+	CommandQueueSize int
+	// CommandQueuePolicy tells what to do with a command received while the queue is full, QueueRejectNewest by default
+	CommandQueuePolicy QueuePolicy
 
 	Items map[string]*Item
 
-	dc         *Dbus
-	timer      *time.Timer
-	properties *prop.Properties
-	log        *logging.Logger
+	dc        *Dbus
+	aliases   []string
+	adding    bool
+	cancelAdd context.CancelFunc
+	// removalHandled tells that the protocol already accepted or caused the removal, it is not told again
+	removalHandled bool
+	// accepting tells that the device waits for AddDeviceSync, it is neither exported nor announced yet
+	accepting bool
+
+	commands        map[string]func([]byte) ([]byte, error)
+	externalMethods map[string]interface{}
+	timer           *time.Timer
+	properties      *prop.Properties
+	log             *logging.Logger
 
-	addItemCB            interface{ AddItem(*Item) }
-	removeItemCB         interface{ RemoveItem(string, string) }
+	addItemCB interface{ AddItem(*Item) }
+	// addItemSyncCB is used instead of addItemCB when implemented, AddItem waits for its result
+	addItemSyncCB interface {
+		AddItemSync(context.Context, *Item) error
+	}
+	// removeItemSyncCB is used instead of removeItemCB when implemented, RemoveItem waits for its result
+	removeItemSyncCB interface {
+		RemoveItemSync(context.Context, *Item) error
+	}
+	removeItemCB interface{ RemoveItem(string, string) }
+	// removeProtocolItemCB is used instead of removeItemCB when implemented, it tells the protocol of the device
+	removeProtocolItemCB interface {
+		RemoveProtocolItem(*Protocol, string, string)
+	}
 	setDeviceOptionCb    interface{ SetDeviceOptions(*Device) }
 	updateFirmwareCb     interface{ UpdateFirmware(*Device, string) }
 	operabilityTimeoutCB interface{ OperabilityWentKo(*Device) }
+	refreshDeviceCB      interface{ RefreshDevice(*Device) }
+	itemChangeCB         func(itemID string, value []byte)
+
+	muted   bool
+	pending []*pendingEmit
+	// coalescing holds back the emits of the device and of its items while DeviceAdded is delayed by CoalesceWindow
+	coalescing bool
+	// announcing is set while DeviceAdded and the emits held back with it are sent at the end of CoalesceWindow
+	announcing bool
+	muteLock   sync.Mutex
+
+	queue        []*queuedCommand
+	queueRunning bool
+	// queueClosed tells that the device is removed or the adapter closed, the commands are dropped
+	queueClosed bool
+	queueLock   sync.Mutex
+
+	counters     map[string]int64
+	countersLock sync.Mutex
+
+	// optionsLock serializes the changes of the options, UpdateOptions reads them before writing the merge
+	optionsLock sync.Mutex
+
+	itemsProvider     func() []ItemSpec
+	itemsProviderLock sync.Mutex
+}
+
+// OnAnyItemChange registers a callback called whenever the value of one of the items of the device changes
+func (d *Device) OnAnyItemChange(cb func(itemID string, value []byte)) {
+	d.Lock()
+	d.itemChangeCB = cb
+	d.Unlock()
+}
+
+// DeviceSpec describes a device given to the ValidateDevice hook before it is added
+type DeviceSpec struct {
+	BridgeID    string
+	DevID       string
+	ComID       string
+	TypeID      string
+	TypeVersion string
+	Options     []byte
+}
+
+// ItemSpec describes an item added by AddItems
+type ItemSpec struct {
+	ItemID      string
+	TypeID      string
+	TypeVersion string
+	Options     []byte
+}
+
+// RejectedItem is an item not added by AddItems with the reason of its rejection
+type RejectedItem struct {
+	ItemID string
+	Reason string
 }
 
 // OperabilityState informs if the device work
@@ -77,8 +196,18 @@ type OperabilityState string
 // PairingState informs the state of the pairing
 type PairingState string
 
-func initDevice(devID string, address string, typeID string, typeVersion string, options []byte, p *Protocol) {
+// initDevice adds and exports the device, the driver is told about it if dispatch is true
+// Its type must have been counted with admitType, p must be locked
+func initDevice(devID string, address string, typeID string, typeVersion string, options []byte, placeholder bool, dispatch bool, p *Protocol) *Device {
+	d := newDevice(devID, address, typeID, typeVersion, options, placeholder, p)
+	d.export(dispatch)
+	return d
+}
+
+// newDevice adds the device to the protocol without exporting it, p must be locked
+func newDevice(devID string, address string, typeID string, typeVersion string, options []byte, placeholder bool, p *Protocol) *Device {
 	d := &Device{
+		Placeholder:  placeholder,
 		DevID:        devID,
 		Address:      address,
 		TypeID:       typeID,
@@ -92,70 +221,401 @@ func initDevice(devID string, address string, typeID string, typeVersion string,
 		dc:           p.dc,
 	}
 	p.Devices[devID] = d
+	p.dc.addMetric(metricDevices, 1)
+	delete(p.tombstones, devID)
+	if address != "" {
+		p.comIDs[address] = devID
+	}
+	return d
+}
 
+// export exports the device added by newDevice and emits DeviceAdded, the driver is told about it if dispatch is true
+// The protocol of the device must be locked
+func (d *Device) export(dispatch bool) {
 	d.SetDbusProperties(nil)
 	d.SetDbusMethods(nil)
 	d.SetCallbacks(d.Protocol.cbs)
-	if !isNil(p.addDeviceCB) {
-		go p.addDeviceCB.AddDevice(p.Devices[devID])
-	}
 
 	//Emit Device Added
-	d.EmitDbusSignal(signalDeviceAdded, d.Address, d.TypeID, d.TypeVersion, d.Options)
+	d.emitDeviceAdded(DeviceAddedPayload{
+		Address:     d.Address,
+		TypeID:      d.TypeID,
+		TypeVersion: d.TypeVersion,
+		Options:     d.Options,
+	})
+	if dispatch {
+		d.Protocol.dispatchAddDevice(d)
+	}
+}
+
+// dispatchAddDevice calls the AddDevice callback, the device is in the adding state until it returns
+// AddDeviceSync is not called from here, the callers wait for it with addDeviceSync to return its error.
+func (p *Protocol) dispatchAddDevice(d *Device) {
+	if isNil(p.addDeviceContextCB) && isNil(p.addDeviceCB) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Lock()
+	d.adding = true
+	d.cancelAdd = cancel
+	d.Unlock()
+
+	d.dispatch(PriorityLow, func() {
+		if !isNil(p.addDeviceContextCB) {
+			p.addDeviceContextCB.AddDeviceContext(ctx, d)
+		} else {
+			p.addDeviceCB.AddDevice(d)
+		}
+		d.Lock()
+		d.adding = false
+		d.Unlock()
+		cancel()
+	})
+}
+
+// dispatchRemoveDevice calls the RemoveDevice callback of the protocol, d must be locked
+func (p *Protocol) dispatchRemoveDevice(d *Device) {
+	if !isNil(p.removeDeviceSyncCB) {
+		d.dispatch(PriorityHigh, func() {
+			if err := p.removeDeviceSyncCB.RemoveDeviceSync(context.Background(), d); err != nil {
+				d.log.Warning("Removal of the device", d.DevID, "failed in the protocol:", err)
+			}
+		})
+	} else if !isNil(p.removeProtocolDeviceCB) {
+		d.dispatch(PriorityHigh, func() { p.removeProtocolDeviceCB.RemoveProtocolDevice(p, d.DevID) })
+	} else if !isNil(p.removeDeviceCB) {
+		d.dispatch(PriorityHigh, func() { p.removeDeviceCB.RemoveDevice(d.DevID) })
+	}
 }
 
 func removeDevice(d *Device) {
 	p := d.Protocol
-	path := dbus.ObjectPath(dbusPathPrefix + p.protocolName + "/" + d.DevID)
+	path := dbus.ObjectPath(p.path + "/" + d.DevID)
+	d.dropCommands()
 	d.Lock()
+	announced := !d.accepting
 	for _, i := range d.Items {
 		removeItem(i)
 	}
-	if !isNil(p.removeDeviceCB) {
-		go p.removeDeviceCB.RemoveDevice(d.DevID)
+	if !d.removalHandled {
+		p.dispatchRemoveDevice(d)
 	}
+	for _, aliasID := range d.aliases {
+		delete(p.aliases, aliasID)
+		p.dc.unexportObject(dbus.ObjectPath(p.path + "/" + aliasID))
+	}
+	d.aliases = nil
 	d.Unlock()
+	p.forgetVirtual(d)
 	delete(p.Devices, d.DevID)
-	p.dc.conn.Emit(path, dbusDeviceInterface+"."+signalDeviceRemoved)
-	p.dc.conn.Export(nil, path, dbusDeviceInterface)
+	if p.dc.TombstoneRetention > 0 {
+		p.tombstones[d.DevID] = time.Now()
+		p.pruneTombstones()
+	}
+	if p.comIDs[d.Address] == d.DevID {
+		delete(p.comIDs, d.Address)
+	}
+	// The emits held back with a cancelled DeviceAdded are not lost, the clients never knew of the device. Once the
+	// window is over and DeviceAdded is being sent, the removal is sent after the emits held back with it.
+	coalesced := p.cancelDeviceAdded(d.DevID)
+	var ifaces []string
+	if announced {
+		ifaces = p.dc.exportedInterfaces(path)
+	}
+	d.muteLock.Lock()
+	sending := d.coalescing && d.announcing
+	coalesced = coalesced || d.coalescing && !d.announcing
+	dropped := 0
+	if sending {
+		s := p.dc.lifecycle()
+		d.pending = append(d.pending, &pendingEmit{signal: func() {
+			p.dc.emitLifecycle(path, dbusDeviceInterface+"."+signalDeviceRemoved, s)
+			p.dc.emitInterfacesRemoved(path, ifaces)
+		}})
+	} else {
+		for _, emit := range d.pending {
+			if emit.signal != nil && !coalesced {
+				dropped++
+			}
+		}
+		d.coalescing = false
+		d.pending = nil
+	}
+	d.muted = false
+	d.muteLock.Unlock()
+	if dropped > 0 {
+		d.dc.addMetric(metricDroppedSignals, int64(dropped))
+	}
+	p.dc.addMetric(metricDevices, -1)
+	p.dc.countType(d.TypeID, -1)
+	if announced && !coalesced && !sending {
+		p.dc.emitLifecycle(path, dbusDeviceInterface+"."+signalDeviceRemoved, p.dc.lifecycle())
+		p.dc.emitInterfacesRemoved(path, ifaces)
+	}
+	p.dc.forgetLazyItems(path)
+	p.dc.unexportObject(path)
 }
 
 func (d *Device) operabilityCBTimeout() {
 	d.SetOperabilityState(OperabilityKo)
 
 	if !isNil(d.operabilityTimeoutCB) {
-		go d.operabilityTimeoutCB.OperabilityWentKo(d)
+		d.dispatch(PriorityLow, func() { d.operabilityTimeoutCB.OperabilityWentKo(d) })
 	}
 }
 
 func (d *Device) setDeviceOptions(c *prop.Change) *dbus.Error {
-	if !isNil(d.setDeviceOptionCb) {
-		go d.setDeviceOptionCb.SetDeviceOptions(d)
+	return d.dc.unlessFrozenWrite(func() *dbus.Error {
+		if err := validateArgs(validOptions("Options", c.Value.([]byte))); err != nil {
+			return err
+		}
+		if !isNil(d.setDeviceOptionCb) {
+			d.dispatch(PriorityLow, func() { d.setDeviceOptionCb.SetDeviceOptions(d) })
+		} else {
+			d.log.Warning("No Options")
+		}
+		return nil
+	})
+}
+
+// Complete is the dbus method to give the missing information of a placeholder device
+// The device goes through the checks of AddDevice, it stays a placeholder if they or AddDeviceSync reject it.
+func (d *Device) Complete(comID string, typeID string, typeVersion string, options []byte) *dbus.Error {
+	d.dc.enterMutation()
+	defer d.dc.exitMutation()
+	d.log.Info("Complete called - devID:", d.DevID, "comID:", comID, "typeID:", typeID, "typeVersion:", typeVersion, "options:", options)
+	if err := validateArgs(maxLength("comID", comID), maxLength("typeID", typeID),
+		maxLength("typeVersion", typeVersion), validOptions("options", options)); err != nil {
+		return err
+	}
+	p := d.Protocol
+	if err := p.checkDevice(DeviceSpec{p.BridgeID, d.DevID, comID, typeID, typeVersion, options}); err != nil {
+		return err
+	}
+	p.Lock()
+	d.Lock()
+	if !d.Placeholder {
+		d.Unlock()
+		p.Unlock()
+		return ErrNotPlaceholder
+	}
+	if err := p.checkIDs(d.DevID, comID); err != nil {
+		d.Unlock()
+		p.Unlock()
+		return err
+	}
+	if typeID != d.TypeID {
+		if err := p.admitType(d.DevID, typeID); err != nil {
+			d.Unlock()
+			p.Unlock()
+			return err
+		}
+		p.dc.countType(d.TypeID, -1)
+	}
+	placeholder := placeholderState{address: d.Address, typeID: d.TypeID, typeVersion: d.TypeVersion, options: d.Options}
+	d.Placeholder = false
+	if p.comIDs[d.Address] == d.DevID {
+		delete(p.comIDs, d.Address)
+	}
+	d.Address = comID
+	d.TypeID = typeID
+	d.TypeVersion = typeVersion
+	d.Options = options
+	if comID != "" {
+		p.comIDs[comID] = d.DevID
+	}
+	d.Unlock()
+	p.Unlock()
+
+	d.SetOption(options)
+	if !isNil(p.addDeviceSyncCB) {
+		if err := p.callAddDeviceSync(d); err != nil {
+			d.restorePlaceholder(placeholder)
+			return err
+		}
 	} else {
-		d.log.Warning("No Options")
+		p.dispatchAddDevice(d)
+	}
+	d.emitDeviceCompleted(DeviceCompletedPayload{
+		Address:     comID,
+		TypeID:      typeID,
+		TypeVersion: typeVersion,
+		Options:     options,
+	})
+	return nil
+}
+
+// placeholderState is what Complete changes on a placeholder, to restore it when the protocol rejects the device
+type placeholderState struct {
+	address     string
+	typeID      string
+	typeVersion string
+	options     []byte
+}
+
+// restorePlaceholder turns the device rejected by AddDeviceSync back into the placeholder it was before Complete
+// The placeholder stays exported as it was, its comID and the count of its type are restored.
+func (d *Device) restorePlaceholder(placeholder placeholderState) {
+	p := d.Protocol
+	p.Lock()
+	d.Lock()
+	if p.Devices[d.DevID] != d {
+		d.Unlock()
+		p.Unlock()
+		return
+	}
+	if p.comIDs[d.Address] == d.DevID {
+		delete(p.comIDs, d.Address)
+	}
+	if d.TypeID != placeholder.typeID {
+		p.dc.countType(d.TypeID, -1)
+		p.dc.countType(placeholder.typeID, 1)
+	}
+	d.Placeholder = true
+	d.Address = placeholder.address
+	d.TypeID = placeholder.typeID
+	d.TypeVersion = placeholder.typeVersion
+	d.Options = placeholder.options
+	if _, taken := p.comIDs[d.Address]; d.Address != "" && !taken {
+		p.comIDs[d.Address] = d.DevID
+	}
+	d.Unlock()
+	p.Unlock()
+
+	d.SetOption(placeholder.options)
+}
+
+// SetComID is the dbus method to change the comID of the device, its items are kept
+func (d *Device) SetComID(comID string) *dbus.Error {
+	d.dc.enterMutation()
+	defer d.dc.exitMutation()
+	d.log.Info("SetComID called - devID:", d.DevID, "comID:", comID)
+	if err := validateArgs(maxLength("comID", comID)); err != nil {
+		return err
+	}
+	p := d.Protocol
+	p.Lock()
+	if devID, taken := p.comIDs[comID]; taken && devID != d.DevID {
+		p.Unlock()
+		return ErrIDTaken
+	}
+	d.Lock()
+	oldComID := d.Address
+	if p.comIDs[oldComID] == d.DevID {
+		delete(p.comIDs, oldComID)
+	}
+	d.Address = comID
+	for _, i := range d.Items {
+		i.Mac = comID
+	}
+	if comID != "" {
+		p.comIDs[comID] = d.DevID
+	}
+	d.Unlock()
+	p.Unlock()
+
+	if oldComID != comID {
+		d.emitComIDChanged(ComIDChangedPayload{OldComID: oldComID, ComID: comID})
 	}
 	return nil
 }
 
 // AddItem adds a new item to device
 func (d *Device) AddItem(itemID string, typeID string, typeVersion string, options []byte) (bool, *dbus.Error) {
+	d.dc.enterMutation()
+	defer d.dc.exitMutation()
+	return d.addItem(itemID, typeID, typeVersion, options)
+}
+
+// addItem adds the item, a diff calls it while it holds the mutations back
+func (d *Device) addItem(itemID string, typeID string, typeVersion string, options []byte) (bool, *dbus.Error) {
 	d.log.Info("AddItem called - itemID:", itemID, "typeID:", typeID, "typeVersion:", typeVersion, "options:", options)
+	if err := validateArgs(requireID("itemID", itemID), maxLength("typeID", typeID),
+		maxLength("typeVersion", typeVersion), validOptions("options", options)); err != nil {
+		return false, err
+	}
 	d.Lock()
 	_, itemPresent := d.Items[itemID]
-	if !itemPresent {
+	if itemPresent {
+		d.Unlock()
+		return true, nil
+	}
+	if isNil(d.addItemSyncCB) {
 		initItem(itemID, typeID, typeVersion, options, d)
 		d.Unlock()
 		return false, nil
 	}
+	i := newItem(itemID, typeID, typeVersion, options, d)
+	i.accepting = true
 	d.Unlock()
-	return true, nil
+	if err := d.addItemSync(i); err != nil {
+		return false, err
+	}
+	d.acceptItem(i)
+	return false, nil
+}
+
+// AddItems is the dbus method to add several items to the device
+// The valid items are added and the rejected ones are returned with the reason of their rejection
+func (d *Device) AddItems(items []ItemSpec) ([]RejectedItem, *dbus.Error) {
+	d.dc.enterMutation()
+	defer d.dc.exitMutation()
+	d.log.Info("AddItems called - devID:", d.DevID, "items:", len(items))
+	rejected := make([]RejectedItem, 0)
+	var added []*Item
+	d.Lock()
+	for _, item := range items {
+		reason := firstFailure(requireID("itemID", item.ItemID), maxLength("typeID", item.TypeID),
+			maxLength("typeVersion", item.TypeVersion), validOptions("options", item.Options))
+		if _, itemPresent := d.Items[item.ItemID]; reason == "" && itemPresent {
+			reason = "item " + item.ItemID + " already added"
+		}
+		if reason != "" {
+			rejected = append(rejected, RejectedItem{ItemID: item.ItemID, Reason: reason})
+			continue
+		}
+		if isNil(d.addItemSyncCB) {
+			initItem(item.ItemID, item.TypeID, item.TypeVersion, item.Options, d)
+		} else {
+			i := newItem(item.ItemID, item.TypeID, item.TypeVersion, item.Options, d)
+			i.accepting = true
+			added = append(added, i)
+		}
+	}
+	d.Unlock()
+	for _, i := range added {
+		if err := d.addItemSync(i); err != nil {
+			rejected = append(rejected, RejectedItem{ItemID: i.ItemID, Reason: err.Error()})
+			continue
+		}
+		d.acceptItem(i)
+	}
+	if len(rejected) > 0 {
+		d.log.Warning(len(rejected), "items rejected by AddItems on the device", d.DevID)
+	}
+	return rejected, nil
 }
 
 // RemoveItem remove item from device
 func (d *Device) RemoveItem(itemID string) *dbus.Error {
+	d.dc.enterMutation()
+	defer d.dc.exitMutation()
+	return d.removeItemByID(itemID)
+}
+
+// removeItemByID removes the item, a diff calls it while it holds the mutations back
+func (d *Device) removeItemByID(itemID string) *dbus.Error {
 	d.log.Info("RemoveItem called - itemID:", itemID)
+	if err := validateArgs(optionalID("itemID", itemID)); err != nil {
+		return err
+	}
 	d.Lock()
 	i, present := d.Items[itemID]
+	if present && !isNil(d.removeItemSyncCB) {
+		d.Unlock()
+		return d.removeItemSync(i)
+	}
 	if present {
 		removeItem(i)
 	}
@@ -165,23 +625,78 @@ func (d *Device) RemoveItem(itemID string) *dbus.Error {
 
 // UpdateFirmware is the dbus method to update the firmware of the device
 func (d *Device) UpdateFirmware(data string) (string, *dbus.Error) {
+	if err := d.startOperation(); err != nil {
+		return "", err
+	}
 	if !isNil(d.updateFirmwareCb) {
-		go d.updateFirmwareCb.UpdateFirmware(d, data)
+		d.dispatch(PriorityLow, func() { d.updateFirmwareCb.UpdateFirmware(d, data) })
+	} else {
+		d.OperationDone()
 	}
 	d.log.Warning("Update firmware not implemented")
 	return "", nil
 }
 
+func (d *Device) startOperation() *dbus.Error {
+	d.Lock()
+	defer d.Unlock()
+	if !d.ExclusiveOperations {
+		return nil
+	}
+	if d.Busy {
+		d.log.Warning("Device", d.DevID, "is busy, command rejected")
+		return ErrDeviceBusy
+	}
+	d.Busy = true
+	return nil
+}
+
+// OperationDone informs that the operation in progress on the device is over
+func (d *Device) OperationDone() {
+	d.Lock()
+	d.Busy = false
+	d.Unlock()
+}
+
+// Refresh is the dbus method to ask the protocol to read again all the values of the device
+func (d *Device) Refresh() *dbus.Error {
+	d.log.Info("Refresh called - devID:", d.DevID)
+	if isNil(d.refreshDeviceCB) {
+		return ErrNoRefreshHandler
+	}
+	d.dispatch(PriorityLow, func() { d.refreshDeviceCB.RefreshDevice(d) })
+	return nil
+}
+
 // EmitDbusSignal emit a dbus signal from device object
 func (d *Device) EmitDbusSignal(sigName string, args ...interface{}) {
-	path := dbus.ObjectPath(dbusPathPrefix + d.Protocol.protocolName + "/" + d.DevID)
-	d.dc.conn.Emit(path, dbusDeviceInterface+"."+sigName, args...)
+	path := dbus.ObjectPath(d.Protocol.path + "/" + d.DevID)
+	d.emitSignal(func() {
+		if err := d.dc.emit(path, func() error { return d.dc.connection().Emit(path, dbusDeviceInterface+"."+sigName, args...) }); err != nil {
+			d.dc.addMetric(metricDroppedSignals, 1)
+		}
+	})
+}
+
+// emitLifecycleSignal emits a lifecycle signal from the device object
+func (d *Device) emitLifecycleSignal(sigName string, s lifecycleSignal) {
+	path := dbus.ObjectPath(d.Protocol.path + "/" + d.DevID)
+	d.emitSignal(func() {
+		if err := d.dc.emitLifecycle(path, dbusDeviceInterface+"."+sigName, s); err != nil {
+			d.dc.addMetric(metricDroppedSignals, 1)
+		}
+	})
 }
 
 // SetOperabilityState set the value of the property OperabilityState
 func (d *Device) SetOperabilityState(state OperabilityState) {
+	d.setOperabilityState(state)
+}
+
+// setOperabilityState set the value of the property OperabilityState and tells whether it changed
+func (d *Device) setOperabilityState(state OperabilityState) bool {
 	if d.properties == nil {
-		return
+		return false
 	}
 
 	if d.OperabilityTimeout != 0 && state == OperabilityOk {
@@ -192,19 +707,21 @@ func (d *Device) SetOperabilityState(state OperabilityState) {
 		}
 	}
 
-	oldVariant, err := d.properties.Get(dbusDeviceInterface, propertyOperabilityState)
+	oldVariant, err := d.getProperty(d.properties, dbusDeviceInterface, propertyOperabilityState)
 
 	if err != nil {
-		return
+		return false
 	}
 
 	oldState := oldVariant.Value().(OperabilityState)
 	if oldState == state {
-		return
+		return false
 	}
 
 	d.log.Info("OperabilityState of the device", d.DevID, "changed from", oldState, "to", state)
-	d.properties.SetMust(dbusDeviceInterface, propertyOperabilityState, state)
+	d.setProperty(d.properties, dbusDeviceInterface, propertyOperabilityState, state)
+	d.dc.notifyChange(Change{Protocol: d.Protocol.protocolName, DevID: d.DevID, Property: propertyOperabilityState, Value: state})
+	return true
 }
 
 // SetPairingState set the value of the property PairingState
@@ -213,7 +730,7 @@ func (d *Device) SetPairingState(state PairingState) {
 		return
 	}
 
-	oldVariant, err := d.properties.Get(dbusDeviceInterface, propertyPairingState)
+	oldVariant, err := d.getProperty(d.properties, dbusDeviceInterface, propertyPairingState)
 
 	if err != nil {
 		return
@@ -225,7 +742,8 @@ func (d *Device) SetPairingState(state PairingState) {
 	}
 
 	d.log.Info("propertyPairingState of the device", d.DevID, "changed from", oldState, "to", state)
-	d.properties.SetMust(dbusDeviceInterface, propertyPairingState, state)
+	d.setProperty(d.properties, dbusDeviceInterface, propertyPairingState, state)
+	d.dc.notifyChange(Change{Protocol: d.Protocol.protocolName, DevID: d.DevID, Property: propertyPairingState, Value: state})
 }
 
 // SetVersion set the value of the property Version
@@ -239,16 +757,30 @@ func (d *Device) SetVersion(newVersion string) {
 	}
 
 	d.log.Info("Version of the device", d.DevID, "changed from", d.FirmwareVersion, "to", newVersion)
-	d.properties.SetMust(dbusDeviceInterface, propertyVersion, newVersion)
+	d.setProperty(d.properties, dbusDeviceInterface, propertyVersion, newVersion)
 }
 
 // SetOption set the value of the property Option
 func (d *Device) SetOption(options []byte) {
+	d.dc.enterMutation()
+	defer d.dc.exitMutation()
+	d.setOption(options)
+}
+
+// setOption set the value of the property Option, a diff calls it while it holds the mutations back
+func (d *Device) setOption(options []byte) {
+	d.optionsLock.Lock()
+	defer d.optionsLock.Unlock()
+	d.storeOptions(options)
+}
+
+// storeOptions set the value of the property Option, d.optionsLock must be locked
+func (d *Device) storeOptions(options []byte) {
 	if d.properties == nil {
 		return
 	}
 
-	oldVariant, err := d.properties.Get(dbusDeviceInterface, propertyOptions)
+	oldVariant, err := d.getProperty(d.properties, dbusDeviceInterface, propertyOptions)
 
 	if err != nil {
 		return
@@ -261,7 +793,134 @@ func (d *Device) SetOption(options []byte) {
 	}
 
 	d.log.Info("propertyOptions of the device", d.DevID, "changed from", string(oldState), "to", string(newState))
-	d.properties.SetMust(dbusDeviceInterface, propertyOptions, newState)
+	d.setProperty(d.properties, dbusDeviceInterface, propertyOptions, newState)
+}
+
+// UpdateOptions is the dbus method to change the options of the device, mode is REPLACE, SHALLOW or DEEP
+// The OptionsMerge mode of the adapter is used when mode is empty
+func (d *Device) UpdateOptions(options []byte, mode string) *dbus.Error {
+	d.dc.enterMutation()
+	defer d.dc.exitMutation()
+	return d.updateOptions(options, mode)
+}
+
+// updateOptions changes the options of the device, a diff calls it while it holds the mutations back
+func (d *Device) updateOptions(options []byte, mode string) *dbus.Error {
+	d.log.Info("UpdateOptions called - devID:", d.DevID, "options:", string(options), "mode:", mode)
+	mergeMode := MergeMode(mode)
+	if mergeMode == "" {
+		mergeMode = d.dc.OptionsMerge
+	}
+	if err := validateArgs(validOptions("options", options), func() string {
+		switch mergeMode {
+		case "", MergeReplace, MergeShallow, MergeDeep:
+			return ""
+		}
+		return "mode " + mode + " is not REPLACE, SHALLOW or DEEP"
+	}); err != nil {
+		return err
+	}
+	if d.properties == nil {
+		return &dbus.ErrMsgNoObject
+	}
+
+	d.optionsLock.Lock()
+	current, err := d.getProperty(d.properties, dbusDeviceInterface, propertyOptions)
+	if err != nil {
+		d.optionsLock.Unlock()
+		return err
+	}
+	merged, mergeErr := mergeOptions(current.Value().([]byte), options, mergeMode)
+	if mergeErr != nil {
+		d.optionsLock.Unlock()
+		return dbus.MakeFailedError(mergeErr)
+	}
+
+	d.Lock()
+	d.Options = merged
+	d.Unlock()
+	d.storeOptions(merged)
+	d.optionsLock.Unlock()
+	if !isNil(d.setDeviceOptionCb) {
+		d.dispatch(PriorityLow, func() { d.setDeviceOptionCb.SetDeviceOptions(d) })
+	}
+	return nil
+}
+
+// SetManufacturer set the value of the property Manufacturer
+func (d *Device) SetManufacturer(manufacturer string) {
+	d.setMetadata(propertyManufacturer, &d.Manufacturer, manufacturer)
+}
+
+// SetModel set the value of the property Model
+func (d *Device) SetModel(model string) {
+	d.setMetadata(propertyModel, &d.Model, model)
+}
+
+// SetSerialNumber set the value of the property SerialNumber
+func (d *Device) SetSerialNumber(serialNumber string) {
+	d.setMetadata(propertySerialNumber, &d.SerialNumber, serialNumber)
+}
+
+// SetHWVersion set the value of the property HWVersion
+func (d *Device) SetHWVersion(hwVersion string) {
+	d.setMetadata(propertyHWVersion, &d.HWVersion, hwVersion)
+}
+
+// restoreMetadata sets the metadata of the device saved in a snapshot, the empty fields are left unchanged
+func (d *Device) restoreMetadata(dev DeviceJson) {
+	if dev.Manufacturer != "" {
+		d.SetManufacturer(dev.Manufacturer)
+	}
+	if dev.Model != "" {
+		d.SetModel(dev.Model)
+	}
+	if dev.SerialNumber != "" {
+		d.SetSerialNumber(dev.SerialNumber)
+	}
+	if dev.HWVersion != "" {
+		d.SetHWVersion(dev.HWVersion)
+	}
+}
+
+func (d *Device) setMetadata(property string, field *string, value string) {
+	if d.properties == nil {
+		return
+	}
+
+	d.Lock()
+	oldValue := *field
+	*field = value
+	d.Unlock()
+	if oldValue == value {
+		return
+	}
+
+	d.log.Info(property, "of the device", d.DevID, "changed from", oldValue, "to", value)
+	d.setProperty(d.properties, dbusDeviceInterface, property, value)
+}
+
+// SetError set the value of the property LastError and emits the signal DeviceError
+// An empty string clears the error
+func (d *Device) SetError(err string) {
+	if d.properties == nil {
+		return
+	}
+
+	d.Lock()
+	oldError := d.LastError
+	d.LastError = err
+	d.Unlock()
+	if oldError != err {
+		d.log.Info("LastError of the device", d.DevID, "changed from", oldError, "to", err)
+		d.setProperty(d.properties, dbusDeviceInterface, propertyLastError, err)
+	}
+	if err != "" {
+		d.emitDeviceError(DeviceErrorPayload{Error: err})
+		d.dc.recordError()
+		d.dc.addMetric(metricErrors, 1)
+		d.IncrementCounter(CounterErrors, 1)
+	}
 }
 
 // SetCallbacks set new callbacks for this device
@@ -271,10 +930,28 @@ func (d *Device) SetCallbacks(cbs interface{}) {
 		d.addItemCB = cb
 	}
 	switch cb := cbs.(type) {
+	case interface {
+		AddItemSync(context.Context, *Item) error
+	}:
+		d.addItemSyncCB = cb
+	}
+	switch cb := cbs.(type) {
 	case interface{ RemoveItem(string, string) }:
 		d.removeItemCB = cb
 	}
 	switch cb := cbs.(type) {
+	case interface {
+		RemoveItemSync(context.Context, *Item) error
+	}:
+		d.removeItemSyncCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface {
+		RemoveProtocolItem(*Protocol, string, string)
+	}:
+		d.removeProtocolItemCB = cb
+	}
+	switch cb := cbs.(type) {
 	case interface{ SetDeviceOptions(*Device) }:
 		d.setDeviceOptionCb = cb
 	}
@@ -286,20 +963,75 @@ func (d *Device) SetCallbacks(cbs interface{}) {
 	case interface{ OperabilityWentKo(*Device) }:
 		d.operabilityTimeoutCB = cb
 	}
+	switch cb := cbs.(type) {
+	case interface{ RefreshDevice(*Device) }:
+		d.refreshDeviceCB = cb
+	}
+}
+
+// AddCommand exports a dbus method on the device calling the handler with the arguments of the command
+// The name must be a valid dbus method name which is not one of the methods of the device interface.
+func (d *Device) AddCommand(name string, handler func(args []byte) ([]byte, error)) *dbus.Error {
+	d.log.Info("AddCommand called - devID:", d.DevID, "command:", name)
+	if err := validateArgs(requireMember("name", name)); err != nil {
+		return err
+	}
+	if _, builtin := d.builtinMethods()[name]; builtin {
+		d.log.Warning("Command", name, "of the device", d.DevID, "rejected, it is a method of the device")
+		return ErrReservedCommand
+	}
+	d.Lock()
+	if d.commands == nil {
+		d.commands = make(map[string]func([]byte) ([]byte, error))
+	}
+	d.commands[name] = handler
+	externalMethods := d.externalMethods
+	d.Unlock()
+
+	d.SetDbusMethods(externalMethods)
+	return nil
+}
+
+// RemoveCommand removes a dbus method added by AddCommand
+func (d *Device) RemoveCommand(name string) {
+	d.log.Info("RemoveCommand called - devID:", d.DevID, "command:", name)
+	d.Lock()
+	delete(d.commands, name)
+	externalMethods := d.externalMethods
+	d.Unlock()
+
+	d.SetDbusMethods(externalMethods)
+}
+
+// GetCommands is the dbus method to get the names of the commands added by AddCommand, sorted
+func (d *Device) GetCommands() ([]string, *dbus.Error) {
+	d.Lock()
+	names := make([]string, 0, len(d.commands))
+	for name := range d.commands {
+		names = append(names, name)
+	}
+	d.Unlock()
+	sort.Strings(names)
+	return names, nil
 }
 
 // SetDbusMethods set new dbusMethods for this device
 func (d *Device) SetDbusMethods(externalMethods map[string]interface{}) bool {
-	path := dbus.ObjectPath(dbusPathPrefix + d.Protocol.protocolName + "/" + d.DevID)
-	exportedMethods := make(map[string]interface{})
-	exportedMethods["AddItem"] = d.AddItem
-	exportedMethods["RemoveItem"] = d.RemoveItem
+	path := dbus.ObjectPath(d.Protocol.path + "/" + d.DevID)
+	exportedMethods := d.builtinMethods()
+
+	d.Lock()
+	d.externalMethods = externalMethods
+	for name, handler := range d.commands {
+		exportedMethods[name] = d.commandMethod(handler)
+	}
+	d.Unlock()
 
 	for name, inter := range externalMethods {
 		exportedMethods[name] = inter
 	}
 
-	err := d.Protocol.dc.conn.ExportMethodTable(exportedMethods, path, dbusDeviceInterface)
+	err := d.dc.exportMethods(path, dbusDeviceInterface, exportedMethods)
 	if err != nil {
 		d.log.Warning("Fail to export device dbus object", d.DevID, err)
 		return false
@@ -307,9 +1039,46 @@ func (d *Device) SetDbusMethods(externalMethods map[string]interface{}) bool {
 	return true
 }
 
+// builtinMethods returns the methods of the device interface, the commands cannot take their names
+func (d *Device) builtinMethods() map[string]interface{} {
+	exportedMethods := make(map[string]interface{})
+	exportedMethods["AddItem"] = func(itemID string, typeID string, typeVersion string, options []byte) (alreadyAdded bool, err *dbus.Error) {
+		err = d.dc.unlessFrozen(func() *dbus.Error {
+			alreadyAdded, err = d.AddItem(itemID, typeID, typeVersion, options)
+			return err
+		})
+		return
+	}
+	exportedMethods["AddItems"] = func(items []ItemSpec) (rejected []RejectedItem, err *dbus.Error) {
+		err = d.dc.unlessFrozen(func() *dbus.Error {
+			rejected, err = d.AddItems(items)
+			return err
+		})
+		return
+	}
+	exportedMethods["RemoveItem"] = func(itemID string) *dbus.Error {
+		return d.dc.unlessFrozen(func() *dbus.Error { return d.RemoveItem(itemID) })
+	}
+	exportedMethods["Refresh"] = d.Refresh
+	exportedMethods["UpdateOptions"] = func(options []byte, mode string) *dbus.Error {
+		return d.dc.unlessFrozen(func() *dbus.Error { return d.UpdateOptions(options, mode) })
+	}
+	exportedMethods["SetComID"] = func(comID string) *dbus.Error {
+		return d.dc.unlessFrozen(func() *dbus.Error { return d.SetComID(comID) })
+	}
+	exportedMethods["Complete"] = func(comID string, typeID string, typeVersion string, options []byte) *dbus.Error {
+		return d.dc.unlessFrozen(func() *dbus.Error { return d.Complete(comID, typeID, typeVersion, options) })
+	}
+	exportedMethods["GetItems"] = d.GetItems
+	exportedMethods["GetCommands"] = d.GetCommands
+	exportedMethods["GetCounters"] = d.GetCounters
+	exportedMethods["ResetCounters"] = d.ResetCounters
+	return exportedMethods
+}
+
 // SetDbusProperties set new DBus properties for this device
 func (d *Device) SetDbusProperties(externalProperties map[string]*prop.Prop) bool {
-	path := dbus.ObjectPath(dbusPathPrefix + d.Protocol.protocolName + "/" + d.DevID)
+	path := dbus.ObjectPath(d.Protocol.path + "/" + d.DevID)
 	propsSpec := map[string]map[string]*prop.Prop{
 		dbusDeviceInterface: {
 			propertyOperabilityState: {
@@ -336,6 +1105,36 @@ func (d *Device) SetDbusProperties(externalProperties map[string]*prop.Prop) boo
 				Emit:     prop.EmitTrue,
 				Callback: d.setDeviceOptions,
 			},
+			propertyManufacturer: {
+				Value:    d.Manufacturer,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyModel: {
+				Value:    d.Model,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertySerialNumber: {
+				Value:    d.SerialNumber,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyHWVersion: {
+				Value:    d.HWVersion,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyLastError: {
+				Value:    d.LastError,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
 		},
 	}
 
@@ -343,7 +1142,7 @@ func (d *Device) SetDbusProperties(externalProperties map[string]*prop.Prop) boo
 		propsSpec[dbusDeviceInterface][pName] = p
 	}
 
-	properties, err := prop.Export(d.dc.conn, path, propsSpec)
+	properties, err := d.dc.exportProperties(path, propsSpec)
 	if err == nil {
 		d.properties = properties
 	} else {
@@ -0,0 +1,700 @@
+package dbusconn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestDeviceMetadata(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	c := newTestClient(t, dc)
+	c.flush()
+
+	setters := map[string]func(string){
+		propertyManufacturer: d.SetManufacturer,
+		propertyModel:        d.SetModel,
+		propertySerialNumber: d.SetSerialNumber,
+		propertyHWVersion:    d.SetHWVersion,
+	}
+	for property, set := range setters {
+		set(property + "-1")
+		value, err := c.property(c.root+"/D1", dbusDeviceInterface, property)
+		if err != nil || value.Value() != property+"-1" {
+			t.Errorf("%s read back as %v, %v", property, value, err)
+		}
+		signals := c.flush()
+		if len(signals) != 1 || signals[0].Name != dbusPropertiesInterface+".PropertiesChanged" {
+			t.Fatalf("%s emitted %v", property, names(signals))
+		}
+		changed := signals[0].Body[1].(map[string]dbus.Variant)
+		if changed[property].Value() != property+"-1" {
+			t.Errorf("%s emitted %v", property, changed)
+		}
+
+		set(property + "-1")
+		if signals := c.flush(); len(signals) != 0 {
+			t.Errorf("%s set to the same value emitted %v", property, names(signals))
+		}
+	}
+
+	state, _ := p.SetReadyWithState(true)
+	var snapshot ProtocolJson
+	if err := json.Unmarshal([]byte(state), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	dev := snapshot.Protocols[p.protocolName][0]
+	if dev.Manufacturer != "Manufacturer-1" || dev.Model != "Model-1" || dev.SerialNumber != "SerialNumber-1" || dev.HWVersion != "HWVersion-1" {
+		t.Errorf("metadata missing from the snapshot: %+v", dev)
+	}
+}
+
+// refreshDriver pushes a new value for each refresh of a device
+type refreshDriver struct {
+	recorder
+}
+
+func (r *refreshDriver) RefreshDevice(d *Device) {
+	r.record(d.DevID)
+	d.Lock()
+	i := d.Items["I1"]
+	d.Unlock()
+	i.SetValue([]byte("refreshed"))
+}
+
+func TestRefreshWithAHandler(t *testing.T) {
+	dc := &Dbus{}
+	driver := &refreshDriver{}
+	p := newTestAdapter(t, dc, driver)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+
+	if err := c.call(c.root+"/D1", dbusDeviceInterface+".Refresh").Err; err != nil {
+		t.Fatal(err)
+	}
+	changed := c.wait(c.root+"/D1/I1", dbusPropertiesInterface+".PropertiesChanged")
+	if value := changed.Body[1].(map[string]dbus.Variant)[propertyValue].Value(); string(value.([]byte)) != "refreshed" {
+		t.Errorf("value pushed by the refresh: %v", value)
+	}
+	if calls := driver.recorded(); len(calls) != 1 || calls[0] != "D1" {
+		t.Errorf("refreshes: %v", calls)
+	}
+}
+
+func TestRefreshWithoutAHandler(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	if err := d.Refresh(); err != ErrNoRefreshHandler {
+		t.Fatalf("Refresh: %v", err)
+	}
+	c := newTestClient(t, dc)
+	err := c.call(c.root+"/D1", dbusDeviceInterface+".Refresh").Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrNoRefreshHandler.Name {
+		t.Fatalf("Refresh over Dbus: %v", err)
+	}
+}
+
+// addDriver records the devices given to AddDevice with their type
+type addDriver struct {
+	recorder
+}
+
+func (r *addDriver) AddDevice(d *Device) {
+	d.Lock()
+	defer d.Unlock()
+	r.record(d.DevID + " " + d.TypeID)
+}
+
+func TestPlaceholderThenComplete(t *testing.T) {
+	dc := &Dbus{}
+	driver := &addDriver{}
+	p := newTestAdapter(t, dc, driver)
+	c := newTestClient(t, dc)
+	path := c.root + "/P1"
+
+	if _, err := p.AddPlaceholderDevice("P1"); err != nil {
+		t.Fatal(err)
+	}
+	var added DeviceAddedPayload
+	s := c.wait(path, dbusDeviceInterface+"."+signalDeviceAdded)
+	if err := dbus.Store(s.Body, &added.Address, &added.TypeID, &added.TypeVersion, &added.Options); err != nil || added.TypeID != "" {
+		t.Fatalf("DeviceAdded of the placeholder: %+v %v", added, err)
+	}
+	d := testDevice(t, p, "P1")
+	if !d.Placeholder {
+		t.Fatal("device added without being a placeholder")
+	}
+
+	if err := d.Complete("C1", "T", "2", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	signals := c.flush()
+	if count(signals, signalDeviceCompleted) != 1 || count(signals, signalDeviceAdded) != 0 {
+		t.Errorf("signals of Complete: %v", names(signals))
+	}
+	if options, err := c.property(path, dbusDeviceInterface, propertyOptions); err != nil || string(options.Value().([]byte)) != `{"a":1}` {
+		t.Errorf("options once completed: %v %v", options, err)
+	}
+	if devID, found, _ := p.FindByComID("C1"); !found || devID != "P1" {
+		t.Errorf("comID once completed: %q %v", devID, found)
+	}
+	waitFor(t, "AddDevice", func() bool { return len(driver.recorded()) == 1 })
+	if calls := driver.recorded(); calls[0] != "P1 T" {
+		t.Errorf("AddDevice callbacks: %v", calls)
+	}
+
+	if err := d.Complete("C1", "T", "2", []byte(`{}`)); err != ErrNotPlaceholder {
+		t.Errorf("second Complete: %v", err)
+	}
+}
+
+func TestCompleteChecksTheDevice(t *testing.T) {
+	dc := &Dbus{RejectUnsupportedTypes: true}
+	dc.ValidateDevice = func(spec DeviceSpec) error {
+		if spec.ComID == "forbidden" {
+			return errors.New("forbidden address")
+		}
+		return nil
+	}
+	p := newTestAdapter(t, dc, nil)
+	dc.RegisterSupportedType("T", "1")
+	if _, err := p.AddDevice("D1", "C0", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	for _, devID := range []string{"P1", "P2"} {
+		if _, err := p.AddPlaceholderDevice(devID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := testDevice(t, p, "P1")
+
+	for _, test := range []struct {
+		comID, typeID string
+		want          string
+	}{
+		{"C1", "Unknown", ErrUnsupportedType.Name},
+		{"forbidden", "T", dbusProtocolInterface + ".Error.DeviceRejected"},
+		{"C0", "T", ErrIDTaken.Name},
+	} {
+		if err := d.Complete(test.comID, test.typeID, "1", []byte("{}")); err == nil || err.Name != test.want {
+			t.Errorf("Complete %s %s: %v, want %s", test.comID, test.typeID, err, test.want)
+		}
+	}
+	if !d.Placeholder || d.TypeID != "" {
+		t.Fatalf("rejected Complete changed the placeholder: %+v", d)
+	}
+
+	// Without a comID, the index of the comIDs is not touched
+	if err := d.Complete("", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDevice(t, p, "P2").Complete("", "T", "1", []byte("{}")); err != nil {
+		t.Fatal("second Complete without a comID:", err)
+	}
+	if _, found, _ := p.FindByComID(""); found {
+		t.Error("empty comID indexed")
+	}
+}
+
+func TestCompleteRejectedByAddDeviceSync(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &syncDriver{})
+	c := newTestClient(t, dc)
+	if _, err := p.AddPlaceholderDevice("bad1"); err != nil {
+		t.Fatal(err)
+	}
+	c.flush()
+
+	d := testDevice(t, p, "bad1")
+	if err := d.Complete("C1", "T", "1", []byte(`{"a":1}`)); err == nil {
+		t.Fatal("Complete accepted the device rejected by the protocol")
+	}
+	if !hasDevice(p, "bad1") || !d.Placeholder || d.TypeID != "" || d.Address != "" {
+		t.Fatalf("placeholder not restored: %+v", d)
+	}
+	if _, found, _ := p.FindByComID("C1"); found {
+		t.Error("comID of the rejected device still indexed")
+	}
+	if options, err := c.property(c.root+"/bad1", dbusDeviceInterface, propertyOptions); err != nil || string(options.Value().([]byte)) != "" {
+		t.Errorf("options of the restored placeholder: %v %v", options, err)
+	}
+	if signals := c.flush(); count(signals, signalDeviceCompleted) != 0 || count(signals, signalDeviceRemoved) != 0 {
+		t.Errorf("signals of the rejected Complete: %v", names(signals))
+	}
+}
+
+func TestDeviceLastError(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+	c.flush()
+
+	d.SetError("timeout")
+	if value, err := c.property(path, dbusDeviceInterface, propertyLastError); err != nil || value.Value() != "timeout" {
+		t.Errorf("LastError: %v %v", value, err)
+	}
+	signals := onPath(c.flush(), path)
+	if want := []string{path + " PropertiesChanged", path + " " + signalDeviceError}; strings.Join(names(signals), ",") != strings.Join(want, ",") {
+		t.Fatalf("signals of SetError: %v", names(signals))
+	}
+	if signals[1].Body[0] != "timeout" {
+		t.Errorf("DeviceError: %v", signals[1].Body)
+	}
+
+	// The same error raised again is signaled although the property does not change
+	d.SetError("timeout")
+	if signals := onPath(c.flush(), path); strings.Join(names(signals), ",") != path+" "+signalDeviceError {
+		t.Errorf("signals of the same error: %v", names(signals))
+	}
+
+	d.SetError("")
+	if value, _ := c.property(path, dbusDeviceInterface, propertyLastError); value.Value() != "" {
+		t.Errorf("LastError once cleared: %v", value)
+	}
+	if signals := onPath(c.flush(), path); count(signals, signalDeviceError) != 0 || count(signals, "PropertiesChanged") != 1 {
+		t.Errorf("signals of the clear: %v", names(signals))
+	}
+	if err := c.call(path, dbusPropertiesInterface+".Set", dbusDeviceInterface, propertyLastError, dbus.MakeVariant("x")).Err; err == nil {
+		t.Error("LastError written by a client")
+	}
+}
+
+// blockingDriver holds the add of the devices whose ID starts with slow until its context is canceled
+type blockingDriver struct {
+	recorder
+	started chan string
+}
+
+func (r *blockingDriver) AddDeviceContext(ctx context.Context, d *Device) {
+	if strings.HasPrefix(d.DevID, "slow") {
+		r.started <- d.DevID
+		<-ctx.Done()
+	}
+	r.record(d.DevID)
+}
+
+func TestCancelAddWhileTheCallbackIsBlocked(t *testing.T) {
+	dc := &Dbus{}
+	driver := &blockingDriver{started: make(chan string, 1)}
+	p := newTestAdapter(t, dc, driver)
+	c := newTestClient(t, dc)
+
+	if _, err := p.AddDevice("slow1", "C1", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	<-driver.started
+	if err := c.call(c.root, dbusProtocolInterface+".CancelAdd", "slow1").Err; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the canceled callback", func() bool { return len(driver.recorded()) == 1 })
+	if hasDevice(p, "slow1") {
+		t.Error("canceled device kept")
+	}
+	if _, found, _ := p.FindByComID("C1"); found {
+		t.Error("comID of the canceled device kept")
+	}
+	if !c.unreachable(c.root+"/slow1", dbusDeviceInterface+".GetItems") {
+		t.Error("canceled device still exported")
+	}
+	if err := p.CancelAdd("slow1"); err != ErrUnknownDevice {
+		t.Errorf("second CancelAdd: %v", err)
+	}
+
+	d := addTestDevice(t, p, "D2", "T")
+	waitFor(t, "the end of the add of D2", func() bool {
+		d.Lock()
+		defer d.Unlock()
+		return !d.adding
+	})
+	if err := p.CancelAdd("D2"); err != ErrNotAdding || !hasDevice(p, "D2") {
+		t.Errorf("CancelAdd of a device added: %v", err)
+	}
+}
+
+// blockingSyncDriver holds AddDeviceSync until its context is canceled
+type blockingSyncDriver struct {
+	started chan struct{}
+}
+
+func (r *blockingSyncDriver) AddDeviceSync(ctx context.Context, d *Device) error {
+	close(r.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCancelAddDuringAddDeviceSync(t *testing.T) {
+	dc := &Dbus{}
+	driver := &blockingSyncDriver{started: make(chan struct{})}
+	p := newTestAdapter(t, dc, driver)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	added := make(chan *dbus.Error, 1)
+	go func() {
+		_, err := p.AddDevice("D1", "", "T", "1", []byte("{}"))
+		added <- err
+	}()
+	<-driver.started
+	if err := p.CancelAdd("D1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-added; err == nil {
+		t.Error("AddDevice of the canceled device succeeded")
+	}
+	if hasDevice(p, "D1") {
+		t.Error("canceled device kept")
+	}
+	if signals := onPath(c.flush(), c.root+"/D1"); len(signals) != 0 {
+		t.Errorf("canceled device announced: %v", names(signals))
+	}
+}
+
+func TestDeviceCommands(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	if err := d.AddCommand("Identify", func(args []byte) ([]byte, error) { return append([]byte("id:"), args...), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddCommand("Reboot", func([]byte) ([]byte, error) { return nil, errors.New("not now") }); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+
+	var result []byte
+	if err := c.call(path, dbusDeviceInterface+".Identify", []byte("x")).Store(&result); err != nil || string(result) != "id:x" {
+		t.Fatalf("Identify: %q %v", result, err)
+	}
+	err := c.call(path, dbusDeviceInterface+".Reboot", []byte{}).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != "org.freedesktop.DBus.Error.Failed" || dbusErr.Body[0] != "not now" {
+		t.Errorf("Reboot: %v", err)
+	}
+	var commands []string
+	if err := c.call(path, dbusDeviceInterface+".GetCommands").Store(&commands); err != nil || strings.Join(commands, ",") != "Identify,Reboot" {
+		t.Errorf("GetCommands: %v %v", commands, err)
+	}
+	if err := c.call(path, dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Error("method of the device once the commands are added:", err)
+	}
+
+	d.RemoveCommand("Reboot")
+	if err := c.call(path, dbusDeviceInterface+".Reboot", []byte{}).Err; err == nil {
+		t.Error("removed command still exported")
+	}
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.unreachable(path, dbusDeviceInterface+".Identify", []byte("x")) {
+		t.Error("command of a removed device still exported")
+	}
+}
+
+func TestCommandsListedAndIntrospected(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+	expect := func(step string, want ...string) {
+		t.Helper()
+		var commands []string
+		if err := c.call(path, dbusDeviceInterface+".GetCommands").Store(&commands); err != nil || strings.Join(commands, ",") != strings.Join(want, ",") {
+			t.Errorf("GetCommands %s: %v %v, want %v", step, commands, err, want)
+		}
+		var data string
+		if err := c.call(path, dbusIntrospectableInterface+".Introspect").Store(&data); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"Identify", "Reboot", "Calibrate"} {
+			listed := false
+			for _, command := range want {
+				listed = listed || command == name
+			}
+			if strings.Contains(data, `<method name="`+name+`">`) != listed {
+				t.Errorf("command %s introspected %s: %v", name, step, !listed)
+			}
+		}
+	}
+	expect("without commands")
+
+	for _, name := range []string{"Reboot", "Identify", "Calibrate"} {
+		if err := d.AddCommand(name, func(args []byte) ([]byte, error) { return args, nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("once added", "Calibrate", "Identify", "Reboot")
+	d.RemoveCommand("Reboot")
+	d.RemoveCommand("Unknown")
+	expect("once one is removed", "Calibrate", "Identify")
+
+	// The methods of the device and the invalid names cannot be commands
+	for _, name := range []string{"GetItems", "GetCommands"} {
+		if err := d.AddCommand(name, func([]byte) ([]byte, error) { return nil, nil }); err != ErrReservedCommand {
+			t.Errorf("AddCommand %s: %v", name, err)
+		}
+	}
+	if err := d.AddCommand("not.valid", func([]byte) ([]byte, error) { return nil, nil }); err == nil || err.Name != "org.freedesktop.DBus.Error.InvalidArgs" {
+		t.Errorf("AddCommand with an invalid name: %v", err)
+	}
+	expect("once the invalid commands are rejected", "Calibrate", "Identify")
+
+}
+
+func TestCommandsChangedWhileCalled(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	if err := d.AddCommand("Identify", func(args []byte) ([]byte, error) { return args, nil }); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+
+	// The commands added and removed meanwhile do not disturb the clients calling the one that stays
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 20; n++ {
+			name := fmt.Sprintf("C%d", n)
+			if err := d.AddCommand(name, func(args []byte) ([]byte, error) { return nil, nil }); err != nil {
+				t.Errorf("AddCommand %s: %v", name, err)
+			}
+			if n%2 == 0 {
+				d.RemoveCommand(name)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 20; n++ {
+			var result []byte
+			if err := c.call(path, dbusDeviceInterface+".Identify", []byte("x")).Store(&result); err != nil || string(result) != "x" {
+				t.Errorf("Identify while the commands change: %q %v", result, err)
+			}
+			if _, err := d.GetCommands(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+	commands, _ := d.GetCommands()
+	if len(commands) != 11 || commands[0] != "C1" || commands[len(commands)-1] != "Identify" {
+		t.Errorf("commands once changed: %v", commands)
+	}
+}
+
+func TestSetComIDKeepsTheItems(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	if _, err := p.AddDevice("D1", "C1", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AddDevice("D2", "C2", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	d := testDevice(t, p, "D1")
+	addTestItem(t, d, "I1", "T")
+	addTestItem(t, d, "I2", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+	c.flush()
+
+	if err := c.call(path, dbusDeviceInterface+".SetComID", "C9").Err; err != nil {
+		t.Fatal(err)
+	}
+	if devID, found, _ := p.FindByComID("C9"); !found || devID != "D1" {
+		t.Errorf("new comID: %q %v", devID, found)
+	}
+	if _, found, _ := p.FindByComID("C1"); found {
+		t.Error("old comID still found")
+	}
+	for _, itemID := range []string{"I1", "I2"} {
+		if !hasItem(d, itemID) {
+			t.Fatalf("item %s lost", itemID)
+		}
+		d.Lock()
+		mac := d.Items[itemID].Mac
+		d.Unlock()
+		if mac != "C9" {
+			t.Errorf("comID of the item %s: %q", itemID, mac)
+		}
+	}
+	signals := onPath(c.flush(), path)
+	if count(signals, signalComIDChanged) != 1 {
+		t.Fatalf("signals of SetComID: %v", names(signals))
+	}
+	var oldComID, newComID string
+	if err := dbus.Store(signals[0].Body, &oldComID, &newComID); err != nil || oldComID != "C1" || newComID != "C9" {
+		t.Errorf("ComIDChanged: %q %q %v", oldComID, newComID, err)
+	}
+
+	if err := d.SetComID("C2"); err != ErrIDTaken {
+		t.Errorf("comID of another device: %v", err)
+	}
+	if err := d.SetComID("C9"); err != nil {
+		t.Fatal(err)
+	}
+	if signals := onPath(c.flush(), path); len(signals) != 0 {
+		t.Errorf("same comID emitted %v", names(signals))
+	}
+}
+
+func TestOnAnyItemChange(t *testing.T) {
+	dc := &Dbus{CallbackWorkers: 1}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	first := addTestItem(t, d, "I1", "T")
+	second := addTestItem(t, d, "I2", "T")
+	other := addTestItem(t, addTestDevice(t, p, "D2", "T"), "I3", "T")
+	changes := &recorder{}
+	d.OnAnyItemChange(func(itemID string, value []byte) { changes.record(itemID + "=" + string(value)) })
+
+	first.SetValue([]byte("1"))
+	second.SetValue([]byte("2"))
+	other.SetValue([]byte("3"))
+	second.SetValue([]byte("2"))
+	first.SetValue([]byte("4"))
+
+	waitFor(t, "the changes", func() bool { return len(changes.recorded()) >= 3 })
+	if calls := strings.Join(changes.recorded(), ","); calls != "I1=1,I2=2,I1=4" {
+		t.Errorf("changes reported: %s", calls)
+	}
+}
+
+func TestUnknownMethodOfADevice(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T")
+	c := newTestClient(t, dc)
+
+	err := c.call(c.root+"/D1", dbusDeviceInterface+".Extension", []byte("x")).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != "org.freedesktop.DBus.Error.UnknownMethod" {
+		t.Errorf("unknown method: %v", err)
+	}
+}
+
+// itemSyncDriver rejects the items whose ID starts with bad
+type itemSyncDriver struct{}
+
+func (r *itemSyncDriver) AddItemSync(ctx context.Context, i *Item) error {
+	if strings.HasPrefix(i.ItemID, "bad") {
+		return errors.New("unsupported by the device")
+	}
+	return nil
+}
+
+func TestAddItemsReturnsTheRejectedOnes(t *testing.T) {
+	for _, driver := range []interface{}{nil, &itemSyncDriver{}} {
+		dc := &Dbus{}
+		p := newTestAdapter(t, dc, driver)
+		d := addTestDevice(t, p, "D1", "T")
+		addTestItem(t, d, "I0", "T")
+		c := newTestClient(t, dc)
+		path := c.root + "/D1"
+		c.flush()
+
+		items := []ItemSpec{
+			{ItemID: "I1", TypeID: "T", TypeVersion: "1", Options: []byte("{}")},
+			{ItemID: "", TypeID: "T", TypeVersion: "1"},
+			{ItemID: "I2", TypeID: "T", TypeVersion: "1", Options: []byte("{")},
+			{ItemID: "I0", TypeID: "T", TypeVersion: "1"},
+			{ItemID: "I3", TypeID: "T", TypeVersion: "1"},
+			{ItemID: "I3", TypeID: "T", TypeVersion: "1"},
+		}
+		want := []string{"=itemID must not be empty", "I2=options is not valid JSON", "I0=item I0 already added", "I3=item I3 already added"}
+		added := []string{"I1", "I3"}
+		if driver != nil {
+			items = append(items, ItemSpec{ItemID: "bad1", TypeID: "T", TypeVersion: "1"})
+			want = append(want, "bad1=unsupported by the device")
+		}
+
+		var rejected []RejectedItem
+		if err := c.call(path, dbusDeviceInterface+".AddItems", items).Store(&rejected); err != nil {
+			t.Fatal(err)
+		}
+		var reasons []string
+		for _, item := range rejected {
+			reasons = append(reasons, item.ItemID+"="+item.Reason)
+		}
+		if strings.Join(reasons, ",") != strings.Join(want, ",") {
+			t.Errorf("rejected with %T: %v", driver, reasons)
+		}
+		for _, itemID := range added {
+			if !hasItem(d, itemID) {
+				t.Errorf("valid item %s not added with %T", itemID, driver)
+			}
+		}
+		if hasItem(d, "bad1") || hasItem(d, "I2") {
+			t.Errorf("rejected item added with %T", driver)
+		}
+		// Only the items added are announced
+		signals := underPath(c.flush(), path)
+		if count(signals, signalItemAdded) != len(added) || count(signals, signalItemRemoved) != 0 {
+			t.Errorf("signals of AddItems with %T: %v", driver, names(signals))
+		}
+	}
+}
+
+func TestCloneDeviceCopiesTheDefinition(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	if _, err := p.AddDevice("D1", "C1", "Light", "2", []byte(`{"dim":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	src := testDevice(t, p, "D1")
+	if _, err := src.AddItem("I1", "Level", "1", []byte(`{"max":100}`)); err != nil {
+		t.Fatal(err)
+	}
+	addTestItem(t, src, "I2", "T")
+	src.Items["I1"].SetValue([]byte("50"))
+	c := newTestClient(t, dc)
+	c.flush()
+
+	var alreadyAdded bool
+	if err := c.call(c.root, dbusProtocolInterface+".CloneDevice", "D1", "D2").Store(&alreadyAdded); err != nil || alreadyAdded {
+		t.Fatalf("CloneDevice: %v %v", alreadyAdded, err)
+	}
+	clone := testDevice(t, p, "D2")
+	clone.Lock()
+	definition := fmt.Sprintf("%s %s %s %s %d", clone.Address, clone.TypeID, clone.TypeVersion, clone.Options, len(clone.Items))
+	i1 := clone.Items["I1"]
+	clone.Unlock()
+	if definition != ` Light 2 {"dim":true} 2` {
+		t.Errorf("definition of the clone: %s", definition)
+	}
+	if i1 == nil || i1.TypeID != "Level" || string(i1.Options) != `{"max":100}` {
+		t.Fatalf("item of the clone: %+v", i1)
+	}
+	if len(i1.currentValue()) != 0 {
+		t.Errorf("value copied to the clone: %q", i1.currentValue())
+	}
+	i1.SetValue([]byte("10"))
+	if string(src.Items["I1"].currentValue()) != "50" {
+		t.Errorf("value of the source changed by the clone: %q", src.Items["I1"].currentValue())
+	}
+	signals := c.flush()
+	if count(onPath(signals, c.root+"/D2"), signalDeviceAdded) != 1 || count(underPath(signals, c.root+"/D2"), signalItemAdded) != 2 {
+		t.Errorf("signals of the clone: %v", names(signals))
+	}
+
+	if err := c.call(c.root, dbusProtocolInterface+".CloneDevice", "D1", "D2").Store(&alreadyAdded); err != nil || !alreadyAdded {
+		t.Errorf("CloneDevice on an existing device: %v %v", alreadyAdded, err)
+	}
+	err := c.call(c.root, dbusProtocolInterface+".CloneDevice", "D9", "D3").Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrUnknownDevice.Name {
+		t.Errorf("CloneDevice of an unknown device: %v", err)
+	}
+}
@@ -0,0 +1,633 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	diffAdd    = "add"
+	diffRemove = "remove"
+	diffUpdate = "update"
+)
+
+// ErrRollbackFailed is returned when an operation of a diff fails and the operations applied before it cannot all be
+// undone
+var ErrRollbackFailed = dbus.NewError(dbusProtocolInterface+".Error.RollbackFailed", []interface{}{"The diff failed and was not undone"})
+
+// ErrDiffInProgress is returned by the property writes while a diff is applied
+var ErrDiffInProgress = dbus.NewError(dbusProtocolInterface+".Error.DiffInProgress", []interface{}{"A diff is being applied"})
+
+// DiffOperation is an operation of a diff document given to ApplyDiff
+// It targets an item when ItemID is set, a device when DevID is set and a bridge otherwise. The devices and the
+// items belong to the bridge BridgeID or to the root protocol if empty. ComID, TypeID and TypeVersion are used to add
+// a device or an item, Options to add or update it.
+type DiffOperation struct {
+	Op          string          `json:"op"`
+	BridgeID    string          `json:"bridgeID"`
+	DevID       string          `json:"devID"`
+	ItemID      string          `json:"itemID"`
+	ComID       string          `json:"comID"`
+	TypeID      string          `json:"typeID"`
+	TypeVersion string          `json:"typeVersion"`
+	Options     json.RawMessage `json:"options"`
+}
+
+// TreeDiff is the diff document given to ApplyDiff, its operations are applied in order
+type TreeDiff struct {
+	Operations []DiffOperation `json:"operations"`
+}
+
+// diffState is the set of the bridges, devices and items of the tree used to check a diff before applying it
+type diffState struct {
+	bridges map[string]bool
+	devices map[string]bool
+	items   map[string]bool
+}
+
+// removedDevice is a device removed by a diff with what its undo gives back
+type removedDevice struct {
+	dev     DeviceJson
+	aliases []string
+	values  map[string]itemValues
+}
+
+// itemValues are the values of a removed item given back by its undo
+type itemValues struct {
+	value       []byte
+	target      []byte
+	updated     time.Time
+	history     []ValueSample
+	historySize int
+}
+
+// diffGate holds the mutations of the Go API back while a diff is applied
+// A diff waits for the mutations in progress, and the mutations go on while it waits: a mutation calling the Go API
+// from its callbacks does not wait for the diff waiting for it.
+type diffGate struct {
+	sync.Mutex
+	cond      *sync.Cond
+	mutations int
+	applying  bool
+	frozen    bool
+}
+
+// wait waits for a change of the gate, g must be locked
+func (g *diffGate) wait() {
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.Mutex)
+	}
+	g.cond.Wait()
+}
+
+// broadcast wakes up the goroutines waiting for the gate, g must be locked
+func (g *diffGate) broadcast() {
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+}
+
+// ApplyDiff is the dbus method to add, remove and update bridges, devices and items as described by a TreeDiff
+// The diff is checked against the tree before applying anything and the operations already applied are undone if
+// one fails. The mutations of the dbus methods and of the Go API wait for the diff, and its signals are held back
+// until it is done: they are sent once the diff is applied, those about the objects of the diff are dropped with
+// its rollback. ErrRollbackFailed is returned when an undo fails, the tree is then partially changed and every
+// signal is sent. The Sync callbacks of the operations must not call the Go API mutations, which wait for the diff.
+func (r *RootProto) ApplyDiff(diff string) (int32, *dbus.Error) {
+	r.log.Info("ApplyDiff called")
+	var treeDiff TreeDiff
+	if err := json.Unmarshal([]byte(diff), &treeDiff); err != nil {
+		return 0, validateArgs(func() string { return "diff is not valid JSON: " + err.Error() })
+	}
+
+	r.dc.freezeLock.Lock()
+	defer r.dc.freezeLock.Unlock()
+	if r.dc.frozen {
+		return 0, ErrFrozen
+	}
+
+	r.dc.startDiff()
+	applied, dropped, err := r.applyDiff(treeDiff)
+	r.dc.endDiff(dropped)
+	return applied, err
+}
+
+// applyDiff checks then applies the operations of the diff, it returns the paths of the objects whose signals are
+// dropped when the diff is rolled back
+func (r *RootProto) applyDiff(treeDiff TreeDiff) (int32, []dbus.ObjectPath, *dbus.Error) {
+	state := r.dc.diffState()
+	for n, op := range treeDiff.Operations {
+		if err := validateArgs(op.check(n, state, r.dc)); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	undos := make([]func() *dbus.Error, 0, len(treeDiff.Operations))
+	paths := make([]dbus.ObjectPath, 0, len(treeDiff.Operations))
+	for n, op := range treeDiff.Operations {
+		paths = append(paths, r.diffPath(op))
+		undo, err := r.applyOperation(op)
+		if err == nil {
+			undos = append(undos, undo)
+			continue
+		}
+
+		r.log.Warning("Operation", n, "of the diff failed, rolling back", len(undos), "operations:", err)
+		failed := false
+		for u := len(undos) - 1; u >= 0; u-- {
+			if undoErr := undos[u](); undoErr != nil {
+				r.log.Error("Fail to undo the operation", u, "of the diff:", undoErr)
+				failed = true
+			}
+		}
+		if failed {
+			return 0, nil, ErrRollbackFailed
+		}
+		return 0, paths, err
+	}
+	return int32(len(undos)), nil, nil
+}
+
+// diffPath returns the object path of the bridge, the device or the item of the operation
+func (r *RootProto) diffPath(op DiffOperation) dbus.ObjectPath {
+	path := r.Protocol.path
+	if op.BridgeID != "" {
+		path = r.dc.bridgePath(op.BridgeID)
+	}
+	if op.DevID != "" {
+		path += "/" + op.DevID
+	}
+	if op.ItemID != "" {
+		path += "/" + op.ItemID
+	}
+	return dbus.ObjectPath(path)
+}
+
+// enterMutation waits for the diff being applied before a mutation of the Go API, exitMutation ends the mutation
+func (dc *Dbus) enterMutation() {
+	g := &dc.diffGate
+	g.Lock()
+	for g.applying {
+		g.wait()
+	}
+	g.mutations++
+	g.Unlock()
+}
+
+func (dc *Dbus) exitMutation() {
+	g := &dc.diffGate
+	g.Lock()
+	g.mutations--
+	if g.mutations == 0 {
+		g.broadcast()
+	}
+	g.Unlock()
+}
+
+// startDiff waits for the mutations in progress, then holds the next ones and the signals back until endDiff
+func (dc *Dbus) startDiff() {
+	g := &dc.diffGate
+	g.Lock()
+	for g.applying || g.mutations > 0 {
+		g.wait()
+	}
+	g.applying = true
+	g.Unlock()
+
+	dc.heldLock.Lock()
+	dc.holding = true
+	dc.heldLock.Unlock()
+}
+
+// endDiff sends the signals held back, except those about the objects of the dropped paths and the changes of the
+// properties superseded by a later one, and lets the mutations in. The signals emitted meanwhile are sent after the
+// held ones.
+func (dc *Dbus) endDiff(dropped []dbus.ObjectPath) {
+	dc.heldLock.Lock()
+	for len(dc.held) > 0 {
+		held := dc.held
+		dc.held = nil
+		dc.heldLock.Unlock()
+		last := make(map[string]int, len(held))
+		for n, signal := range held {
+			if signal.key != "" {
+				last[signal.key] = n
+			}
+		}
+		for n, signal := range held {
+			if signal.isAbout(dropped) || (signal.key != "" && last[signal.key] != n) {
+				continue
+			}
+			if err := signal.send(); err != nil {
+				dc.Log.Warning("Fail to send a signal held back by the diff", err)
+				dc.addMetric(metricDroppedSignals, 1)
+			}
+		}
+		dropped = nil
+		dc.heldLock.Lock()
+	}
+	dc.holding = false
+	dc.heldLock.Unlock()
+
+	g := &dc.diffGate
+	g.Lock()
+	g.applying = false
+	g.broadcast()
+	g.Unlock()
+}
+
+// isAbout tells if the signal is about one of the objects of the paths or one of their children
+func (signal heldSignal) isAbout(paths []dbus.ObjectPath) bool {
+	for _, path := range paths {
+		if signal.about == path || strings.HasPrefix(string(signal.about), string(path)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffState returns the current bridges, devices and items of the tree
+func (dc *Dbus) diffState() *diffState {
+	state := &diffState{bridges: make(map[string]bool), devices: make(map[string]bool), items: make(map[string]bool)}
+	for _, p := range dc.protocols() {
+		state.bridges[p.BridgeID] = true
+		p.Lock()
+		for devID, d := range p.Devices {
+			state.devices[p.BridgeID+"/"+devID] = true
+			d.Lock()
+			for itemID := range d.Items {
+				state.items[p.BridgeID+"/"+devID+"/"+itemID] = true
+			}
+			d.Unlock()
+		}
+		p.Unlock()
+	}
+	return state
+}
+
+// check validates the operation against the state and applies it to the state
+func (op DiffOperation) check(n int, state *diffState, dc *Dbus) argCheck {
+	return func() string {
+		if reason := firstFailure(optionalID("bridgeID", op.BridgeID), optionalID("devID", op.DevID), optionalID("itemID", op.ItemID),
+			maxLength("comID", op.ComID), maxLength("typeID", op.TypeID), maxLength("typeVersion", op.TypeVersion),
+			validOptions("options", op.Options)); reason != "" {
+			return fmt.Sprintf("operation %d: %s", n, reason)
+		}
+
+		device := op.BridgeID + "/" + op.DevID
+		item := device + "/" + op.ItemID
+		var reason string
+		switch {
+		case op.ItemID != "" && op.DevID == "":
+			reason = "an item needs a devID"
+		case op.ItemID != "":
+			reason = state.checkEntry(op.Op, "item "+op.ItemID, state.items, item, state.devices[device])
+		case op.DevID != "":
+			reason = state.checkEntry(op.Op, "device "+op.DevID, state.devices, device, state.bridges[op.BridgeID])
+			if reason == "" && op.Op == diffAdd && !dc.isSupportedType(op.TypeID) {
+				reason = "type " + op.TypeID + " is not supported"
+			}
+			if reason == "" && op.Op == diffRemove {
+				state.removeChildren(state.items, device+"/")
+			}
+		case op.BridgeID != "":
+			if op.Op == diffUpdate {
+				reason = "a bridge cannot be updated"
+				break
+			}
+			reason = state.checkEntry(op.Op, "bridge "+op.BridgeID, state.bridges, op.BridgeID, true)
+			if reason == "" && op.Op == diffAdd && dc.MaxBridges > 0 && len(state.bridges)-1 > dc.MaxBridges {
+				reason = "the maximum number of bridges is reached"
+			}
+			if reason == "" && op.Op == diffRemove {
+				state.removeChildren(state.devices, op.BridgeID+"/")
+				state.removeChildren(state.items, op.BridgeID+"/")
+			}
+		default:
+			reason = "no bridgeID, devID or itemID"
+		}
+		if reason != "" {
+			return fmt.Sprintf("operation %d: %s", n, reason)
+		}
+		return ""
+	}
+}
+
+// checkEntry checks an add, remove or update of an entry whose parent must exist and applies it to the entries
+func (state *diffState) checkEntry(op string, name string, entries map[string]bool, key string, parentPresent bool) string {
+	if !parentPresent {
+		return "the parent of the " + name + " does not exist"
+	}
+	switch op {
+	case diffAdd:
+		if entries[key] {
+			return name + " already exists"
+		}
+		entries[key] = true
+	case diffRemove:
+		if !entries[key] {
+			return name + " does not exist"
+		}
+		delete(entries, key)
+	case diffUpdate:
+		if !entries[key] {
+			return name + " does not exist"
+		}
+	default:
+		return "op " + op + " is not add, remove or update"
+	}
+	return ""
+}
+
+func (state *diffState) removeChildren(entries map[string]bool, prefix string) {
+	for key := range entries {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			delete(entries, key)
+		}
+	}
+}
+
+// applyOperation applies a checked operation and returns the function undoing it
+// The undos look the bridge, the device or the item up again, the removal of one of them undone before gives back a
+// new one.
+func (r *RootProto) applyOperation(op DiffOperation) (func() *dbus.Error, *dbus.Error) {
+	if op.DevID == "" {
+		if op.Op == diffAdd {
+			if _, err := r.addBridge(op.BridgeID); err != nil {
+				return nil, err
+			}
+			return func() *dbus.Error { return r.removeBridge(op.BridgeID) }, nil
+		}
+		r.Protocol.Lock()
+		b := r.dc.Bridges[op.BridgeID]
+		r.Protocol.Unlock()
+		p := b.Protocol
+		p.Lock()
+		state, endpoint := b.State, b.Endpoint
+		devices := make([]removedDevice, 0, len(p.Devices))
+		for _, d := range p.sortedDevices() {
+			devices = append(devices, d.removed())
+		}
+		p.Unlock()
+		if err := r.removeBridge(op.BridgeID); err != nil {
+			return nil, err
+		}
+		return func() *dbus.Error {
+			if _, err := r.addBridge(op.BridgeID); err != nil {
+				return err
+			}
+			r.Protocol.Lock()
+			restored := r.dc.Bridges[op.BridgeID]
+			r.Protocol.Unlock()
+			restored.SetState(state)
+			restored.SetEndpoint(endpoint)
+			for _, removed := range devices {
+				if err := restoreRemovedDevice(restored.Protocol, removed); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	}
+
+	p := r.diffProtocol(op.BridgeID)
+	p.Lock()
+	d := p.Devices[op.DevID]
+	p.Unlock()
+	if op.ItemID == "" {
+		return r.applyDeviceOperation(p, d, op)
+	}
+	return r.applyItemOperation(d, op)
+}
+
+func (r *RootProto) applyDeviceOperation(p *Protocol, d *Device, op DiffOperation) (func() *dbus.Error, *dbus.Error) {
+	switch op.Op {
+	case diffAdd:
+		if _, err := p.addDevice(op.DevID, op.ComID, op.TypeID, op.TypeVersion, op.Options); err != nil {
+			return nil, err
+		}
+		return func() *dbus.Error {
+			p := r.diffProtocol(op.BridgeID)
+			if p == nil {
+				return ErrUnknownDevice
+			}
+			return p.removeDeviceByID(op.DevID)
+		}, nil
+	case diffRemove:
+		p.Lock()
+		removed := d.removed()
+		p.Unlock()
+		if err := p.removeDeviceByID(op.DevID); err != nil {
+			return nil, err
+		}
+		return func() *dbus.Error {
+			p := r.diffProtocol(op.BridgeID)
+			if p == nil {
+				return ErrUnknownDevice
+			}
+			return restoreRemovedDevice(p, removed)
+		}, nil
+	}
+
+	d.Lock()
+	options := d.Options
+	d.Unlock()
+	if err := d.updateOptions(op.Options, string(MergeReplace)); err != nil {
+		return nil, err
+	}
+	return func() *dbus.Error {
+		restored := r.diffDevice(op)
+		if restored == nil {
+			return ErrUnknownDevice
+		}
+		return restored.updateOptions(options, string(MergeReplace))
+	}, nil
+}
+
+func (r *RootProto) applyItemOperation(d *Device, op DiffOperation) (func() *dbus.Error, *dbus.Error) {
+	switch op.Op {
+	case diffAdd:
+		if _, err := d.addItem(op.ItemID, op.TypeID, op.TypeVersion, op.Options); err != nil {
+			return nil, err
+		}
+		return func() *dbus.Error {
+			restored := r.diffDevice(op)
+			if restored == nil {
+				return ErrUnknownDevice
+			}
+			return restored.removeItemByID(op.ItemID)
+		}, nil
+	}
+
+	d.Lock()
+	i := d.Items[op.ItemID]
+	d.Unlock()
+	i.Lock()
+	typeID, typeVersion, options := i.TypeID, i.TypeVersion, i.Options
+	i.Unlock()
+	if op.Op == diffRemove {
+		values := i.values()
+		if err := d.removeItemByID(op.ItemID); err != nil {
+			return nil, err
+		}
+		return func() *dbus.Error {
+			restored := r.diffDevice(op)
+			if restored == nil {
+				return ErrUnknownDevice
+			}
+			if _, err := restored.addItem(op.ItemID, typeID, typeVersion, options); err != nil {
+				return err
+			}
+			restored.Lock()
+			i := restored.Items[op.ItemID]
+			restored.Unlock()
+			if i == nil {
+				return &dbus.ErrMsgNoObject
+			}
+			i.restoreValues(values)
+			return nil
+		}, nil
+	}
+
+	i.updateOptions(op.Options)
+	return func() *dbus.Error {
+		restored := r.diffDevice(op)
+		if restored == nil {
+			return ErrUnknownDevice
+		}
+		restored.Lock()
+		i := restored.Items[op.ItemID]
+		restored.Unlock()
+		if i == nil {
+			return &dbus.ErrMsgNoObject
+		}
+		i.updateOptions(options)
+		return nil
+	}, nil
+}
+
+// removed returns the device with its aliases and the values of its items, p must be locked
+func (d *Device) removed() removedDevice {
+	d.Lock()
+	defer d.Unlock()
+	removed := removedDevice{
+		dev:     d.snapshot(),
+		aliases: append([]string{}, d.aliases...),
+		values:  make(map[string]itemValues, len(d.Items)),
+	}
+	for itemID, i := range d.Items {
+		removed.values[itemID] = i.values()
+	}
+	return removed
+}
+
+// restoreRemovedDevice adds again a device removed by a diff with its aliases and the values of its items
+func restoreRemovedDevice(p *Protocol, removed removedDevice) *dbus.Error {
+	if err := restoreDevice(p, removed.dev); err != nil {
+		p.log.Warning("Fail to restore the device", removed.dev.DevID, err)
+		return dbus.MakeFailedError(err)
+	}
+	for _, aliasID := range removed.aliases {
+		if err := p.addAlias(removed.dev.DevID, aliasID); err != nil {
+			p.log.Warning("Fail to restore the alias", aliasID, "of the device", removed.dev.DevID, err)
+			return err
+		}
+	}
+	p.Lock()
+	d := p.Devices[removed.dev.DevID]
+	p.Unlock()
+	if d == nil {
+		return ErrUnknownDevice
+	}
+	d.Lock()
+	items := make(map[string]*Item, len(d.Items))
+	for itemID, i := range d.Items {
+		items[itemID] = i
+	}
+	d.Unlock()
+	for itemID, values := range removed.values {
+		if i, present := items[itemID]; present {
+			i.restoreValues(values)
+		}
+	}
+	return nil
+}
+
+// values returns the values of the item given back by restoreValues
+func (i *Item) values() itemValues {
+	var values itemValues
+	if i.properties != nil {
+		if variant, err := i.Device.getProperty(i.properties, dbusItemInterface, propertyValue); err == nil {
+			values.value = variant.Value().([]byte)
+		}
+		if variant, err := i.Device.getProperty(i.properties, dbusItemInterface, propertyTarget); err == nil {
+			values.target = variant.Value().([]byte)
+		}
+	}
+	i.Lock()
+	values.updated = i.LastUpdated
+	values.history = append([]ValueSample{}, i.history...)
+	values.historySize = i.historySize
+	i.Unlock()
+	return values
+}
+
+// restoreValues gives back to a restored item its values without telling the driver
+func (i *Item) restoreValues(values itemValues) {
+	if i.properties == nil {
+		return
+	}
+	typed, err := i.dc.valueCodec(i.TypeID).Decode(values.value)
+	i.Lock()
+	i.LastUpdated = values.updated
+	i.typedValue = nil
+	if err == nil {
+		i.typedValue = typed
+	}
+	i.history = values.history
+	i.historySize = values.historySize
+	i.Unlock()
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyValue, values.value)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyTarget, values.target)
+}
+
+// updateOptions set the options of the item and calls the SetItemOptions callback
+func (i *Item) updateOptions(options []byte) {
+	i.Lock()
+	i.Options = options
+	i.Unlock()
+	i.setOption(options)
+	if !isNil(i.setItemOptionCb) {
+		i.Device.dispatch(PriorityLow, func() { i.setItemOptionCb.SetItemOptions(i) })
+	}
+}
+
+// diffProtocol returns the bridge protocol or the root protocol if bridgeID is empty, nil if the bridge is unknown
+func (r *RootProto) diffProtocol(bridgeID string) *Protocol {
+	if bridgeID == "" {
+		return r.Protocol
+	}
+	r.Protocol.Lock()
+	defer r.Protocol.Unlock()
+	b, present := r.dc.Bridges[bridgeID]
+	if !present {
+		return nil
+	}
+	return b.Protocol
+}
+
+// diffDevice returns the device of the operation as it is in the tree, nil if it is not there
+func (r *RootProto) diffDevice(op DiffOperation) *Device {
+	p := r.diffProtocol(op.BridgeID)
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.Devices[op.DevID]
+}
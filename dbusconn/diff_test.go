@@ -0,0 +1,366 @@
+package dbusconn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// diffDocument returns the JSON document of the operations
+func diffDocument(t testing.TB, operations ...DiffOperation) string {
+	t.Helper()
+	document, err := json.Marshal(TreeDiff{Operations: operations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(document)
+}
+
+// diffTree adds to the adapter the device D1 with its item I1 and its alias A1, and the bridge b with the device D2
+func diffTree(t *testing.T, dc *Dbus, p *Protocol) {
+	t.Helper()
+	d := addTestDevice(t, p, "D1", "T")
+	i := addTestItem(t, d, "I1", "T")
+	i.SetValue([]byte("42"))
+	if err := p.AddAlias("D1", "A1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	addTestDevice(t, bridge.Protocol, "D2", "T")
+}
+
+func TestApplyDiff(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	diffTree(t, dc, p)
+	c := newTestClient(t, dc)
+
+	diff := diffDocument(t,
+		DiffOperation{Op: diffAdd, BridgeID: "c"},
+		DiffOperation{Op: diffAdd, BridgeID: "c", DevID: "D3", TypeID: "T", TypeVersion: "1", Options: json.RawMessage("{}")},
+		DiffOperation{Op: diffAdd, BridgeID: "c", DevID: "D3", ItemID: "I3", TypeID: "T", TypeVersion: "1"},
+		DiffOperation{Op: diffUpdate, DevID: "D1", Options: json.RawMessage(`{"speed":2}`)},
+		DiffOperation{Op: diffUpdate, DevID: "D1", ItemID: "I1", Options: json.RawMessage(`{"unit":"C"}`)},
+		DiffOperation{Op: diffRemove, BridgeID: "b"},
+	)
+	var applied int32
+	if err := c.call(c.root, dbusProtocolInterface+".ApplyDiff", diff).Store(&applied); err != nil || applied != 6 {
+		t.Fatalf("ApplyDiff: %d %v", applied, err)
+	}
+	bridge, present := testBridge(dc, "c")
+	if !present || !hasItem(testDevice(t, bridge.Protocol, "D3"), "I3") {
+		t.Error("bridge c not added with its device")
+	}
+	if _, present := testBridge(dc, "b"); present {
+		t.Error("bridge b not removed")
+	}
+	if value, err := c.property(c.root+"/D1", dbusDeviceInterface, propertyOptions); err != nil || string(value.Value().([]byte)) != `{"speed":2}` {
+		t.Errorf("options of D1: %v %v", value, err)
+	}
+	if value, err := c.property(c.root+"/D1/I1", dbusItemInterface, propertyOptions); err != nil || string(value.Value().([]byte)) != `{"unit":"C"}` {
+		t.Errorf("options of I1: %v %v", value, err)
+	}
+}
+
+func TestApplyDiffCheckedBeforeApplying(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	diffTree(t, dc, p)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	for name, operations := range map[string][]DiffOperation{
+		"device already there": {{Op: diffAdd, DevID: "D4", TypeID: "T"}, {Op: diffAdd, DevID: "D1", TypeID: "T"}},
+		"unknown item":         {{Op: diffRemove, DevID: "D1"}, {Op: diffRemove, DevID: "D1", ItemID: "I1"}},
+		"unknown bridge":       {{Op: diffAdd, BridgeID: "x", DevID: "D4", TypeID: "T"}},
+		"update of a bridge":   {{Op: diffUpdate, BridgeID: "b"}},
+		"unknown op":           {{Op: "move", DevID: "D1"}},
+		"item without device":  {{Op: diffAdd, ItemID: "I4"}},
+	} {
+		err := c.call(c.root, dbusProtocolInterface+".ApplyDiff", diffDocument(t, operations...)).Err
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != "org.freedesktop.DBus.Error.InvalidArgs" {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if hasDevice(p, "D4") || !hasItem(testDevice(t, p, "D1"), "I1") {
+		t.Error("tree changed by a rejected diff")
+	}
+	if signals := c.flush(); len(signals) != 0 {
+		t.Errorf("signals of a rejected diff: %v", names(signals))
+	}
+}
+
+func TestApplyDiffRollsBack(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &concurrentDriver{})
+	diffTree(t, dc, p)
+	c := newTestClient(t, dc)
+
+	// The driver rejects the device bad only once the operations before it are applied
+	diff := diffDocument(t,
+		DiffOperation{Op: diffUpdate, DevID: "D1", Options: json.RawMessage(`{"speed":2}`)},
+		DiffOperation{Op: diffRemove, DevID: "D1"},
+		DiffOperation{Op: diffRemove, BridgeID: "b"},
+		DiffOperation{Op: diffAdd, DevID: "D4", TypeID: "T", TypeVersion: "1"},
+		DiffOperation{Op: diffAdd, DevID: "bad", TypeID: "T", TypeVersion: "1"},
+	)
+	if err := c.call(c.root, dbusProtocolInterface+".ApplyDiff", diff).Err; err == nil {
+		t.Fatal("diff applied with a rejected device")
+	}
+	if hasDevice(p, "D4") || hasDevice(p, "bad") {
+		t.Error("added devices kept once rolled back")
+	}
+	d1 := testDevice(t, p, "D1")
+	if !hasItem(d1, "I1") {
+		t.Fatal("removed item not restored")
+	}
+	if value, err := c.property(c.root+"/D1/I1", dbusItemInterface, propertyValue); err != nil || string(value.Value().([]byte)) != "42" {
+		t.Errorf("value of the restored item: %v %v", value, err)
+	}
+	if value, err := c.property(c.root+"/D1", dbusDeviceInterface, propertyOptions); err != nil || string(value.Value().([]byte)) != "{}" {
+		t.Errorf("options of the restored device: %v %v", value, err)
+	}
+	if err := c.call(c.root+"/A1", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Error("alias of the restored device:", err)
+	}
+	bridge, present := testBridge(dc, "b")
+	if !present || !hasDevice(bridge.Protocol, "D2") {
+		t.Error("removed bridge not restored with its device")
+	}
+}
+
+// orderDriver records the devices in the order it is asked to add them, each add takes a while and the devices bad*
+// are rejected
+type orderDriver struct {
+	recorder
+}
+
+func (r *orderDriver) AddDeviceSync(ctx context.Context, d *Device) error {
+	r.record(d.DevID)
+	time.Sleep(5 * time.Millisecond)
+	if strings.HasPrefix(d.DevID, "bad") {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func TestMutationsWaitForTheDiff(t *testing.T) {
+	for _, rollback := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rollback=%v", rollback), func(t *testing.T) {
+			driver := &orderDriver{}
+			dc := &Dbus{}
+			p := newTestAdapter(t, dc, driver)
+			c := newTestClient(t, dc)
+			clients := make([]*testClient, 4)
+			for n := range clients {
+				clients[n] = newTestClient(t, dc)
+			}
+
+			var operations []DiffOperation
+			for n := 0; n < 20; n++ {
+				operations = append(operations, DiffOperation{Op: diffAdd, DevID: fmt.Sprintf("X%d", n), TypeID: "T", TypeVersion: "1"})
+			}
+			if rollback {
+				operations = append(operations, DiffOperation{Op: diffAdd, DevID: "bad", TypeID: "T", TypeVersion: "1"})
+			}
+			diffDone := make(chan error, 1)
+			go func() {
+				diffDone <- c.call(c.root, dbusProtocolInterface+".ApplyDiff", diffDocument(t, operations...)).Err
+			}()
+			waitFor(t, "the diff to start", func() bool { return hasDevice(p, "X0") })
+
+			var wg sync.WaitGroup
+			for n, client := range clients {
+				wg.Add(1)
+				go func(n int, client *testClient) {
+					defer wg.Done()
+					devID := fmt.Sprintf("M%d", n)
+					if err := client.call(client.root, dbusProtocolInterface+".AddDevice", devID, "", "T", "1", []byte("{}")).Err; err != nil {
+						t.Errorf("AddDevice %s: %v", devID, err)
+					}
+				}(n, client)
+			}
+			wg.Wait()
+			if err := <-diffDone; (err != nil) != rollback {
+				t.Fatalf("ApplyDiff: %v", err)
+			}
+
+			for n := 0; n < 4; n++ {
+				if !hasDevice(p, fmt.Sprintf("M%d", n)) {
+					t.Errorf("device M%d added during the diff missing", n)
+				}
+			}
+			for n := 0; n < 20; n++ {
+				if hasDevice(p, fmt.Sprintf("X%d", n)) == rollback {
+					t.Errorf("device X%d of the diff present: %v", n, !rollback)
+				}
+			}
+			// The mutations waited for the diff, its rollback included, instead of running along with it
+			adds := driver.recorded()
+			last := 0
+			for n, devID := range adds {
+				if strings.HasPrefix(devID, "X") || devID == "bad" {
+					last = n
+				}
+			}
+			for _, devID := range adds[:last] {
+				if strings.HasPrefix(devID, "M") {
+					t.Fatalf("%s added during the diff: %v", devID, adds)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkApplyDiff(b *testing.B) {
+	dc := &Dbus{}
+	newTestAdapter(b, dc, nil)
+	r := &dc.RootProtocol
+	var add, remove []DiffOperation
+	for n := 0; n < 20; n++ {
+		devID := fmt.Sprintf("D%d", n)
+		add = append(add, DiffOperation{Op: diffAdd, DevID: devID, TypeID: "T", TypeVersion: "1"},
+			DiffOperation{Op: diffAdd, DevID: devID, ItemID: "I1", TypeID: "T", TypeVersion: "1"})
+		remove = append(remove, DiffOperation{Op: diffRemove, DevID: devID})
+	}
+	addDiff, removeDiff := diffDocument(b, add...), diffDocument(b, remove...)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := r.ApplyDiff(addDiff); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := r.ApplyDiff(removeDiff); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestApplyDiffHoldsTheSignalsBack(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &concurrentDriver{})
+	diffTree(t, dc, p)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	// A rolled back diff leaves no trace on the bus but the last change of the metrics
+	diff := diffDocument(t,
+		DiffOperation{Op: diffUpdate, DevID: "D1", Options: json.RawMessage(`{"speed":2}`)},
+		DiffOperation{Op: diffRemove, DevID: "D1"},
+		DiffOperation{Op: diffAdd, DevID: "D4", TypeID: "T", TypeVersion: "1"},
+		DiffOperation{Op: diffAdd, DevID: "bad", TypeID: "T", TypeVersion: "1"},
+	)
+	if err := c.call(c.root, dbusProtocolInterface+".ApplyDiff", diff).Err; err == nil {
+		t.Fatal("diff applied with a rejected device")
+	}
+	if signals := c.flush(); len(signals) > 1 || len(onPath(signals, c.root)) != len(signals) {
+		t.Errorf("signals of a rolled back diff: %v", names(signals))
+	}
+
+	// The signals of an applied diff are sent once it is done
+	diff = diffDocument(t,
+		DiffOperation{Op: diffRemove, DevID: "D1"},
+		DiffOperation{Op: diffAdd, DevID: "D4", TypeID: "T", TypeVersion: "1"},
+	)
+	if err := c.call(c.root, dbusProtocolInterface+".ApplyDiff", diff).Err; err != nil {
+		t.Fatal("ApplyDiff:", err)
+	}
+	signals := c.flush()
+	if count(onPath(signals, c.root+"/D1"), signalDeviceRemoved) != 1 || count(onPath(signals, c.root+"/D4"), signalDeviceAdded) != 1 {
+		t.Errorf("signals of the diff: %v", names(signals))
+	}
+}
+
+// rollbackDriver rejects the device bad and the second add of the device D1, the undo of its removal
+type rollbackDriver struct {
+	sync.Mutex
+	added map[string]int
+}
+
+func (r *rollbackDriver) AddDeviceSync(ctx context.Context, d *Device) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.added == nil {
+		r.added = make(map[string]int)
+	}
+	r.added[d.DevID]++
+	if d.DevID == "bad" || (d.DevID == "D1" && r.added[d.DevID] > 1) {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func TestApplyDiffRollbackFailed(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, &rollbackDriver{})
+	diffTree(t, dc, p)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	diff := diffDocument(t,
+		DiffOperation{Op: diffRemove, DevID: "D1"},
+		DiffOperation{Op: diffAdd, DevID: "bad", TypeID: "T", TypeVersion: "1"},
+	)
+	err := c.call(c.root, dbusProtocolInterface+".ApplyDiff", diff).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrRollbackFailed.Name {
+		t.Fatal("ApplyDiff with a rejected undo:", err)
+	}
+	if hasDevice(p, "D1") {
+		t.Fatal("device restored although its driver rejected it")
+	}
+	// The tree is partially changed, its signals tell the clients
+	if signals := c.flush(); count(onPath(signals, c.root+"/D1"), signalDeviceRemoved) != 1 {
+		t.Errorf("signals of the failed rollback: %v", names(signals))
+	}
+}
+
+func TestGoAPIWaitsForTheDiff(t *testing.T) {
+	driver := &heldDriver{started: make(chan struct{}), release: make(chan struct{})}
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, driver)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+
+	diffDone := make(chan error, 1)
+	go func() {
+		diff := diffDocument(t, DiffOperation{Op: diffAdd, DevID: "slow", TypeID: "T", TypeVersion: "1"})
+		diffDone <- c.call(c.root, dbusProtocolInterface+".ApplyDiff", diff).Err
+	}()
+	<-driver.started
+
+	added := make(chan *dbus.Error, 1)
+	go func() {
+		_, err := p.AddDevice("G1", "", "T", "1", []byte("{}"))
+		added <- err
+	}()
+	// The property writes cannot wait, godbus holds the properties which the diff may set
+	err := c.call(c.root+"/D1/I1", dbusPropertiesInterface+".Set", dbusItemInterface, propertyTarget, dbus.MakeVariant([]byte("1"))).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrDiffInProgress.Name {
+		t.Error("Target written during the diff:", err)
+	}
+	select {
+	case <-added:
+		t.Fatal("AddDevice ran during the diff")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(driver.release)
+	if err := <-diffDone; err != nil {
+		t.Fatal("ApplyDiff:", err)
+	}
+	if err := <-added; err != nil {
+		t.Fatal("AddDevice after the diff:", err)
+	}
+	if !hasDevice(p, "slow") || !hasDevice(p, "G1") {
+		t.Error("devices missing once the diff is done")
+	}
+}
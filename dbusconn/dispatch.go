@@ -0,0 +1,359 @@
+package dbusconn
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// PriorityLow is the priority of the routine callbacks
+	PriorityLow CallbackPriority = iota
+	// PriorityHigh is the priority of the callbacks handled before the routine ones, such as removals
+	PriorityHigh
+)
+
+const defaultBackpressureHigh = 1000
+
+// CallbackPriority informs in which order the callbacks are handled when the workers are busy
+type CallbackPriority int
+
+type rateLimit struct {
+	interval time.Duration
+	next     time.Time
+}
+
+type dispatcher struct {
+	sync.Mutex
+	cond *sync.Cond
+	// lanes holds the callbacks of each device in the order they were dispatched when ordered, a lane runs one
+	// callback at a time. Each callback has its own lane otherwise.
+	lanes   map[string]*lane
+	ordered bool
+	// ready are the lanes waiting for a worker, each one in the queue of the highest priority of its callbacks
+	ready  [PriorityHigh + 1][]*lane
+	queued int
+	closed bool
+	// rateLimitWait tells how long the next callback of a rate limited type has to wait, see SetTypeRateLimit
+	rateLimitWait func(typeID string, now time.Time) time.Duration
+	// wakeup wakes the workers up when the first rate limited callback can run
+	wakeup *time.Timer
+
+	high, low    int
+	backpressure bool
+	notify       chan struct{}
+}
+
+// lane is the FIFO of the callbacks of a device, the priority only orders the lanes between them
+type lane struct {
+	key       string
+	callbacks []queuedCallback
+	running   bool
+	waiting   bool
+	level     CallbackPriority
+}
+
+type queuedCallback struct {
+	priority CallbackPriority
+	// typeID is the type whose rate limit applies to the callback, empty if none
+	typeID string
+	cb     func()
+}
+
+func newDispatcher(high int, low int) *dispatcher {
+	d := &dispatcher{lanes: make(map[string]*lane), high: high, low: low}
+	d.cond = sync.NewCond(d)
+	return d
+}
+
+// startDispatcher starts the workers handling the callbacks
+// Without CallbackWorkers, a goroutine takes from the queue the callbacks held back by the rate limit of their type or
+// by OrderedCallbacks and runs each one in its own goroutine, the other callbacks are not queued.
+func (dc *Dbus) startDispatcher() {
+	d := newDispatcher(dc.backpressureWatermarks())
+	d.ordered = dc.OrderedCallbacks
+	d.rateLimitWait = dc.rateLimitWait
+	dc.dispatcher = d
+	if dc.CallbackWorkers <= 0 {
+		go d.spawn()
+	}
+	for i := 0; i < dc.CallbackWorkers; i++ {
+		go d.work()
+	}
+	if dc.OnBackpressure != nil {
+		d.notify = make(chan struct{}, 1)
+		go d.notifyBackpressure(dc.OnBackpressure)
+	}
+}
+
+// backpressureWatermarks returns the watermarks of the callback queue, defaults included
+func (dc *Dbus) backpressureWatermarks() (int, int) {
+	high := dc.BackpressureHigh
+	if high <= 0 {
+		high = defaultBackpressureHigh
+	}
+	low := dc.BackpressureLow
+	if low <= 0 || low >= high {
+		low = high / 2
+	}
+	return high, low
+}
+
+// dispatch queues the callback for the workers
+// With OrderedCallbacks, the callbacks of the same key, a device or a bridge, are handled in the order they are
+// dispatched whatever their priority, the priority orders the callbacks of different keys.
+func (dc *Dbus) dispatch(key string, priority CallbackPriority, cb func()) {
+	dc.dispatchLimited(key, priority, "", cb)
+}
+
+// dispatchLimited queues the callback, it waits for the rate limit of the type if there is one
+func (dc *Dbus) dispatchLimited(key string, priority CallbackPriority, typeID string, cb func()) {
+	if dc.dispatcher == nil || (dc.CallbackWorkers <= 0 && !dc.OrderedCallbacks && !dc.isRateLimited(typeID)) {
+		go cb()
+		return
+	}
+	dc.dispatcher.dispatch(key, queuedCallback{priority: priority, typeID: typeID, cb: cb})
+}
+
+func (d *dispatcher) dispatch(key string, c queuedCallback) {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return
+	}
+	l, present := d.lanes[key]
+	if !present {
+		l = &lane{key: key}
+		if d.ordered {
+			d.lanes[key] = l
+		}
+	}
+	l.callbacks = append(l.callbacks, c)
+	d.queued++
+	if !l.running {
+		d.schedule(l)
+	}
+	if !d.backpressure && d.queued >= d.high {
+		d.setBackpressure(true)
+	}
+	d.Unlock()
+	d.cond.Signal()
+}
+
+// schedule puts the lane in the ready queue of the highest priority of its callbacks, d must be locked
+// A lane already waiting in a lower queue is moved up, so a removal takes the callbacks queued before it along.
+func (d *dispatcher) schedule(l *lane) {
+	level := PriorityLow
+	for _, c := range l.callbacks {
+		if c.priority > level {
+			level = c.priority
+		}
+	}
+	if l.waiting {
+		if l.level >= level {
+			return
+		}
+		d.unready(l)
+	}
+	l.waiting = true
+	l.level = level
+	d.ready[level] = append(d.ready[level], l)
+}
+
+// unready removes the lane from its ready queue, d must be locked
+func (d *dispatcher) unready(l *lane) {
+	queue := d.ready[l.level]
+	for n, waiting := range queue {
+		if waiting == l {
+			copy(queue[n:], queue[n+1:])
+			queue[len(queue)-1] = nil
+			d.ready[l.level] = queue[:len(queue)-1]
+			break
+		}
+	}
+	l.waiting = false
+}
+
+// SetTypeRateLimit limits the number of low priority callbacks per second for the devices of a type
+// The callbacks over the limit wait in the queue of the callbacks, along with the ones queued after them for the same
+// device, a perSecond of 0 removes the limit
+func (dc *Dbus) SetTypeRateLimit(typeID string, perSecond int) {
+	dc.rateLimitsLock.Lock()
+	if perSecond <= 0 {
+		delete(dc.rateLimits, typeID)
+	} else {
+		if dc.rateLimits == nil {
+			dc.rateLimits = make(map[string]*rateLimit)
+		}
+		dc.rateLimits[typeID] = &rateLimit{interval: time.Second / time.Duration(perSecond)}
+	}
+	dc.rateLimitsLock.Unlock()
+
+	if dc.dispatcher != nil {
+		dc.dispatcher.wake()
+	}
+}
+
+// isRateLimited tells if the callbacks of the type have a rate limit
+func (dc *Dbus) isRateLimited(typeID string) bool {
+	if typeID == "" {
+		return false
+	}
+	dc.rateLimitsLock.Lock()
+	defer dc.rateLimitsLock.Unlock()
+	_, present := dc.rateLimits[typeID]
+	return present
+}
+
+// rateLimitWait tells how long a callback for the type has to wait, the callback takes the slot when it is 0
+func (dc *Dbus) rateLimitWait(typeID string, now time.Time) time.Duration {
+	dc.rateLimitsLock.Lock()
+	defer dc.rateLimitsLock.Unlock()
+	limit, present := dc.rateLimits[typeID]
+	if !present {
+		return 0
+	}
+	if now.Before(limit.next) {
+		return limit.next.Sub(now)
+	}
+	limit.next = now.Add(limit.interval)
+	return 0
+}
+
+// dispatch dispatches a callback of the device, the low priority ones respect the rate limit of its type
+func (d *Device) dispatch(priority CallbackPriority, cb func()) {
+	key := d.Protocol.path + "/" + d.DevID
+	if priority == PriorityHigh {
+		d.dc.dispatch(key, priority, cb)
+		return
+	}
+	d.dc.dispatchLimited(key, priority, d.TypeID, cb)
+}
+
+// next waits for the first callback of the lane of highest priority which can run, the lane is running until done is
+// called
+// A lane whose first callback is over the rate limit of its type is skipped, the workers are woken up once it can run.
+func (d *dispatcher) next() (*lane, func()) {
+	d.Lock()
+	defer d.Unlock()
+	for !d.closed {
+		now := time.Now()
+		var wait time.Duration
+		for priority := PriorityHigh; priority >= PriorityLow; priority-- {
+			for _, l := range d.ready[priority] {
+				c := l.callbacks[0]
+				if c.typeID != "" && d.rateLimitWait != nil {
+					if w := d.rateLimitWait(c.typeID, now); w > 0 {
+						if wait == 0 || w < wait {
+							wait = w
+						}
+						continue
+					}
+				}
+				d.unready(l)
+				l.callbacks[0] = queuedCallback{}
+				l.callbacks = l.callbacks[1:]
+				l.running = true
+				d.queued--
+				if d.backpressure && d.queued <= d.low {
+					d.setBackpressure(false)
+				}
+				return l, c.cb
+			}
+		}
+		if wait > 0 {
+			d.wakeAfter(wait)
+		}
+		d.cond.Wait()
+	}
+	return nil, nil
+}
+
+// wakeAfter wakes the workers up once the delay has elapsed, d must be locked
+func (d *dispatcher) wakeAfter(delay time.Duration) {
+	if d.wakeup != nil {
+		d.wakeup.Stop()
+	}
+	d.wakeup = time.AfterFunc(delay, d.wake)
+}
+
+// wake makes the workers look again for a callback which can run
+func (d *dispatcher) wake() {
+	// Locking ensures that a worker about to wait is waiting
+	d.Lock()
+	d.Unlock()
+	d.cond.Broadcast()
+}
+
+// done puts the lane back in the ready queues once its callback returned, or forgets it if it is empty
+func (d *dispatcher) done(l *lane) {
+	d.Lock()
+	l.running = false
+	if len(l.callbacks) == 0 || d.closed {
+		delete(d.lanes, l.key)
+		d.Unlock()
+		return
+	}
+	d.schedule(l)
+	d.Unlock()
+	d.cond.Signal()
+}
+
+func (d *dispatcher) work() {
+	for l, cb := d.next(); cb != nil; l, cb = d.next() {
+		cb()
+		d.done(l)
+	}
+}
+
+// spawn runs each callback in its own goroutine, for the adapters without CallbackWorkers
+func (d *dispatcher) spawn() {
+	for l, cb := d.next(); cb != nil; l, cb = d.next() {
+		go func(l *lane, cb func()) {
+			cb()
+			d.done(l)
+		}(l, cb)
+	}
+}
+
+// stop drops the queued callbacks and stops the workers, the callbacks running are not interrupted
+func (d *dispatcher) stop() {
+	d.Lock()
+	d.closed = true
+	if d.wakeup != nil {
+		d.wakeup.Stop()
+	}
+	d.lanes = make(map[string]*lane)
+	d.ready = [PriorityHigh + 1][]*lane{}
+	d.queued = 0
+	if d.notify != nil {
+		close(d.notify)
+	}
+	d.Unlock()
+	d.cond.Broadcast()
+}
+
+// setBackpressure changes the backpressure state and wakes up its notifier, d must be locked
+func (d *dispatcher) setBackpressure(active bool) {
+	d.backpressure = active
+	if d.notify == nil {
+		return
+	}
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// notifyBackpressure calls the callback from a single goroutine each time the backpressure state changes
+func (d *dispatcher) notifyBackpressure(cb func(active bool)) {
+	notified := false
+	for range d.notify {
+		d.Lock()
+		active := d.backpressure
+		d.Unlock()
+		if active != notified {
+			notified = active
+			cb(active)
+		}
+	}
+}
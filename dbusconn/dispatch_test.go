@@ -0,0 +1,359 @@
+package dbusconn
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// priorityDriver blocks the first refresh until the gate is opened
+type priorityDriver struct {
+	recorder
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (r *priorityDriver) RefreshDevice(d *Device) {
+	r.record("refresh")
+	if len(r.recorded()) == 1 {
+		close(r.started)
+		<-r.gate
+	}
+}
+
+func (r *priorityDriver) RemoveDevice(devID string) {
+	r.record("remove " + devID)
+}
+
+func TestHighPriorityRemovalGoesFirst(t *testing.T) {
+	driver := &priorityDriver{started: make(chan struct{}), gate: make(chan struct{})}
+	dc := &Dbus{CallbackWorkers: 1}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "D1", "T")
+	addTestDevice(t, p, "D2", "T")
+
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	<-driver.started
+	for n := 0; n < 3; n++ {
+		d.Refresh()
+	}
+	if err := p.RemoveDevice("D2"); err != nil {
+		t.Fatal(err)
+	}
+	close(driver.gate)
+
+	waitFor(t, "the callbacks", func() bool { return len(driver.recorded()) == 5 })
+	want := "refresh,remove D2,refresh,refresh,refresh"
+	if calls := strings.Join(driver.recorded(), ","); calls != want {
+		t.Errorf("callbacks %s, want %s", calls, want)
+	}
+}
+
+// runQueued runs the callbacks of the dispatcher the way a single worker does until none is left
+func runQueued(d *dispatcher, n int) {
+	for ; n > 0; n-- {
+		l, cb := d.next()
+		cb()
+		d.done(l)
+	}
+}
+
+func TestDispatchOrderOfTheQueues(t *testing.T) {
+	d := newDispatcher(defaultBackpressureHigh, defaultBackpressureHigh/2)
+	order := []string{}
+	for _, call := range []struct {
+		key      string
+		priority CallbackPriority
+		name     string
+	}{{"A", PriorityLow, "low1"}, {"B", PriorityHigh, "high1"}, {"C", PriorityLow, "low2"}, {"D", PriorityHigh, "high2"}} {
+		name := call.name
+		d.dispatch(call.key, queuedCallback{priority: call.priority, cb: func() { order = append(order, name) }})
+	}
+	runQueued(d, 4)
+	if got := strings.Join(order, ","); got != "high1,high2,low1,low2" {
+		t.Errorf("order %s", got)
+	}
+}
+
+func TestDispatchKeepsTheOrderOfAKey(t *testing.T) {
+	d := newDispatcher(defaultBackpressureHigh, defaultBackpressureHigh/2)
+	d.ordered = true
+	order := []string{}
+	for _, call := range []struct {
+		key      string
+		priority CallbackPriority
+		name     string
+	}{{"A", PriorityLow, "add A"}, {"B", PriorityLow, "add B"}, {"A", PriorityLow, "update A"}, {"A", PriorityHigh, "remove A"}} {
+		name := call.name
+		d.dispatch(call.key, queuedCallback{priority: call.priority, cb: func() { order = append(order, name) }})
+	}
+	runQueued(d, 4)
+	// The removal of A takes the callbacks of A queued before it ahead of B
+	if got := strings.Join(order, ","); got != "add A,update A,remove A,add B" {
+		t.Errorf("order %s", got)
+	}
+	if len(d.lanes) != 0 {
+		t.Errorf("%d lanes left once the callbacks are done", len(d.lanes))
+	}
+}
+
+func TestHighPriorityGoesBeforeTheCallbacksOfItsKey(t *testing.T) {
+	d := newDispatcher(defaultBackpressureHigh, defaultBackpressureHigh/2)
+	order := []string{}
+	for _, call := range []struct {
+		key      string
+		priority CallbackPriority
+		name     string
+	}{{"A", PriorityLow, "update A"}, {"B", PriorityLow, "update B"}, {"A", PriorityLow, "update A"}, {"A", PriorityHigh, "remove A"}} {
+		name := call.name
+		d.dispatch(call.key, queuedCallback{priority: call.priority, cb: func() { order = append(order, name) }})
+	}
+	runQueued(d, 4)
+	// Without ordering, each callback has its own lane
+	if got := strings.Join(order, ","); got != "remove A,update A,update B,update A" {
+		t.Errorf("order %s", got)
+	}
+}
+
+// laneDriver blocks the first refresh until the gate is opened and records the adds and removals
+type laneDriver struct {
+	recorder
+	started chan struct{}
+	gate    chan struct{}
+	once    sync.Once
+}
+
+func (r *laneDriver) AddDevice(d *Device) {
+	r.record("add " + d.DevID)
+}
+
+func (r *laneDriver) RemoveDevice(devID string) {
+	r.record("remove " + devID)
+}
+
+func (r *laneDriver) RefreshDevice(d *Device) {
+	r.record("refresh")
+	r.once.Do(func() {
+		close(r.started)
+		<-r.gate
+	})
+}
+
+func TestRemovalWaitsForTheQueuedAdd(t *testing.T) {
+	driver := &laneDriver{started: make(chan struct{}), gate: make(chan struct{})}
+	dc := &Dbus{CallbackWorkers: 1, OrderedCallbacks: true}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "D0", "T")
+	waitFor(t, "the add of D0", func() bool { return len(driver.recorded()) == 1 })
+
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	<-driver.started
+	d.Refresh()
+	d.Refresh()
+	if _, err := p.AddDevice("D1", "", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	close(driver.gate)
+
+	waitFor(t, "the callbacks", func() bool { return len(driver.recorded()) == 6 })
+	want := "add D0,refresh,add D1,remove D1,refresh,refresh"
+	if calls := strings.Join(driver.recorded(), ","); calls != want {
+		t.Errorf("callbacks %s, want %s", calls, want)
+	}
+}
+
+// timingDriver records when each device is refreshed
+type timingDriver struct {
+	sync.Mutex
+	refreshes map[string][]time.Time
+}
+
+func (r *timingDriver) RefreshDevice(d *Device) {
+	r.Lock()
+	defer r.Unlock()
+	r.refreshes[d.DevID] = append(r.refreshes[d.DevID], time.Now())
+}
+
+// span returns how long the refreshes of the device took, once they are all done
+func (r *timingDriver) span(t *testing.T, devID string, refreshes int) time.Duration {
+	t.Helper()
+	waitFor(t, "the refreshes of "+devID, func() bool {
+		r.Lock()
+		defer r.Unlock()
+		return len(r.refreshes[devID]) == refreshes
+	})
+	r.Lock()
+	defer r.Unlock()
+	times := r.refreshes[devID]
+	return times[len(times)-1].Sub(times[0])
+}
+
+func TestTypeRateLimit(t *testing.T) {
+	driver := &timingDriver{refreshes: map[string][]time.Time{}}
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, driver)
+	chatty := addTestDevice(t, p, "C1", "chatty")
+	quiet := addTestDevice(t, p, "Q1", "quiet")
+	dc.SetTypeRateLimit("chatty", 20)
+
+	for n := 0; n < 5; n++ {
+		chatty.Refresh()
+		quiet.Refresh()
+	}
+	// 20 callbacks per second are one every 50ms
+	if span := driver.span(t, "C1", 5); span < 180*time.Millisecond {
+		t.Errorf("refreshes of the limited type done in %v", span)
+	}
+	if span := driver.span(t, "Q1", 5); span > 100*time.Millisecond {
+		t.Errorf("refreshes of the other type done in %v", span)
+	}
+
+	dc.SetTypeRateLimit("chatty", 0)
+	driver.Lock()
+	delete(driver.refreshes, "C1")
+	driver.Unlock()
+	for n := 0; n < 5; n++ {
+		chatty.Refresh()
+	}
+	if span := driver.span(t, "C1", 5); span > 100*time.Millisecond {
+		t.Errorf("refreshes once the limit is removed done in %v", span)
+	}
+}
+
+func TestRateLimitKeepsTheOrderOfTheDevice(t *testing.T) {
+	driver := &laneDriver{started: make(chan struct{}), gate: make(chan struct{})}
+	close(driver.gate)
+	dc := &Dbus{OrderedCallbacks: true}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "C1", "chatty")
+	waitFor(t, "the add of C1", func() bool { return len(driver.recorded()) == 1 })
+	dc.SetTypeRateLimit("chatty", 20)
+
+	for n := 0; n < 3; n++ {
+		d.Refresh()
+	}
+	if err := p.RemoveDevice("C1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the callbacks", func() bool { return len(driver.recorded()) == 5 })
+	want := "add C1,refresh,refresh,refresh,remove C1"
+	if calls := strings.Join(driver.recorded(), ","); calls != want {
+		t.Errorf("callbacks %s, want %s", calls, want)
+	}
+}
+
+func TestRateLimitedCallbacksCountInTheBackpressure(t *testing.T) {
+	changes := &recorder{}
+	driver := &timingDriver{refreshes: map[string][]time.Time{}}
+	dc := &Dbus{
+		BackpressureHigh: 5,
+		BackpressureLow:  2,
+		OnBackpressure:   func(active bool) { changes.record(fmt.Sprint(active)) },
+	}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "C1", "chatty")
+	dc.SetTypeRateLimit("chatty", 20)
+
+	// The first refresh runs, the next ones wait for the rate limit
+	for n := 0; n < 6; n++ {
+		d.Refresh()
+	}
+	waitFor(t, "the backpressure", func() bool { return len(changes.recorded()) == 1 })
+	driver.span(t, "C1", 6)
+	waitFor(t, "the end of the backpressure", func() bool { return len(changes.recorded()) == 2 })
+	if calls := strings.Join(changes.recorded(), ","); calls != "true,false" {
+		t.Errorf("backpressure changes: %s", calls)
+	}
+}
+
+func TestCloseDropsTheRateLimitedCallbacks(t *testing.T) {
+	driver := &timingDriver{refreshes: map[string][]time.Time{}}
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "C1", "chatty")
+	dc.SetTypeRateLimit("chatty", 5)
+
+	for n := 0; n < 3; n++ {
+		d.Refresh()
+	}
+	driver.span(t, "C1", 1)
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	driver.Lock()
+	defer driver.Unlock()
+	if refreshes := len(driver.refreshes["C1"]); refreshes != 1 {
+		t.Errorf("%d refreshes once closed", refreshes)
+	}
+}
+
+func TestBackpressureWatermarks(t *testing.T) {
+	changes := &recorder{}
+	driver := &priorityDriver{started: make(chan struct{}), gate: make(chan struct{})}
+	dc := &Dbus{
+		CallbackWorkers:  1,
+		BackpressureHigh: 5,
+		BackpressureLow:  2,
+		OnBackpressure:   func(active bool) { changes.record(fmt.Sprint(active)) },
+	}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "D1", "T")
+
+	// The worker is held by the first refresh, the next ones wait in the queue
+	d.Refresh()
+	<-driver.started
+	for n := 0; n < 4; n++ {
+		d.Refresh()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if calls := changes.recorded(); len(calls) != 0 {
+		t.Fatalf("backpressure below the high watermark: %v", calls)
+	}
+	d.Refresh()
+	waitFor(t, "the backpressure", func() bool { return len(changes.recorded()) == 1 })
+
+	close(driver.gate)
+	waitFor(t, "the end of the backpressure", func() bool { return len(changes.recorded()) == 2 })
+	if calls := strings.Join(changes.recorded(), ","); calls != "true,false" {
+		t.Errorf("backpressure changes: %s", calls)
+	}
+	waitFor(t, "the refreshes", func() bool { return len(driver.recorded()) == 6 })
+}
+
+// blockingAddDriver blocks the add of the devices until the gate is opened and records their refreshes
+type blockingAddDriver struct {
+	recorder
+	gate chan struct{}
+}
+
+func (r *blockingAddDriver) AddDevice(d *Device) {
+	<-r.gate
+}
+
+func (r *blockingAddDriver) RefreshDevice(d *Device) {
+	r.record("refresh " + d.DevID)
+}
+
+func TestCallbacksWithoutWorkersRunConcurrently(t *testing.T) {
+	driver := &blockingAddDriver{gate: make(chan struct{})}
+	defer close(driver.gate)
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, driver)
+	d := addTestDevice(t, p, "D1", "T")
+
+	// The add of the device is still running, its refresh does not wait for it
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the refresh", func() bool { return len(driver.recorded()) == 1 })
+}
@@ -0,0 +1,544 @@
+package dbusconn
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	dbusIntrospectableInterface = "org.freedesktop.DBus.Introspectable"
+	dbusPropertiesInterface     = "org.freedesktop.DBus.Properties"
+
+	// reconcileProbe is the method called by Reconcile to check that an interface is exported, no object has it
+	reconcileProbe = "ReconcileProbe"
+)
+
+// InterfaceOptions configures how an interface is exported
+type InterfaceOptions struct {
+	// HideFromIntrospection removes the interface from the introspection data, its methods stay callable
+	HideFromIntrospection bool
+}
+
+// exportedObject keeps track of everything exported on an object path
+// so that it can be checked and exported again if needed
+type exportedObject struct {
+	methods    map[string]map[string]interface{}
+	properties *prop.Properties
+	// propsSpec holds the current values of the properties, used to export them again on a new connection
+	propsSpec map[string]map[string]*prop.Prop
+	// aliasOf is the path of the object this one is an alias of
+	aliasOf dbus.ObjectPath
+	// emits is how the changes of the properties are emitted, the adapter sends PropertiesChanged itself
+	emits map[string]map[string]prop.EmitType
+	// readers computes on demand the value of the properties read by the clients, see setPropertyReader
+	readers map[string]map[string]func() (interface{}, *dbus.Error)
+	// writers are told who changed the properties set by the clients, see setPropertyWriter
+	writers map[string]map[string]func(sender string, value interface{})
+	failed  bool
+}
+
+// propertiesHandler implements org.freedesktop.DBus.Properties for an object, the properties having a reader are
+// read through it instead of returning their stored value
+type propertiesHandler struct {
+	*prop.Properties
+	dc *Dbus
+	// path is the path of the object owning the readers, the one of the device for an alias
+	path dbus.ObjectPath
+}
+
+// Get implements org.freedesktop.DBus.Properties.Get
+func (h *propertiesHandler) Get(iface, property string) (dbus.Variant, *dbus.Error) {
+	reader := h.dc.propertyReader(h.path, iface, property)
+	if reader == nil {
+		return h.Properties.Get(iface, property)
+	}
+	value, err := reader()
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+	return dbus.MakeVariant(value), nil
+}
+
+// GetAll implements org.freedesktop.DBus.Properties.GetAll
+// A property whose reader fails keeps its stored value so that the other ones can be read.
+func (h *propertiesHandler) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	all, err := h.Properties.GetAll(iface)
+	if err != nil {
+		return nil, err
+	}
+	for name := range all {
+		if reader := h.dc.propertyReader(h.path, iface, name); reader != nil {
+			if value, err := reader(); err == nil {
+				all[name] = dbus.MakeVariant(value)
+			}
+		}
+	}
+	return all, nil
+}
+
+// Set implements org.freedesktop.DBus.Properties.Set, the writer of the property is told the sender of the change
+func (h *propertiesHandler) Set(sender dbus.Sender, iface, property string, newv dbus.Variant) *dbus.Error {
+	if err := h.Properties.Set(iface, property, newv); err != nil {
+		return err
+	}
+	if writer := h.dc.propertyWriter(h.path, iface, property); writer != nil {
+		writer(string(sender), newv.Value())
+	}
+	return nil
+}
+
+func (dc *Dbus) exportedObject(path dbus.ObjectPath) *exportedObject {
+	obj, present := dc.exports[path]
+	if !present {
+		obj = &exportedObject{methods: make(map[string]map[string]interface{})}
+		dc.exports[path] = obj
+	}
+	return obj
+}
+
+// exportMethods exports a method table on the path and registers it
+func (dc *Dbus) exportMethods(path dbus.ObjectPath, iface string, methods map[string]interface{}) error {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	obj := dc.exportedObject(path)
+	methods = dc.trackedMethods(methods)
+	obj.methods[iface] = methods
+	err := dc.connection().ExportMethodTable(methods, path, iface)
+	if err == nil {
+		err = dc.exportIntrospectable(path)
+	}
+	obj.failed = err != nil
+	return err
+}
+
+// exportProperties exports the properties on the path and registers them
+func (dc *Dbus) exportProperties(path dbus.ObjectPath, propsSpec map[string]map[string]*prop.Prop) (*prop.Properties, error) {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	obj := dc.exportedObject(path)
+	obj.propsSpec, obj.emits = dc.ownEmits(propsSpec)
+	properties, err := prop.Export(dc.connection(), path, obj.propsSpec)
+	if err == nil {
+		delete(dc.propertiesPaths, obj.properties)
+		obj.properties = properties
+		dc.propertiesPaths[properties] = path
+		err = dc.connection().Export(dc.propertiesHandler(path, obj), path, dbusPropertiesInterface)
+	}
+	if err == nil {
+		err = dc.exportIntrospectable(path)
+	}
+	obj.failed = err != nil
+	return properties, err
+}
+
+// exportAlias exports on aliasPath the same interfaces and properties as on path
+func (dc *Dbus) exportAlias(path dbus.ObjectPath, aliasPath dbus.ObjectPath) error {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	obj, present := dc.exports[path]
+	if !present {
+		return fmt.Errorf("no object exported on %s", path)
+	}
+	alias := dc.exportedObject(aliasPath)
+	for iface, methods := range obj.methods {
+		alias.methods[iface] = methods
+	}
+	alias.properties = obj.properties
+	alias.emits = obj.emits
+	alias.aliasOf = path
+	err := dc.reexportObject(aliasPath, alias)
+	alias.failed = err != nil
+	return err
+}
+
+// unexportObject removes all the interfaces exported on the path
+func (dc *Dbus) unexportObject(path dbus.ObjectPath) {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	obj, present := dc.exports[path]
+	if !present {
+		return
+	}
+	if obj.aliasOf == "" {
+		delete(dc.propertiesPaths, obj.properties)
+	}
+	conn := dc.connection()
+	for iface := range obj.methods {
+		conn.Export(nil, path, iface)
+	}
+	conn.Export(nil, path, dbusPropertiesInterface)
+	conn.Export(nil, path, dbusIntrospectableInterface)
+	delete(dc.exports, path)
+}
+
+func (dc *Dbus) exportIntrospectable(path dbus.ObjectPath) error {
+	introspectMethod := func() (string, *dbus.Error) {
+		dc.loadItemsOnIntrospect(path)
+		return dc.introspect(path), nil
+	}
+	return dc.connection().ExportMethodTable(map[string]interface{}{"Introspect": introspectMethod}, path, dbusIntrospectableInterface)
+}
+
+func (dc *Dbus) reexportObject(path dbus.ObjectPath, obj *exportedObject) error {
+	for iface, methods := range obj.methods {
+		err := dc.connection().ExportMethodTable(methods, path, iface)
+		if err != nil {
+			return err
+		}
+	}
+	if obj.properties != nil {
+		err := dc.connection().Export(dc.propertiesHandler(path, obj), path, dbusPropertiesInterface)
+		if err != nil {
+			return err
+		}
+	}
+	return dc.exportIntrospectable(path)
+}
+
+// Reconcile checks through the bus that every object of the tree is exported, exports again the ones which are not
+// and returns their number
+// The objects whose export failed are exported again without being checked. It covers the exports lost silently by
+// the connection, which the adapter cannot see otherwise.
+func (dc *Dbus) Reconcile() (int, *dbus.Error) {
+	conn := dc.connection()
+	if conn == nil {
+		return 0, &dbus.ErrMsgNoObject
+	}
+	names := conn.Names()
+	if len(names) == 0 {
+		return 0, dbus.MakeFailedError(errors.New("the connection has no name"))
+	}
+
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	repaired := 0
+	for path, obj := range dc.exports {
+		if !obj.failed && dc.isExported(conn, names[0], path, obj) {
+			continue
+		}
+		err := dc.reexportObject(path, obj)
+		obj.failed = err != nil
+		if err != nil {
+			dc.Log.Warning("Fail to export again the object", path, err)
+			continue
+		}
+		dc.Log.Info("Object", path, "has been exported again")
+		repaired++
+	}
+	return repaired, nil
+}
+
+// isExported checks that the connection exports every interface of the object
+// Each interface is called through the bus with a method it does not have: the connection answers UnknownMethod when
+// the interface is exported, UnknownObject or UnknownInterface when it lost it. The methods of the object are not run.
+func (dc *Dbus) isExported(conn *dbus.Conn, name string, path dbus.ObjectPath, obj *exportedObject) bool {
+	ifaces := []string{dbusIntrospectableInterface}
+	for iface := range obj.methods {
+		ifaces = append(ifaces, iface)
+	}
+	if obj.properties != nil {
+		ifaces = append(ifaces, dbusPropertiesInterface)
+	}
+
+	for _, iface := range ifaces {
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+		err := conn.Object(name, path).CallWithContext(ctx, iface+"."+reconcileProbe, 0).Err
+		cancel()
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != dbus.ErrMsgUnknownMethod.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// introspect generates the introspection data of an exported object
+func (dc *Dbus) introspect(path dbus.ObjectPath) string {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	node := introspect.Node{Name: string(path)}
+	obj, present := dc.exports[path]
+	if present {
+		ifaces := make([]string, 0, len(obj.methods))
+		for iface := range obj.methods {
+			ifaces = append(ifaces, iface)
+		}
+		if obj.properties != nil && !dc.isHidden(dbusPropertiesInterface) {
+			node.Interfaces = append(node.Interfaces, prop.IntrospectData)
+		}
+		sort.Strings(ifaces)
+		for _, iface := range ifaces {
+			if dc.isHidden(iface) {
+				continue
+			}
+			intro := introspect.Interface{Name: iface, Methods: introspectMethods(obj.methods[iface])}
+			if obj.properties != nil {
+				intro.Properties = introspectProperties(obj.properties.Introspection(iface), obj.emits[iface])
+			}
+			node.Interfaces = append(node.Interfaces, intro)
+		}
+	}
+	node.Interfaces = append(node.Interfaces, introspect.IntrospectData)
+
+	prefix := string(path) + "/"
+	children := make(map[string]bool)
+	for p := range dc.exports {
+		if strings.HasPrefix(string(p), prefix) {
+			children[strings.Split(string(p)[len(prefix):], "/")[0]] = true
+		}
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node.Children = append(node.Children, introspect.Node{Name: name})
+	}
+
+	data, err := xml.Marshal(node)
+	if err != nil {
+		dc.Log.Error("Fail to generate the introspection data of", path, err)
+		return ""
+	}
+	return strings.TrimSpace(introspect.IntrospectDeclarationString) + string(data)
+}
+
+// propertiesHandler returns the handler of the properties of the object exported on the path
+func (dc *Dbus) propertiesHandler(path dbus.ObjectPath, obj *exportedObject) *propertiesHandler {
+	if obj.aliasOf != "" {
+		path = obj.aliasOf
+	}
+	return &propertiesHandler{Properties: obj.properties, dc: dc, path: path}
+}
+
+// setPropertyReader makes the clients read the property of the object exported on the path through reader
+// The reader is kept until the object is unexported, a nil reader restores the stored value.
+func (dc *Dbus) setPropertyReader(path dbus.ObjectPath, iface string, name string, reader func() (interface{}, *dbus.Error)) {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	obj := dc.exportedObject(path)
+	if reader == nil {
+		delete(obj.readers[iface], name)
+		return
+	}
+	if obj.readers == nil {
+		obj.readers = make(map[string]map[string]func() (interface{}, *dbus.Error))
+	}
+	if obj.readers[iface] == nil {
+		obj.readers[iface] = make(map[string]func() (interface{}, *dbus.Error))
+	}
+	obj.readers[iface][name] = reader
+}
+
+// propertyReader returns the reader of the property of the object exported on the path, nil if none
+// It must be called without holding exportsLock.
+func (dc *Dbus) propertyReader(path dbus.ObjectPath, iface string, name string) func() (interface{}, *dbus.Error) {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+	if obj, present := dc.exports[path]; present {
+		return obj.readers[iface][name]
+	}
+	return nil
+}
+
+// setPropertyWriter makes the writer called with the sender and the value each time a client sets the property of the
+// object exported on the path, a nil writer removes it
+// The writer is called once the change is accepted by the Callback of the property.
+func (dc *Dbus) setPropertyWriter(path dbus.ObjectPath, iface string, name string, writer func(sender string, value interface{})) {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	obj := dc.exportedObject(path)
+	if writer == nil {
+		delete(obj.writers[iface], name)
+		return
+	}
+	if obj.writers == nil {
+		obj.writers = make(map[string]map[string]func(string, interface{}))
+	}
+	if obj.writers[iface] == nil {
+		obj.writers[iface] = make(map[string]func(string, interface{}))
+	}
+	obj.writers[iface][name] = writer
+}
+
+// propertyWriter returns the writer of the property of the object exported on the path, nil if none
+// It must be called without holding exportsLock.
+func (dc *Dbus) propertyWriter(path dbus.ObjectPath, iface string, name string) func(string, interface{}) {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+	if obj, present := dc.exports[path]; present {
+		return obj.writers[iface][name]
+	}
+	return nil
+}
+
+// ownEmits returns a copy of the properties which do not emit their changes through prop, with how they emit them
+// prop sends one PropertiesChanged per property set, the adapter sends them itself with setPropertyValue so that
+// several changes of an object can go in a single signal. A write from a client still emits the change.
+func (dc *Dbus) ownEmits(propsSpec map[string]map[string]*prop.Prop) (map[string]map[string]*prop.Prop, map[string]map[string]prop.EmitType) {
+	owned := make(map[string]map[string]*prop.Prop, len(propsSpec))
+	emits := make(map[string]map[string]prop.EmitType, len(propsSpec))
+	for iface, props := range propsSpec {
+		owned[iface] = make(map[string]*prop.Prop, len(props))
+		emits[iface] = make(map[string]prop.EmitType, len(props))
+		for name, p := range props {
+			ownedProp := *p
+			emits[iface][name] = p.Emit
+			if p.Emit == prop.EmitTrue || p.Emit == prop.EmitInvalidates {
+				ownedProp.Emit = prop.EmitFalse
+				if p.Writable {
+					ownedProp.Callback = dc.emitOnWrite(p.Callback)
+				}
+			}
+			owned[iface][name] = &ownedProp
+		}
+	}
+	return owned, emits
+}
+
+// emitOnWrite returns the callback of a writable property emitting the change once written by a client
+func (dc *Dbus) emitOnWrite(callback func(*prop.Change) *dbus.Error) func(*prop.Change) *dbus.Error {
+	return func(c *prop.Change) *dbus.Error {
+		if callback != nil {
+			if err := callback(c); err != nil {
+				return err
+			}
+		}
+		// The value is stored once the callback returns, Get waits for it
+		go func() {
+			if value, err := c.Props.Get(c.Iface, c.Name); err == nil {
+				dc.emitPropertiesChanged(c.Props, c.Iface, map[string]interface{}{c.Name: value.Value()})
+			}
+		}()
+		return nil
+	}
+}
+
+// setPropertyValue set the value of a property and emits PropertiesChanged
+// The value is kept even if the signal cannot be sent because the connection is lost, it is exported again with
+// the tree once reconnected.
+func (dc *Dbus) setPropertyValue(properties *prop.Properties, iface string, name string, value interface{}) {
+	dc.setPropertyValues(properties, iface, map[string]interface{}{name: value})
+}
+
+// setPropertyValues set the values of several properties of an interface and emits them in a single PropertiesChanged
+func (dc *Dbus) setPropertyValues(properties *prop.Properties, iface string, values map[string]interface{}) {
+	for name, value := range values {
+		properties.SetMust(iface, name, value)
+	}
+	dc.emitPropertiesChanged(properties, iface, values)
+}
+
+// emitPropertiesChanged emits the changes of the properties of an interface as declared in their Emit
+func (dc *Dbus) emitPropertiesChanged(properties *prop.Properties, iface string, values map[string]interface{}) {
+	dc.exportsLock.Lock()
+	path, present := dc.propertiesPaths[properties]
+	var emits map[string]prop.EmitType
+	if present {
+		emits = dc.exports[path].emits[iface]
+	}
+	dc.exportsLock.Unlock()
+	if !present {
+		return
+	}
+
+	changed := make(map[string]dbus.Variant)
+	invalidated := []string{}
+	for name, value := range values {
+		switch emits[name] {
+		case prop.EmitTrue:
+			changed[name] = dbus.MakeVariant(value)
+		case prop.EmitInvalidates:
+			invalidated = append(invalidated, name)
+		}
+	}
+	if len(changed) == 0 && len(invalidated) == 0 {
+		return
+	}
+	sort.Strings(invalidated)
+	// A change held back by a diff is superseded by a later change of the same properties
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := dc.emitHeld(heldSignal{
+		about: path,
+		key:   string(path) + " " + iface + " " + strings.Join(names, ","),
+		send: func() error {
+			return dc.connection().Emit(path, dbusPropertiesInterface+".PropertiesChanged", iface, changed, invalidated)
+		},
+	}); err != nil {
+		dc.Log.Warning("Fail to emit the change of the properties of", path, iface, err)
+	}
+}
+
+// introspectProperties gives back to the properties the EmitsChangedSignal annotation of their declared Emit
+func introspectProperties(properties []introspect.Property, emits map[string]prop.EmitType) []introspect.Property {
+	for n, p := range properties {
+		emit, present := emits[p.Name]
+		if !present {
+			continue
+		}
+		for a, annotation := range p.Annotations {
+			if annotation.Name == "org.freedesktop.DBus.Property.EmitsChangedSignal" {
+				properties[n].Annotations[a].Value = emit.String()
+			}
+		}
+	}
+	return properties
+}
+
+func (dc *Dbus) isHidden(iface string) bool {
+	return dc.InterfaceOptions[iface].HideFromIntrospection
+}
+
+func introspectMethods(methods map[string]interface{}) []introspect.Method {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	senderType := reflect.TypeOf((*dbus.Sender)(nil)).Elem()
+	messageType := reflect.TypeOf((*dbus.Message)(nil)).Elem()
+	errorType := reflect.TypeOf(&dbus.Error{})
+
+	intro := make([]introspect.Method, 0, len(methods))
+	for _, name := range names {
+		mt := reflect.TypeOf(methods[name])
+		if mt == nil || mt.Kind() != reflect.Func {
+			continue
+		}
+		m := introspect.Method{Name: name}
+		for j := 0; j < mt.NumIn(); j++ {
+			if mt.In(j) != senderType && mt.In(j) != messageType {
+				m.Args = append(m.Args, introspect.Arg{Type: dbus.SignatureOfType(mt.In(j)).String(), Direction: "in"})
+			}
+		}
+		for j := 0; j < mt.NumOut(); j++ {
+			if mt.Out(j) != errorType {
+				m.Args = append(m.Args, introspect.Arg{Type: dbus.SignatureOfType(mt.Out(j)).String(), Direction: "out"})
+			}
+		}
+		intro = append(intro, m)
+	}
+	return intro
+}
@@ -0,0 +1,103 @@
+package dbusconn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestReconcileRepairsADroppedExport(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T")
+	addTestDevice(t, p, "D2", "T")
+	c := newTestClient(t, dc)
+	path := dbus.ObjectPath(c.root + "/D1")
+
+	// The connection loses the export behind the back of the adapter
+	dc.connection().Export(nil, path, dbusDeviceInterface)
+	if !c.unreachable(string(path), dbusDeviceInterface+".GetItems") {
+		t.Fatal("GetItems answered on a dropped export")
+	}
+	repaired, err := dc.Reconcile()
+	if err != nil || repaired != 1 {
+		t.Fatalf("Reconcile repaired %d, %v", repaired, err)
+	}
+	if err := c.call(string(path), dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Fatal("GetItems after Reconcile:", err)
+	}
+	if err := c.call(c.root+"/D2", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Fatal("GetItems on the device left exported:", err)
+	}
+	if repaired, _ := dc.Reconcile(); repaired != 0 {
+		t.Fatalf("second Reconcile repaired %d", repaired)
+	}
+}
+
+func TestReconcileRepairsASilentDrop(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T")
+	c := newTestClient(t, dc)
+
+	dc.connection().Export(nil, dbus.ObjectPath(c.root+"/D1"), dbusDeviceInterface)
+	repaired, err := dc.Reconcile()
+	if err != nil || repaired != 1 {
+		t.Fatalf("Reconcile repaired %d, %v", repaired, err)
+	}
+	if err := c.call(c.root+"/D1", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Fatal("GetItems after Reconcile:", err)
+	}
+	if repaired, _ := dc.Reconcile(); repaired != 0 {
+		t.Fatal("Reconcile repaired again", repaired, "objects")
+	}
+}
+
+func TestReconcileRepairsTheExportsLostWithTheConnection(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+
+	// Every interface of the item is dropped, the properties and the introspection included
+	path := dbus.ObjectPath(c.root + "/D1/I1")
+	for _, iface := range []string{dbusItemInterface, dbusPropertiesInterface, dbusIntrospectableInterface} {
+		dc.connection().Export(nil, path, iface)
+	}
+	repaired, err := dc.Reconcile()
+	if err != nil || repaired != 1 {
+		t.Fatalf("Reconcile repaired %d, %v", repaired, err)
+	}
+	if _, err := c.property(string(path), dbusItemInterface, propertyValue); err != nil {
+		t.Fatal("Value after Reconcile:", err)
+	}
+	if err := c.call(string(path), dbusItemInterface+".GetInfo").Err; err != nil {
+		t.Fatal("GetInfo after Reconcile:", err)
+	}
+}
+
+func TestHiddenInterfaceStaysCallable(t *testing.T) {
+	dc := &Dbus{InterfaceOptions: map[string]InterfaceOptions{dbusDeviceInterface: {HideFromIntrospection: true}}}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+
+	var xml string
+	if err := c.call(c.root+"/D1", dbusIntrospectableInterface+".Introspect").Store(&xml); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(xml, `"`+dbusDeviceInterface+`"`) {
+		t.Errorf("hidden interface introspected:\n%s", xml)
+	}
+	if err := c.call(c.root+"/D1", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Error("method of the hidden interface:", err)
+	}
+
+	if err := c.call(c.root+"/D1/I1", dbusIntrospectableInterface+".Introspect").Store(&xml); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(xml, `"`+dbusItemInterface+`"`) {
+		t.Errorf("interface left visible not introspected:\n%s", xml)
+	}
+}
@@ -0,0 +1,65 @@
+package dbusconn
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+// ErrFrozen is returned by the mutating dbus methods while the tree is frozen
+var ErrFrozen = dbus.NewError(dbusProtocolInterface+".Error.Frozen", []interface{}{"The tree is frozen"})
+
+// Freeze rejects the mutating dbus methods with ErrFrozen until Unfreeze, the reads and the signals are not affected
+// It waits for the mutations in progress to complete
+func (dc *Dbus) Freeze() {
+	dc.freezeLock.Lock()
+	dc.frozen = true
+	dc.setGateFrozen(true)
+	dc.freezeLock.Unlock()
+	dc.Log.Info("Tree frozen")
+}
+
+// Unfreeze accepts again the mutating dbus methods
+func (dc *Dbus) Unfreeze() {
+	dc.freezeLock.Lock()
+	dc.frozen = false
+	dc.setGateFrozen(false)
+	dc.freezeLock.Unlock()
+	dc.Log.Info("Tree unfrozen")
+}
+
+// unlessFrozen runs the mutation of a dbus method, it is rejected with ErrFrozen while the tree is frozen
+// Freeze and ApplyDiff wait for the mutation to return.
+func (dc *Dbus) unlessFrozen(mutation func() *dbus.Error) *dbus.Error {
+	dc.freezeLock.RLock()
+	defer dc.freezeLock.RUnlock()
+	if dc.frozen {
+		return ErrFrozen
+	}
+	return mutation()
+}
+
+// unlessFrozenWrite runs the callback of a property written by a client, the write is rejected with ErrFrozen while
+// the tree is frozen and with ErrDiffInProgress while a diff is applied. ApplyDiff waits for the callback to return.
+// godbus holds the lock of the properties while the callback runs, so the write never waits for a diff setting them.
+func (dc *Dbus) unlessFrozenWrite(write func() *dbus.Error) *dbus.Error {
+	g := &dc.diffGate
+	g.Lock()
+	switch {
+	case g.frozen:
+		g.Unlock()
+		return ErrFrozen
+	case g.applying:
+		g.Unlock()
+		return ErrDiffInProgress
+	}
+	g.mutations++
+	g.Unlock()
+	defer dc.exitMutation()
+	return write()
+}
+
+// setGateFrozen keeps the copy of the frozen flag read by unlessFrozenWrite, which cannot wait for freezeLock
+func (dc *Dbus) setGateFrozen(frozen bool) {
+	dc.diffGate.Lock()
+	dc.diffGate.frozen = frozen
+	dc.diffGate.Unlock()
+}
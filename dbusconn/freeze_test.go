@@ -0,0 +1,94 @@
+package dbusconn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// heldDriver holds AddDeviceSync of the device "slow" until release is closed
+type heldDriver struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *heldDriver) AddDeviceSync(ctx context.Context, d *Device) error {
+	if d.DevID == "slow" {
+		close(r.started)
+		<-r.release
+	}
+	return nil
+}
+
+func TestFreezeRejectsTheMutations(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+	c.flush()
+	frozen := func(what string, err error) {
+		t.Helper()
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrFrozen.Name {
+			t.Errorf("%s while frozen: %v", what, err)
+		}
+	}
+
+	dc.Freeze()
+	frozen("AddDevice", c.call(c.root, dbusProtocolInterface+".AddDevice", "D2", "", "T", "1", []byte("{}")).Err)
+	frozen("RemoveDevice", c.call(c.root, dbusProtocolInterface+".RemoveDevice", "D1").Err)
+	frozen("AddItem", c.call(c.root+"/D1", dbusDeviceInterface+".AddItem", "I2", "T", "1", []byte("{}")).Err)
+	frozen("Options", c.call(c.root+"/D1", dbusPropertiesInterface+".Set", dbusDeviceInterface, propertyOptions, dbus.MakeVariant([]byte("{}"))).Err)
+	frozen("Target", c.call(c.root+"/D1/I1", dbusPropertiesInterface+".Set", dbusItemInterface, propertyTarget, dbus.MakeVariant([]byte("1"))).Err)
+	if hasDevice(p, "D2") || !hasDevice(p, "D1") || hasItem(testDevice(t, p, "D1"), "I2") {
+		t.Fatal("tree changed while frozen")
+	}
+
+	// The reads and the signals go on
+	if err := c.call(c.root+"/D1", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Error("GetItems while frozen:", err)
+	}
+	i.SetValue([]byte("1"))
+	if signals := onPath(c.flush(), c.root+"/D1/I1"); count(signals, "PropertiesChanged") != 1 {
+		t.Errorf("signals of a value set while frozen: %v", names(signals))
+	}
+
+	dc.Unfreeze()
+	if err := c.call(c.root, dbusProtocolInterface+".AddDevice", "D2", "", "T", "1", []byte("{}")).Err; err != nil || !hasDevice(p, "D2") {
+		t.Errorf("AddDevice once unfrozen: %v", err)
+	}
+}
+
+func TestFreezeWaitsForTheMutationsInProgress(t *testing.T) {
+	driver := &heldDriver{started: make(chan struct{}), release: make(chan struct{})}
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, driver)
+	c := newTestClient(t, dc)
+
+	added := make(chan error, 1)
+	go func() {
+		added <- c.call(c.root, dbusProtocolInterface+".AddDevice", "slow", "", "T", "1", []byte("{}")).Err
+	}()
+	<-driver.started
+	done := make(chan struct{})
+	go func() {
+		dc.Freeze()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Freeze returned during a mutation")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(driver.release)
+	<-done
+	if err := <-added; err != nil || !hasDevice(p, "slow") {
+		t.Errorf("mutation in progress once frozen: %v", err)
+	}
+	if err := c.call(c.root, dbusProtocolInterface+".RemoveDevice", "slow").Err; err == nil {
+		t.Error("RemoveDevice accepted once frozen")
+	}
+	dc.Unfreeze()
+}
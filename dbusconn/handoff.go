@@ -0,0 +1,84 @@
+package dbusconn
+
+import (
+	"encoding/json"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// TreeSnapshot returns the bridges, devices and items of the adapter as a JSON document in the format of ProtocolJson,
+// the document can be given to ImportTree
+func (dc *Dbus) TreeSnapshot() (string, error) {
+	snapshot := ProtocolJson{Protocols: make(map[string][]DeviceJson)}
+	for _, p := range dc.protocols() {
+		p.Lock()
+		snapshot.Protocols[p.protocolName] = p.snapshot()
+		p.Unlock()
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// nameRequestFlags returns the flags used to request the bus name of the adapter
+// The name is always taken from a running instance that allows it, so a new instance can replace the current one
+func (dc *Dbus) nameRequestFlags() dbus.RequestNameFlags {
+	flags := dbus.NameFlagReplaceExisting | dbus.NameFlagDoNotQueue
+	if dc.AllowHandoff {
+		flags |= dbus.NameFlagAllowReplacement
+	}
+	return flags
+}
+
+// watchNameLost listens to NameLost to hand the tree over when another instance takes the bus name
+func (dc *Dbus) watchNameLost(dbusName string) {
+	if !dc.AllowHandoff {
+		return
+	}
+	done, started := dc.startWatcher(&dc.handoffDone)
+	if !started {
+		return
+	}
+	conn := dc.connection()
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+	go func() {
+		for {
+			select {
+			case signal, ok := <-signals:
+				if !ok {
+					return
+				}
+				if signal.Name != dbusDaemonInterface+".NameLost" || len(signal.Body) != 1 {
+					continue
+				}
+				if name, _ := signal.Body[0].(string); name == dbusName {
+					dc.handOff(dbusName)
+				}
+			case <-done:
+				conn.RemoveSignal(signals)
+				return
+			}
+		}
+	}()
+}
+
+func (dc *Dbus) stopWatchingNameLost() {
+	dc.stopWatcher(&dc.handoffDone)
+}
+
+// handOff gives the snapshot of the tree to OnNameLost once the bus name is taken by another instance
+func (dc *Dbus) handOff(dbusName string) {
+	dc.Log.Warning("Dbus name", dbusName, "taken by another instance, handing the tree over")
+	snapshot, err := dc.TreeSnapshot()
+	if err != nil {
+		dc.Log.Error("Fail to serialize the tree for the handoff", err)
+		return
+	}
+	if dc.OnNameLost != nil {
+		dc.OnNameLost(snapshot)
+	}
+}
@@ -0,0 +1,64 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// takeName requests the bus name of the adapter from a connection of its own, the way an incoming instance does
+func takeName(t *testing.T, dc *Dbus) dbus.RequestNameReply {
+	t.Helper()
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	reply, err := conn.RequestName(dbusNamePrefix+dc.ProtocolName, dbus.NameFlagReplaceExisting|dbus.NameFlagDoNotQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestHandoffOnNameLost(t *testing.T) {
+	snapshots := make(chan string, 1)
+	dc := &Dbus{AllowHandoff: true, OnNameLost: func(snapshot string) { snapshots <- snapshot }}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+
+	if reply := takeName(t, dc); reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("name not taken over: %v", reply)
+	}
+	var snapshot string
+	select {
+	case snapshot = <-snapshots:
+	case <-time.After(signalTimeout):
+		t.Fatal("OnNameLost not called")
+	}
+	var tree ProtocolJson
+	if err := json.Unmarshal([]byte(snapshot), &tree); err != nil {
+		t.Fatal(err)
+	}
+	devices := tree.Protocols[dc.ProtocolName]
+	if len(devices) != 1 || devices[0].DevID != "D1" || len(devices[0].Items) != 1 || devices[0].Items[0].ItemID != "I1" {
+		t.Errorf("snapshot handed over: %s", snapshot)
+	}
+}
+
+func TestNoHandoffWithoutPermission(t *testing.T) {
+	called := make(chan string, 1)
+	dc := &Dbus{OnNameLost: func(snapshot string) { called <- snapshot }}
+	newTestAdapter(t, dc, nil)
+
+	if reply := takeName(t, dc); reply != dbus.RequestNameReplyExists {
+		t.Fatalf("name taken from an instance not allowing it: %v", reply)
+	}
+	select {
+	case <-called:
+		t.Error("OnNameLost called without AllowHandoff")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
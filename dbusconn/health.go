@@ -0,0 +1,98 @@
+package dbusconn
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	propertyHealth = "Health"
+
+	// healthErrorWindow is how long a device error degrades the health of the protocol
+	healthErrorWindow = 5 * time.Minute
+
+	// HealthOk state 'ok' for HealthState
+	HealthOk HealthState = "OK"
+	// HealthStarting state 'starting' for HealthState, the protocol is not ready yet
+	HealthStarting HealthState = "STARTING"
+	// HealthDegraded state 'degraded' for HealthState, some devices reported errors recently
+	HealthDegraded HealthState = "DEGRADED"
+	// HealthKo state 'ko' for HealthState, the bus connection is lost
+	HealthKo HealthState = "KO"
+)
+
+// HealthState summarizes the readiness, the connection and the recent errors of the protocol
+type HealthState string
+
+func (dc *Dbus) healthProperty() *prop.Prop {
+	return &prop.Prop{
+		Value:    HealthStarting,
+		Writable: false,
+		Emit:     prop.EmitTrue,
+		Callback: nil,
+	}
+}
+
+// recordError counts a device error in the health of the protocol
+func (dc *Dbus) recordError() {
+	dc.healthLock.Lock()
+	dc.errorTimes = append(dc.errorTimes, time.Now())
+	dc.healthLock.Unlock()
+
+	dc.updateHealth()
+	time.AfterFunc(healthErrorWindow, dc.updateHealth)
+}
+
+// health computes the health of the protocol
+func (dc *Dbus) health() HealthState {
+	if conn := dc.connection(); conn == nil || !conn.Connected() {
+		return HealthKo
+	}
+
+	root := dc.RootProtocol.Protocol
+	root.Lock()
+	ready := root.ready
+	root.Unlock()
+	if !ready {
+		return HealthStarting
+	}
+
+	dc.healthLock.Lock()
+	defer dc.healthLock.Unlock()
+	for len(dc.errorTimes) > 0 && time.Since(dc.errorTimes[0]) > healthErrorWindow {
+		dc.errorTimes = dc.errorTimes[1:]
+	}
+	if len(dc.errorTimes) > 0 {
+		return HealthDegraded
+	}
+	return HealthOk
+}
+
+// updateHealth set the value of the property Health when one of its inputs changed
+func (dc *Dbus) updateHealth() {
+	root := dc.RootProtocol.Protocol
+	if root == nil {
+		return
+	}
+	root.Lock()
+	properties := root.properties
+	root.Unlock()
+	if properties == nil {
+		return
+	}
+
+	state := dc.health()
+	oldVariant, err := properties.Get(dbusProtocolInterface, propertyHealth)
+	if err != nil {
+		return
+	}
+
+	oldState := oldVariant.Value().(HealthState)
+	if oldState == state {
+		return
+	}
+
+	dc.Log.Info("Health of the protocol", dc.ProtocolName, "changed from", oldState, "to", state)
+	dc.setPropertyValue(properties, dbusProtocolInterface, propertyHealth, state)
+}
@@ -0,0 +1,65 @@
+package dbusconn
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// healthChanges returns the values of Health emitted in the signals, the other properties are left out
+func healthChanges(signals []*dbus.Signal) string {
+	var changes []string
+	for _, s := range signals {
+		if s.Name != dbusPropertiesInterface+".PropertiesChanged" {
+			continue
+		}
+		if value, present := s.Body[1].(map[string]dbus.Variant)[propertyHealth]; present {
+			changes = append(changes, value.Value().(string))
+		}
+	}
+	return strings.Join(changes, ",")
+}
+
+func TestHealthTransitions(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	c := newTestClient(t, dc)
+	c.flush()
+
+	expect := func(step string, want HealthState) {
+		t.Helper()
+		if value, err := c.property(c.root, dbusProtocolInterface, propertyHealth); err != nil || value.Value() != string(want) {
+			t.Fatalf("Health %s: %v %v, want %s", step, value, err, want)
+		}
+		if changes := healthChanges(onPath(c.flush(), c.root)); changes != string(want) {
+			t.Fatalf("Health emitted %s: %s", step, changes)
+		}
+	}
+	if value, _ := c.property(c.root, dbusProtocolInterface, propertyHealth); value.Value() != string(HealthStarting) {
+		t.Fatalf("Health before ready: %v", value)
+	}
+
+	p.Ready()
+	expect("once ready", HealthOk)
+	d.SetError("timeout")
+	expect("after a device error", HealthDegraded)
+	d.SetError("timeout")
+	if changes := healthChanges(onPath(c.flush(), c.root)); changes != "" {
+		t.Errorf("Health emitted after a second error: %s", changes)
+	}
+
+	// The errors older than the window do not count any more
+	dc.healthLock.Lock()
+	for n := range dc.errorTimes {
+		dc.errorTimes[n] = dc.errorTimes[n].Add(-healthErrorWindow - time.Second)
+	}
+	dc.healthLock.Unlock()
+	dc.updateHealth()
+	expect("once the errors are old", HealthOk)
+
+	p.SetReadyWithState(false)
+	expect("once not ready", HealthStarting)
+}
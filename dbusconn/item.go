@@ -2,6 +2,12 @@ package dbusconn
 
 import (
 	"bytes"
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
@@ -9,15 +15,46 @@ import (
 )
 
 const (
-	signalItemAdded   = "ItemAdded"
-	signalItemRemoved = "ItemRemoved"
+	signalItemAdded     = "ItemAdded"
+	signalItemRemoved   = "ItemRemoved"
+	signalValueRejected = "ValueRejected"
 
 	propertyTarget = "Target"
 	propertyValue  = "Value"
+	propertyMin    = "Min"
+	propertyMax    = "Max"
+	propertyStep   = "Step"
+	propertyUnit   = "Unit"
+	propertyScale  = "Scale"
+	propertyOffset = "Offset"
+
+	// stepTolerance is the relative error accepted on the number of steps of a value in the range
+	stepTolerance = 1e-9
 )
 
+var (
+	// ErrOutOfRange is returned when a numeric value is outside of the range of the item
+	ErrOutOfRange = dbus.NewError(dbusItemInterface+".Error.OutOfRange", []interface{}{"The value is out of the range of the item"})
+	// ErrInvalidRange is returned when setting a range whose Min is above its Max or whose Step is negative
+	ErrInvalidRange = dbus.NewError(dbusItemInterface+".Error.InvalidRange", []interface{}{"The range is invalid"})
+)
+
+// ErrNotNumeric is returned when scaling a value which is not a number
+var ErrNotNumeric = dbus.NewError(dbusItemInterface+".Error.NotNumeric", []interface{}{"The value of the item is not a number"})
+
+// ErrValueUnavailable is returned when the value provider of the item fails
+var ErrValueUnavailable = dbus.NewError(dbusItemInterface+".Error.ValueUnavailable", []interface{}{"The value of the item is unavailable"})
+
+// ValueSample is a value of an item with the time it was set, in milliseconds since epoch
+type ValueSample struct {
+	Timestamp int64
+	Value     []byte
+}
+
 // Item object structure
 type Item struct {
+	sync.Mutex
+
 	Device *Device
 
 	ItemID      string
@@ -27,6 +64,32 @@ type Item struct {
 	Options     []byte
 	Target      []byte
 	Value       []byte
+	LastUpdated time.Time
+	Min         float64
+	Max         float64
+	Step        float64
+	// Unit is the unit of the scaled values, the raw values are scaled by raw*Scale+Offset
+	Unit   string
+	Scale  float64
+	Offset float64
+	// Calibration is applied to the raw values before the scaling, see SetCalibration
+	Calibration []byte
+	// EnforceRange rejects the values and targets which are not numbers of the range set by SetRange, within
+	// [Min, Max] and a multiple of Step from Min. It has no effect until SetRange is called.
+	EnforceRange bool
+
+	// rangeSet tells if SetRange was called, the zero range of a new item is not enforced
+	rangeSet bool
+
+	history     []ValueSample
+	historySize int
+	// typedValue is the value decoded by the codec of the type when it was set, returned by GetValue
+	typedValue interface{}
+
+	valueProvider func() ([]byte, error)
+	providerTTL   time.Duration
+	providedValue []byte
+	providedAt    time.Time
 
 	dc         *Dbus
 	properties *prop.Properties
@@ -34,73 +97,167 @@ type Item struct {
 
 	setItemOptionCb interface{ SetItemOptions(*Item) }
 	setItemTargetCb interface{ SetItemTarget(*Item, []byte) }
+	// removalHandled tells that the protocol already accepted or caused the removal, it is not told again
+	removalHandled bool
+	// accepting tells that the item waits for AddItemSync, it is neither exported nor announced yet
+	accepting bool
 }
 
+// initItem adds and exports the item and calls the AddItem callback, d must be locked
+// AddItemSync is not called from here, the callers wait for it with addItemSync to return its error.
 func initItem(itemID string, typeID string, typeVersion string, options []byte, d *Device) *Item {
+	i := newItem(itemID, typeID, typeVersion, options, d)
+	i.export()
+	if !isNil(d.addItemCB) {
+		d.dispatch(PriorityLow, func() { d.addItemCB.AddItem(i) })
+	}
+	return i
+}
+
+// newItem adds the item to the device without exporting it nor telling the protocol, d must be locked
+func newItem(itemID string, typeID string, typeVersion string, options []byte, d *Device) *Item {
 	i := &Item{
 		ItemID:      itemID,
 		Mac:         d.Address,
 		TypeID:      typeID,
 		TypeVersion: typeVersion,
 		Options:     options,
+		Scale:       1,
 		log:         d.log,
 		Device:      d,
 		dc:          d.dc,
 	}
 
 	d.Items[itemID] = i
+	d.dc.addMetric(metricItems, 1)
+	i.SetCallbacks(d.Protocol.cbs)
+	return i
+}
 
-	if i.dc.conn == nil {
+// export exports the item added by newItem and emits ItemAdded, its device must be locked
+func (i *Item) export() {
+	if i.dc.connection() == nil {
 		i.dc.Log.Warning("Unable to export dbus object because dbus connection nil")
 	}
 
 	i.SetDbusProperties(nil)
 	i.SetDbusMethods(nil)
-	i.SetCallbacks(d.Protocol.cbs)
-
-	if !isNil(d.addItemCB) {
-		go d.addItemCB.AddItem(i)
-	}
 
-	i.EmitDbusSignal(signalItemAdded, i.TypeID, i.TypeVersion, i.Options)
+	i.emitItemAdded(ItemAddedPayload{
+		TypeID:      i.TypeID,
+		TypeVersion: i.TypeVersion,
+		Options:     i.Options,
+	})
+}
 
-	return i
+// dispatchRemoveItem calls the RemoveItem callback of the protocol, d must be locked
+func (d *Device) dispatchRemoveItem(i *Item) {
+	if !isNil(d.removeItemSyncCB) {
+		d.dispatch(PriorityHigh, func() {
+			if err := d.removeItemSyncCB.RemoveItemSync(context.Background(), i); err != nil {
+				d.log.Warning("Removal of the item", i.ItemID, "of the device", d.DevID, "failed in the protocol:", err)
+			}
+		})
+	} else if !isNil(d.removeProtocolItemCB) {
+		d.dispatch(PriorityHigh, func() { d.removeProtocolItemCB.RemoveProtocolItem(d.Protocol, d.DevID, i.ItemID) })
+	} else if !isNil(d.removeItemCB) {
+		d.dispatch(PriorityHigh, func() { d.removeItemCB.RemoveItem(d.DevID, i.ItemID) })
+	}
 }
 
 func removeItem(i *Item) {
 	d := i.Device
-	path := dbus.ObjectPath(dbusPathPrefix + i.Device.Protocol.protocolName + "/" + i.Device.DevID + "/" + i.ItemID)
+	path := dbus.ObjectPath(i.Device.Protocol.path + "/" + i.Device.DevID + "/" + i.ItemID)
 
-	if !isNil(i.Device.removeItemCB) {
-		go d.removeItemCB.RemoveItem(d.DevID, i.ItemID)
+	if !i.removalHandled {
+		d.dispatchRemoveItem(i)
 	}
 	delete(d.Items, i.ItemID)
-	d.dc.conn.Emit(path, dbusItemInterface+"."+signalItemRemoved)
-	d.dc.conn.Export(nil, path, dbusItemInterface)
+	d.dc.addMetric(metricItems, -1)
+	d.dropPending(i.properties)
+	if i.accepting {
+		return
+	}
+	s := d.dc.lifecycle()
+	ifaces := d.dc.exportedInterfaces(path)
+	d.emitSignal(func() {
+		d.dc.emitLifecycle(path, dbusItemInterface+"."+signalItemRemoved, s)
+		d.dc.emitInterfacesRemoved(path, ifaces)
+	})
+	d.dc.unexportObject(path)
 }
 
 func (i *Item) setItemOptions(c *prop.Change) *dbus.Error {
-	if !isNil(i.setItemOptionCb) {
-		go i.setItemOptionCb.SetItemOptions(i)
-	} else {
-		i.log.Warning("No Options")
-	}
-	return nil
+	return i.dc.unlessFrozenWrite(func() *dbus.Error {
+		if err := validateArgs(validOptions("Options", c.Value.([]byte))); err != nil {
+			return err
+		}
+		if !isNil(i.setItemOptionCb) {
+			i.Device.dispatch(PriorityLow, func() { i.setItemOptionCb.SetItemOptions(i) })
+		} else {
+			i.log.Warning("No Options")
+		}
+		return nil
+	})
 }
 
 func (i *Item) setItemTarget(c *prop.Change) *dbus.Error {
-	if !isNil(i.setItemTargetCb) {
-		go i.setItemTargetCb.SetItemTarget(i, c.Value.([]byte))
-	} else {
-		i.log.Warning("No Target callback")
+	return i.dc.unlessFrozenWrite(func() *dbus.Error {
+		if !i.inRange(c.Value.([]byte)) {
+			i.log.Warning("Target of the item", i.ItemID, "out of range:", string(c.Value.([]byte)))
+			return ErrOutOfRange
+		}
+		if err := i.Device.startOperation(); err != nil {
+			return err
+		}
+		if !isNil(i.setItemTargetCb) {
+			target := c.Value.([]byte)
+			i.Device.dispatch(PriorityLow, func() { i.setItemTargetCb.SetItemTarget(i, target) })
+		} else {
+			i.Device.OperationDone()
+			i.log.Warning("No Target callback")
+		}
+		return nil
+	})
+}
+
+// inRange checks that a value is a number of the range of the item when the range is enforced
+func (i *Item) inRange(value []byte) bool {
+	i.Lock()
+	defer i.Unlock()
+	if !i.EnforceRange || !i.rangeSet {
+		return true
 	}
-	return nil
+	f, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+	if err != nil || f < i.Min || f > i.Max {
+		return false
+	}
+	if i.Step == 0 {
+		return true
+	}
+	// The tolerance absorbs the rounding of the decimal steps, 0.1 is not exact
+	steps := (f - i.Min) / i.Step
+	return math.Abs(steps-math.Round(steps)) <= stepTolerance*math.Max(1, math.Abs(steps))
 }
 
 // EmitDbusSignal emit a dbus signal from item object
 func (i *Item) EmitDbusSignal(sigName string, args ...interface{}) {
-	path := dbus.ObjectPath(dbusPathPrefix + i.Device.Protocol.protocolName + "/" + i.Device.DevID + "/" + i.ItemID)
-	i.dc.conn.Emit(path, dbusItemInterface+"."+sigName, args...)
+	path := dbus.ObjectPath(i.Device.Protocol.path + "/" + i.Device.DevID + "/" + i.ItemID)
+	i.Device.emitSignal(func() {
+		if err := i.dc.emit(path, func() error { return i.dc.connection().Emit(path, dbusItemInterface+"."+sigName, args...) }); err != nil {
+			i.dc.addMetric(metricDroppedSignals, 1)
+		}
+	})
+}
+
+// emitLifecycleSignal emits a lifecycle signal from the item object
+func (i *Item) emitLifecycleSignal(sigName string, s lifecycleSignal) {
+	path := dbus.ObjectPath(i.Device.Protocol.path + "/" + i.Device.DevID + "/" + i.ItemID)
+	i.Device.emitSignal(func() {
+		if err := i.dc.emitLifecycle(path, dbusItemInterface+"."+sigName, s); err != nil {
+			i.dc.addMetric(metricDroppedSignals, 1)
+		}
+	})
 }
 
 // SetCallbacks set new callbacks for this item
@@ -115,10 +272,99 @@ func (i *Item) SetCallbacks(cbs interface{}) {
 	}
 }
 
+// currentValue returns the value of the property Value, including the change kept while the device is muted
+func (i *Item) currentValue() []byte {
+	if i.properties == nil {
+		return nil
+	}
+	variant, err := i.Device.getProperty(i.properties, dbusItemInterface, propertyValue)
+	if err != nil {
+		return nil
+	}
+	return variant.Value().([]byte)
+}
+
+// SetValueProvider makes the value of the item computed on demand by the provider instead of stored
+// The clients reading the property Value, GetValueWithAge or GetValueScaled get the value of the provider.
+// The value is cached during ttl, a null ttl calls the provider on each read and a nil provider restores the stored value
+func (i *Item) SetValueProvider(provider func() ([]byte, error), ttl time.Duration) {
+	i.Lock()
+	defer i.Unlock()
+	i.valueProvider = provider
+	i.providerTTL = ttl
+	i.providedValue = nil
+	i.providedAt = time.Time{}
+}
+
+// readValue returns the value of the item from its provider if any, with the time it was read
+func (i *Item) readValue() ([]byte, time.Time, *dbus.Error) {
+	i.Lock()
+	provider := i.valueProvider
+	if provider == nil {
+		updated := i.LastUpdated
+		i.Unlock()
+		return i.currentValue(), updated, nil
+	}
+	if i.providerTTL > 0 && !i.providedAt.IsZero() && time.Since(i.providedAt) < i.providerTTL {
+		value, at := i.providedValue, i.providedAt
+		i.Unlock()
+		return value, at, nil
+	}
+	i.Unlock()
+
+	value, err := provider()
+	if err != nil {
+		i.log.Warning("Fail to get the value of the item", i.ItemID, "from its provider:", err)
+		return nil, time.Time{}, ErrValueUnavailable
+	}
+	now := time.Now()
+	i.Lock()
+	i.providedValue = value
+	i.providedAt = now
+	i.Unlock()
+	return value, now, nil
+}
+
+// readProperty is the reader of the property Value, it goes through the value provider of the item if set
+func (i *Item) readProperty() (interface{}, *dbus.Error) {
+	value, _, err := i.readValue()
+	return value, err
+}
+
+// GetValueWithAge is the dbus method to get the value of the item with the time elapsed since its last update
+// The age is -1 if the value has never been updated
+func (i *Item) GetValueWithAge() ([]byte, int64, *dbus.Error) {
+	if i.properties == nil {
+		return nil, -1, &dbus.ErrMsgNoObject
+	}
+
+	value, updated, err := i.readValue()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	var age int64 = -1
+	if !updated.IsZero() {
+		age = time.Since(updated).Milliseconds()
+	}
+	return value, age, nil
+}
+
 // SetDbusMethods set new dbusMethods for this Item
 func (i *Item) SetDbusMethods(externalMethods map[string]interface{}) bool {
-	path := dbus.ObjectPath(dbusPathPrefix + i.Device.Protocol.protocolName + "/" + i.Device.DevID + "/" + i.ItemID)
-	err := i.Device.Protocol.dc.conn.ExportMethodTable(externalMethods, path, dbusItemInterface)
+	path := dbus.ObjectPath(i.Device.Protocol.path + "/" + i.Device.DevID + "/" + i.ItemID)
+	exportedMethods := make(map[string]interface{})
+	exportedMethods["GetValueWithAge"] = i.GetValueWithAge
+	exportedMethods["GetHistory"] = i.GetHistory
+	exportedMethods["GetValueScaled"] = i.GetValueScaled
+	exportedMethods["GetInfo"] = i.GetInfo
+	exportedMethods["GetCalibration"] = i.GetCalibration
+
+	for name, inter := range externalMethods {
+		exportedMethods[name] = inter
+	}
+
+	err := i.dc.exportMethods(path, dbusItemInterface, exportedMethods)
 	if err != nil {
 		i.log.Warning("Fail to export item dbus object", i.ItemID, err)
 		return false
@@ -128,7 +374,7 @@ func (i *Item) SetDbusMethods(externalMethods map[string]interface{}) bool {
 
 // SetDbusProperties set new DBus properties for this item
 func (i *Item) SetDbusProperties(externalProperties map[string]*prop.Prop) bool {
-	path := dbus.ObjectPath(dbusPathPrefix + i.Device.Protocol.protocolName + "/" + i.Device.DevID + "/" + i.ItemID)
+	path := dbus.ObjectPath(i.Device.Protocol.path + "/" + i.Device.DevID + "/" + i.ItemID)
 	propsSpec := map[string]map[string]*prop.Prop{
 		dbusItemInterface: {
 			propertyOptions: {
@@ -149,6 +395,48 @@ func (i *Item) SetDbusProperties(externalProperties map[string]*prop.Prop) bool
 				Emit:     prop.EmitTrue,
 				Callback: nil,
 			},
+			propertyMin: {
+				Value:    i.Min,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyMax: {
+				Value:    i.Max,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyStep: {
+				Value:    i.Step,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyUnit: {
+				Value:    i.Unit,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyScale: {
+				Value:    i.Scale,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyOffset: {
+				Value:    i.Offset,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyCalibration: {
+				Value:    i.Calibration,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
 		},
 	}
 
@@ -156,9 +444,10 @@ func (i *Item) SetDbusProperties(externalProperties map[string]*prop.Prop) bool
 		propsSpec[dbusDeviceInterface][pName] = p
 	}
 
-	properties, err := prop.Export(i.dc.conn, path, propsSpec)
+	properties, err := i.dc.exportProperties(path, propsSpec)
 	if err == nil {
 		i.properties = properties
+		i.dc.setPropertyReader(path, dbusItemInterface, propertyValue, i.readProperty)
 	} else {
 		i.log.Error("Fail to export the properties of the device", i.Device.DevID, i.ItemID, err)
 		return false
@@ -168,11 +457,18 @@ func (i *Item) SetDbusProperties(externalProperties map[string]*prop.Prop) bool
 
 // SetOption set the value of the property Option
 func (i *Item) SetOption(options []byte) {
+	i.dc.enterMutation()
+	defer i.dc.exitMutation()
+	i.setOption(options)
+}
+
+// setOption set the value of the property Option, a diff calls it while it holds the mutations back
+func (i *Item) setOption(options []byte) {
 	if i.properties == nil {
 		return
 	}
 
-	oldVariant, err := i.properties.Get(dbusItemInterface, propertyOptions)
+	oldVariant, err := i.Device.getProperty(i.properties, dbusItemInterface, propertyOptions)
 
 	if err != nil {
 		return
@@ -185,16 +481,37 @@ func (i *Item) SetOption(options []byte) {
 	}
 
 	i.log.Info("propertyOptions of the item", i.ItemID, "changed from", string(oldState), "to", string(newState))
-	i.properties.SetMust(dbusItemInterface, propertyOptions, newState)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyOptions, newState)
 }
 
 // SetValue set the value of the property Value
+// The value is decoded with the codec of the type of the item and kept for GetValue, the values the codec cannot
+// decode are still set and GetValue returns the error of the codec. The values rejected by the enforced range are counted in ValuesRejected and signaled with
+// ValueRejected.
 func (i *Item) SetValue(value []byte) {
 	if i.properties == nil {
 		return
 	}
 
-	oldVariant, err := i.properties.Get(dbusItemInterface, propertyValue)
+	if !i.inRange(value) {
+		i.log.Warning("Value of the item", i.ItemID, "out of range:", string(value))
+		i.Device.IncrementCounter(CounterValuesRejected, 1)
+		i.emitValueRejected(ValueRejectedPayload{Value: value, Reason: ErrOutOfRange.Name})
+		return
+	}
+	typed, decodeErr := i.dc.valueCodec(i.TypeID).Decode(value)
+	if decodeErr != nil {
+		i.log.Warning("Value of the item", i.ItemID, "invalid for its type", i.TypeID, ":", decodeErr)
+		typed = nil
+	}
+
+	i.Lock()
+	i.LastUpdated = time.Now()
+	i.typedValue = typed
+	updated := i.LastUpdated
+	i.Unlock()
+
+	oldVariant, err := i.Device.getProperty(i.properties, dbusItemInterface, propertyValue)
 
 	if err != nil {
 		return
@@ -207,5 +524,140 @@ func (i *Item) SetValue(value []byte) {
 	}
 
 	i.log.Info("propertyValue of the item", i.ItemID, "changed from", string(oldState), "to", string(newState))
-	i.properties.SetMust(dbusItemInterface, propertyValue, newState)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyValue, newState)
+	i.recordSample(ValueSample{Timestamp: updated.UnixNano() / int64(time.Millisecond), Value: newState})
+	i.Device.IncrementCounter(CounterValuesReceived, 1)
+	i.dc.notifyChange(Change{
+		Protocol: i.Device.Protocol.protocolName,
+		DevID:    i.Device.DevID,
+		ItemID:   i.ItemID,
+		Property: propertyValue,
+		Value:    string(newState),
+	})
+
+	i.Device.Lock()
+	cb := i.Device.itemChangeCB
+	i.Device.Unlock()
+	if cb != nil {
+		i.Device.dispatch(PriorityLow, func() { cb(i.ItemID, newState) })
+	}
+	i.Device.Protocol.propagate(i, newState)
+}
+
+// SetHistorySize set the number of values kept in the history of the item, the history is disabled if 0 or less
+func (i *Item) SetHistorySize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	i.Lock()
+	i.historySize = n
+	if len(i.history) > n {
+		i.history = append([]ValueSample{}, i.history[len(i.history)-n:]...)
+	}
+	i.Unlock()
+}
+
+func (i *Item) recordSample(sample ValueSample) {
+	i.Lock()
+	defer i.Unlock()
+	if i.historySize <= 0 {
+		return
+	}
+	i.history = append(i.history, sample)
+	if len(i.history) > i.historySize {
+		i.history = i.history[len(i.history)-i.historySize:]
+	}
+}
+
+// GetHistory is the dbus method to get the last values of the item, the most recent last
+// All the history is returned if limit is 0
+func (i *Item) GetHistory(limit int32) ([]ValueSample, *dbus.Error) {
+	i.Lock()
+	defer i.Unlock()
+	start := 0
+	if limit > 0 && int(limit) < len(i.history) {
+		start = len(i.history) - int(limit)
+	}
+	history := make([]ValueSample, len(i.history)-start)
+	copy(history, i.history[start:])
+	return history, nil
+}
+
+// SetRange set the values of the properties Min, Max and Step
+// Min must not be above Max and Step must not be negative, a Step of 0 means that the values are not stepped.
+func (i *Item) SetRange(min float64, max float64, step float64) *dbus.Error {
+	if !(min <= max) || !(step >= 0) {
+		i.log.Warning("Range of the item", i.ItemID, "rejected:", min, max, step)
+		return ErrInvalidRange
+	}
+	i.Lock()
+	i.Min = min
+	i.Max = max
+	i.Step = step
+	i.rangeSet = true
+	i.Unlock()
+
+	if i.properties == nil {
+		return nil
+	}
+
+	i.log.Info("Range of the item", i.ItemID, "set to", min, max, step)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyMin, min)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyMax, max)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyStep, step)
+	return nil
+}
+
+// SetUnit set the values of the properties Unit, Scale and Offset
+func (i *Item) SetUnit(unit string, scale float64, offset float64) {
+	i.Lock()
+	i.Unit = unit
+	i.Scale = scale
+	i.Offset = offset
+	i.Unlock()
+
+	if i.properties == nil {
+		return
+	}
+
+	i.log.Info("Unit of the item", i.ItemID, "set to", unit, scale, offset)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyUnit, unit)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyScale, scale)
+	i.Device.setProperty(i.properties, dbusItemInterface, propertyOffset, offset)
+}
+
+// GetValueScaled is the dbus method to get the numeric value of the item converted with raw*Scale+Offset
+// The raw value is calibrated first when the item has a calibration
+func (i *Item) GetValueScaled() (float64, *dbus.Error) {
+	value, _, err := i.readValue()
+	if err != nil {
+		return 0, err
+	}
+	raw, parseErr := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+	if parseErr != nil {
+		return 0, ErrNotNumeric
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	if c := parseCalibration(i.Calibration); c != nil {
+		raw = c.apply(raw)
+	}
+	return raw*i.Scale + i.Offset, nil
+}
+
+// GetInfo is the dbus method to get the description of the item: its type, range and unit
+func (i *Item) GetInfo() (map[string]dbus.Variant, *dbus.Error) {
+	i.Lock()
+	defer i.Unlock()
+	return map[string]dbus.Variant{
+		"TypeID":       dbus.MakeVariant(i.TypeID),
+		"TypeVersion":  dbus.MakeVariant(i.TypeVersion),
+		propertyMin:    dbus.MakeVariant(i.Min),
+		propertyMax:    dbus.MakeVariant(i.Max),
+		propertyStep:   dbus.MakeVariant(i.Step),
+		propertyUnit:   dbus.MakeVariant(i.Unit),
+		propertyScale:  dbus.MakeVariant(i.Scale),
+		propertyOffset: dbus.MakeVariant(i.Offset),
+	}, nil
 }
@@ -0,0 +1,331 @@
+package dbusconn
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestGetValueWithAgeGrows(t *testing.T) {
+	p := newTestAdapter(t, &Dbus{}, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+
+	if _, age, err := i.GetValueWithAge(); err != nil || age != -1 {
+		t.Fatalf("age of a value never updated: %d, %v", age, err)
+	}
+	i.SetValue([]byte("1"))
+	value, first, err := i.GetValueWithAge()
+	if err != nil || string(value) != "1" || first < 0 {
+		t.Fatalf("first read: %q %d %v", value, first, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, second, err := i.GetValueWithAge()
+	if err != nil || second < first+50 {
+		t.Fatalf("age did not grow: %d then %d, %v", first, second, err)
+	}
+
+	i.SetValue([]byte("2"))
+	if value, age, _ := i.GetValueWithAge(); string(value) != "2" || age >= second {
+		t.Fatalf("age not reset by an update: %q %d", value, age)
+	}
+}
+
+func TestGetValueWithAgeOverDbus(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	i.SetValue([]byte("42"))
+	c := newTestClient(t, dc)
+
+	var value []byte
+	var age int64
+	if err := c.call(c.root+"/D1/I1", dbusItemInterface+".GetValueWithAge").Store(&value, &age); err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "42" || age < 0 {
+		t.Fatalf("GetValueWithAge: %q %d", value, age)
+	}
+}
+
+func TestRangeEnforcement(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	if err := i.SetRange(0, 10, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][3]float64{{10, 0, 1}, {0, 10, -1}, {math.NaN(), 10, 1}} {
+		if err := i.SetRange(r[0], r[1], r[2]); err != ErrInvalidRange {
+			t.Errorf("range %v: %v", r, err)
+		}
+	}
+	c := newTestClient(t, dc)
+	path := c.root + "/D1/I1"
+
+	for name, want := range map[string]float64{propertyMin: 0, propertyMax: 10, propertyStep: 0.5} {
+		if value, err := c.property(path, dbusItemInterface, name); err != nil || value.Value() != want {
+			t.Errorf("%s: %v %v", name, value, err)
+		}
+		if err := c.call(path, dbusPropertiesInterface+".Set", dbusItemInterface, name, dbus.MakeVariant(1.0)).Err; err == nil {
+			t.Errorf("%s written by a client", name)
+		}
+	}
+	var info map[string]dbus.Variant
+	if err := c.call(path, dbusItemInterface+".GetInfo").Store(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info[propertyMin].Value() != 0.0 || info[propertyMax].Value() != 10.0 || info[propertyStep].Value() != 0.5 {
+		t.Errorf("GetInfo: %v", info)
+	}
+
+	// Without enforcement the range is only informative
+	i.SetValue([]byte("12"))
+	if string(i.currentValue()) != "12" {
+		t.Fatalf("value out of range not enforced: %q", i.currentValue())
+	}
+
+	i.Lock()
+	i.EnforceRange = true
+	i.Unlock()
+	i.SetValue([]byte("11"))
+	if string(i.currentValue()) != "12" {
+		t.Errorf("value out of range set: %q", i.currentValue())
+	}
+	i.SetValue([]byte("10"))
+	if string(i.currentValue()) != "10" {
+		t.Errorf("value within range rejected: %q", i.currentValue())
+	}
+	err := c.call(path, dbusPropertiesInterface+".Set", dbusItemInterface, propertyTarget, dbus.MakeVariant([]byte("-1"))).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrOutOfRange.Name {
+		t.Errorf("target out of range: %v", err)
+	}
+	if err := c.call(path, dbusPropertiesInterface+".Set", dbusItemInterface, propertyTarget, dbus.MakeVariant([]byte("5"))).Err; err != nil {
+		t.Errorf("target within range: %v", err)
+	}
+
+	// The values off the steps and the values which are not numbers are rejected too, and signaled
+	c.flush()
+	for _, value := range []string{"2.25", "on"} {
+		i.SetValue([]byte(value))
+		if string(i.currentValue()) != "10" {
+			t.Errorf("value %s set: %q", value, i.currentValue())
+		}
+	}
+	i.SetValue([]byte("2.5"))
+	if string(i.currentValue()) != "2.5" {
+		t.Errorf("value on a step rejected: %q", i.currentValue())
+	}
+	if err := i.SetRange(0, 1, 0.1); err != nil {
+		t.Fatal(err)
+	}
+	i.SetValue([]byte("0.3"))
+	if string(i.currentValue()) != "0.3" {
+		t.Errorf("decimal step rejected: %q", i.currentValue())
+	}
+	signals := onPath(c.flush(), path)
+	if count(signals, signalValueRejected) != 2 {
+		t.Fatalf("rejections signaled: %v", names(signals))
+	}
+	for _, s := range signals {
+		if strings.HasSuffix(s.Name, "."+signalValueRejected) {
+			var payload ValueRejectedPayload
+			if err := dbus.Store(s.Body, &payload.Value, &payload.Reason); err != nil || payload.Reason != ErrOutOfRange.Name {
+				t.Errorf("ValueRejected: %v %v", payload, err)
+			}
+		}
+	}
+	if counters, _ := i.Device.GetCounters(); counters[CounterValuesRejected] != 3 {
+		t.Errorf("values rejected counted: %v", counters)
+	}
+}
+
+func TestRangeEnforcedOnceSet(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	i.Lock()
+	i.EnforceRange = true
+	i.Unlock()
+
+	// The zero range of a new item is not a range
+	i.SetValue([]byte("12"))
+	if string(i.currentValue()) != "12" {
+		t.Fatalf("value rejected before the range is set: %q", i.currentValue())
+	}
+	if err := i.SetRange(0, 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	i.SetValue([]byte("11"))
+	if string(i.currentValue()) != "12" {
+		t.Errorf("value out of the range set: %q", i.currentValue())
+	}
+}
+
+func TestValueHistory(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	values := func(samples []ValueSample) string {
+		var list []string
+		for _, sample := range samples {
+			list = append(list, string(sample.Value))
+		}
+		return strings.Join(list, ",")
+	}
+
+	i.SetValue([]byte("0"))
+	if history, _ := i.GetHistory(0); len(history) != 0 {
+		t.Fatalf("history kept without a size: %v", values(history))
+	}
+
+	i.SetHistorySize(3)
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		i.SetValue([]byte(value))
+	}
+	history, err := i.GetHistory(0)
+	if err != nil || values(history) != "3,4,5" {
+		t.Fatalf("history: %v %v", values(history), err)
+	}
+	for n, sample := range history {
+		if sample.Timestamp < before || (n > 0 && sample.Timestamp < history[n-1].Timestamp) {
+			t.Errorf("timestamp of sample %d: %d", n, sample.Timestamp)
+		}
+	}
+	if history, _ := i.GetHistory(2); values(history) != "4,5" {
+		t.Errorf("history limited to 2: %v", values(history))
+	}
+	if history, _ := i.GetHistory(10); values(history) != "3,4,5" {
+		t.Errorf("history limited over its size: %v", values(history))
+	}
+
+	c := newTestClient(t, dc)
+	var samples []ValueSample
+	if err := c.call(c.root+"/D1/I1", dbusItemInterface+".GetHistory", int32(1)).Store(&samples); err != nil || values(samples) != "5" {
+		t.Errorf("GetHistory over Dbus: %v %v", values(samples), err)
+	}
+
+	i.SetHistorySize(1)
+	if history, _ := i.GetHistory(0); values(history) != "5" {
+		t.Errorf("history once shrunk: %v", values(history))
+	}
+	i.SetHistorySize(-1)
+	i.SetValue([]byte("6"))
+	if history, _ := i.GetHistory(0); len(history) != 0 {
+		t.Errorf("history once disabled: %v", values(history))
+	}
+}
+
+func TestValueProvider(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	i.SetValue([]byte("stored"))
+	c := newTestClient(t, dc)
+	path := c.root + "/D1/I1"
+	var calls int32
+	var failing int32
+	i.SetValueProvider(func() ([]byte, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) != 0 {
+			return nil, errors.New("sensor offline")
+		}
+		return []byte(fmt.Sprintf("computed%d", n)), nil
+	}, 0)
+	readValue := func() (string, error) {
+		value, err := c.property(path, dbusItemInterface, propertyValue)
+		if err != nil {
+			return "", err
+		}
+		return string(value.Value().([]byte)), nil
+	}
+
+	if value, err := readValue(); err != nil || value != "computed1" {
+		t.Fatalf("Value from the provider: %q %v", value, err)
+	}
+	var value []byte
+	var age int64
+	if err := c.call(path, dbusItemInterface+".GetValueWithAge").Store(&value, &age); err != nil || string(value) != "computed2" || age < 0 {
+		t.Errorf("GetValueWithAge from the provider: %q %d %v", value, age, err)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	for _, err := range []error{
+		func() error { _, err := readValue(); return err }(),
+		c.call(path, dbusItemInterface+".GetValueWithAge").Err,
+	} {
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrValueUnavailable.Name {
+			t.Errorf("read with a failing provider: %v", err)
+		}
+	}
+	atomic.StoreInt32(&failing, 0)
+
+	// Within the TTL the provider is called once
+	i.SetValueProvider(func() ([]byte, error) {
+		return []byte(fmt.Sprintf("cached%d", atomic.AddInt32(&calls, 1))), nil
+	}, 100*time.Millisecond)
+	atomic.StoreInt32(&calls, 0)
+	first, _ := readValue()
+	second, _ := readValue()
+	if first != "cached1" || second != "cached1" || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("reads within the TTL: %q %q, %d calls", first, second, atomic.LoadInt32(&calls))
+	}
+	time.Sleep(120 * time.Millisecond)
+	if value, _ := readValue(); value != "cached2" {
+		t.Errorf("read once the TTL is over: %q", value)
+	}
+
+	i.SetValueProvider(nil, 0)
+	if value, err := readValue(); err != nil || value != "stored" {
+		t.Errorf("Value once the provider is removed: %q %v", value, err)
+	}
+}
+
+func TestUnitAndScaling(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/D1/I1"
+	scaled := func() (float64, error) {
+		var value float64
+		err := c.call(path, dbusItemInterface+".GetValueScaled").Store(&value)
+		return value, err
+	}
+
+	i.SetValue([]byte("21"))
+	if value, err := scaled(); err != nil || value != 21 {
+		t.Errorf("value with the default scale: %v %v", value, err)
+	}
+	i.SetUnit("°C", 0.5, -10)
+	for name, want := range map[string]interface{}{propertyUnit: "°C", propertyScale: 0.5, propertyOffset: -10.0} {
+		if value, err := c.property(path, dbusItemInterface, name); err != nil || value.Value() != want {
+			t.Errorf("%s: %v %v", name, value, err)
+		}
+		if err := c.call(path, dbusPropertiesInterface+".Set", dbusItemInterface, name, dbus.MakeVariant(want)).Err; err == nil {
+			t.Errorf("%s written by a client", name)
+		}
+	}
+	if value, err := scaled(); err != nil || value != 0.5 {
+		t.Errorf("scaled value: %v %v", value, err)
+	}
+	var info map[string]dbus.Variant
+	if err := c.call(path, dbusItemInterface+".GetInfo").Store(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info[propertyUnit].Value() != "°C" || info[propertyScale].Value() != 0.5 || info[propertyOffset].Value() != -10.0 {
+		t.Errorf("GetInfo: %v", info)
+	}
+
+	i.SetValue([]byte("on"))
+	_, err := scaled()
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrNotNumeric.Name {
+		t.Errorf("scaled value of a string: %v", err)
+	}
+}
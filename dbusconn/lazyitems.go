@@ -0,0 +1,65 @@
+package dbusconn
+
+import "github.com/godbus/dbus/v5"
+
+// SetItemsProvider gives the items of the device on demand, for devices with many items
+// The provider is called once, when a client first lists the items with GetItems or introspects the device, and
+// the items it returns are added as with AddItems.
+func (d *Device) SetItemsProvider(provider func() []ItemSpec) {
+	path := dbus.ObjectPath(d.Protocol.path + "/" + d.DevID)
+	d.itemsProviderLock.Lock()
+	d.itemsProvider = provider
+	d.itemsProviderLock.Unlock()
+
+	d.dc.lazyItemsLock.Lock()
+	defer d.dc.lazyItemsLock.Unlock()
+	if d.dc.lazyItems == nil {
+		d.dc.lazyItems = make(map[dbus.ObjectPath]*Device)
+	}
+	d.dc.lazyItems[path] = d
+}
+
+// GetItems is the dbus method to get the IDs of the items of the device, sorted
+func (d *Device) GetItems() ([]string, *dbus.Error) {
+	d.loadItems()
+	d.Lock()
+	defer d.Unlock()
+	itemIDs := make([]string, 0, len(d.Items))
+	for _, i := range d.sortedItems() {
+		itemIDs = append(itemIDs, i.ItemID)
+	}
+	return itemIDs, nil
+}
+
+// loadItems adds the items given by the provider of the device the first time it is called
+// The calls made meanwhile wait for the items to be added, d must not be locked
+func (d *Device) loadItems() {
+	d.itemsProviderLock.Lock()
+	defer d.itemsProviderLock.Unlock()
+	if d.itemsProvider == nil {
+		return
+	}
+	provider := d.itemsProvider
+	d.itemsProvider = nil
+	d.dc.forgetLazyItems(dbus.ObjectPath(d.Protocol.path + "/" + d.DevID))
+
+	d.log.Info("Enumerating the items of the device", d.DevID)
+	d.AddItems(provider())
+}
+
+// loadItemsOnIntrospect loads the items of the device exported on the path if they have not been yet
+func (dc *Dbus) loadItemsOnIntrospect(path dbus.ObjectPath) {
+	dc.lazyItemsLock.Lock()
+	d, lazy := dc.lazyItems[path]
+	dc.lazyItemsLock.Unlock()
+	if lazy {
+		d.loadItems()
+	}
+}
+
+// forgetLazyItems stops loading the items of the device exported on the path on introspection
+func (dc *Dbus) forgetLazyItems(path dbus.ObjectPath) {
+	dc.lazyItemsLock.Lock()
+	defer dc.lazyItemsLock.Unlock()
+	delete(dc.lazyItems, path)
+}
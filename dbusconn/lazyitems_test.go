@@ -0,0 +1,95 @@
+package dbusconn
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lazyDevice adds a device whose items I0 to I(items-1) are given by a provider, it returns the count of its calls
+func lazyDevice(t *testing.T, p *Protocol, devID string, items int) *int32 {
+	t.Helper()
+	var calls int32
+	addTestDevice(t, p, devID, "T").SetItemsProvider(func() []ItemSpec {
+		atomic.AddInt32(&calls, 1)
+		specs := make([]ItemSpec, 0, items)
+		for n := 0; n < items; n++ {
+			specs = append(specs, ItemSpec{ItemID: fmt.Sprintf("I%d", n), TypeID: "T", TypeVersion: "1", Options: []byte("{}")})
+		}
+		return specs
+	})
+	return &calls
+}
+
+func TestItemsProviderCalledOnGetItems(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	calls := lazyDevice(t, p, "D1", 50)
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+
+	if _, err := c.property(path, dbusDeviceInterface, propertyOptions); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(calls); n != 0 {
+		t.Fatalf("provider called %d times before the items are listed", n)
+	}
+
+	// The clients listing the items at the same time all wait for the provider, called once
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func(client *testClient) {
+			defer wg.Done()
+			var itemIDs []string
+			if err := client.call(path, dbusDeviceInterface+".GetItems").Store(&itemIDs); err != nil || len(itemIDs) != 50 {
+				t.Errorf("GetItems: %d items %v", len(itemIDs), err)
+			}
+		}(newTestClient(t, dc))
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("provider called %d times", n)
+	}
+	if value, err := c.property(path+"/I49", dbusItemInterface, propertyValue); err != nil {
+		t.Errorf("item given by the provider not exported: %v %v", value, err)
+	}
+	if err := c.call(path, dbusDeviceInterface+".GetItems").Err; err != nil || atomic.LoadInt32(calls) != 1 {
+		t.Errorf("GetItems once loaded: %v, provider called %d times", err, atomic.LoadInt32(calls))
+	}
+}
+
+func TestItemsProviderCalledOnIntrospection(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	calls := lazyDevice(t, p, "D1", 3)
+	other := lazyDevice(t, p, "D2", 3)
+	c := newTestClient(t, dc)
+
+	var data string
+	if err := c.call(c.root+"/D1", dbusIntrospectableInterface+".Introspect").Store(&data); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(calls) != 1 || !strings.Contains(data, `<node name="I2">`) {
+		t.Errorf("introspection of the device, provider called %d times:\n%s", atomic.LoadInt32(calls), data)
+	}
+	if err := c.call(c.root+"/D1", dbusIntrospectableInterface+".Introspect").Store(&data); err != nil || atomic.LoadInt32(calls) != 1 {
+		t.Errorf("second introspection: %v, provider called %d times", err, atomic.LoadInt32(calls))
+	}
+	if n := atomic.LoadInt32(other); n != 0 {
+		t.Errorf("provider of another device called %d times", n)
+	}
+
+	// The items of a device removed before they are listed are never enumerated
+	if err := p.RemoveDevice("D2"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.unreachable(c.root+"/D2", dbusDeviceInterface+".GetItems") {
+		t.Error("removed device still exported")
+	}
+	if n := atomic.LoadInt32(other); n != 0 {
+		t.Errorf("provider of a removed device called %d times", n)
+	}
+}
@@ -0,0 +1,64 @@
+package dbusconn
+
+import (
+	"sort"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// matchRule is a match rule on signals with its text as sent to the bus
+type matchRule struct {
+	rule    string
+	options []dbus.MatchOption
+}
+
+// newMatchRule builds a match rule on signals from key and value pairs
+func newMatchRule(pairs ...string) matchRule {
+	m := matchRule{rule: "type='signal'"}
+	for n := 0; n+1 < len(pairs); n += 2 {
+		m.options = append(m.options, dbus.WithMatchOption(pairs[n], pairs[n+1]))
+		m.rule += "," + pairs[n] + "='" + pairs[n+1] + "'"
+	}
+	return m
+}
+
+// addMatch installs the match rule on the bus and records it
+func (dc *Dbus) addMatch(m matchRule) error {
+	if err := dc.connection().AddMatchSignal(m.options...); err != nil {
+		return err
+	}
+	dc.matchRulesLock.Lock()
+	defer dc.matchRulesLock.Unlock()
+	if dc.matchRules == nil {
+		dc.matchRules = make(map[string]int)
+	}
+	dc.matchRules[m.rule]++
+	return nil
+}
+
+// removeMatch removes the match rule from the bus and forgets it
+func (dc *Dbus) removeMatch(m matchRule) error {
+	dc.matchRulesLock.Lock()
+	if dc.matchRules[m.rule] > 1 {
+		dc.matchRules[m.rule]--
+	} else {
+		delete(dc.matchRules, m.rule)
+	}
+	dc.matchRulesLock.Unlock()
+	return dc.connection().RemoveMatchSignal(m.options...)
+}
+
+// ExportedMatchRules returns the match rules the adapter has installed on the bus, sorted
+// A rule installed several times is listed as many times
+func (dc *Dbus) ExportedMatchRules() []string {
+	dc.matchRulesLock.Lock()
+	defer dc.matchRulesLock.Unlock()
+	rules := make([]string, 0, len(dc.matchRules))
+	for rule, count := range dc.matchRules {
+		for n := 0; n < count; n++ {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
@@ -0,0 +1,65 @@
+package dbusconn
+
+import (
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// installedRules returns how many times each rule is installed by the adapter, according to the adapter and to the bus
+func installedRules(t *testing.T, dc *Dbus, c *testClient, rules ...string) (listed []int, onTheBus []int) {
+	t.Helper()
+	var all map[string][]string
+	if err := c.conn.Object(dbusDaemonInterface, "/org/freedesktop/DBus").
+		Call("org.freedesktop.DBus.Debug.Stats.GetAllMatchRules", 0).Store(&all); err != nil {
+		t.Fatal("Statistics of the bus:", err)
+	}
+	exported := dc.ExportedMatchRules()
+	for _, rule := range rules {
+		listed, onTheBus = append(listed, 0), append(onTheBus, 0)
+		for _, r := range exported {
+			if r == rule {
+				listed[len(listed)-1]++
+			}
+		}
+		for _, r := range all[dc.connection().Names()[0]] {
+			if r == rule {
+				onTheBus[len(onTheBus)-1]++
+			}
+		}
+	}
+	return listed, onTheBus
+}
+
+func TestExportedMatchRules(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	tracking := "type='signal',interface='" + dbusDaemonInterface + "',member='NameOwnerChanged'"
+	rule := "type='signal',interface='com.ubiant.Test',member='Ping',path='" + c.root + "'"
+	expect := func(step string, subscribed int) {
+		t.Helper()
+		listed, onTheBus := installedRules(t, dc, c, tracking, rule)
+		if listed[0] < 1 || onTheBus[0] < listed[0] {
+			t.Errorf("rule tracking the clients %s: listed %d times, %d on the bus", step, listed[0], onTheBus[0])
+		}
+		if listed[1] != subscribed || onTheBus[1] != subscribed {
+			t.Errorf("rule of the subscriptions %s: listed %d times, %d on the bus, want %d", step, listed[1], onTheBus[1], subscribed)
+		}
+	}
+	expect("at the start", 0)
+
+	var cancels []func()
+	for n := 0; n < 2; n++ {
+		cancel, err := dc.Subscribe("com.ubiant.Test", "Ping", dbus.ObjectPath(c.root), func(*dbus.Signal) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancels = append(cancels, cancel)
+		expect("once subscribed", n+1)
+	}
+	for n, cancel := range cancels {
+		cancel()
+		expect("once a subscription is cancelled", len(cancels)-n-1)
+	}
+}
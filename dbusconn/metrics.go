@@ -0,0 +1,72 @@
+package dbusconn
+
+import (
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	propertyMetrics = "Metrics"
+
+	metricBridges         = "Bridges"
+	metricDevices         = "Devices"
+	metricItems           = "Items"
+	metricErrors          = "Errors"
+	metricDroppedSignals  = "DroppedSignals"
+	metricQuotaRejections = "QuotaRejections"
+)
+
+func newMetrics() map[string]int64 {
+	return map[string]int64{
+		metricBridges:         0,
+		metricDevices:         0,
+		metricItems:           0,
+		metricErrors:          0,
+		metricDroppedSignals:  0,
+		metricQuotaRejections: 0,
+	}
+}
+
+func (dc *Dbus) metricsProperty() *prop.Prop {
+	dc.metricsLock.Lock()
+	defer dc.metricsLock.Unlock()
+	if dc.metricValues == nil {
+		dc.metricValues = newMetrics()
+	}
+	return &prop.Prop{
+		Value:    dc.copyMetrics(),
+		Writable: false,
+		Emit:     prop.EmitTrue,
+		Callback: nil,
+	}
+}
+
+// Metrics returns the counters exported in the property Metrics
+func (dc *Dbus) Metrics() map[string]int64 {
+	dc.metricsLock.Lock()
+	defer dc.metricsLock.Unlock()
+	return dc.copyMetrics()
+}
+
+// addMetric adds delta to a counter and set the value of the property Metrics
+func (dc *Dbus) addMetric(name string, delta int64) {
+	dc.metricsLock.Lock()
+	defer dc.metricsLock.Unlock()
+	if dc.metricValues == nil {
+		dc.metricValues = newMetrics()
+	}
+	dc.metricValues[name] += delta
+
+	root := dc.RootProtocol.Protocol
+	if root != nil && root.properties != nil {
+		dc.setPropertyValue(root.properties, dbusProtocolInterface, propertyMetrics, dc.copyMetrics())
+	}
+}
+
+// copyMetrics returns a copy of the counters, metricsLock must be locked
+func (dc *Dbus) copyMetrics() map[string]int64 {
+	metrics := make(map[string]int64, len(dc.metricValues))
+	for name, value := range dc.metricValues {
+		metrics[name] = value
+	}
+	return metrics
+}
@@ -0,0 +1,74 @@
+package dbusconn
+
+import (
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestMetricsFollowTheOperations(t *testing.T) {
+	dc := &Dbus{TypeQuotas: map[string]int{"Q": 1}}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	expect := func(step string, want map[string]int64, changed bool) {
+		t.Helper()
+		value, err := c.property(c.root, dbusProtocolInterface, propertyMetrics)
+		if err != nil {
+			t.Fatalf("Metrics %s: %v", step, err)
+		}
+		metrics := value.Value().(map[string]int64)
+		for name, count := range want {
+			if metrics[name] != count {
+				t.Errorf("%s %s: %d, want %d", name, step, metrics[name], count)
+			}
+		}
+		emitted := false
+		for _, s := range onPath(c.flush(), c.root) {
+			if s.Name != dbusPropertiesInterface+".PropertiesChanged" {
+				continue
+			}
+			if _, present := s.Body[1].(map[string]dbus.Variant)[propertyMetrics]; present {
+				emitted = true
+			}
+		}
+		if emitted != changed {
+			t.Errorf("Metrics emitted %s: %v", step, emitted)
+		}
+	}
+	expect("at start", map[string]int64{metricBridges: 0, metricDevices: 0, metricItems: 0, metricErrors: 0, metricQuotaRejections: 0}, false)
+
+	d := addTestDevice(t, p, "D1", "T")
+	addTestItem(t, d, "I1", "T")
+	addTestItem(t, d, "I2", "T")
+	addTestDevice(t, p, "D2", "T")
+	expect("after the adds", map[string]int64{metricDevices: 2, metricItems: 2}, true)
+
+	d.RemoveItem("I2")
+	p.RemoveDevice("D2")
+	expect("after the removals", map[string]int64{metricDevices: 1, metricItems: 1}, true)
+
+	d.SetError("timeout")
+	d.SetError("timeout")
+	expect("after the errors", map[string]int64{metricErrors: 2}, true)
+
+	addTestDevice(t, p, "Q1", "Q")
+	if _, err := p.AddDevice("Q2", "", "Q", "1", []byte("{}")); err != ErrTypeQuotaExceeded {
+		t.Fatalf("device over the quota: %v", err)
+	}
+	expect("after a quota rejection", map[string]int64{metricDevices: 2, metricQuotaRejections: 1}, true)
+
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	expect("after a bridge is added", map[string]int64{metricBridges: 1}, true)
+	if err := dc.RootProtocol.RemoveBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	expect("after the bridge is removed", map[string]int64{metricBridges: 0}, true)
+
+	if metrics := dc.Metrics(); metrics[metricDevices] != 2 || metrics[metricErrors] != 2 {
+		t.Errorf("Metrics from the Go API: %v", metrics)
+	}
+}
@@ -0,0 +1,150 @@
+package dbusconn
+
+import (
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// pendingKey identifies a property of the device or of one of its items
+type pendingKey struct {
+	properties *prop.Properties
+	iface      string
+	name       string
+}
+
+// pendingEmit is an emit kept while the device is muted, either a property change or a signal
+type pendingEmit struct {
+	key    *pendingKey
+	value  interface{}
+	signal func()
+}
+
+// Mute suppresses the signals of the device and of its items until Unmute
+// The changes of the properties are kept and only their last value is emitted on Unmute
+func (d *Device) Mute() {
+	d.muteLock.Lock()
+	d.muted = true
+	d.muteLock.Unlock()
+}
+
+// Unmute emits the changes kept since Mute, each property once with its last value and the properties of an object
+// interface in a single PropertiesChanged
+// The emits held back with a DeviceAdded delayed by CoalesceWindow wait for the end of the window.
+func (d *Device) Unmute() {
+	d.muteLock.Lock()
+	d.muted = false
+	if d.coalescing {
+		d.muteLock.Unlock()
+		return
+	}
+	pending := d.pending
+	d.pending = nil
+	d.muteLock.Unlock()
+
+	d.log.Info("Device", d.DevID, "unmuted,", len(pending), "emits kept")
+	d.dc.emitPending(pending)
+}
+
+// FlushEmits synchronously emits the changes kept for the device, the device stays muted
+// It returns once the signals are sent, useful to read back a value just set on a muted device
+// Nothing is emitted while DeviceAdded is delayed by CoalesceWindow.
+func (d *Device) FlushEmits() error {
+	d.muteLock.Lock()
+	var pending []*pendingEmit
+	if !d.coalescing {
+		pending = d.pending
+		d.pending = nil
+	}
+	d.muteLock.Unlock()
+
+	if d.properties == nil {
+		return &dbus.ErrMsgNoObject
+	}
+	d.dc.emitPending(pending)
+	return nil
+}
+
+// emitPending emits the signals kept in order, then the changes of the properties with one PropertiesChanged per
+// interface of each object
+func (dc *Dbus) emitPending(pending []*pendingEmit) {
+	type objectInterface struct {
+		properties *prop.Properties
+		iface      string
+	}
+	var changed []objectInterface
+	values := make(map[objectInterface]map[string]interface{})
+	for _, emit := range pending {
+		if emit.key == nil {
+			emit.signal()
+			continue
+		}
+		key := objectInterface{properties: emit.key.properties, iface: emit.key.iface}
+		if values[key] == nil {
+			values[key] = make(map[string]interface{})
+			changed = append(changed, key)
+		}
+		values[key][emit.key.name] = emit.value
+	}
+	for _, key := range changed {
+		dc.setPropertyValues(key.properties, key.iface, values[key])
+	}
+}
+
+// setProperty set the value of a property of the device or of one of its items
+func (d *Device) setProperty(properties *prop.Properties, iface string, name string, value interface{}) {
+	d.muteLock.Lock()
+	if !d.muted && !d.coalescing {
+		d.muteLock.Unlock()
+		d.dc.setPropertyValue(properties, iface, name, value)
+		return
+	}
+	defer d.muteLock.Unlock()
+
+	key := pendingKey{properties: properties, iface: iface, name: name}
+	for _, emit := range d.pending {
+		if emit.key != nil && *emit.key == key {
+			emit.value = value
+			return
+		}
+	}
+	d.pending = append(d.pending, &pendingEmit{key: &key, value: value})
+}
+
+// getProperty returns the value of a property of the device or of one of its items, including the change kept while muted
+func (d *Device) getProperty(properties *prop.Properties, iface string, name string) (dbus.Variant, *dbus.Error) {
+	d.muteLock.Lock()
+	key := pendingKey{properties: properties, iface: iface, name: name}
+	for _, emit := range d.pending {
+		if emit.key != nil && *emit.key == key {
+			d.muteLock.Unlock()
+			return dbus.MakeVariant(emit.value), nil
+		}
+	}
+	d.muteLock.Unlock()
+	return properties.Get(iface, name)
+}
+
+// emitSignal emits a signal of the device or of one of its items, the signal is kept until Unmute while muted
+func (d *Device) emitSignal(signal func()) {
+	d.muteLock.Lock()
+	if d.muted || d.coalescing {
+		d.pending = append(d.pending, &pendingEmit{signal: signal})
+		d.muteLock.Unlock()
+		return
+	}
+	d.muteLock.Unlock()
+	signal()
+}
+
+// dropPending forgets the emits kept for the properties, used when their object is unexported
+func (d *Device) dropPending(properties *prop.Properties) {
+	d.muteLock.Lock()
+	defer d.muteLock.Unlock()
+	pending := d.pending[:0]
+	for _, emit := range d.pending {
+		if emit.key == nil || emit.key.properties != properties {
+			pending = append(pending, emit)
+		}
+	}
+	d.pending = pending
+}
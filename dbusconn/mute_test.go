@@ -0,0 +1,128 @@
+package dbusconn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// underPath returns the signals emitted by the object and the objects below it
+func underPath(signals []*dbus.Signal, path string) []*dbus.Signal {
+	var under []*dbus.Signal
+	for _, s := range signals {
+		if string(s.Path) == path || strings.HasPrefix(string(s.Path), path+"/") {
+			under = append(under, s)
+		}
+	}
+	return under
+}
+
+func TestMuteHoldsTheEmits(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	first := addTestItem(t, d, "I1", "T")
+	second := addTestItem(t, d, "I2", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+	c.flush()
+
+	d.Mute()
+	first.SetValue([]byte("1"))
+	first.SetValue([]byte("2"))
+	second.SetValue([]byte("3"))
+	d.SetModel("M1")
+	d.SetManufacturer("X1")
+	d.SetError("timeout")
+	if _, err := d.AddItem("I3", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if signals := underPath(c.flush(), path); len(signals) != 0 {
+		t.Fatalf("signals while muted: %v", names(signals))
+	}
+	if value := first.currentValue(); string(value) != "2" {
+		t.Errorf("value of a muted item: %q", value)
+	}
+
+	d.Unmute()
+	signals := underPath(c.flush(), path)
+	changes := map[string][]map[string]dbus.Variant{}
+	for _, s := range signals {
+		if s.Name == dbusPropertiesInterface+".PropertiesChanged" {
+			changes[string(s.Path)] = append(changes[string(s.Path)], s.Body[1].(map[string]dbus.Variant))
+		}
+	}
+	if len(changes[path+"/I1"]) != 1 || string(changes[path+"/I1"][0][propertyValue].Value().([]byte)) != "2" {
+		t.Errorf("changes of I1: %v", changes[path+"/I1"])
+	}
+	if len(changes[path+"/I2"]) != 1 || string(changes[path+"/I2"][0][propertyValue].Value().([]byte)) != "3" {
+		t.Errorf("changes of I2: %v", changes[path+"/I2"])
+	}
+	if device := changes[path]; len(device) != 1 || device[0][propertyModel].Value() != "M1" || device[0][propertyManufacturer].Value() != "X1" || device[0][propertyLastError].Value() != "timeout" {
+		t.Errorf("changes of the device: %v", device)
+	}
+	if count(signals, signalDeviceError) != 1 || count(signals, signalItemAdded) != 1 {
+		t.Errorf("signals on Unmute: %v", names(signals))
+	}
+	if signals := underPath(c.flush(), path); len(signals) != 0 {
+		t.Errorf("signals after Unmute: %v", names(signals))
+	}
+}
+
+func TestRemovingAMutedDeviceDropsItsEmits(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	i := addTestItem(t, d, "I1", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/D1"
+	c.flush()
+
+	d.Mute()
+	i.SetValue([]byte("1"))
+	d.SetModel("M1")
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	d.Unmute()
+	for _, s := range underPath(c.flush(), path) {
+		if s.Name == dbusPropertiesInterface+".PropertiesChanged" {
+			t.Errorf("change of the removed device emitted on %s", s.Path)
+		}
+	}
+}
+
+func TestFlushEmitsOfAMutedDevice(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	i := addTestItem(t, d, "I1", "T")
+	c := newTestClient(t, dc)
+	path := c.root + "/D1/I1"
+	c.flush()
+
+	d.Mute()
+	i.SetValue([]byte("1"))
+	i.SetValue([]byte("2"))
+	if err := d.FlushEmits(); err != nil {
+		t.Fatal(err)
+	}
+	signals := onPath(c.flush(), path)
+	if len(signals) != 1 || string(signals[0].Body[1].(map[string]dbus.Variant)[propertyValue].Value().([]byte)) != "2" {
+		t.Fatalf("signals of FlushEmits: %v", names(signals))
+	}
+	if value, err := c.property(path, dbusItemInterface, propertyValue); err != nil || string(value.Value().([]byte)) != "2" {
+		t.Errorf("value read back once flushed: %v %v", value, err)
+	}
+
+	// The device stays muted
+	i.SetValue([]byte("3"))
+	if signals := onPath(c.flush(), path); len(signals) != 0 {
+		t.Errorf("signals after FlushEmits: %v", names(signals))
+	}
+	d.Unmute()
+	if signals := onPath(c.flush(), path); len(signals) != 1 {
+		t.Errorf("signals of Unmute: %v", names(signals))
+	}
+}
@@ -0,0 +1,119 @@
+package dbusconn
+
+import (
+	"sort"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	dbusObjectManagerInterface = "org.freedesktop.DBus.ObjectManager"
+	signalInterfacesAdded      = "InterfacesAdded"
+	signalInterfacesRemoved    = "InterfacesRemoved"
+)
+
+// GetManagedObjects is the dbus method of the ObjectManager of the root protocol to get the bridges, the devices and
+// the items with the properties of their interfaces, by object path
+// The bridges are listed although their paths are beside the path of the root protocol rather than below it.
+func (dc *Dbus) GetManagedObjects() (map[dbus.ObjectPath]map[string]map[string]dbus.Variant, *dbus.Error) {
+	paths := make([]dbus.ObjectPath, 0)
+	for _, p := range dc.protocols() {
+		p.Lock()
+		if p.isBridged {
+			paths = append(paths, dbus.ObjectPath(p.path))
+		}
+		for _, d := range p.sortedDevices() {
+			paths = append(paths, dbus.ObjectPath(p.path+"/"+d.DevID))
+			d.Lock()
+			for itemID := range d.Items {
+				paths = append(paths, dbus.ObjectPath(p.path+"/"+d.DevID+"/"+itemID))
+			}
+			d.Unlock()
+		}
+		p.Unlock()
+	}
+
+	objects := make(map[dbus.ObjectPath]map[string]map[string]dbus.Variant, len(paths))
+	for _, path := range paths {
+		if interfaces := dc.objectInterfaces(path); len(interfaces) > 0 {
+			objects[path] = interfaces
+		}
+	}
+	return objects, nil
+}
+
+// exportManager exports the ObjectManager on the path of the root protocol
+func (dc *Dbus) exportManager(path dbus.ObjectPath) error {
+	return dc.exportMethods(path, dbusObjectManagerInterface, map[string]interface{}{"GetManagedObjects": dc.GetManagedObjects})
+}
+
+// exportedInterfaces returns the interfaces exported on the path that are not hidden, sorted
+func (dc *Dbus) exportedInterfaces(path dbus.ObjectPath) []string {
+	ifaces, _ := dc.exportedObjectInterfaces(path)
+	return ifaces
+}
+
+// exportedObjectInterfaces returns the interfaces exported on the path that are not hidden, sorted, and the
+// properties exported on the path
+func (dc *Dbus) exportedObjectInterfaces(path dbus.ObjectPath) ([]string, *propertiesHandler) {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+	obj, present := dc.exports[path]
+	if !present {
+		return nil, nil
+	}
+	ifaces := make([]string, 0, len(obj.methods))
+	for iface := range obj.methods {
+		if !dc.isHidden(iface) {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	sort.Strings(ifaces)
+	if obj.properties == nil {
+		return ifaces, nil
+	}
+	return ifaces, dc.propertiesHandler(path, obj)
+}
+
+// objectInterfaces returns the properties of each interface exported on the path
+func (dc *Dbus) objectInterfaces(path dbus.ObjectPath) map[string]map[string]dbus.Variant {
+	ifaces, exported := dc.exportedObjectInterfaces(path)
+	interfaces := make(map[string]map[string]dbus.Variant, len(ifaces))
+	for _, iface := range ifaces {
+		properties := make(map[string]dbus.Variant)
+		if exported != nil {
+			if all, err := exported.GetAll(iface); err == nil {
+				properties = all
+			}
+		}
+		interfaces[iface] = properties
+	}
+	return interfaces
+}
+
+// emitInterfacesAdded emits InterfacesAdded from the root protocol for the object exported on the path
+func (dc *Dbus) emitInterfacesAdded(path dbus.ObjectPath) {
+	interfaces := dc.objectInterfaces(path)
+	if len(interfaces) == 0 {
+		return
+	}
+	root := dbus.ObjectPath(dbusPathPrefix + dc.ProtocolName)
+	if err := dc.emit(path, func() error {
+		return dc.connection().Emit(root, dbusObjectManagerInterface+"."+signalInterfacesAdded, path, interfaces)
+	}); err != nil {
+		dc.addMetric(metricDroppedSignals, 1)
+	}
+}
+
+// emitInterfacesRemoved emits InterfacesRemoved from the root protocol for the interfaces unexported from the path
+func (dc *Dbus) emitInterfacesRemoved(path dbus.ObjectPath, ifaces []string) {
+	if len(ifaces) == 0 {
+		return
+	}
+	root := dbus.ObjectPath(dbusPathPrefix + dc.ProtocolName)
+	if err := dc.emit(path, func() error {
+		return dc.connection().Emit(root, dbusObjectManagerInterface+"."+signalInterfacesRemoved, path, ifaces)
+	}); err != nil {
+		dc.addMetric(metricDroppedSignals, 1)
+	}
+}
@@ -0,0 +1,181 @@
+package dbusconn
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// managedObjects returns the objects listed by the ObjectManager of the root protocol
+func managedObjects(t *testing.T, c *testClient) map[dbus.ObjectPath]map[string]map[string]dbus.Variant {
+	t.Helper()
+	var objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	if err := c.call(c.root, dbusObjectManagerInterface+".GetManagedObjects").Store(&objects); err != nil {
+		t.Fatal("GetManagedObjects:", err)
+	}
+	return objects
+}
+
+func TestGetManagedObjects(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	addTestItem(t, d, "I1", "T").SetValue([]byte("1"))
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	addTestDevice(t, bridge.Protocol, "D2", "T")
+	c := newTestClient(t, dc)
+	device, item, bridged := dbus.ObjectPath(c.root+"/D1"), dbus.ObjectPath(c.root+"/D1/I1"), dbus.ObjectPath(c.root+"_b")
+
+	objects := managedObjects(t, c)
+	if len(objects) != 4 {
+		t.Errorf("managed objects: %v", objects)
+	}
+	if properties := objects[device][dbusDeviceInterface]; properties[propertyOptions].Value() == nil || string(properties[propertyOptions].Value().([]byte)) != "{}" {
+		t.Errorf("properties of the device: %v", objects[device])
+	}
+	if properties := objects[item][dbusItemInterface]; properties[propertyValue].Value() == nil || string(properties[propertyValue].Value().([]byte)) != "1" {
+		t.Errorf("properties of the item: %v", objects[item])
+	}
+	if _, present := objects[bridged][dbusProtocolInterface]; !present {
+		t.Errorf("bridge not listed: %v", objects[bridged])
+	}
+	if _, present := objects[bridged+"/D2"][dbusDeviceInterface]; !present {
+		t.Errorf("device of the bridge not listed: %v", objects[bridged+"/D2"])
+	}
+	if _, present := objects[dbus.ObjectPath(c.root)]; present {
+		t.Error("root protocol listed as one of its objects")
+	}
+
+	if err := dc.RootProtocol.RemoveBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	if objects := managedObjects(t, c); len(objects) != 0 {
+		t.Errorf("managed objects once removed: %v", objects)
+	}
+}
+
+func TestInterfacesAddedAndRemoved(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+	// changes returns the paths given by the InterfacesAdded and InterfacesRemoved of the root protocol
+	changes := func(signals []*dbus.Signal) []string {
+		var list []string
+		for _, s := range onPath(signals, c.root) {
+			if strings.HasPrefix(s.Name, dbusObjectManagerInterface+".") {
+				list = append(list, fmt.Sprint(s.Name[len(dbusObjectManagerInterface)+1:], " ", s.Body[0]))
+			}
+		}
+		return list
+	}
+
+	d := addTestDevice(t, p, "D1", "T")
+	addTestItem(t, d, "I1", "T")
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	signals := c.flush()
+	want := []string{"InterfacesAdded " + c.root + "/D1", "InterfacesAdded " + c.root + "/D1/I1", "InterfacesAdded " + c.root + "_b"}
+	if strings.Join(changes(signals), ",") != strings.Join(want, ",") {
+		t.Errorf("signals of the adds: %v, want %v", changes(signals), want)
+	}
+	// InterfacesAdded follows the custom signal and carries the properties
+	for n, s := range signals {
+		if s.Name == dbusObjectManagerInterface+"."+signalInterfacesAdded && s.Body[0] == dbus.ObjectPath(c.root+"/D1") {
+			if n == 0 || signals[n-1].Name != dbusDeviceInterface+"."+signalDeviceAdded {
+				t.Errorf("InterfacesAdded of the device before DeviceAdded: %v", names(signals))
+			}
+			if _, present := s.Body[1].(map[string]map[string]dbus.Variant)[dbusDeviceInterface][propertyOptions]; !present {
+				t.Errorf("InterfacesAdded without the properties: %v", s.Body[1])
+			}
+		}
+	}
+
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.RootProtocol.RemoveBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	signals = c.flush()
+	want = []string{"InterfacesRemoved " + c.root + "/D1/I1", "InterfacesRemoved " + c.root + "/D1", "InterfacesRemoved " + c.root + "_b"}
+	if strings.Join(changes(signals), ",") != strings.Join(want, ",") {
+		t.Errorf("signals of the removals: %v, want %v", changes(signals), want)
+	}
+	for _, s := range withMember(signals, signalInterfacesRemoved) {
+		if ifaces := s.Body[1].([]string); len(ifaces) != 1 {
+			t.Errorf("interfaces removed from %v: %v", s.Body[0], ifaces)
+		}
+	}
+}
+
+func TestIntrospectionOfTheHierarchy(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+	introspect := func(path string) string {
+		t.Helper()
+		var data string
+		if err := c.call(path, dbusIntrospectableInterface+".Introspect").Store(&data); err != nil {
+			t.Fatalf("Introspect %s: %v", path, err)
+		}
+		return data
+	}
+
+	for path, want := range map[string][]string{
+		c.root:            {`<interface name="` + dbusProtocolInterface + `">`, `<interface name="` + dbusObjectManagerInterface + `">`, `<method name="GetManagedObjects">`},
+		c.root + "/D1":    {`<interface name="` + dbusDeviceInterface + `">`, `<method name="GetItems">`, `<node name="I1">`},
+		c.root + "/D1/I1": {`<interface name="` + dbusItemInterface + `">`, `<property name="Value" type="ay"`},
+	} {
+		data := introspect(path)
+		for _, element := range want {
+			if !strings.Contains(data, element) {
+				t.Errorf("introspection of %s without %s:\n%s", path, element, data)
+			}
+		}
+	}
+}
+
+func TestManagedObjectsWhileTheTreeChanges(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+
+	// The objects listed while the devices come and go are whole: each device is listed with its interface
+	var wg sync.WaitGroup
+	for n := 0; n < 3; n++ {
+		wg.Add(1)
+		go func(devID string) {
+			defer wg.Done()
+			for m := 0; m < 10; m++ {
+				addTestItem(t, addTestDevice(t, p, devID, "T"), "I1", "T")
+				if err := p.RemoveDevice(devID); err != nil {
+					t.Errorf("RemoveDevice %s: %v", devID, err)
+					return
+				}
+			}
+		}(fmt.Sprintf("D%d", n))
+	}
+	for m := 0; m < 10; m++ {
+		for path, interfaces := range managedObjects(t, c) {
+			if len(interfaces) == 0 {
+				t.Errorf("%s listed without its interfaces", path)
+			}
+		}
+	}
+	wg.Wait()
+	if objects := managedObjects(t, c); len(objects) != 0 {
+		t.Errorf("managed objects once the devices are removed: %v", objects)
+	}
+}
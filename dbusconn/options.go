@@ -0,0 +1,54 @@
+package dbusconn
+
+import (
+	"encoding/json"
+)
+
+const (
+	// MergeReplace mode 'replace' for MergeMode, the new options replace the current ones
+	MergeReplace MergeMode = "REPLACE"
+	// MergeShallow mode 'shallow' for MergeMode, the top level keys of the new options replace the current ones
+	MergeShallow MergeMode = "SHALLOW"
+	// MergeDeep mode 'deep' for MergeMode, the nested objects of the options are merged key by key
+	MergeDeep MergeMode = "DEEP"
+)
+
+// MergeMode tells how UpdateOptions combines the new options with the current ones
+type MergeMode string
+
+// mergeOptions combines the JSON options, the new value is kept when the types differ
+func mergeOptions(current []byte, update []byte, mode MergeMode) ([]byte, error) {
+	if mode != MergeShallow && mode != MergeDeep {
+		return update, nil
+	}
+
+	var currentValue, updateValue interface{}
+	if len(current) == 0 || json.Unmarshal(current, &currentValue) != nil {
+		return update, nil
+	}
+	if err := json.Unmarshal(update, &updateValue); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValues(currentValue, updateValue, mode == MergeDeep))
+}
+
+func mergeValues(current interface{}, update interface{}, deep bool) interface{} {
+	currentObject, currentIsObject := current.(map[string]interface{})
+	updateObject, updateIsObject := update.(map[string]interface{})
+	if !currentIsObject || !updateIsObject {
+		return update
+	}
+
+	merged := make(map[string]interface{}, len(currentObject)+len(updateObject))
+	for key, value := range currentObject {
+		merged[key] = value
+	}
+	for key, value := range updateObject {
+		if oldValue, present := merged[key]; present && deep {
+			merged[key] = mergeValues(oldValue, value, deep)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
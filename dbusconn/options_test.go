@@ -0,0 +1,99 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// optionsDriver records the options the device has when SetDeviceOptions is called
+type optionsDriver struct {
+	recorder
+}
+
+func (r *optionsDriver) SetDeviceOptions(d *Device) {
+	d.Lock()
+	defer d.Unlock()
+	r.record(string(d.Options))
+}
+
+func TestUpdateOptionsModes(t *testing.T) {
+	driver := &optionsDriver{}
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, driver)
+	c := newTestClient(t, dc)
+	const initial = `{"a":1,"nested":{"x":1,"y":2},"kind":{"k":1}}`
+
+	for _, update := range []struct {
+		mode    string
+		options string
+		want    string
+	}{
+		{"REPLACE", `{"b":2}`, `{"b":2}`},
+		{"SHALLOW", `{"b":2,"nested":{"x":3}}`, `{"a":1,"b":2,"kind":{"k":1},"nested":{"x":3}}`},
+		{"DEEP", `{"b":2,"nested":{"x":3}}`, `{"a":1,"b":2,"kind":{"k":1},"nested":{"x":3,"y":2}}`},
+		// On a type conflict the new value wins
+		{"DEEP", `{"a":{"v":1},"kind":"plain"}`, `{"a":{"v":1},"kind":"plain","nested":{"x":1,"y":2}}`},
+	} {
+		devID := "D" + update.mode
+		if _, err := p.AddDevice(devID, "", "T", "1", []byte(initial)); err != nil {
+			t.Fatal(err)
+		}
+		before := len(driver.recorded())
+		if err := c.call(c.root+"/"+devID, dbusDeviceInterface+".UpdateOptions", []byte(update.options), update.mode).Err; err != nil {
+			t.Fatalf("%s %s: %v", update.mode, update.options, err)
+		}
+		value, err := c.property(c.root+"/"+devID, dbusDeviceInterface, propertyOptions)
+		if err != nil || string(value.Value().([]byte)) != update.want {
+			t.Errorf("%s %s: %s %v, want %s", update.mode, update.options, value, err, update.want)
+		}
+		waitFor(t, "SetDeviceOptions", func() bool { return len(driver.recorded()) > before })
+		if calls := driver.recorded(); calls[len(calls)-1] != update.want {
+			t.Errorf("%s %s: SetDeviceOptions called with %s", update.mode, update.options, calls[len(calls)-1])
+		}
+		p.RemoveDevice(devID)
+	}
+}
+
+func TestUpdateOptionsDefaultMode(t *testing.T) {
+	dc := &Dbus{OptionsMerge: MergeShallow}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	d.SetOption([]byte(`{"a":1}`))
+
+	if err := d.UpdateOptions([]byte(`{"b":2}`), ""); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := d.getProperty(d.properties, dbusDeviceInterface, propertyOptions)
+	if string(value.Value().([]byte)) != `{"a":1,"b":2}` {
+		t.Errorf("options merged with the mode of the adapter: %s", value)
+	}
+	if err := d.UpdateOptions([]byte(`{}`), "MIXED"); err == nil || err.Name != "org.freedesktop.DBus.Error.InvalidArgs" {
+		t.Errorf("unknown mode: %v", err)
+	}
+}
+
+func TestConcurrentUpdateOptionsMerge(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+
+	// Each merge adds its own key, none is lost
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if err := d.UpdateOptions([]byte(fmt.Sprintf(`{"k%d":%d}`, n, n)), string(MergeShallow)); err != nil {
+				t.Error(err)
+			}
+		}(n)
+	}
+	wg.Wait()
+	value, _ := d.getProperty(d.properties, dbusDeviceInterface, propertyOptions)
+	var options map[string]int
+	if err := json.Unmarshal(value.Value().([]byte), &options); err != nil || len(options) != 20 {
+		t.Errorf("options once merged concurrently: %s %v", value, err)
+	}
+}
@@ -0,0 +1,162 @@
+package dbusconn
+
+import (
+	"context"
+	"encoding/xml"
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+// FindOrphans returns the paths exported by the adapter which are not part of the tree
+// The paths are found in the export registry and by introspecting the bus from /
+func (dc *Dbus) FindOrphans() ([]string, error) {
+	orphans, err := dc.findOrphans()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(orphans))
+	for path := range orphans {
+		paths = append(paths, string(path))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// CleanOrphans unexports the paths returned by FindOrphans and returns them
+// The objects which are not in the registry and do not answer to introspection are left exported
+func (dc *Dbus) CleanOrphans() ([]string, error) {
+	orphans, err := dc.findOrphans()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(orphans))
+	for path, ifaces := range orphans {
+		dc.exportsLock.Lock()
+		_, registered := dc.exports[path]
+		dc.exportsLock.Unlock()
+		if registered {
+			dc.unexportObject(path)
+		} else if len(ifaces) > 0 {
+			for _, iface := range ifaces {
+				dc.connection().Export(nil, path, iface)
+			}
+		} else {
+			dc.Log.Warning("Unable to unexport the orphan object", path, "its interfaces are unknown")
+			continue
+		}
+		dc.Log.Info("Orphan object", path, "unexported")
+		paths = append(paths, string(path))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// findOrphans returns the orphan paths with the interfaces found on them
+func (dc *Dbus) findOrphans() (map[dbus.ObjectPath][]string, error) {
+	found := make(map[dbus.ObjectPath][]string)
+	if err := dc.walkBus("/", found); err != nil {
+		return nil, err
+	}
+	dc.exportsLock.Lock()
+	for path := range dc.exports {
+		if _, present := found[path]; !present {
+			found[path] = nil
+		}
+	}
+	dc.exportsLock.Unlock()
+
+	expected := dc.treePaths()
+	orphans := make(map[dbus.ObjectPath][]string)
+	for path, ifaces := range found {
+		if !expected[path] && dc.ownsPath(path) {
+			orphans[path] = ifaces
+		}
+	}
+	return orphans, nil
+}
+
+// walkBus introspects the path and its children through the bus and collects the paths with interfaces
+func (dc *Dbus) walkBus(path dbus.ObjectPath, found map[dbus.ObjectPath][]string) error {
+	conn := dc.connection()
+	names := conn.Names()
+	if len(names) == 0 {
+		return dbus.ErrClosed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+
+	var data string
+	obj := conn.Object(names[0], path)
+	if err := obj.CallWithContext(ctx, dbusIntrospectableInterface+".Introspect", 0).Store(&data); err != nil {
+		return err
+	}
+	var node introspect.Node
+	if err := xml.Unmarshal([]byte(data), &node); err != nil {
+		return err
+	}
+
+	var ifaces []string
+	for _, iface := range node.Interfaces {
+		if iface.Name != dbusIntrospectableInterface && iface.Name != "org.freedesktop.DBus.Peer" {
+			ifaces = append(ifaces, iface.Name)
+		}
+	}
+	if len(ifaces) > 0 {
+		found[path] = append(ifaces, dbusIntrospectableInterface)
+	}
+
+	prefix := string(path) + "/"
+	if path == "/" {
+		prefix = "/"
+	}
+	for _, child := range node.Children {
+		childPath := dbus.ObjectPath(prefix + child.Name)
+		if err := dc.walkBus(childPath, found); err != nil {
+			// The object exists but does not export Introspectable, its interfaces are unknown
+			found[childPath] = nil
+		}
+	}
+	return nil
+}
+
+// treePaths returns the paths of the protocols, devices, aliases and items of the tree
+func (dc *Dbus) treePaths() map[dbus.ObjectPath]bool {
+	paths := make(map[dbus.ObjectPath]bool)
+	for _, p := range dc.protocols() {
+		p.Lock()
+		paths[dbus.ObjectPath(p.path)] = true
+		for aliasID := range p.aliases {
+			paths[dbus.ObjectPath(p.path+"/"+aliasID)] = true
+		}
+		for _, d := range p.Devices {
+			d.Lock()
+			paths[dbus.ObjectPath(p.path+"/"+d.DevID)] = true
+			for _, i := range d.Items {
+				paths[dbus.ObjectPath(p.path+"/"+d.DevID+"/"+i.ItemID)] = true
+			}
+			d.Unlock()
+		}
+		p.Unlock()
+	}
+	return paths
+}
+
+// ownsPath checks that the path is in the namespace of the adapter: the root protocol, its default bridge paths and
+// the subtrees of the protocols of the tree
+func (dc *Dbus) ownsPath(path dbus.ObjectPath) bool {
+	root := dbusPathPrefix + dc.ProtocolName
+	p := string(path)
+	if p == root || strings.HasPrefix(p, root+"/") || strings.HasPrefix(p, root+"_") {
+		return true
+	}
+	for _, protocol := range dc.protocols() {
+		if strings.HasPrefix(p, protocol.path+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package dbusconn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+const strayInterface = "com.ubiant.Test.Stray"
+
+// stray is an object left exported on the connection, outside of the registry of the adapter
+type stray struct{}
+
+func (s *stray) Ping() *dbus.Error {
+	return nil
+}
+
+// exportStray exports a stray object on the path, with the introspection data needed to find it
+func exportStray(t *testing.T, dc *Dbus, path dbus.ObjectPath) {
+	t.Helper()
+	node := introspect.Node{Interfaces: []introspect.Interface{
+		introspect.IntrospectData,
+		{Name: strayInterface, Methods: introspect.Methods(&stray{})},
+	}}
+	if err := dc.connection().Export(&stray{}, path, strayInterface); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.connection().Export(introspect.NewIntrospectable(&node), path, dbusIntrospectableInterface); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrphansAreFoundAndCleaned(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+
+	if orphans, err := dc.FindOrphans(); err != nil || len(orphans) != 0 {
+		t.Fatalf("orphans of a clean tree: %v %v", orphans, err)
+	}
+
+	registered := c.root + "/D1/Stale"
+	if err := dc.exportMethods(dbus.ObjectPath(registered), dbusItemInterface, map[string]interface{}{
+		"Ping": func() *dbus.Error { return nil },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The objects of the adapter only introspect the registry, the stray is left by a bridge removed behind its back
+	unregistered := c.root + "_gone/D1"
+	exportStray(t, dc, dbus.ObjectPath(unregistered))
+	// An object outside of the namespace of the adapter is not its orphan
+	foreign := dbus.ObjectPath("/com/ubiant/Test/Foreign")
+	exportStray(t, dc, foreign)
+	defer func() {
+		dc.connection().Export(nil, foreign, strayInterface)
+		dc.connection().Export(nil, foreign, dbusIntrospectableInterface)
+	}()
+
+	want := []string{registered, unregistered}
+	if orphans, err := dc.FindOrphans(); err != nil || !reflect.DeepEqual(orphans, want) {
+		t.Fatalf("FindOrphans: %v %v, want %v", orphans, err, want)
+	}
+	if cleaned, err := dc.CleanOrphans(); err != nil || !reflect.DeepEqual(cleaned, want) {
+		t.Fatalf("CleanOrphans: %v %v, want %v", cleaned, err, want)
+	}
+	if !c.unreachable(registered, dbusItemInterface+".Ping") || !c.unreachable(unregistered, strayInterface+".Ping") {
+		t.Error("orphan still exported once cleaned")
+	}
+	if err := c.call(c.root+"/D1/I1", dbusItemInterface+".GetInfo").Err; err != nil {
+		t.Error("item of the tree unexported by the cleaning:", err)
+	}
+	if orphans, err := dc.FindOrphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("orphans once cleaned: %v %v", orphans, err)
+	}
+}
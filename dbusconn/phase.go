@@ -0,0 +1,62 @@
+package dbusconn
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	propertyPhase      = "Phase"
+	signalPhaseChanged = "PhaseChanged"
+)
+
+// phaseIndex returns the position of the phase in ReadinessPhases, -1 for the empty initial phase
+func (dc *Dbus) phaseIndex(phase string) (int, bool) {
+	if phase == "" {
+		return -1, true
+	}
+	for n, name := range dc.ReadinessPhases {
+		if name == phase {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// SetPhase set the readiness phase of the protocol and emits the signal PhaseChanged
+// A phase can only be reached from the phase before it in ReadinessPhases, or from any later phase to go back.
+// The protocol is ready only in the last phase.
+func (p *Protocol) SetPhase(phase string) *dbus.Error {
+	index, known := p.dc.phaseIndex(phase)
+	if !known {
+		return validateArgs(func() string { return "phase " + phase + " is not one of the readiness phases" })
+	}
+
+	p.Lock()
+	oldPhase := p.phase
+	current, _ := p.dc.phaseIndex(oldPhase)
+	if index > current+1 {
+		p.Unlock()
+		return validateArgs(func() string {
+			return fmt.Sprintf("phase %s depends on %s, the protocol is in the phase %q", phase, p.dc.ReadinessPhases[index-1], oldPhase)
+		})
+	}
+	if phase == oldPhase {
+		p.Unlock()
+		return nil
+	}
+	p.phase = phase
+	wasReady := p.ready
+	p.ready = index == len(p.dc.ReadinessPhases)-1
+	ready := p.ready
+	p.Unlock()
+
+	p.log.Info("Phase of the protocol", p.protocolName, "changed from", oldPhase, "to", phase)
+	if p.properties != nil {
+		p.dc.setPropertyValue(p.properties, dbusProtocolInterface, propertyPhase, phase)
+	}
+	p.EmitDbusSignal(signalPhaseChanged, oldPhase, phase)
+	p.readyChanged(wasReady, ready)
+	return nil
+}
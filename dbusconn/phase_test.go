@@ -0,0 +1,101 @@
+package dbusconn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// withMember returns the signals of the member
+func withMember(signals []*dbus.Signal, member string) []*dbus.Signal {
+	var list []*dbus.Signal
+	for _, s := range signals {
+		if strings.HasSuffix(s.Name, "."+member) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func TestReadinessPhases(t *testing.T) {
+	dc := &Dbus{ReadinessPhases: []string{"Connected", "Enumerated", "Ready"}}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	expect := func(step string, phase string, ready bool) {
+		t.Helper()
+		if value, err := c.property(c.root, dbusProtocolInterface, propertyPhase); err != nil || value.Value() != phase {
+			t.Errorf("phase %s: %v %v, want %s", step, value, err, phase)
+		}
+		var isReady bool
+		if err := c.call(c.root, dbusProtocolInterface+".IsReady").Store(&isReady); err != nil || isReady != ready {
+			t.Errorf("IsReady %s: %v %v", step, isReady, err)
+		}
+	}
+	expect("at the start", "", false)
+
+	for _, phase := range []string{"Enumerated", "Ready", "Booting"} {
+		if err := p.SetPhase(phase); err == nil || err.Name != "org.freedesktop.DBus.Error.InvalidArgs" {
+			t.Errorf("SetPhase %s from the start: %v", phase, err)
+		}
+	}
+	expect("once the phases are rejected", "", false)
+	c.flush()
+
+	for n, phase := range dc.ReadinessPhases {
+		if err := p.SetPhase(phase); err != nil {
+			t.Fatalf("SetPhase %s: %v", phase, err)
+		}
+		expect("after "+phase, phase, n == len(dc.ReadinessPhases)-1)
+	}
+	if err := p.SetPhase("Ready"); err != nil {
+		t.Error("SetPhase of the current phase:", err)
+	}
+	var changes [][]interface{}
+	for _, s := range withMember(c.flush(), signalPhaseChanged) {
+		changes = append(changes, s.Body)
+	}
+	want := [][]interface{}{{"", "Connected"}, {"Connected", "Enumerated"}, {"Enumerated", "Ready"}}
+	if len(changes) != len(want) {
+		t.Fatalf("PhaseChanged: %v, want %v", changes, want)
+	}
+	for n := range want {
+		if changes[n][0] != want[n][0] || changes[n][1] != want[n][1] {
+			t.Errorf("PhaseChanged %d: %v, want %v", n, changes[n], want[n])
+		}
+	}
+
+	// Going back to an earlier phase is allowed and ends the readiness
+	if err := p.SetPhase("Connected"); err != nil {
+		t.Fatal(err)
+	}
+	expect("back to Connected", "Connected", false)
+	if err := p.SetPhase("Ready"); err == nil {
+		t.Error("SetPhase Ready without Enumerated")
+	}
+}
+
+func TestPhasesOfABridge(t *testing.T) {
+	dc := &Dbus{ReadinessPhases: []string{"Connected", "Ready"}}
+	newTestAdapter(t, dc, nil)
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	c := newTestClient(t, dc)
+	c.flush()
+
+	for _, phase := range dc.ReadinessPhases {
+		if err := bridge.Protocol.SetPhase(phase); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signals := withMember(onPath(c.flush(), c.root), signalAnyBridgeReadyChanged)
+	if len(signals) != 1 || signals[0].Body[0] != "b" || signals[0].Body[1] != true {
+		t.Errorf("AnyBridgeReadyChanged: %v", names(signals))
+	}
+	var ready bool
+	if err := c.call(c.root, dbusProtocolInterface+".IsReady").Store(&ready); err != nil || ready {
+		t.Errorf("root protocol made ready by its bridge: %v %v", ready, err)
+	}
+}
@@ -1,7 +1,10 @@
 package dbusconn
 
 import (
+	"context"
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
@@ -11,9 +14,18 @@ import (
 const (
 	propertyLogLevel          = "LogLevel"
 	propertyReachabilityState = "ReachabilityState"
+	propertyBridgeState       = "BridgeState"
+	propertyEndpoint          = "Endpoint"
 
-	signalBridgeAdded   = "BridgeAdded"
-	signalBridgeRemoved = "BridgeRemoved"
+	signalBridgeAdded        = "BridgeAdded"
+	signalBridgeRemoved      = "BridgeRemoved"
+	signalLimitExceeded      = "LimitExceeded"
+	signalBridgeStateChanged = "BridgeStateChanged"
+
+	signalAnyBridgeReadyChanged = "AnyBridgeReadyChanged"
+	signalReachabilityChanged   = "ReachabilityChanged"
+
+	logLevelHistorySize = 20
 
 	// ReachabilityOk state 'ok' for ReachabilityState
 	ReachabilityOk ReachabilityState = "OK"
@@ -21,26 +33,87 @@ const (
 	ReachabilityKo ReachabilityState = "KO"
 	// ReachabilityUnknown state 'unknown' for ReachabilityState
 	ReachabilityUnknown ReachabilityState = "UNKNOWN"
+
+	// BridgeConnecting state 'connecting' for BridgeState
+	BridgeConnecting BridgeState = "CONNECTING"
+	// BridgeConnected state 'connected' for BridgeState
+	BridgeConnected BridgeState = "CONNECTED"
+	// BridgeError state 'error' for BridgeState
+	BridgeError BridgeState = "ERROR"
+	// BridgeUnknown state 'unknown' for BridgeState
+	BridgeUnknown BridgeState = "UNKNOWN"
+)
+
+var (
+	// ErrBridgeLimit is returned when adding a bridge while the maximum number of bridges is reached
+	ErrBridgeLimit = dbus.NewError(dbusProtocolInterface+".Error.BridgeLimit", []interface{}{"The maximum number of bridges is reached"})
+	// ErrBridgeNotEmpty is returned when removing a bridge whose devices could not all be removed, the bridge is kept
+	ErrBridgeNotEmpty = dbus.NewError(dbusProtocolInterface+".Error.BridgeNotEmpty", []interface{}{"Some devices of the bridge were not removed"})
+	// ErrBridgeRemoved is returned when adding a device to a bridge removed meanwhile
+	ErrBridgeRemoved = dbus.NewError(dbusProtocolInterface+".Error.BridgeRemoved", []interface{}{"The bridge is removed"})
+	// ErrUnknownDevice is returned when the device is not in the protocol
+	ErrUnknownDevice = dbus.NewError(dbusProtocolInterface+".Error.UnknownDevice", []interface{}{"The device is unknown"})
+	// ErrIDTaken is returned when the ID is already used by another device or alias
+	ErrIDTaken = dbus.NewError(dbusProtocolInterface+".Error.IDTaken", []interface{}{"The ID is already used"})
+	// ErrUnsupportedType is returned when adding a device whose type is not in the catalog of the supported types
+	ErrUnsupportedType = dbus.NewError(dbusProtocolInterface+".Error.UnsupportedType", []interface{}{"The type is not supported"})
+	// ErrTypeQuotaExceeded is returned when adding a device whose type already has as many devices as its quota
+	ErrTypeQuotaExceeded = dbus.NewError(dbusProtocolInterface+".Error.TypeQuotaExceeded", []interface{}{"The quota of the type is reached"})
 )
 
 // ReachabilityState informs if the device is reachable
 type ReachabilityState string
 
+// BridgeState informs about the connection of the bridge
+type BridgeState string
+
 // Protocol is a dbus object which represents the states of a protocol
 type Protocol struct {
 	BridgeID     string
 	Devices      map[string]*Device
 	Reachability ReachabilityState
 
-	ready          bool
-	log            *logging.Logger
-	properties     *prop.Properties
-	dc             *Dbus
-	protocolName   string
-	addDeviceCB    interface{ AddDevice(*Device) }
+	ready bool
+	phase string
+	// removed tells that the bridge of the protocol is removed, no device is added to it any more
+	removed      bool
+	comIDs       map[string]string
+	tombstones   map[string]time.Time
+	aliases      map[string]string
+	log          *logging.Logger
+	properties   *prop.Properties
+	dc           *Dbus
+	protocolName string
+	path         string
+	addDeviceCB  interface{ AddDevice(*Device) }
+	// addDeviceSyncCB is used instead of addDeviceCB when implemented, AddDevice waits for its result
+	// A new device is exported once accepted, its items and properties are set after the callback returns.
+	addDeviceSyncCB interface {
+		AddDeviceSync(context.Context, *Device) error
+	}
+	// removeDeviceSyncCB is used instead of removeDeviceCB when implemented, RemoveDevice waits for its result
+	removeDeviceSyncCB interface {
+		RemoveDeviceSync(context.Context, *Device) error
+	}
+	// addDeviceContextCB is used instead of addDeviceCB when implemented, its context is canceled by CancelAdd
+	addDeviceContextCB interface {
+		AddDeviceContext(context.Context, *Device)
+	}
 	removeDeviceCB interface{ RemoveDevice(string) }
-	cbs            interface{}
-	isBridged      bool
+	// removeProtocolDeviceCB is used instead of removeDeviceCB when implemented, it tells the protocol of the device
+	removeProtocolDeviceCB interface {
+		RemoveProtocolDevice(*Protocol, string)
+	}
+	cbs       interface{}
+	isBridged bool
+
+	externalMethods map[string]interface{}
+
+	removals       map[string]*time.Timer
+	virtualSources map[string][]*virtualItem
+	virtualLock    sync.Mutex
+	pendingAdds    map[string]*time.Timer
+	churnLock      sync.Mutex
 	sync.Mutex
 }
 
@@ -51,16 +124,21 @@ type RootProto struct {
 	log            *logging.Logger
 	addBridgeCB    interface{ AddBridge(*Protocol) }
 	removeBridgeCB interface{ RemoveBridge(string) }
+
+	logLevelHistory []string
+	commands        map[string]func([]byte) ([]byte, error)
 }
 
 // Protocol is a dbus object which represents the states of a bridge protocol
 type BridgeProto struct {
 	Protocol *Protocol
+	State    BridgeState
+	Endpoint string
 	dc       *Dbus
 }
 
 func (dc *Dbus) initRootProtocol(cbs interface{}) *Protocol {
-	if dc.conn == nil {
+	if dc.connection() == nil {
 		dc.Log.Warning("Unable to export Protocol dbus object because dbus connection nil")
 		return nil
 	}
@@ -71,8 +149,12 @@ func (dc *Dbus) initRootProtocol(cbs interface{}) *Protocol {
 	dc.RootProtocol.Protocol = &Protocol{ready: false,
 		dc:           dc,
 		Devices:      make(map[string]*Device),
+		comIDs:       make(map[string]string),
+		tombstones:   make(map[string]time.Time),
+		aliases:      make(map[string]string),
 		log:          dc.Log,
 		protocolName: dc.ProtocolName,
+		path:         dbusPathPrefix + dc.ProtocolName,
 		Reachability: ReachabilityUnknown,
 		cbs:          cbs,
 		isBridged:    false,
@@ -86,6 +168,11 @@ func (dc *Dbus) initRootProtocol(cbs interface{}) *Protocol {
 		return nil
 	}
 
+	if err := dc.exportManager(dbus.ObjectPath(dc.RootProtocol.Protocol.path)); err != nil {
+		dc.Log.Error("Fail to export the object manager of the protocol", dc.ProtocolName, err)
+		return nil
+	}
+
 	dc.RootProtocol.SetRootProtocolCBs(cbs)
 	dc.RootProtocol.Protocol.SetProtocolCBs(cbs)
 	return dc.RootProtocol.Protocol
@@ -104,19 +191,49 @@ func (r *RootProto) setLogLevel(c *prop.Change) *dbus.Error {
 	return nil
 }
 
+// recordLogLevel keeps the change of the log level made by the sender in the history
+func (r *RootProto) recordLogLevel(sender string, value interface{}) {
+	r.Protocol.Lock()
+	defer r.Protocol.Unlock()
+	r.logLevelHistory = append(r.logLevelHistory, time.Now().Format(time.RFC3339)+" "+sender+" "+value.(string))
+	if len(r.logLevelHistory) > logLevelHistorySize {
+		r.logLevelHistory = r.logLevelHistory[len(r.logLevelHistory)-logLevelHistorySize:]
+	}
+}
+
 // AddBridge is the dbus method to add a new bridge
 func (r *RootProto) AddBridge(bridgeID string) (bool, *dbus.Error) {
+	r.dc.enterMutation()
+	defer r.dc.exitMutation()
+	return r.addBridge(bridgeID)
+}
+
+// addBridge adds the bridge, a diff calls it while it holds the mutations back
+func (r *RootProto) addBridge(bridgeID string) (bool, *dbus.Error) {
 	r.log.Info("AddBridge called - bridgeID:", bridgeID)
+	if err := validateArgs(requireID("bridgeID", bridgeID)); err != nil {
+		return false, err
+	}
 
 	protoName := r.dc.ProtocolName + "_" + bridgeID
 	r.Protocol.Lock()
 	_, alreadyAdded := r.dc.Bridges[bridgeID]
+	if !alreadyAdded && r.dc.MaxBridges > 0 && len(r.dc.Bridges) >= r.dc.MaxBridges {
+		r.Protocol.Unlock()
+		r.log.Warning("Unable to add the bridge", bridgeID, "the maximum number of bridges is reached:", r.dc.MaxBridges)
+		r.Protocol.emitLimitExceeded(LimitExceededPayload{BridgeID: bridgeID, MaxBridges: int32(r.dc.MaxBridges)})
+		return false, ErrBridgeLimit
+	}
 	if !alreadyAdded {
 		var p = &Protocol{ready: false,
 			dc:           r.dc,
 			Devices:      make(map[string]*Device),
+			comIDs:       make(map[string]string),
+			tombstones:   make(map[string]time.Time),
+			aliases:      make(map[string]string),
 			log:          r.log,
 			protocolName: protoName,
+			path:         r.dc.bridgePath(bridgeID),
 			Reachability: ReachabilityUnknown,
 			cbs:          r.Protocol.cbs,
 			isBridged:    true,
@@ -127,27 +244,438 @@ func (r *RootProto) AddBridge(bridgeID string) (bool, *dbus.Error) {
 		p.SetDbusMethods(nil)
 		p.SetProtocolCBs(p.cbs)
 
-		var bridge = &BridgeProto{Protocol: p, dc: r.dc}
+		var bridge = &BridgeProto{Protocol: p, State: BridgeUnknown, dc: r.dc}
 		r.dc.Bridges[bridgeID] = bridge
+		r.dc.addMetric(metricBridges, 1)
 		if !isNil(r.addBridgeCB) {
-			go r.addBridgeCB.AddBridge(p)
+			r.dc.dispatch(p.path, PriorityLow, func() { r.addBridgeCB.AddBridge(p) })
 		}
-		p.EmitDbusSignal(signalBridgeAdded)
+		p.emitLifecycleSignal(signalBridgeAdded, r.dc.lifecycle())
+		r.dc.emitInterfacesAdded(dbus.ObjectPath(p.path))
 	}
 	r.Protocol.Unlock()
 	return alreadyAdded, nil
 }
 
+// bridgePath returns the object path of the bridge using BridgePath when it gives a valid path
+func (dc *Dbus) bridgePath(bridgeID string) string {
+	path := dbusPathPrefix + dc.ProtocolName + "_" + bridgeID
+	if dc.BridgePath == nil {
+		return path
+	}
+	customPath := dc.BridgePath(bridgeID)
+	if !customPath.IsValid() {
+		dc.Log.Warning("Invalid path", customPath, "for the bridge", bridgeID, "using", path)
+		return path
+	}
+	return string(customPath)
+}
+
+// GetBridgesDetailed is the dbus method to get the state of every bridge by bridge ID
+func (r *RootProto) GetBridgesDetailed() (map[string]map[string]dbus.Variant, *dbus.Error) {
+	r.Protocol.Lock()
+	bridges := make([]*BridgeProto, 0, len(r.dc.Bridges))
+	for _, bridge := range r.dc.Bridges {
+		bridges = append(bridges, bridge)
+	}
+	r.Protocol.Unlock()
+
+	details := make(map[string]map[string]dbus.Variant, len(bridges))
+	for _, bridge := range bridges {
+		details[bridge.Protocol.BridgeID] = bridge.details()
+	}
+	return details, nil
+}
+
+// Errors is the dbus method to get, by object path, the last error of every device having one and the state of every
+// bridge in error
+func (r *RootProto) Errors() (map[string]string, *dbus.Error) {
+	r.Protocol.Lock()
+	bridges := make([]*BridgeProto, 0, len(r.dc.Bridges))
+	for _, bridge := range r.dc.Bridges {
+		bridges = append(bridges, bridge)
+	}
+	r.Protocol.Unlock()
+
+	failures := make(map[string]string)
+	for _, bridge := range bridges {
+		p := bridge.Protocol
+		p.Lock()
+		if bridge.State == BridgeError {
+			failures[p.path] = string(bridge.State)
+		}
+		p.Unlock()
+	}
+	for _, p := range r.dc.protocols() {
+		p.Lock()
+		for devID, d := range p.Devices {
+			d.Lock()
+			if d.LastError != "" {
+				failures[p.path+"/"+devID] = d.LastError
+			}
+			d.Unlock()
+		}
+		p.Unlock()
+	}
+	return failures, nil
+}
+
+func (b *BridgeProto) details() map[string]dbus.Variant {
+	p := b.Protocol
+	p.Lock()
+	defer p.Unlock()
+	return map[string]dbus.Variant{
+		"Ready":             dbus.MakeVariant(p.ready),
+		"Devices":           dbus.MakeVariant(int32(len(p.Devices))),
+		propertyBridgeState: dbus.MakeVariant(string(b.State)),
+		propertyEndpoint:    dbus.MakeVariant(b.Endpoint),
+	}
+}
+
+// SetState set the value of the property BridgeState and emits the signal BridgeStateChanged
+func (b *BridgeProto) SetState(state BridgeState) {
+	p := b.Protocol
+	p.Lock()
+	oldState := b.State
+	b.State = state
+	p.Unlock()
+	if oldState == state || p.properties == nil {
+		return
+	}
+
+	p.log.Info("BridgeState of the bridge", p.BridgeID, "changed from", oldState, "to", state)
+	p.dc.setPropertyValue(p.properties, dbusProtocolInterface, propertyBridgeState, state)
+	p.emitBridgeStateChanged(BridgeStateChangedPayload{OldState: string(oldState), State: string(state)})
+}
+
+// SetEndpoint set the value of the property Endpoint, the link to the bridge such as a serial port or a TCP address
+func (b *BridgeProto) SetEndpoint(endpoint string) {
+	p := b.Protocol
+	p.Lock()
+	oldEndpoint := b.Endpoint
+	b.Endpoint = endpoint
+	p.Unlock()
+	if oldEndpoint == endpoint || p.properties == nil {
+		return
+	}
+
+	p.log.Info("Endpoint of the bridge", p.BridgeID, "changed from", oldEndpoint, "to", endpoint)
+	p.dc.setPropertyValue(p.properties, dbusProtocolInterface, propertyEndpoint, endpoint)
+}
+
+// GetLogLevelHistory is the dbus method to get the last changes of the log level
+// Each entry gives the time of the change, the bus name of the client which made it and the level.
+func (r *RootProto) GetLogLevelHistory() ([]string, *dbus.Error) {
+	r.Protocol.Lock()
+	history := make([]string, len(r.logLevelHistory))
+	copy(history, r.logLevelHistory)
+	r.Protocol.Unlock()
+	return history, nil
+}
+
 // AddDevice is the dbus method to add a new device
 func (p *Protocol) AddDevice(devID string, comID string, typeID string, typeVersion string, options []byte) (bool, *dbus.Error) {
+	p.dc.enterMutation()
+	defer p.dc.exitMutation()
+	return p.addDevice(devID, comID, typeID, typeVersion, options)
+}
+
+// addDevice adds the device, a diff calls it while it holds the mutations back
+func (p *Protocol) addDevice(devID string, comID string, typeID string, typeVersion string, options []byte) (bool, *dbus.Error) {
 	p.log.Info("AddDevice called - devID:", devID, "comID:", comID, "typeID:", typeID, "typeVersion:", options, "typeVersion:", options)
+	if err := validateArgs(requireID("devID", devID), maxLength("comID", comID), maxLength("typeID", typeID),
+		maxLength("typeVersion", typeVersion), validOptions("options", options)); err != nil {
+		return false, err
+	}
+	if err := p.checkDevice(DeviceSpec{p.BridgeID, devID, comID, typeID, typeVersion, options}); err != nil {
+		return false, err
+	}
+	p.Lock()
+	if _, alreadyAdded := p.Devices[devID]; alreadyAdded {
+		p.Unlock()
+		return true, nil
+	}
+	if err := p.checkIDs(devID, comID); err != nil {
+		p.Unlock()
+		return false, err
+	}
+	if err := p.admitDevice(devID, typeID); err != nil {
+		p.Unlock()
+		return false, err
+	}
+	if isNil(p.addDeviceSyncCB) {
+		initDevice(devID, comID, typeID, typeVersion, options, false, true, p)
+		p.Unlock()
+		return false, nil
+	}
+	d := newDevice(devID, comID, typeID, typeVersion, options, false, p)
+	d.accepting = true
+	p.Unlock()
+	if err := p.addDeviceSync(d); err != nil {
+		return false, err
+	}
+	p.acceptDevice(d)
+	return false, nil
+}
+
+// admitDevice tells if a device of the type can be added to the protocol, p must be locked
+// The device is rejected once the bridge is removed and when the quota of its type is reached.
+func (p *Protocol) admitDevice(devID string, typeID string) *dbus.Error {
+	if p.removed {
+		p.log.Warning("Device", devID, "rejected, the bridge", p.BridgeID, "is removed")
+		return ErrBridgeRemoved
+	}
+	return p.admitType(devID, typeID)
+}
+
+// checkIDs tells if the ID or the comID of the device are already used by another device or alias, p must be locked
+// A comID is unique in the protocol, FindByComID could not tell which device has it otherwise.
+func (p *Protocol) checkIDs(devID string, comID string) *dbus.Error {
+	if _, taken := p.aliases[devID]; taken {
+		p.log.Warning("Device", devID, "rejected, the ID is an alias")
+		return ErrIDTaken
+	}
+	if owner, taken := p.comIDs[comID]; comID != "" && taken && owner != devID {
+		p.log.Warning("Device", devID, "rejected, the comID", comID, "is used by the device", owner)
+		return ErrIDTaken
+	}
+	return nil
+}
+
+// checkDevice runs the checks of a new device before adding it: the ValidateDevice hook and the catalog of the
+// supported types. It is called without holding the lock of the protocol, the hook may call the adapter.
+func (p *Protocol) checkDevice(spec DeviceSpec) *dbus.Error {
+	if err := p.validateDevice(spec); err != nil {
+		p.log.Warning("Device", spec.DevID, "rejected by the ValidateDevice hook:", err)
+		return err
+	}
+	if !p.dc.isSupportedType(spec.TypeID) {
+		p.log.Warning("Device", spec.DevID, "rejected, the type", spec.TypeID, "is not supported")
+		return ErrUnsupportedType
+	}
+	return nil
+}
+
+// validateDevice runs the ValidateDevice hook on the device about to be added
+// The error of the hook is returned as is if it is a *dbus.Error, as a DeviceRejected error otherwise
+func (p *Protocol) validateDevice(spec DeviceSpec) *dbus.Error {
+	if p.dc.ValidateDevice == nil {
+		return nil
+	}
+	err := p.dc.ValidateDevice(spec)
+	if err == nil {
+		return nil
+	}
+	return asDbusError(err, dbusProtocolInterface+".Error.DeviceRejected")
+}
+
+// CloneDevice is the dbus method to add a device with the type, the options and the items of another one
+// The values of the items are not copied, neither is the comID which identifies the physical device, it is given
+// later with SetComID
+func (p *Protocol) CloneDevice(srcID string, newID string) (bool, *dbus.Error) {
+	p.dc.enterMutation()
+	defer p.dc.exitMutation()
+	p.log.Info("CloneDevice called - srcID:", srcID, "newID:", newID)
+	if err := validateArgs(requireID("srcID", srcID), requireID("newID", newID)); err != nil {
+		return false, err
+	}
+	p.Lock()
+	src, present := p.Devices[srcID]
+	if !present {
+		p.Unlock()
+		return false, ErrUnknownDevice
+	}
+	if _, alreadyAdded := p.Devices[newID]; alreadyAdded {
+		p.Unlock()
+		return true, nil
+	}
+
+	src.Lock()
+	typeID, typeVersion, options := src.TypeID, src.TypeVersion, append([]byte{}, src.Options...)
+	items := make([]ItemSpec, 0, len(src.Items))
+	for _, i := range src.sortedItems() {
+		items = append(items, ItemSpec{ItemID: i.ItemID, TypeID: i.TypeID, TypeVersion: i.TypeVersion, Options: append([]byte{}, i.Options...)})
+	}
+	src.Unlock()
+	p.Unlock()
+
+	if err := p.checkDevice(DeviceSpec{p.BridgeID, newID, "", typeID, typeVersion, options}); err != nil {
+		return false, err
+	}
+	p.Lock()
+	if _, alreadyAdded := p.Devices[newID]; alreadyAdded {
+		p.Unlock()
+		return true, nil
+	}
+	if err := p.checkIDs(newID, ""); err != nil {
+		p.Unlock()
+		return false, err
+	}
+	if err := p.admitDevice(newID, typeID); err != nil {
+		p.Unlock()
+		return false, err
+	}
+	var d *Device
+	if isNil(p.addDeviceSyncCB) {
+		d = initDevice(newID, "", typeID, typeVersion, options, false, true, p)
+		p.Unlock()
+	} else {
+		d = newDevice(newID, "", typeID, typeVersion, options, false, p)
+		d.accepting = true
+		p.Unlock()
+		if err := p.addDeviceSync(d); err != nil {
+			return false, err
+		}
+		p.acceptDevice(d)
+	}
+
+	// The items of the source are valid, only the protocol can reject them and the clone is then removed
+	if rejected, _ := d.AddItems(items); len(rejected) > 0 {
+		p.log.Warning("Clone", newID, "removed, its item", rejected[0].ItemID, "was rejected:", rejected[0].Reason)
+		p.RemoveDevice(newID)
+		return false, dbus.NewError(dbusDeviceInterface+".Error.CallbackFailed", []interface{}{"item " + rejected[0].ItemID + " rejected: " + rejected[0].Reason})
+	}
+	return false, nil
+}
+
+// AddAlias is the dbus method to export a device under an additional ID
+func (p *Protocol) AddAlias(devID string, aliasID string) *dbus.Error {
+	p.dc.enterMutation()
+	defer p.dc.exitMutation()
+	return p.addAlias(devID, aliasID)
+}
+
+// addAlias exports the device under the alias, a diff calls it while it holds the mutations back
+func (p *Protocol) addAlias(devID string, aliasID string) *dbus.Error {
+	p.log.Info("AddAlias called - devID:", devID, "aliasID:", aliasID)
+	if err := validateArgs(requireID("devID", devID), requireID("aliasID", aliasID)); err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	d, present := p.Devices[devID]
+	if !present {
+		return ErrUnknownDevice
+	}
+	if _, taken := p.Devices[aliasID]; taken {
+		return ErrIDTaken
+	}
+	if _, taken := p.aliases[aliasID]; taken {
+		return ErrIDTaken
+	}
+
+	path := dbus.ObjectPath(p.path + "/" + devID)
+	aliasPath := dbus.ObjectPath(p.path + "/" + aliasID)
+	if err := p.dc.exportAlias(path, aliasPath); err != nil {
+		p.log.Warning("Fail to export the alias", aliasID, "of the device", devID, err)
+		return dbus.MakeFailedError(err)
+	}
+	p.aliases[aliasID] = devID
+	d.Lock()
+	d.aliases = append(d.aliases, aliasID)
+	d.Unlock()
+	return nil
+}
+
+// AddPlaceholderDevice is the dbus method to add a device known only by its ID, completed later with Complete
+func (p *Protocol) AddPlaceholderDevice(devID string) (bool, *dbus.Error) {
+	p.dc.enterMutation()
+	defer p.dc.exitMutation()
+	p.log.Info("AddPlaceholderDevice called - devID:", devID)
+	if err := validateArgs(requireID("devID", devID)); err != nil {
+		return false, err
+	}
 	p.Lock()
 	_, alreadyAdded := p.Devices[devID]
-	if !alreadyAdded {
-		initDevice(devID, comID, typeID, typeVersion, options, p)
+	if alreadyAdded {
+		p.Unlock()
+		return true, nil
 	}
+	if err := p.admitDevice(devID, ""); err != nil {
+		p.Unlock()
+		return false, err
+	}
+	initDevice(devID, "", "", "", []byte{}, true, false, p)
 	p.Unlock()
-	return alreadyAdded, nil
+	return false, nil
+}
+
+// CancelAdd is the dbus method to cancel the add of a device whose AddDevice callback is still running
+// The context given to the callback is canceled and the device is removed
+func (p *Protocol) CancelAdd(devID string) *dbus.Error {
+	p.dc.enterMutation()
+	defer p.dc.exitMutation()
+	p.log.Info("CancelAdd called - devID:", devID)
+	if err := validateArgs(requireID("devID", devID)); err != nil {
+		return err
+	}
+	p.Lock()
+	d, present := p.Devices[devID]
+	p.Unlock()
+	if !present {
+		return ErrUnknownDevice
+	}
+
+	d.Lock()
+	adding := d.adding
+	cancel := d.cancelAdd
+	d.Unlock()
+	if !adding {
+		return ErrNotAdding
+	}
+
+	cancel()
+	return p.RemoveDevice(devID)
+}
+
+// FindByComID is the dbus method to get the ID of the device using a comID
+func (p *Protocol) FindByComID(comID string) (string, bool, *dbus.Error) {
+	if err := validateArgs(maxLength("comID", comID)); err != nil {
+		return "", false, err
+	}
+	p.Lock()
+	devID, found := p.comIDs[comID]
+	p.Unlock()
+	return devID, found, nil
+}
+
+// GetAllItemValues is the dbus method to get the values of all the items of the protocol by device ID and item ID
+func (p *Protocol) GetAllItemValues() (map[string]map[string][]byte, *dbus.Error) {
+	values := make(map[string]map[string][]byte)
+	p.Lock()
+	for devID, d := range p.Devices {
+		d.Lock()
+		itemValues := make(map[string][]byte, len(d.Items))
+		for itemID, i := range d.Items {
+			itemValues[itemID] = i.currentValue()
+		}
+		d.Unlock()
+		values[devID] = itemValues
+	}
+	p.Unlock()
+	return values, nil
+}
+
+// GetTombstones is the dbus method to get the devices removed during the retention window
+// with their removal time in milliseconds since epoch
+func (p *Protocol) GetTombstones() (map[string]int64, *dbus.Error) {
+	p.Lock()
+	p.pruneTombstones()
+	tombstones := make(map[string]int64, len(p.tombstones))
+	for devID, removal := range p.tombstones {
+		tombstones[devID] = removal.UnixNano() / int64(time.Millisecond)
+	}
+	p.Unlock()
+	return tombstones, nil
+}
+
+// pruneTombstones removes the tombstones older than the retention window, p must be locked
+func (p *Protocol) pruneTombstones() {
+	for devID, removal := range p.tombstones {
+		if time.Since(removal) > p.dc.TombstoneRetention {
+			delete(p.tombstones, devID)
+		}
+	}
 }
 
 // IsReady dbus method to know if the protocol is ready or not
@@ -159,37 +687,88 @@ func (p *Protocol) IsReady() (bool, *dbus.Error) {
 }
 
 // RemoveBridge is the dbus method to remove a bridge
+// Its devices are removed first, the bridge is kept and ErrBridgeNotEmpty is returned if one of them cannot be
+// removed, the devices already removed stay removed. A device added meanwhile keeps the bridge as well, the adds
+// made once the bridge is removed are rejected with ErrBridgeRemoved.
 func (r *RootProto) RemoveBridge(bridgeID string) *dbus.Error {
+	r.dc.enterMutation()
+	defer r.dc.exitMutation()
+	return r.removeBridge(bridgeID)
+}
+
+// removeBridge removes the bridge and its devices, a diff calls it while it holds the mutations back
+func (r *RootProto) removeBridge(bridgeID string) *dbus.Error {
 	r.log.Info("RemoveBridge called - bridgeID:", bridgeID)
+	if err := validateArgs(optionalID("bridgeID", bridgeID)); err != nil {
+		return err
+	}
 	r.Protocol.Lock()
 	bridge, bridgePresent := r.dc.Bridges[bridgeID]
-
+	r.Protocol.Unlock()
 	if !bridgePresent {
-		r.Protocol.Unlock()
 		return nil
 	}
 
-	for device := range bridge.Protocol.Devices {
-		bridge.Protocol.RemoveDevice(device)
+	// The removals may wait for the protocol, they run without holding the root protocol
+	bridge.Protocol.Lock()
+	devices := bridge.Protocol.sortedDevices()
+	bridge.Protocol.Unlock()
+	kept := 0
+	for _, d := range devices {
+		if err := bridge.Protocol.removeDeviceByID(d.DevID); err != nil {
+			r.log.Warning("Device", d.DevID, "of the bridge", bridgeID, "not removed:", err.Error())
+			kept++
+		}
+	}
+	if kept > 0 {
+		return ErrBridgeNotEmpty
+	}
+
+	r.Protocol.Lock()
+	if r.dc.Bridges[bridgeID] != bridge {
+		r.Protocol.Unlock()
+		return nil
 	}
 	bridge.Protocol.Lock()
+	if len(bridge.Protocol.Devices) > 0 {
+		bridge.Protocol.Unlock()
+		r.Protocol.Unlock()
+		return ErrBridgeNotEmpty
+	}
+	bridge.Protocol.removed = true
 	if !isNil(r.removeBridgeCB) {
-		go r.removeBridgeCB.RemoveBridge(bridgeID)
+		r.dc.dispatch(bridge.Protocol.path, PriorityHigh, func() { r.removeBridgeCB.RemoveBridge(bridgeID) })
 	}
 	bridge.Protocol.Unlock()
 	delete(r.dc.Bridges, bridgeID)
-	path := dbus.ObjectPath(dbusPathPrefix + bridgeID + "_" + bridgeID)
-	r.dc.conn.Emit(path, dbusProtocolInterface+"."+signalBridgeRemoved)
-	r.dc.conn.Export(nil, path, dbusProtocolInterface)
+	r.dc.addMetric(metricBridges, -1)
+	path := dbus.ObjectPath(bridge.Protocol.path)
+	r.dc.emitLifecycle(path, dbusProtocolInterface+"."+signalBridgeRemoved, r.dc.lifecycle())
+	r.dc.emitInterfacesRemoved(path, r.dc.exportedInterfaces(path))
+	r.dc.unexportObject(path)
 	r.Protocol.Unlock()
 	return nil
 }
 
 // RemoveDevice is the dbus method to remove a device
 func (p *Protocol) RemoveDevice(devID string) *dbus.Error {
+	p.dc.enterMutation()
+	defer p.dc.exitMutation()
+	return p.removeDeviceByID(devID)
+}
+
+// removeDeviceByID removes the device, a diff calls it while it holds the mutations back
+func (p *Protocol) removeDeviceByID(devID string) *dbus.Error {
 	p.log.Info("RemoveDevice called - devID:", devID)
+	if err := validateArgs(optionalID("devID", devID)); err != nil {
+		return err
+	}
 	p.Lock()
 	d, devicePresent := p.Devices[devID]
+	if devicePresent && !isNil(p.removeDeviceSyncCB) {
+		p.Unlock()
+		return p.removeDeviceSync(d)
+	}
 	if devicePresent {
 		removeDevice(d)
 	}
@@ -197,38 +776,152 @@ func (p *Protocol) RemoveDevice(devID string) *dbus.Error {
 	return nil
 }
 
+// DeviceLineage is the dbus method to get the chain of the device from the root protocol: the protocol name,
+// the bridge ID if the device belongs to a bridge and the device ID
+func (p *Protocol) DeviceLineage(devID string) ([]string, *dbus.Error) {
+	if err := validateArgs(requireID("devID", devID)); err != nil {
+		return nil, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if _, present := p.Devices[devID]; !present {
+		return nil, ErrUnknownDevice
+	}
+	lineage := []string{p.dc.ProtocolName}
+	if p.isBridged {
+		lineage = append(lineage, p.BridgeID)
+	}
+	return append(lineage, devID), nil
+}
+
+// ScheduleRemoveDevice removes the device once the delay has elapsed unless cancel is called before
+// Scheduling again the removal of a device replaces the previous schedule, the removals are canceled by Close
+func (p *Protocol) ScheduleRemoveDevice(devID string, after time.Duration) (func(), *dbus.Error) {
+	p.log.Info("ScheduleRemoveDevice called - devID:", devID, "after:", after)
+	p.Lock()
+	defer p.Unlock()
+	if _, present := p.Devices[devID]; !present {
+		return nil, ErrUnknownDevice
+	}
+	if p.removals == nil {
+		p.removals = make(map[string]*time.Timer)
+	}
+	if timer, scheduled := p.removals[devID]; scheduled {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(after, func() {
+		p.Lock()
+		current := p.removals[devID] == timer
+		if current {
+			delete(p.removals, devID)
+		}
+		p.Unlock()
+		if current {
+			p.log.Info("Scheduled removal of the device", devID)
+			p.RemoveDevice(devID)
+		}
+	})
+	p.removals[devID] = timer
+
+	cancel := func() {
+		p.Lock()
+		defer p.Unlock()
+		if p.removals[devID] == timer {
+			timer.Stop()
+			delete(p.removals, devID)
+			p.log.Info("Scheduled removal of the device", devID, "canceled")
+		}
+	}
+	return cancel, nil
+}
+
+// cancelRemovals stops the scheduled removals of the devices of the protocol
+func (p *Protocol) cancelRemovals() {
+	p.Lock()
+	defer p.Unlock()
+	for devID, timer := range p.removals {
+		timer.Stop()
+		delete(p.removals, devID)
+	}
+}
+
 // EmitDbusSignal emit a dbus signal from protocol object
 func (p *Protocol) EmitDbusSignal(sigName string, args ...interface{}) {
-	path := dbus.ObjectPath(dbusPathPrefix + p.protocolName)
-	p.dc.conn.Emit(path, dbusProtocolInterface+"."+sigName, args...)
+	path := dbus.ObjectPath(p.path)
+	if err := p.dc.emit(path, func() error { return p.dc.connection().Emit(path, dbusProtocolInterface+"."+sigName, args...) }); err != nil {
+		p.dc.addMetric(metricDroppedSignals, 1)
+	}
+}
+
+// emitLifecycleSignal emits a lifecycle signal from the protocol object
+func (p *Protocol) emitLifecycleSignal(sigName string, s lifecycleSignal) {
+	path := dbus.ObjectPath(p.path)
+	if err := p.dc.emitLifecycle(path, dbusProtocolInterface+"."+sigName, s); err != nil {
+		p.dc.addMetric(metricDroppedSignals, 1)
+	}
 }
 
 // Ready set the Protocol object parameter "ready" to true
 func (p *Protocol) Ready() {
 	if p != nil {
 		p.Lock()
+		wasReady := p.ready
 		p.ready = true
 		p.Unlock()
+		p.readyChanged(wasReady, true)
+	}
+}
+
+// readyChanged updates the health and emits the signal AnyBridgeReadyChanged on the root protocol when a bridge
+// readiness flips
+func (p *Protocol) readyChanged(wasReady bool, ready bool) {
+	p.dc.updateHealth()
+	if p.isBridged && wasReady != ready {
+		p.log.Info("Readiness of the bridge", p.BridgeID, "changed to", ready)
+		p.emitAnyBridgeReadyChanged(AnyBridgeReadyChangedPayload{BridgeID: p.BridgeID, Ready: ready})
+	}
+}
+
+// SetReadyWithState set the Protocol object parameter "ready" and returns the JSON snapshot
+// of the devices taken at the same moment
+func (p *Protocol) SetReadyWithState(ready bool) (string, *dbus.Error) {
+	p.Lock()
+	wasReady := p.ready
+	p.ready = ready
+	snapshot := ProtocolJson{Protocols: map[string][]DeviceJson{p.protocolName: p.snapshot()}}
+	p.Unlock()
+	p.readyChanged(wasReady, ready)
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		p.log.Error("Fail to serialize the snapshot of the protocol", p.protocolName, err)
+		return "", dbus.MakeFailedError(err)
 	}
+	return string(data), nil
 }
 
 // SetDbusMethods set new dbusMethods for this protocol
 func (p *Protocol) SetDbusMethods(externalMethods map[string]interface{}) bool {
-	path := dbus.ObjectPath(dbusPathPrefix + p.protocolName)
-	exportedMethods := make(map[string]interface{})
-	exportedMethods["IsReady"] = p.IsReady
-	exportedMethods["AddDevice"] = p.AddDevice
-	exportedMethods["RemoveDevice"] = p.RemoveDevice
+	path := dbus.ObjectPath(p.path)
+	exportedMethods := p.builtinMethods()
 	if !p.isBridged {
-		exportedMethods["AddBridge"] = p.dc.RootProtocol.AddBridge
-		exportedMethods["RemoveBridge"] = p.dc.RootProtocol.RemoveBridge
+		p.Lock()
+		for name, handler := range p.dc.RootProtocol.commands {
+			exportedMethods[name] = handlerMethod(handler)
+		}
+		p.Unlock()
 	}
 
+	p.Lock()
+	p.externalMethods = externalMethods
+	p.Unlock()
 	for name, inter := range externalMethods {
 		exportedMethods[name] = inter
 	}
 
-	err := p.dc.conn.ExportMethodTable(exportedMethods, path, dbusProtocolInterface)
+	err := p.dc.exportMethods(path, dbusProtocolInterface, exportedMethods)
 	if err != nil {
 		p.dc.Log.Warning("Fail to export protocol dbus object", p.protocolName, err)
 		return false
@@ -236,9 +929,82 @@ func (p *Protocol) SetDbusMethods(externalMethods map[string]interface{}) bool {
 	return true
 }
 
+// builtinMethods returns the methods of the protocol interface, the commands cannot take their names
+func (p *Protocol) builtinMethods() map[string]interface{} {
+	exportedMethods := make(map[string]interface{})
+	exportedMethods["IsReady"] = p.IsReady
+	exportedMethods["DeviceLineage"] = p.DeviceLineage
+	exportedMethods["AddDevice"] = func(devID string, comID string, typeID string, typeVersion string, options []byte) (alreadyAdded bool, err *dbus.Error) {
+		err = p.dc.unlessFrozen(func() *dbus.Error {
+			alreadyAdded, err = p.AddDevice(devID, comID, typeID, typeVersion, options)
+			return err
+		})
+		return
+	}
+	exportedMethods["RemoveDevice"] = func(devID string) *dbus.Error {
+		return p.dc.unlessFrozen(func() *dbus.Error { return p.RemoveDevice(devID) })
+	}
+	exportedMethods["CancelAdd"] = func(devID string) *dbus.Error {
+		return p.dc.unlessFrozen(func() *dbus.Error { return p.CancelAdd(devID) })
+	}
+	exportedMethods["FindByComID"] = p.FindByComID
+	exportedMethods["AddPlaceholderDevice"] = func(devID string) (alreadyAdded bool, err *dbus.Error) {
+		err = p.dc.unlessFrozen(func() *dbus.Error {
+			alreadyAdded, err = p.AddPlaceholderDevice(devID)
+			return err
+		})
+		return
+	}
+	exportedMethods["GetTombstones"] = p.GetTombstones
+	exportedMethods["GetAllItemValues"] = p.GetAllItemValues
+	exportedMethods["CloneDevice"] = func(srcID string, newID string) (alreadyAdded bool, err *dbus.Error) {
+		err = p.dc.unlessFrozen(func() *dbus.Error {
+			alreadyAdded, err = p.CloneDevice(srcID, newID)
+			return err
+		})
+		return
+	}
+	exportedMethods["AddAlias"] = func(devID string, aliasID string) *dbus.Error {
+		return p.dc.unlessFrozen(func() *dbus.Error { return p.AddAlias(devID, aliasID) })
+	}
+	if !p.isBridged {
+		r := &p.dc.RootProtocol
+		exportedMethods["AddBridge"] = func(bridgeID string) (alreadyAdded bool, err *dbus.Error) {
+			err = p.dc.unlessFrozen(func() *dbus.Error {
+				alreadyAdded, err = r.AddBridge(bridgeID)
+				return err
+			})
+			return
+		}
+		exportedMethods["RemoveBridge"] = func(bridgeID string) *dbus.Error {
+			return p.dc.unlessFrozen(func() *dbus.Error { return r.RemoveBridge(bridgeID) })
+		}
+		exportedMethods["Reconcile"] = p.dc.Reconcile
+		exportedMethods["GetLogLevelHistory"] = p.dc.RootProtocol.GetLogLevelHistory
+		exportedMethods["GetBridgesDetailed"] = p.dc.RootProtocol.GetBridgesDetailed
+		exportedMethods["Errors"] = p.dc.RootProtocol.Errors
+		exportedMethods["StateChecksum"] = p.dc.RootProtocol.StateChecksum
+		exportedMethods["GetSequence"] = p.dc.GetSequence
+		exportedMethods["NegotiateSignals"] = p.dc.NegotiateSignals
+		exportedMethods["GetSupportedTypes"] = p.dc.RootProtocol.GetSupportedTypes
+		exportedMethods["ApplyDiff"] = p.dc.RootProtocol.ApplyDiff
+		exportedMethods["SelfTest"] = func() (report string, err *dbus.Error) {
+			err = p.dc.unlessFrozen(func() *dbus.Error {
+				report, err = p.dc.SelfTest()
+				return err
+			})
+			return
+		}
+		exportedMethods["ImportTree"] = func(tree string, replace bool) *dbus.Error {
+			return p.dc.unlessFrozen(func() *dbus.Error { return p.dc.RootProtocol.ImportTree(tree, replace) })
+		}
+	}
+	return exportedMethods
+}
+
 // SetDbusProperties set new DBus properties for this protocol
 func (p *Protocol) SetDbusProperties(externalProperties map[string]*prop.Prop) bool {
-	path := dbus.ObjectPath(dbusPathPrefix + p.protocolName)
+	path := dbus.ObjectPath(p.path)
 	propsSpec := map[string]map[string]*prop.Prop{
 		dbusProtocolInterface: {
 			propertyReachabilityState: {
@@ -247,9 +1013,21 @@ func (p *Protocol) SetDbusProperties(externalProperties map[string]*prop.Prop) b
 				Emit:     prop.EmitTrue,
 				Callback: nil,
 			},
+			propertyPhase: {
+				Value:    p.phase,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
 		},
 	}
 
+	if !p.isBridged {
+		propsSpec[dbusProtocolInterface][propertyHealth] = p.dc.healthProperty()
+		propsSpec[dbusProtocolInterface][propertyBuildInfo] = buildInfoProperty()
+		propsSpec[dbusProtocolInterface][propertyMetrics] = p.dc.metricsProperty()
+	}
+
 	if p.isBridged {
 		rootPropsSpec := prop.Prop{
 			Value:    logging.GetLevel(p.dc.RootProtocol.log.Module).String(),
@@ -258,19 +1036,34 @@ func (p *Protocol) SetDbusProperties(externalProperties map[string]*prop.Prop) b
 			Callback: p.dc.RootProtocol.setLogLevel,
 		}
 		propsSpec[dbusProtocolInterface][propertyLogLevel] = &rootPropsSpec
+		propsSpec[dbusProtocolInterface][propertyBridgeState] = &prop.Prop{
+			Value:    BridgeUnknown,
+			Writable: false,
+			Emit:     prop.EmitTrue,
+			Callback: nil,
+		}
+		propsSpec[dbusProtocolInterface][propertyEndpoint] = &prop.Prop{
+			Value:    "",
+			Writable: false,
+			Emit:     prop.EmitTrue,
+			Callback: nil,
+		}
 	}
 
 	for pName, pr := range externalProperties {
 		propsSpec[dbusProtocolInterface][pName] = pr
 	}
 
-	properties, err := prop.Export(p.dc.conn, path, propsSpec)
+	properties, err := p.dc.exportProperties(path, propsSpec)
 	if err == nil {
 		p.properties = properties
 	} else {
 		p.log.Error("Fail to export the properties of the protocol", p.protocolName, err)
 		return false
 	}
+	if p.isBridged {
+		p.dc.setPropertyWriter(path, dbusProtocolInterface, propertyLogLevel, p.dc.RootProtocol.recordLogLevel)
+	}
 	return true
 }
 
@@ -281,9 +1074,33 @@ func (p *Protocol) SetProtocolCBs(cbs interface{}) {
 		p.addDeviceCB = cb
 	}
 	switch cb := cbs.(type) {
+	case interface {
+		AddDeviceContext(context.Context, *Device)
+	}:
+		p.addDeviceContextCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface {
+		AddDeviceSync(context.Context, *Device) error
+	}:
+		p.addDeviceSyncCB = cb
+	}
+	switch cb := cbs.(type) {
 	case interface{ RemoveDevice(string) }:
 		p.removeDeviceCB = cb
 	}
+	switch cb := cbs.(type) {
+	case interface {
+		RemoveDeviceSync(context.Context, *Device) error
+	}:
+		p.removeDeviceSyncCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface {
+		RemoveProtocolDevice(*Protocol, string)
+	}:
+		p.removeProtocolDeviceCB = cb
+	}
 }
 
 // SetReachabilityState set the value of the property ReachabilityState
@@ -303,7 +1120,81 @@ func (p *Protocol) SetReachabilityState(state ReachabilityState) {
 	}
 
 	p.log.Info("propertyReachabilityState of the protocol", p.protocolName, "changed from", oldState, "to", state)
-	p.properties.SetMust(dbusProtocolInterface, propertyReachabilityState, state)
+	p.dc.setPropertyValue(p.properties, dbusProtocolInterface, propertyReachabilityState, state)
+	p.dc.notifyChange(Change{Protocol: p.protocolName, Property: propertyReachabilityState, Value: state})
+}
+
+// SetReachability set the OperabilityState of the listed devices to OK when reachable or KO otherwise
+// A single signal ReachabilityChanged lists the devices whose state changed, the unknown IDs are skipped
+// Each device still emits PropertiesChanged for its OperabilityState for the clients of the standard interfaces.
+func (p *Protocol) SetReachability(ids []string, reachable bool) *dbus.Error {
+	if p.properties == nil {
+		return &dbus.ErrMsgNoObject
+	}
+
+	state := OperabilityKo
+	if reachable {
+		state = OperabilityOk
+	}
+
+	p.Lock()
+	devices := make([]*Device, 0, len(ids))
+	for _, devID := range ids {
+		d, present := p.Devices[devID]
+		if !present {
+			p.log.Warning("Reachability of the unknown device", devID, "ignored")
+			continue
+		}
+		devices = append(devices, d)
+	}
+	p.Unlock()
+
+	changed := make([]string, 0, len(devices))
+	for _, d := range devices {
+		if d.setOperabilityState(state) {
+			changed = append(changed, d.DevID)
+		}
+	}
+
+	if len(changed) > 0 {
+		p.log.Info("Reachability of", len(changed), "devices of the protocol", p.protocolName, "changed to", reachable)
+		p.emitReachabilityChanged(ReachabilityChangedPayload{DevIDs: changed, Reachable: reachable})
+	}
+	return nil
+}
+
+// RegisterCommand exports a dbus method on the root protocol calling the handler with the arguments of the command
+// The name must be a valid dbus method name which is not one of the methods of the protocol interface.
+func (r *RootProto) RegisterCommand(name string, handler func(args []byte) ([]byte, error)) *dbus.Error {
+	r.log.Info("RegisterCommand called - command:", name)
+	if err := validateArgs(requireMember("name", name)); err != nil {
+		return err
+	}
+	if _, builtin := r.Protocol.builtinMethods()[name]; builtin {
+		r.log.Warning("Command", name, "rejected, it is a method of the protocol")
+		return ErrReservedCommand
+	}
+	r.Protocol.Lock()
+	if r.commands == nil {
+		r.commands = make(map[string]func([]byte) ([]byte, error))
+	}
+	r.commands[name] = handler
+	externalMethods := r.Protocol.externalMethods
+	r.Protocol.Unlock()
+
+	r.Protocol.SetDbusMethods(externalMethods)
+	return nil
+}
+
+// UnregisterCommand removes a dbus method added by RegisterCommand
+func (r *RootProto) UnregisterCommand(name string) {
+	r.log.Info("UnregisterCommand called - command:", name)
+	r.Protocol.Lock()
+	delete(r.commands, name)
+	externalMethods := r.Protocol.externalMethods
+	r.Protocol.Unlock()
+
+	r.Protocol.SetDbusMethods(externalMethods)
 }
 
 // SetRootProtocolCBs set new callbacks for this Root protocol
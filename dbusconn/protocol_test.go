@@ -0,0 +1,826 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/op/go-logging"
+)
+
+func TestFindByComID(t *testing.T) {
+	p := newTestAdapter(t, &Dbus{}, nil)
+	if _, err := p.AddDevice("D1", "C1", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AddDevice("D2", "C2", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if devID, found, err := p.FindByComID("C1"); err != nil || !found || devID != "D1" {
+		t.Errorf("hit: %q %v %v", devID, found, err)
+	}
+	if devID, found, _ := p.FindByComID("C3"); found || devID != "" {
+		t.Errorf("miss: %q %v", devID, found)
+	}
+
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := p.FindByComID("C1"); found {
+		t.Error("comID of a removed device still found")
+	}
+	if devID, found, _ := p.FindByComID("C2"); !found || devID != "D2" {
+		t.Errorf("comID of the device kept: %q %v", devID, found)
+	}
+}
+
+func TestIDsTakenByAnotherDevice(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	if _, err := p.AddDevice("D1", "C1", "T", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddAlias("D1", "L1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.AddDevice("D2", "C1", "T", "1", []byte("{}")); err != ErrIDTaken {
+		t.Errorf("AddDevice with the comID of another device: %v", err)
+	}
+	if _, err := p.AddDevice("L1", "C2", "T", "1", []byte("{}")); err != ErrIDTaken {
+		t.Errorf("AddDevice with the ID of an alias: %v", err)
+	}
+	if _, err := p.CloneDevice("D1", "L1"); err != ErrIDTaken {
+		t.Errorf("CloneDevice with the ID of an alias: %v", err)
+	}
+	if hasDevice(p, "D2") || hasDevice(p, "L1") {
+		t.Error("device added with a taken ID")
+	}
+	if devID, found, _ := p.FindByComID("C1"); !found || devID != "D1" {
+		t.Errorf("comID taken over: %q %v", devID, found)
+	}
+	if counts := dc.typeCounts["T"]; counts != 1 {
+		t.Errorf("%d devices of the type counted", counts)
+	}
+
+	// The same add again is still idempotent
+	if alreadyAdded, err := p.AddDevice("D1", "C1", "T", "1", []byte("{}")); err != nil || !alreadyAdded {
+		t.Errorf("AddDevice of the device again: %v %v", alreadyAdded, err)
+	}
+}
+
+func TestLogLevelHistory(t *testing.T) {
+	// The level is set back once the adapter is closed, go-logging does not lock its levels
+	t.Cleanup(func() { logging.SetLevel(logging.CRITICAL, "dbus-adapter") })
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, dc)
+	path := c.root + "_b"
+
+	levels := []string{"DEBUG", "WARNING", "ERROR"}
+	for _, level := range levels {
+		if err := c.call(path, dbusPropertiesInterface+".Set", dbusProtocolInterface, propertyLogLevel, dbus.MakeVariant(level)).Err; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.call(path, dbusPropertiesInterface+".Set", dbusProtocolInterface, propertyLogLevel, dbus.MakeVariant("LOUD")).Err; err == nil {
+		t.Error("invalid level accepted")
+	}
+
+	history, err := dc.RootProtocol.GetLogLevelHistory()
+	if err != nil || len(history) != len(levels) {
+		t.Fatalf("history: %v, %v", history, err)
+	}
+	for n, entry := range history {
+		fields := strings.Fields(entry)
+		if len(fields) != 3 || fields[1] != c.conn.Names()[0] || fields[2] != levels[n] {
+			t.Errorf("entry %d: %q", n, entry)
+		}
+		if _, err := time.Parse(time.RFC3339, fields[0]); err != nil {
+			t.Errorf("entry %d: %v", n, err)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	dc := &Dbus{TombstoneRetention: 200 * time.Millisecond}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T")
+	addTestDevice(t, p, "D2", "T")
+	c := newTestClient(t, dc)
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	tombstones, err := p.GetTombstones()
+	if removal, present := tombstones["D1"]; err != nil || !present || removal < before || len(tombstones) != 1 {
+		t.Fatalf("tombstones after the removal: %v %v", tombstones, err)
+	}
+	if !c.unreachable(c.root+"/D1", dbusDeviceInterface+".GetItems") {
+		t.Error("removed device still exported")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if tombstones, _ := p.GetTombstones(); len(tombstones) != 0 {
+		t.Errorf("tombstones after the window: %v", tombstones)
+	}
+
+	p.RemoveDevice("D2")
+	addTestDevice(t, p, "D2", "T")
+	if tombstones, _ := p.GetTombstones(); len(tombstones) != 0 {
+		t.Errorf("tombstone of a device added again: %v", tombstones)
+	}
+}
+
+func TestNoTombstoneWithoutRetention(t *testing.T) {
+	p := newTestAdapter(t, &Dbus{}, nil)
+	addTestDevice(t, p, "D1", "T")
+	p.RemoveDevice("D1")
+	if tombstones, _ := p.GetTombstones(); len(tombstones) != 0 {
+		t.Errorf("tombstones: %v", tombstones)
+	}
+}
+
+func TestBridgeLimit(t *testing.T) {
+	dc := &Dbus{MaxBridges: 2}
+	newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	r := dc.RootProtocol
+
+	for _, bridgeID := range []string{"b1", "b2"} {
+		if _, err := r.AddBridge(bridgeID); err != nil {
+			t.Fatalf("bridge %s within the limit: %v", bridgeID, err)
+		}
+	}
+	if alreadyAdded, err := r.AddBridge("b1"); err != nil || !alreadyAdded {
+		t.Fatalf("bridge added again at the limit: %v %v", alreadyAdded, err)
+	}
+	c.flush()
+	if _, err := r.AddBridge("b3"); err != ErrBridgeLimit {
+		t.Fatalf("bridge over the limit: %v", err)
+	}
+	signals := c.flush()
+	if len(signals) != 1 || signals[0].Name != dbusProtocolInterface+"."+signalLimitExceeded {
+		t.Fatalf("signals over the limit: %v", names(signals))
+	}
+	var bridgeID string
+	var limit int32
+	if err := dbus.Store(signals[0].Body, &bridgeID, &limit); err != nil || bridgeID != "b3" || limit != 2 {
+		t.Errorf("LimitExceeded %q %d %v", bridgeID, limit, err)
+	}
+	if _, present := dc.Bridges["b3"]; present {
+		t.Error("bridge over the limit added")
+	}
+
+	if err := r.RemoveBridge("b1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AddBridge("b3"); err != nil {
+		t.Fatal("bridge added once another is removed:", err)
+	}
+}
+
+func TestSetReadyWithStateIsTakenAtTheFlip(t *testing.T) {
+	p := newTestAdapter(t, &Dbus{}, nil)
+	added := make(chan int, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 100; n++ {
+			p.AddDevice(fmt.Sprintf("D%03d", n), "", "T", "1", []byte("{}"))
+			added <- n
+		}
+	}()
+	<-added
+
+	state, err := p.SetReadyWithState(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+	devices := len(p.Devices)
+	ready := p.ready
+	p.Unlock()
+	<-done
+
+	var snapshot ProtocolJson
+	if err := json.Unmarshal([]byte(state), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	listed := snapshot.Protocols[p.protocolName]
+	if len(listed) == 0 || len(listed) > devices || !ready {
+		t.Fatalf("%d devices in the snapshot, %d once it returned, ready %v", len(listed), devices, ready)
+	}
+	// The devices are added one after the other, the snapshot holds the first ones only
+	for n, dev := range listed {
+		if dev.DevID != fmt.Sprintf("D%03d", n) {
+			t.Fatalf("device %d of the snapshot is %s", n, dev.DevID)
+		}
+	}
+}
+
+func TestGetAllItemValues(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	want := map[string]map[string][]byte{}
+	for _, devID := range []string{"D1", "D2", "D3"} {
+		d := addTestDevice(t, p, devID, "T")
+		want[devID] = map[string][]byte{}
+		for _, itemID := range []string{"I1", "I2"} {
+			i := addTestItem(t, d, itemID, "T")
+			if devID != "D3" {
+				i.SetValue([]byte(devID + itemID))
+			}
+			want[devID][itemID] = i.currentValue()
+		}
+	}
+	addTestDevice(t, p, "D4", "T")
+	want["D4"] = map[string][]byte{}
+
+	c := newTestClient(t, dc)
+	var values map[string]map[string][]byte
+	if err := c.call(c.root, dbusProtocolInterface+".GetAllItemValues").Store(&values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(want) {
+		t.Fatalf("values: %v", values)
+	}
+	for devID, items := range want {
+		if len(values[devID]) != len(items) {
+			t.Errorf("items of %s: %v", devID, values[devID])
+		}
+		for itemID, value := range items {
+			if got, present := values[devID][itemID]; !present || string(got) != string(value) {
+				t.Errorf("%s/%s: %q, want %q", devID, itemID, got, value)
+			}
+		}
+	}
+}
+
+func TestAliasReachesTheSameDevice(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	addTestDevice(t, p, "D2", "T")
+	c := newTestClient(t, dc)
+
+	if err := p.AddAlias("D1", "L1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddAlias("D3", "L3"); err != ErrUnknownDevice {
+		t.Errorf("alias of an unknown device: %v", err)
+	}
+	if err := p.AddAlias("D1", "D2"); err != ErrIDTaken {
+		t.Errorf("alias taken by a device: %v", err)
+	}
+	if err := p.AddAlias("D2", "L1"); err != ErrIDTaken {
+		t.Errorf("alias taken by an alias: %v", err)
+	}
+
+	if err := c.call(c.root+"/L1", dbusDeviceInterface+".AddItem", "I1", "T", "1", []byte("{}")).Err; err != nil {
+		t.Fatal("AddItem through the alias:", err)
+	}
+	if !hasItem(d, "I1") {
+		t.Fatal("item added through the alias missing from the device")
+	}
+	d.SetModel("M1")
+	for _, path := range []string{c.root + "/D1", c.root + "/L1"} {
+		if value, err := c.property(path, dbusDeviceInterface, propertyModel); err != nil || value.Value() != "M1" {
+			t.Errorf("Model read on %s: %v %v", path, value, err)
+		}
+	}
+
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.unreachable(c.root+"/L1", dbusDeviceInterface+".GetItems") {
+		t.Error("alias still exported once the device is removed")
+	}
+	if err := p.AddAlias("D2", "L1"); err != nil {
+		t.Error("alias of a removed device still taken:", err)
+	}
+}
+
+func TestBridgeStateTransitions(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge := dc.Bridges["b"]
+	c := newTestClient(t, dc)
+	path := c.root + "_b"
+
+	if value, err := c.property(path, dbusProtocolInterface, propertyBridgeState); err != nil || value.Value() != string(BridgeUnknown) {
+		t.Fatalf("BridgeState of a new bridge: %v %v", value, err)
+	}
+	c.flush()
+
+	previous := BridgeUnknown
+	for _, state := range []BridgeState{BridgeConnecting, BridgeConnected, BridgeError, BridgeConnecting} {
+		bridge.SetState(state)
+		signals := onPath(c.flush(), path)
+		if want := []string{path + " PropertiesChanged", path + " " + signalBridgeStateChanged}; strings.Join(names(signals), ",") != strings.Join(want, ",") {
+			t.Fatalf("signals of %s: %v", state, names(signals))
+		}
+		if changed := signals[0].Body[1].(map[string]dbus.Variant); changed[propertyBridgeState].Value() != string(state) {
+			t.Errorf("PropertiesChanged of %s: %v", state, changed)
+		}
+		var oldState, newState string
+		if err := dbus.Store(signals[1].Body, &oldState, &newState); err != nil || oldState != string(previous) || newState != string(state) {
+			t.Errorf("BridgeStateChanged of %s: %q %q %v", state, oldState, newState, err)
+		}
+		previous = state
+	}
+
+	bridge.SetState(BridgeConnecting)
+	if signals := c.flush(); len(signals) != 0 {
+		t.Errorf("same state emitted %v", names(signals))
+	}
+	if err := c.call(path, dbusPropertiesInterface+".Set", dbusProtocolInterface, propertyBridgeState, dbus.MakeVariant("CONNECTED")).Err; err == nil {
+		t.Error("BridgeState written by a client")
+	}
+
+	var details map[string]map[string]dbus.Variant
+	if err := c.call(c.root, dbusProtocolInterface+".GetBridgesDetailed").Store(&details); err != nil {
+		t.Fatal(err)
+	}
+	if details["b"][propertyBridgeState].Value() != string(BridgeConnecting) {
+		t.Errorf("GetBridgesDetailed: %v", details)
+	}
+}
+
+func TestBridgeEndpoint(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	c := newTestClient(t, dc)
+	path := c.root + "_b"
+	expect := func(step string, endpoint string) {
+		t.Helper()
+		if value, err := c.property(path, dbusProtocolInterface, propertyEndpoint); err != nil || value.Value() != endpoint {
+			t.Errorf("Endpoint %s: %v %v", step, value, err)
+		}
+		var details map[string]map[string]dbus.Variant
+		if err := c.call(c.root, dbusProtocolInterface+".GetBridgesDetailed").Store(&details); err != nil || details["b"][propertyEndpoint].Value() != endpoint {
+			t.Errorf("GetBridgesDetailed %s: %v %v", step, details, err)
+		}
+	}
+	expect("of a new bridge", "")
+	c.flush()
+
+	bridge.SetEndpoint("tcp://192.168.1.10:502")
+	expect("once set", "tcp://192.168.1.10:502")
+	signals := onPath(c.flush(), path)
+	if len(signals) != 1 || signals[0].Body[1].(map[string]dbus.Variant)[propertyEndpoint].Value() != "tcp://192.168.1.10:502" {
+		t.Errorf("signals of the endpoint: %v", names(signals))
+	}
+	bridge.SetEndpoint("tcp://192.168.1.10:502")
+	if signals := c.flush(); len(signals) != 0 {
+		t.Errorf("same endpoint emitted %v", names(signals))
+	}
+	bridge.SetEndpoint("/dev/ttyUSB0")
+	expect("once changed", "/dev/ttyUSB0")
+	if err := c.call(path, dbusPropertiesInterface+".Set", dbusProtocolInterface, propertyEndpoint, dbus.MakeVariant("ble")).Err; err == nil {
+		t.Error("Endpoint written by a client")
+	}
+	if value, err := c.property(c.root, dbusProtocolInterface, propertyEndpoint); err == nil {
+		t.Errorf("Endpoint of the root protocol: %v", value)
+	}
+}
+
+func TestErrorsOfTheTree(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T").SetError("timeout")
+	addTestDevice(t, p, "D2", "T")
+	for _, bridgeID := range []string{"b", "c"} {
+		if _, err := dc.RootProtocol.AddBridge(bridgeID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failing, _ := testBridge(dc, "b")
+	failing.SetState(BridgeError)
+	addTestDevice(t, failing.Protocol, "D3", "T").SetError("no answer")
+	healthy, _ := testBridge(dc, "c")
+	healthy.SetState(BridgeConnected)
+	addTestDevice(t, healthy.Protocol, "D4", "T")
+	c := newTestClient(t, dc)
+	expect := func(step string, want map[string]string) {
+		t.Helper()
+		var failures map[string]string
+		if err := c.call(c.root, dbusProtocolInterface+".Errors").Store(&failures); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(failures, want) {
+			t.Errorf("Errors %s: %v, want %v", step, failures, want)
+		}
+	}
+	expect("with devices and bridges in error", map[string]string{
+		c.root + "/D1":   "timeout",
+		c.root + "_b":    string(BridgeError),
+		c.root + "_b/D3": "no answer",
+	})
+
+	testDevice(t, p, "D1").SetError("")
+	failing.SetState(BridgeConnected)
+	expect("once recovered", map[string]string{c.root + "_b/D3": "no answer"})
+	if err := dc.RootProtocol.RemoveBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	expect("once the bridge in error is removed", map[string]string{})
+}
+
+func TestRemoveBridgeWhileAddingDevices(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	r := dc.RootProtocol
+
+	for round := 0; round < 10; round++ {
+		bridgeID := fmt.Sprintf("b%d", round)
+		if _, err := r.AddBridge(bridgeID); err != nil {
+			t.Fatal(err)
+		}
+		r.Protocol.Lock()
+		p := dc.Bridges[bridgeID].Protocol
+		r.Protocol.Unlock()
+
+		results := make(chan *dbus.Error, 20)
+		go func() {
+			for n := 0; n < cap(results); n++ {
+				_, err := p.AddDevice(fmt.Sprintf("D%d", n), "", "T", "1", []byte("{}"))
+				results <- err
+			}
+			close(results)
+		}()
+		for {
+			err := r.RemoveBridge(bridgeID)
+			if err == nil {
+				break
+			}
+			if err != ErrBridgeNotEmpty {
+				t.Fatal(err)
+			}
+		}
+
+		for err := range results {
+			if err != nil && err != ErrBridgeRemoved {
+				t.Fatalf("add during the removal of the bridge: %v", err)
+			}
+		}
+		p.Lock()
+		devices := len(p.Devices)
+		p.Unlock()
+		if devices != 0 {
+			t.Fatalf("%d devices left on the removed bridge %s", devices, bridgeID)
+		}
+		if _, present := dc.Bridges[bridgeID]; present {
+			t.Fatalf("bridge %s kept", bridgeID)
+		}
+	}
+}
+
+func TestCustomBridgePath(t *testing.T) {
+	dc := &Dbus{}
+	dc.BridgePath = func(bridgeID string) dbus.ObjectPath {
+		if bridgeID == "invalid" {
+			return "bridges"
+		}
+		return dbus.ObjectPath("/com/ubiant/bridges/" + dc.ProtocolName + "/" + bridgeID)
+	}
+	newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	subtree := "/com/ubiant/bridges/" + dc.ProtocolName + "/b"
+	c.subtrees = append(c.subtrees, subtree)
+
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	d := addTestDevice(t, dc.Bridges["b"].Protocol, "D1", "T")
+	addTestItem(t, d, "I1", "T")
+	signals := c.flush()
+	for path, member := range map[string]string{subtree: signalBridgeAdded, subtree + "/D1": signalDeviceAdded, subtree + "/D1/I1": signalItemAdded} {
+		if count(onPath(signals, path), member) != 1 {
+			t.Errorf("%s not emitted on %s: %v", member, path, names(signals))
+		}
+	}
+	if err := c.call(subtree+"/D1", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Error("device of the bridge under the custom path:", err)
+	}
+	var ready bool
+	if err := c.call(subtree, dbusProtocolInterface+".IsReady").Store(&ready); err != nil {
+		t.Error("bridge under the custom path:", err)
+	}
+	if !c.unreachable(c.root+"_b/D1", dbusDeviceInterface+".GetItems") {
+		t.Error("device of the bridge exported under the default path")
+	}
+
+	// A path the builder gets wrong falls back to the default one
+	if _, err := dc.RootProtocol.AddBridge("invalid"); err != nil {
+		t.Fatal(err)
+	}
+	addTestDevice(t, dc.Bridges["invalid"].Protocol, "D2", "T")
+	if err := c.call(c.root+"_invalid/D2", dbusDeviceInterface+".GetItems").Err; err != nil {
+		t.Error("device of the bridge with an invalid custom path:", err)
+	}
+}
+
+func TestAnyBridgeReadyChanged(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	for _, bridgeID := range []string{"b1", "b2"} {
+		if _, err := dc.RootProtocol.AddBridge(bridgeID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestClient(t, dc)
+	c.flush()
+	changes := func() string {
+		t.Helper()
+		var list []string
+		for _, s := range onPath(c.flush(), c.root) {
+			if !strings.HasSuffix(s.Name, "."+signalAnyBridgeReadyChanged) {
+				continue
+			}
+			var bridgeID string
+			var ready bool
+			if err := dbus.Store(s.Body, &bridgeID, &ready); err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, fmt.Sprintf("%s=%v", bridgeID, ready))
+		}
+		return strings.Join(list, ",")
+	}
+
+	dc.Bridges["b1"].Protocol.Ready()
+	dc.Bridges["b2"].Protocol.Ready()
+	if got := changes(); got != "b1=true,b2=true" {
+		t.Errorf("signals once both bridges are ready: %s", got)
+	}
+	dc.Bridges["b1"].Protocol.Ready()
+	if _, err := dc.Bridges["b2"].Protocol.SetReadyWithState(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := changes(); got != "b2=false" {
+		t.Errorf("signals once b2 is not ready: %s", got)
+	}
+	// The readiness of the root protocol is not the one of a bridge
+	p.Ready()
+	if got := changes(); got != "" {
+		t.Errorf("signals once the root is ready: %s", got)
+	}
+}
+
+func TestSetReachabilityOfManyDevices(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	for _, devID := range []string{"D1", "D2", "D3"} {
+		addTestDevice(t, p, devID, "T")
+	}
+	c := newTestClient(t, dc)
+	c.flush()
+	expect := func(step string, states map[string]OperabilityState, changed []string, reachable bool) {
+		t.Helper()
+		for devID, state := range states {
+			if value, err := c.property(c.root+"/"+devID, dbusDeviceInterface, propertyOperabilityState); err != nil || value.Value() != string(state) {
+				t.Errorf("OperabilityState of %s %s: %v %v, want %s", devID, step, value, err, state)
+			}
+		}
+		all := c.flush()
+		for _, devID := range changed {
+			if count(onPath(all, c.root+"/"+devID), "PropertiesChanged") != 1 {
+				t.Errorf("PropertiesChanged of %s %s: %v", devID, step, names(all))
+			}
+		}
+		var signals []*dbus.Signal
+		for _, s := range onPath(all, c.root) {
+			if strings.HasSuffix(s.Name, "."+signalReachabilityChanged) {
+				signals = append(signals, s)
+			}
+		}
+		if len(changed) == 0 {
+			if len(signals) != 0 {
+				t.Errorf("ReachabilityChanged emitted %s", step)
+			}
+			return
+		}
+		if len(signals) != 1 {
+			t.Fatalf("%d ReachabilityChanged %s", len(signals), step)
+		}
+		var devices []string
+		var signaled bool
+		if err := dbus.Store(signals[0].Body, &devices, &signaled); err != nil || strings.Join(devices, ",") != strings.Join(changed, ",") || signaled != reachable {
+			t.Errorf("ReachabilityChanged %s: %v %v %v", step, devices, signaled, err)
+		}
+	}
+
+	if err := p.SetReachability([]string{"D1", "unknown", "D2"}, false); err != nil {
+		t.Fatal(err)
+	}
+	expect("once unreachable", map[string]OperabilityState{"D1": OperabilityKo, "D2": OperabilityKo, "D3": OperabilityUnknown}, []string{"D1", "D2"}, false)
+	p.SetReachability([]string{"D1", "D2"}, false)
+	expect("once unreachable again", map[string]OperabilityState{"D1": OperabilityKo, "D2": OperabilityKo}, nil, false)
+	p.SetReachability([]string{"D2", "D3"}, true)
+	expect("once reachable", map[string]OperabilityState{"D1": OperabilityKo, "D2": OperabilityOk, "D3": OperabilityOk}, []string{"D2", "D3"}, true)
+}
+
+func TestScheduleRemoveDevice(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	for _, devID := range []string{"D1", "D2", "D3"} {
+		addTestDevice(t, p, devID, "T")
+	}
+
+	if _, err := p.ScheduleRemoveDevice("D1", 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	cancel, err := p.ScheduleRemoveDevice("D2", 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scheduling again replaces the schedule
+	p.ScheduleRemoveDevice("D3", 10*time.Millisecond)
+	p.ScheduleRemoveDevice("D3", time.Hour)
+	if !hasDevice(p, "D1") {
+		t.Fatal("device removed before its delay")
+	}
+	cancel()
+	waitFor(t, "the scheduled removal", func() bool { return !hasDevice(p, "D1") })
+	time.Sleep(50 * time.Millisecond)
+	if !hasDevice(p, "D2") || !hasDevice(p, "D3") {
+		t.Error("device removed once canceled or rescheduled")
+	}
+	cancel()
+
+	if _, err := p.ScheduleRemoveDevice("D9", time.Millisecond); err != ErrUnknownDevice {
+		t.Errorf("removal of an unknown device: %v", err)
+	}
+}
+
+func TestCloseCancelsTheScheduledRemovals(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T")
+	if _, err := p.ScheduleRemoveDevice("D1", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	dc.Close()
+	p.Lock()
+	scheduled := len(p.removals)
+	p.Unlock()
+	if scheduled != 0 {
+		t.Errorf("%d removals scheduled once closed", scheduled)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if !hasDevice(p, "D1") {
+		t.Error("device removed after Close")
+	}
+}
+
+func TestProtocolCommands(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	r := &dc.RootProtocol
+	if err := r.RegisterCommand("StartDiscovery", func(args []byte) ([]byte, error) {
+		return append([]byte("started "), args...), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterCommand("StopDiscovery", func(args []byte) ([]byte, error) {
+		return nil, fmt.Errorf("discovery not running")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"AddDevice", "ApplyDiff", "Reconcile"} {
+		if err := r.RegisterCommand(name, func([]byte) ([]byte, error) { return nil, nil }); err != ErrReservedCommand {
+			t.Errorf("RegisterCommand %s: %v", name, err)
+		}
+	}
+	if err := r.RegisterCommand("not.valid", func([]byte) ([]byte, error) { return nil, nil }); err == nil || err.Name != "org.freedesktop.DBus.Error.InvalidArgs" {
+		t.Errorf("RegisterCommand with an invalid name: %v", err)
+	}
+	c := newTestClient(t, dc)
+	if err := c.call(c.root, dbusProtocolInterface+".AddDevice", "D1", "", "T", "1", []byte("{}")).Err; err != nil {
+		t.Error("AddDevice once its name is rejected as a command:", err)
+	}
+
+	var result []byte
+	if err := c.call(c.root, dbusProtocolInterface+".StartDiscovery", []byte("zigbee")).Store(&result); err != nil || string(result) != "started zigbee" {
+		t.Errorf("StartDiscovery: %q %v", result, err)
+	}
+	err := c.call(c.root, dbusProtocolInterface+".StopDiscovery", []byte{}).Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != "org.freedesktop.DBus.Error.Failed" || dbusErr.Body[0] != "discovery not running" {
+		t.Errorf("StopDiscovery: %v", err)
+	}
+	// The builtin methods are still exported along with the commands
+	if err := c.call(c.root, dbusProtocolInterface+".StateChecksum").Err; err != nil {
+		t.Error("StateChecksum with the commands registered:", err)
+	}
+
+	r.UnregisterCommand("StartDiscovery")
+	if !c.unreachable(c.root, dbusProtocolInterface+".StartDiscovery", []byte("zigbee")) {
+		t.Error("StartDiscovery callable once unregistered")
+	}
+	if err := c.call(c.root, dbusProtocolInterface+".StateChecksum").Err; err != nil {
+		t.Error("StateChecksum once a command is unregistered:", err)
+	}
+
+	dc.Close()
+	r.Protocol.Lock()
+	commands := len(r.commands)
+	r.Protocol.Unlock()
+	if commands != 0 {
+		t.Errorf("%d commands kept once closed", commands)
+	}
+}
+
+func TestDeviceLineage(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestDevice(t, p, "D1", "T")
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	addTestDevice(t, dc.Bridges["b"].Protocol, "D2", "T")
+	c := newTestClient(t, dc)
+
+	// The bridges do not nest, the deepest device belongs to a bridge of the root protocol
+	for path, want := range map[string][]string{
+		c.root + " D1":   {dc.ProtocolName, "D1"},
+		c.root + "_b D2": {dc.ProtocolName, "b", "D2"},
+	} {
+		parts := strings.Split(path, " ")
+		var lineage []string
+		if err := c.call(parts[0], dbusProtocolInterface+".DeviceLineage", parts[1]).Store(&lineage); err != nil || strings.Join(lineage, "/") != strings.Join(want, "/") {
+			t.Errorf("lineage of %s: %v %v, want %v", parts[1], lineage, err, want)
+		}
+	}
+	// A protocol only knows its own devices
+	err := c.call(c.root, dbusProtocolInterface+".DeviceLineage", "D2").Err
+	if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != ErrUnknownDevice.Name {
+		t.Errorf("lineage of a device of a bridge from the root: %v", err)
+	}
+}
+
+func TestValidateDevice(t *testing.T) {
+	var specs recorder
+	dc := &Dbus{ValidateDevice: func(spec DeviceSpec) error {
+		specs.record(fmt.Sprintf("%s/%s %s %s %s %s", spec.BridgeID, spec.DevID, spec.ComID, spec.TypeID, spec.TypeVersion, spec.Options))
+		switch spec.DevID {
+		case "Vetoed":
+			return errors.New("unsupported hardware")
+		case "Forbidden":
+			return dbus.NewError("com.ubiant.Test.Error.Forbidden", nil)
+		}
+		return nil
+	}}
+	p := newTestAdapter(t, dc, nil)
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	c := newTestClient(t, dc)
+	c.flush()
+
+	if err := c.call(c.root, dbusProtocolInterface+".AddDevice", "D1", "C1", "T", "1", []byte(`{"a":1}`)).Err; err != nil {
+		t.Fatal("device accepted by the hook:", err)
+	}
+	if _, err := bridge.Protocol.AddDevice("D2", "", "T", "2", []byte("{}")); err != nil {
+		t.Fatal("device of the bridge accepted by the hook:", err)
+	}
+	c.flush()
+
+	for _, vetoed := range []struct{ devID, err string }{
+		{"Vetoed", dbusProtocolInterface + ".Error.DeviceRejected"},
+		{"Forbidden", "com.ubiant.Test.Error.Forbidden"},
+	} {
+		err := c.call(c.root, dbusProtocolInterface+".AddDevice", vetoed.devID, "", "T", "1", []byte("{}")).Err
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != vetoed.err {
+			t.Errorf("AddDevice %s: %v, want %s", vetoed.devID, err, vetoed.err)
+		}
+		if hasDevice(p, vetoed.devID) {
+			t.Errorf("device %s added once vetoed", vetoed.devID)
+		}
+	}
+	if signals := c.flush(); len(signals) != 0 {
+		t.Errorf("signals of the vetoed devices: %v", names(signals))
+	}
+	want := []string{"/D1 C1 T 1 {\"a\":1}", "b/D2  T 2 {}", "/Vetoed  T 1 {}", "/Forbidden  T 1 {}"}
+	if got := specs.recorded(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("devices given to the hook: %q, want %q", got, want)
+	}
+}
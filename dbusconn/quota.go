@@ -0,0 +1,41 @@
+package dbusconn
+
+import "github.com/godbus/dbus/v5"
+
+// countType adds delta to the number of devices of the type
+func (dc *Dbus) countType(typeID string, delta int) {
+	dc.typeCountsLock.Lock()
+	defer dc.typeCountsLock.Unlock()
+	if dc.typeCounts == nil {
+		dc.typeCounts = make(map[string]int)
+	}
+	dc.typeCounts[typeID] += delta
+	if dc.typeCounts[typeID] <= 0 {
+		delete(dc.typeCounts, typeID)
+	}
+}
+
+// reserveType counts a device of the type unless it would exceed the quota of the type in TypeQuotas
+// The check and the count are atomic so that concurrent adds on several protocols cannot exceed the quota.
+func (dc *Dbus) reserveType(typeID string) bool {
+	dc.typeCountsLock.Lock()
+	defer dc.typeCountsLock.Unlock()
+	if quota, limited := dc.TypeQuotas[typeID]; limited && dc.typeCounts[typeID] >= quota {
+		return false
+	}
+	if dc.typeCounts == nil {
+		dc.typeCounts = make(map[string]int)
+	}
+	dc.typeCounts[typeID]++
+	return true
+}
+
+// admitType counts the new device devID of the type, ErrTypeQuotaExceeded is returned if its quota is reached
+func (p *Protocol) admitType(devID string, typeID string) *dbus.Error {
+	if p.dc.reserveType(typeID) {
+		return nil
+	}
+	p.log.Warning("Device", devID, "rejected, the quota of the type", typeID, "is reached")
+	p.dc.addMetric(metricQuotaRejections, 1)
+	return ErrTypeQuotaExceeded
+}
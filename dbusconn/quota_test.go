@@ -0,0 +1,131 @@
+package dbusconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// rejectingDriver rejects in AddDeviceSync the devices whose ID starts with X
+type rejectingDriver struct{}
+
+func (r *rejectingDriver) AddDeviceSync(ctx context.Context, d *Device) error {
+	if strings.HasPrefix(d.DevID, "X") {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func TestTypeQuotas(t *testing.T) {
+	dc := &Dbus{TypeQuotas: map[string]int{"Q": 2}}
+	p := newTestAdapter(t, dc, nil)
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+
+	addTestDevice(t, p, "D1", "Q")
+	addTestDevice(t, bridge.Protocol, "D2", "Q")
+	if _, err := p.AddDevice("D3", "", "Q", "1", []byte("{}")); err != ErrTypeQuotaExceeded {
+		t.Errorf("AddDevice over the quota of the type across the bridges: %v", err)
+	}
+	if hasDevice(p, "D3") {
+		t.Error("device over the quota added")
+	}
+	if alreadyAdded, err := p.AddDevice("D1", "", "Q", "1", []byte("{}")); err != nil || !alreadyAdded {
+		t.Errorf("AddDevice of a device already added once the quota is reached: %v %v", alreadyAdded, err)
+	}
+
+	// The other types are not limited
+	for n := 0; n < 5; n++ {
+		addTestDevice(t, p, fmt.Sprintf("T%d", n), "T")
+	}
+	if _, err := p.CloneDevice("D1", "D4"); err != ErrTypeQuotaExceeded {
+		t.Errorf("CloneDevice over the quota: %v", err)
+	}
+	if _, err := p.AddPlaceholderDevice("P1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDevice(t, p, "P1").Complete("addr", "Q", "1", []byte("{}")); err != ErrTypeQuotaExceeded {
+		t.Errorf("Complete of a placeholder over the quota: %v", err)
+	}
+	if rejections := dc.Metrics()[metricQuotaRejections]; rejections != 3 {
+		t.Errorf("%d rejections counted, want 3", rejections)
+	}
+
+	// A removed device frees its place, on the protocol that had it or on another one
+	if err := bridge.Protocol.RemoveDevice("D2"); err != nil {
+		t.Fatal(err)
+	}
+	addTestDevice(t, p, "D3", "Q")
+	if err := testDevice(t, p, "P1").Complete("addr", "Q", "1", []byte("{}")); err != ErrTypeQuotaExceeded {
+		t.Errorf("Complete of a placeholder once the place is taken again: %v", err)
+	}
+	if err := p.RemoveDevice("D1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDevice(t, p, "P1").Complete("addr", "Q", "1", []byte("{}")); err != nil {
+		t.Errorf("Complete of a placeholder within the quota: %v", err)
+	}
+}
+
+func TestTypeQuotaOfRejectedDevices(t *testing.T) {
+	dc := &Dbus{TypeQuotas: map[string]int{"Q": 1}}
+	p := newTestAdapter(t, dc, &rejectingDriver{})
+
+	// A device rejected by the protocol does not keep its place
+	for n := 0; n < 3; n++ {
+		if _, err := p.AddDevice(fmt.Sprintf("X%d", n), "", "Q", "1", []byte("{}")); err == nil {
+			t.Fatal("device accepted by the driver rejecting it")
+		}
+	}
+	addTestDevice(t, p, "D1", "Q")
+	if _, err := p.AddDevice("D2", "", "Q", "1", []byte("{}")); err != ErrTypeQuotaExceeded {
+		t.Errorf("AddDevice over the quota: %v", err)
+	}
+}
+
+func TestConcurrentAddsWithinTheQuota(t *testing.T) {
+	const quota = 5
+	dc := &Dbus{TypeQuotas: map[string]int{"Q": quota}}
+	p := newTestAdapter(t, dc, nil)
+	protocols := []*Protocol{p}
+	for _, bridgeID := range []string{"b", "c", "d"} {
+		if _, err := dc.RootProtocol.AddBridge(bridgeID); err != nil {
+			t.Fatal(err)
+		}
+		bridge, _ := testBridge(dc, bridgeID)
+		protocols = append(protocols, bridge.Protocol)
+	}
+
+	// The adds of the protocols race for the places of the type, as many as the quota succeed
+	var added, rejected int32
+	var wg sync.WaitGroup
+	for n, protocol := range protocols {
+		for m := 0; m < quota; m++ {
+			wg.Add(1)
+			go func(protocol *Protocol, devID string) {
+				defer wg.Done()
+				switch _, err := protocol.AddDevice(devID, "", "Q", "1", []byte("{}")); err {
+				case nil:
+					atomic.AddInt32(&added, 1)
+				case ErrTypeQuotaExceeded:
+					atomic.AddInt32(&rejected, 1)
+				default:
+					t.Errorf("AddDevice %s: %v", devID, err)
+				}
+			}(protocol, fmt.Sprintf("D%d_%d", n, m))
+		}
+	}
+	wg.Wait()
+	if added != quota || int(rejected) != len(protocols)*quota-quota {
+		t.Errorf("%d devices added and %d rejected, want %d added", added, rejected, quota)
+	}
+	if rejections := dc.Metrics()[metricQuotaRejections]; rejections != int64(rejected) {
+		t.Errorf("%d rejections counted, want %d", rejections, rejected)
+	}
+}
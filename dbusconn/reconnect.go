@@ -0,0 +1,203 @@
+package dbusconn
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	// reconnectMinDelay is the delay before the first attempt to reconnect, doubled after each failed attempt
+	reconnectMinDelay = time.Second
+	// defaultReconnectMaxDelay is the longest delay between two attempts to reconnect
+	defaultReconnectMaxDelay = 30 * time.Second
+)
+
+// watchConnection reconnects to the system bus when the connection of the adapter is lost
+// The adapters of a shared connection all reconnect on the same new connection, see SharedConn.redial.
+func (dc *Dbus) watchConnection(dbusName string) {
+	done, started := dc.startWatcher(&dc.reconnectDone)
+	if !started {
+		return
+	}
+	conn := dc.connection()
+	go func() {
+		select {
+		case <-conn.Context().Done():
+		case <-done:
+			return
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		dc.Log.Warning("Connection to Dbus lost, reconnecting")
+		dc.updateHealth()
+		dc.reconnect(dbusName, conn, done)
+	}()
+}
+
+func (dc *Dbus) stopWatchingConnection() {
+	dc.stopWatcher(&dc.reconnectDone)
+}
+
+// reconnect connects again to the system bus with a growing delay between the attempts until it succeeds or the
+// adapter is closed
+func (dc *Dbus) reconnect(dbusName string, lost *dbus.Conn, done chan struct{}) {
+	maxDelay := dc.ReconnectMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultReconnectMaxDelay
+	}
+	delay := reconnectMinDelay
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(delay):
+		}
+
+		conn, err := dc.dial(lost)
+		if err == nil {
+			var reply dbus.RequestNameReply
+			reply, err = conn.RequestName(dbusName, dc.nameRequestFlags())
+			if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+				dc.Log.Warning("Dbus name", dbusName, "is already taken")
+			}
+		}
+		if err == nil {
+			dc.resume(conn, dbusName)
+			return
+		}
+		if conn != nil && dc.SharedConn == nil {
+			conn.Close()
+		}
+
+		dc.Log.Warning("Fail to reconnect to Dbus, next attempt in", delay, err)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// dial opens a new connection to the system bus to replace the lost one
+func (dc *Dbus) dial(lost *dbus.Conn) (*dbus.Conn, error) {
+	if dc.SharedConn != nil {
+		return dc.SharedConn.redial(lost)
+	}
+	return dbus.ConnectSystemBus()
+}
+
+// resume exports the tree again on the new connection with the current values of the properties, installs again
+// the match rules and calls OnReconnected
+func (dc *Dbus) resume(conn *dbus.Conn, dbusName string) {
+	// Close waits for the tree to be exported on the new connection and closes it, or the new connection is dropped
+	dc.lifecycleLock.Lock()
+	if dc.closed {
+		dc.lifecycleLock.Unlock()
+		if dc.SharedConn == nil {
+			conn.Close()
+		}
+		return
+	}
+	dc.freezeLock.Lock()
+	dc.setConnection(conn)
+	dc.reexportAll()
+	dc.freezeLock.Unlock()
+	dc.lifecycleLock.Unlock()
+	dc.refreshProperties()
+	dc.updateHealth()
+
+	dc.matchRulesLock.Lock()
+	dc.matchRules = nil
+	dc.matchRulesLock.Unlock()
+	dc.trackClients()
+	dc.watchNameLost(dbusName)
+	dc.resubscribe()
+	dc.watchConnection(dbusName)
+	dc.Log.Info("Reconnected on DBus")
+
+	if dc.OnReconnected != nil {
+		dc.OnReconnected()
+	}
+}
+
+// reexportAll exports every registered object on the connection, the properties are exported with their current
+// values and the aliases share again the properties of their device
+func (dc *Dbus) reexportAll() {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+
+	for path, obj := range dc.exports {
+		if obj.propsSpec == nil {
+			continue
+		}
+		properties, err := prop.Export(dc.connection(), path, obj.propsSpec)
+		if err != nil {
+			dc.Log.Warning("Fail to export again the properties of", path, err)
+			obj.failed = true
+			continue
+		}
+		delete(dc.propertiesPaths, obj.properties)
+		obj.properties = properties
+		dc.propertiesPaths[properties] = path
+	}
+	for path, obj := range dc.exports {
+		if source, present := dc.exports[obj.aliasOf]; obj.aliasOf != "" && present {
+			obj.properties = source.properties
+		}
+		err := dc.reexportObject(path, obj)
+		obj.failed = err != nil
+		if err != nil {
+			dc.Log.Warning("Fail to export again the object", path, err)
+		}
+	}
+}
+
+// exportedProperties returns the properties exported on the path
+func (dc *Dbus) exportedProperties(path dbus.ObjectPath) *prop.Properties {
+	dc.exportsLock.Lock()
+	defer dc.exportsLock.Unlock()
+	if obj, present := dc.exports[path]; present {
+		return obj.properties
+	}
+	return nil
+}
+
+// refreshProperties gives the protocols, the devices and the items the properties exported on the new connection
+func (dc *Dbus) refreshProperties() {
+	for _, p := range dc.protocols() {
+		p.Lock()
+		p.properties = dc.exportedProperties(dbus.ObjectPath(p.path))
+		for devID, d := range p.Devices {
+			d.Lock()
+			d.properties = dc.exportedProperties(dbus.ObjectPath(p.path + "/" + devID))
+			for itemID, i := range d.Items {
+				i.Lock()
+				i.properties = dc.exportedProperties(dbus.ObjectPath(p.path + "/" + devID + "/" + itemID))
+				i.Unlock()
+			}
+			d.Unlock()
+		}
+		p.Unlock()
+	}
+}
+
+// resubscribe installs again the match rules of the subscriptions and listens to the new connection
+func (dc *Dbus) resubscribe() {
+	dc.subscriptionsLock.Lock()
+	subscriptions := make([]*subscription, 0, len(dc.subscriptions))
+	for _, s := range dc.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	dc.subscriptionsLock.Unlock()
+
+	for _, s := range subscriptions {
+		if err := dc.addMatch(s.rule); err != nil {
+			dc.Log.Warning("Fail to subscribe again to the signals of", s.info.Interface, s.info.Member, s.info.Path, err)
+		}
+		dc.listen(s)
+	}
+}
@@ -0,0 +1,195 @@
+package dbusconn
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// newReconnectingAdapter returns an adapter with the channel told about each reconnection
+func newReconnectingAdapter(t *testing.T, dc *Dbus) (*Protocol, chan struct{}) {
+	t.Helper()
+	reconnected := make(chan struct{}, 1)
+	dc.OnReconnected = func() { reconnected <- struct{}{} }
+	return newTestAdapter(t, dc, nil), reconnected
+}
+
+// dropConnection closes the connection of the adapter and waits for the adapter to be connected again
+func dropConnection(t *testing.T, dc *Dbus, reconnected chan struct{}, meanwhile func()) {
+	t.Helper()
+	lost := dc.connection()
+	lost.Close()
+	if meanwhile != nil {
+		meanwhile()
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(signalTimeout):
+		t.Fatal("Timeout waiting for the reconnection")
+	}
+	if dc.connection() == lost {
+		t.Fatal("connection not replaced")
+	}
+}
+
+func TestReconnectExportsTheTreeAgain(t *testing.T) {
+	dc := &Dbus{}
+	p, reconnected := newReconnectingAdapter(t, dc)
+	d := addTestDevice(t, p, "D1", "T")
+	i := addTestItem(t, d, "I1", "T")
+	i.SetValue([]byte("1"))
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	addTestDevice(t, bridge.Protocol, "D2", "T")
+	received := make(chan *dbus.Signal, 1)
+	cancel, err := dc.Subscribe("com.ubiant.Test", "Ping", "", func(s *dbus.Signal) { received <- s })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	p.SetReadyWithState(true)
+
+	dropConnection(t, dc, reconnected, func() {
+		if health := dc.health(); health != HealthKo {
+			t.Errorf("health once the connection is lost: %s", health)
+		}
+		i.SetValue([]byte("2"))
+	})
+	c := newTestClient(t, dc)
+	var owner string
+	if err := c.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, dbusNamePrefix+dc.ProtocolName).Store(&owner); err != nil || owner != dc.connection().Names()[0] {
+		t.Errorf("owner of the name once reconnected: %q %v", owner, err)
+	}
+	if value, err := c.property(c.root+"/D1/I1", dbusItemInterface, propertyValue); err != nil || string(value.Value().([]byte)) != "2" {
+		t.Errorf("value set while disconnected: %v %v", value, err)
+	}
+	if _, err := c.property(c.root+"_b/D2", dbusDeviceInterface, propertyOptions); err != nil {
+		t.Error("device of the bridge not exported again:", err)
+	}
+	if objects := managedObjects(t, c); len(objects) != 4 {
+		t.Errorf("managed objects once reconnected: %v", objects)
+	}
+
+	// The changes and the subscriptions work on the new connection
+	i.SetValue([]byte("3"))
+	changed := c.wait(c.root+"/D1/I1", dbusPropertiesInterface+".PropertiesChanged")
+	if value := changed.Body[1].(map[string]dbus.Variant)[propertyValue].Value(); string(value.([]byte)) != "3" {
+		t.Errorf("value changed once reconnected: %v", value)
+	}
+	if err := c.conn.Emit(dbus.ObjectPath("/test"), "com.ubiant.Test.Ping"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(signalTimeout):
+		t.Error("subscription lost by the reconnection")
+	}
+	if health, err := c.property(c.root, dbusProtocolInterface, propertyHealth); err != nil || health.Value() != string(HealthOk) {
+		t.Errorf("health once reconnected: %v %v", health, err)
+	}
+}
+
+func TestReconnectWithConcurrentAdds(t *testing.T) {
+	dc := &Dbus{}
+	p, reconnected := newReconnectingAdapter(t, dc)
+
+	// The devices added while the connection is lost and while it is replaced are all exported on the new one
+	const adders = 4
+	adds := make([]int, adders)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	dropConnection(t, dc, reconnected, func() {
+		for n := 0; n < adders; n++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				for m := 0; ; m++ {
+					d := addTestDevice(t, p, fmt.Sprintf("D%d_%d", n, m), "T")
+					addTestItem(t, d, "I1", "T").SetValue([]byte(fmt.Sprint(m)))
+					select {
+					case <-stop:
+						adds[n] = m + 1
+						return
+					case <-time.After(20 * time.Millisecond):
+					}
+				}
+			}(n)
+		}
+	})
+	close(stop)
+	wg.Wait()
+
+	c := newTestClient(t, dc)
+	for n := 0; n < adders; n++ {
+		for m := 0; m < adds[n]; m++ {
+			path := fmt.Sprintf("%s/D%d_%d/I1", c.root, n, m)
+			if value, err := c.property(path, dbusItemInterface, propertyValue); err != nil || string(value.Value().([]byte)) != fmt.Sprint(m) {
+				t.Errorf("%s once reconnected: %v %v", path, value, err)
+			}
+			// The item changes its properties on the connection where they are exported
+			d := testDevice(t, p, fmt.Sprintf("D%d_%d", n, m))
+			d.Lock()
+			i := d.Items["I1"]
+			d.Unlock()
+			i.SetValue([]byte("new"))
+			if value, err := c.property(path, dbusItemInterface, propertyValue); err != nil || string(value.Value().([]byte)) != "new" {
+				t.Errorf("%s changed once reconnected: %v %v", path, value, err)
+			}
+		}
+	}
+}
+
+func TestSequenceKeptAcrossReconnects(t *testing.T) {
+	dc := &Dbus{SignalSequence: true}
+	p, reconnected := newReconnectingAdapter(t, dc)
+	addTestDevice(t, p, "D1", "T")
+	before, _ := dc.GetSequence()
+
+	for reconnect := 0; reconnect < 2; reconnect++ {
+		dropConnection(t, dc, reconnected, func() { addTestDevice(t, p, fmt.Sprintf("L%d", reconnect), "T") })
+	}
+	c := newTestClient(t, dc)
+	c.flush()
+	addTestDevice(t, p, "D2", "T")
+	added := c.wait(c.root+"/D2", dbusDeviceInterface+"."+signalDeviceAdded)
+	sequence, ok := added.Body[len(added.Body)-1].(uint64)
+	if !ok || sequence != before+3 {
+		t.Errorf("sequence of DeviceAdded once reconnected twice: %v, before the reconnections %d", added.Body, before)
+	}
+	var last uint64
+	if err := c.call(c.root, dbusProtocolInterface+".GetSequence").Store(&last); err != nil || last != sequence {
+		t.Errorf("GetSequence: %d %v, want %d", last, err, sequence)
+	}
+}
+
+func TestCloseWhileReconnecting(t *testing.T) {
+	for _, delay := range []time.Duration{0, reconnectMinDelay - 5*time.Millisecond, reconnectMinDelay + 5*time.Millisecond} {
+		t.Run(delay.String(), func(t *testing.T) {
+			dc := &Dbus{AllowHandoff: true}
+			p, reconnected := newReconnectingAdapter(t, dc)
+			addTestDevice(t, p, "D1", "T")
+			c := newTestClient(t, dc)
+
+			dc.connection().Close()
+			time.Sleep(delay)
+			// The name cannot be released on the lost connection, the error of Close is expected
+			dc.Close()
+			// A reconnection made during Close drops its connection, the name is released
+			waitFor(t, "the release of the name", func() bool {
+				return c.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, dbusNamePrefix+dc.ProtocolName).Err != nil
+			})
+			select {
+			case <-reconnected:
+			case <-time.After(reconnectMinDelay):
+			}
+			if dc.connection().Connected() {
+				t.Error("connection left open once closed")
+			}
+		})
+	}
+}
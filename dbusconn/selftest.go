@@ -0,0 +1,140 @@
+package dbusconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// selfTestPathPrefix is outside of the tree so that the clients of the devices never see the self-test object
+	selfTestPathPrefix = "/com/ubiant/SelfTest/"
+	selfTestInterface  = "com.ubiant.SelfTest"
+	signalSelfTest     = "SelfTest"
+)
+
+// ErrSelfTestFailed is returned when a step of the self-test fails, the report tells which one
+var ErrSelfTestFailed = dbus.NewError(dbusProtocolInterface+".Error.SelfTestFailed", []interface{}{"The self-test failed"})
+
+// selfTestReport is the result of the steps of the self-test, one line per step
+type selfTestReport struct {
+	lines  []string
+	failed bool
+}
+
+func (r *selfTestReport) step(name string, err error) bool {
+	if err != nil {
+		r.lines = append(r.lines, name+": FAIL: "+err.Error())
+		r.failed = true
+		return false
+	}
+	r.lines = append(r.lines, name+": PASS")
+	return true
+}
+
+func (r *selfTestReport) String() string {
+	return strings.Join(r.lines, "\n")
+}
+
+// SelfTest checks the export and emit pipeline on the bus with a throwaway object outside of the tree
+// The object is exported, checked through introspection, emits a signal which must be received back and is
+// unexported. It is not a device: the driver, the lifecycle signals, the metrics, the quotas and the tombstones
+// are not involved. The report has a PASS or FAIL line per step, ErrSelfTestFailed is returned with it when a step
+// fails.
+func (dc *Dbus) SelfTest() (string, *dbus.Error) {
+	dc.Log.Info("SelfTest called")
+	if dc.connection() == nil {
+		return "", &dbus.ErrMsgNoObject
+	}
+	path := dbus.ObjectPath(fmt.Sprintf("%s%s/T%d", selfTestPathPrefix, dc.ProtocolName, time.Now().UnixNano()))
+	report := &selfTestReport{}
+
+	ping := map[string]interface{}{"Ping": func() *dbus.Error { return nil }}
+	if !report.step("export", dc.exportMethods(path, selfTestInterface, ping)) {
+		dc.unexportObject(path)
+		return report.String(), ErrSelfTestFailed
+	}
+
+	if report.step("introspect", errorIf(!dc.introspectsInterface(path, selfTestInterface), "the self-test interface is not introspected")) {
+		report.step("emit and receive", dc.selfTestSignal(path))
+	}
+
+	dc.unexportObject(path)
+	report.step("unexport", errorIf(dc.selfTestPing(path) == nil, "the self-test object still answers"))
+
+	if report.failed {
+		return report.String(), ErrSelfTestFailed
+	}
+	return report.String(), nil
+}
+
+// introspectsInterface checks through the bus that the introspection data of the path has the interface
+// Any path answers to introspection, only the interfaces tell whether an object is exported on it
+func (dc *Dbus) introspectsInterface(path dbus.ObjectPath, iface string) bool {
+	conn := dc.connection()
+	names := conn.Names()
+	if len(names) == 0 {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+
+	var data string
+	obj := conn.Object(names[0], path)
+	if err := obj.CallWithContext(ctx, dbusIntrospectableInterface+".Introspect", 0).Store(&data); err != nil {
+		return false
+	}
+	return strings.Contains(data, `"`+iface+`"`)
+}
+
+// selfTestPing calls the method Ping of the self-test object through the bus
+// An unexported path is not introspected to check it is gone, godbus answers it without locking its objects.
+func (dc *Dbus) selfTestPing(path dbus.ObjectPath) error {
+	conn := dc.connection()
+	names := conn.Names()
+	if len(names) == 0 {
+		return errors.New("the connection has no name")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	return conn.Object(names[0], path).CallWithContext(ctx, selfTestInterface+".Ping", 0).Err
+}
+
+// selfTestSignal emits a signal from the path and waits to receive it back from the bus
+func (dc *Dbus) selfTestSignal(path dbus.ObjectPath) error {
+	received := make(chan struct{}, 1)
+	cancel, err := dc.Subscribe(selfTestInterface, signalSelfTest, path, func(*dbus.Signal) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	if err := dc.connection().Emit(path, selfTestInterface+"."+signalSelfTest); err != nil {
+		return err
+	}
+	select {
+	case <-received:
+		return nil
+	case <-time.After(callTimeout):
+		return fmt.Errorf("the signal was not received within %s", callTimeout)
+	}
+}
+
+// errorIf returns an error with the message if the condition is true
+func errorIf(condition bool, msg string) error {
+	if condition {
+		return errors.New(msg)
+	}
+	return nil
+}
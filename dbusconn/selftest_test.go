@@ -0,0 +1,64 @@
+package dbusconn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestSelfTestPasses(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+	metrics := dc.Metrics()
+	rules := dc.ExportedMatchRules()
+
+	var report string
+	if err := c.call(c.root, dbusProtocolInterface+".SelfTest").Store(&report); err != nil {
+		t.Fatal(err, report)
+	}
+	if want := "export: PASS\nintrospect: PASS\nemit and receive: PASS\nunexport: PASS"; report != want {
+		t.Errorf("report:\n%s\nwant:\n%s", report, want)
+	}
+
+	// The self-test leaves nothing behind and the clients of the tree see none of it
+	if signals := c.flush(); len(signals) != 0 {
+		t.Errorf("signals of the self-test: %v", names(signals))
+	}
+	p.Lock()
+	devices := len(p.Devices)
+	p.Unlock()
+	if devices != 0 {
+		t.Errorf("%d devices once the self-test is over", devices)
+	}
+	if !reflect.DeepEqual(dc.Metrics(), metrics) {
+		t.Errorf("metrics changed by the self-test: %v, before %v", dc.Metrics(), metrics)
+	}
+	if !reflect.DeepEqual(dc.ExportedMatchRules(), rules) {
+		t.Errorf("match rules left by the self-test: %v, before %v", dc.ExportedMatchRules(), rules)
+	}
+}
+
+func TestSelfTestReportsABrokenConnection(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	broken, err := dbus.ConnectSystemBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.Close()
+	working := dc.connection()
+	dc.setConnection(broken)
+	t.Cleanup(func() { dc.setConnection(working) })
+
+	report, dbusErr := dc.SelfTest()
+	if dbusErr != ErrSelfTestFailed {
+		t.Errorf("SelfTest on a closed connection: %v", dbusErr)
+	}
+	if !strings.Contains(report, "introspect: FAIL") || strings.Contains(report, "emit and receive") {
+		t.Errorf("report of a closed connection:\n%s", report)
+	}
+}
@@ -0,0 +1,206 @@
+package dbusconn
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// DeviceAddedPayload is the content of the signal DeviceAdded
+type DeviceAddedPayload struct {
+	Address     string
+	TypeID      string
+	TypeVersion string
+	Options     []byte
+}
+
+// DeviceCompletedPayload is the content of the signal DeviceCompleted
+type DeviceCompletedPayload struct {
+	Address     string
+	TypeID      string
+	TypeVersion string
+	Options     []byte
+}
+
+// ItemAddedPayload is the content of the signal ItemAdded
+type ItemAddedPayload struct {
+	TypeID      string
+	TypeVersion string
+	Options     []byte
+}
+
+// ComIDChangedPayload is the content of the signal ComIDChanged
+type ComIDChangedPayload struct {
+	OldComID string
+	ComID    string
+}
+
+// DeviceErrorPayload is the content of the signal DeviceError
+type DeviceErrorPayload struct {
+	Error string
+}
+
+// ValueRejectedPayload is the content of the signal ValueRejected, Reason is the name of the error of the rejection
+type ValueRejectedPayload struct {
+	Value  []byte
+	Reason string
+}
+
+// LimitExceededPayload is the content of the signal LimitExceeded
+type LimitExceededPayload struct {
+	BridgeID   string
+	MaxBridges int32
+}
+
+// BridgeStateChangedPayload is the content of the signal BridgeStateChanged
+type BridgeStateChangedPayload struct {
+	OldState string
+	State    string
+}
+
+// AnyBridgeReadyChangedPayload is the content of the signal AnyBridgeReadyChanged
+type AnyBridgeReadyChangedPayload struct {
+	BridgeID string
+	Ready    bool
+}
+
+// ReachabilityChangedPayload is the content of the signal ReachabilityChanged
+type ReachabilityChangedPayload struct {
+	DevIDs    []string
+	Reachable bool
+}
+
+// signalArgs converts a signal payload into the signal arguments, in the order of its fields
+func signalArgs(payload interface{}) []interface{} {
+	v := reflect.ValueOf(payload)
+	args := make([]interface{}, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		args = append(args, v.Field(i).Interface())
+	}
+	return args
+}
+
+// lifecycle gives the next sequence number to the arguments of a lifecycle signal
+func (dc *Dbus) lifecycle(args ...interface{}) lifecycleSignal {
+	dc.sequenceLock.Lock()
+	dc.sequence++
+	sequence := dc.sequence
+	dc.sequenceLock.Unlock()
+	return lifecycleSignal{args: args, sequence: sequence}
+}
+
+// GetSequence is the dbus method to get the sequence number of the last lifecycle signal
+func (dc *Dbus) GetSequence() (uint64, *dbus.Error) {
+	dc.sequenceLock.Lock()
+	defer dc.sequenceLock.Unlock()
+	return dc.sequence, nil
+}
+
+func (d *Device) emitDeviceAdded(payload DeviceAddedPayload) {
+	path := dbus.ObjectPath(d.Protocol.path + "/" + d.DevID)
+	s := d.dc.lifecycle(signalArgs(payload)...)
+	added := func() {
+		if err := d.dc.emitLifecycle(path, dbusDeviceInterface+"."+signalDeviceAdded, s); err != nil {
+			d.dc.addMetric(metricDroppedSignals, 1)
+		}
+		d.dc.emitInterfacesAdded(path)
+	}
+	if !d.Protocol.delayDeviceAdded(d, added) {
+		d.emitSignal(added)
+	}
+}
+
+func (d *Device) emitDeviceCompleted(payload DeviceCompletedPayload) {
+	d.emitLifecycleSignal(signalDeviceCompleted, d.dc.lifecycle(signalArgs(payload)...))
+}
+
+func (i *Item) emitItemAdded(payload ItemAddedPayload) {
+	i.emitLifecycleSignal(signalItemAdded, i.dc.lifecycle(signalArgs(payload)...))
+	path := dbus.ObjectPath(i.Device.Protocol.path + "/" + i.Device.DevID + "/" + i.ItemID)
+	i.Device.emitSignal(func() { i.dc.emitInterfacesAdded(path) })
+}
+
+func (d *Device) emitComIDChanged(payload ComIDChangedPayload) {
+	d.emitLifecycleSignal(signalComIDChanged, d.dc.lifecycle(signalArgs(payload)...))
+}
+
+func (d *Device) emitDeviceError(payload DeviceErrorPayload) {
+	d.EmitDbusSignal(signalDeviceError, signalArgs(payload)...)
+}
+
+func (i *Item) emitValueRejected(payload ValueRejectedPayload) {
+	i.EmitDbusSignal(signalValueRejected, signalArgs(payload)...)
+}
+
+func (p *Protocol) emitLimitExceeded(payload LimitExceededPayload) {
+	p.EmitDbusSignal(signalLimitExceeded, signalArgs(payload)...)
+}
+
+func (p *Protocol) emitBridgeStateChanged(payload BridgeStateChangedPayload) {
+	p.emitLifecycleSignal(signalBridgeStateChanged, p.dc.lifecycle(signalArgs(payload)...))
+}
+
+// emitAnyBridgeReadyChanged emits the signal on the root protocol
+func (p *Protocol) emitAnyBridgeReadyChanged(payload AnyBridgeReadyChangedPayload) {
+	p.dc.RootProtocol.Protocol.emitLifecycleSignal(signalAnyBridgeReadyChanged, p.dc.lifecycle(signalArgs(payload)...))
+}
+
+func (p *Protocol) emitReachabilityChanged(payload ReachabilityChangedPayload) {
+	p.EmitDbusSignal(signalReachabilityChanged, signalArgs(payload)...)
+}
+
+// heldSignal is a signal held back while a diff is applied
+type heldSignal struct {
+	// about is the path of the object the signal tells about
+	about dbus.ObjectPath
+	// key is set when a later held signal with the same key supersedes this one
+	key  string
+	send func() error
+}
+
+// emit sends a signal about the object of the path, the signal is held back while a diff is applied and sent once
+// the diff is done
+func (dc *Dbus) emit(about dbus.ObjectPath, send func() error) error {
+	return dc.emitHeld(heldSignal{about: about, send: send})
+}
+
+// emitHeld sends the signal or holds it back while a diff is applied
+func (dc *Dbus) emitHeld(signal heldSignal) error {
+	dc.heldLock.Lock()
+	if dc.holding {
+		dc.held = append(dc.held, signal)
+		dc.heldLock.Unlock()
+		return nil
+	}
+	dc.heldLock.Unlock()
+	return signal.send()
+}
+
+// EmitTo emits a signal addressed to a single bus name instead of broadcasting it
+// The signal must be formatted as "interface.member"
+func (dc *Dbus) EmitTo(dest string, path dbus.ObjectPath, signal string, args ...interface{}) error {
+	if !path.IsValid() {
+		return errors.New("invalid object path")
+	}
+	i := strings.LastIndex(signal, ".")
+	if i == -1 {
+		return errors.New("invalid signal name")
+	}
+
+	msg := &dbus.Message{
+		Type: dbus.TypeSignal,
+		Headers: map[dbus.HeaderField]dbus.Variant{
+			dbus.FieldPath:        dbus.MakeVariant(path),
+			dbus.FieldInterface:   dbus.MakeVariant(signal[:i]),
+			dbus.FieldMember:      dbus.MakeVariant(signal[i+1:]),
+			dbus.FieldDestination: dbus.MakeVariant(dest),
+		},
+		Body: args,
+	}
+	if len(args) > 0 {
+		msg.Headers[dbus.FieldSignature] = dbus.MakeVariant(dbus.SignatureOf(args...))
+	}
+	return dc.connection().Send(msg, nil).Err
+}
@@ -0,0 +1,180 @@
+package dbusconn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestSignalPayloads(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+
+	if _, err := p.AddDevice("D1", "C1", "T", "2", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	var added DeviceAddedPayload
+	s := c.wait(c.root+"/D1", dbusDeviceInterface+"."+signalDeviceAdded)
+	if err := dbus.Store(s.Body, &added.Address, &added.TypeID, &added.TypeVersion, &added.Options); err != nil {
+		t.Fatal(err)
+	}
+	if added.Address != "C1" || added.TypeID != "T" || added.TypeVersion != "2" || string(added.Options) != `{"a":1}` {
+		t.Errorf("DeviceAdded decoded as %+v", added)
+	}
+
+	d := testDevice(t, p, "D1")
+	if _, err := d.AddItem("I1", "IT", "3", []byte(`{"b":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	var itemAdded ItemAddedPayload
+	s = c.wait(c.root+"/D1/I1", dbusItemInterface+"."+signalItemAdded)
+	if err := dbus.Store(s.Body, &itemAdded.TypeID, &itemAdded.TypeVersion, &itemAdded.Options); err != nil {
+		t.Fatal(err)
+	}
+	if itemAdded.TypeID != "IT" || itemAdded.TypeVersion != "3" || string(itemAdded.Options) != `{"b":2}` {
+		t.Errorf("ItemAdded decoded as %+v", itemAdded)
+	}
+
+	if _, err := p.AddPlaceholderDevice("P1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDevice(t, p, "P1").Complete("C2", "T", "4", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	var completed DeviceCompletedPayload
+	s = c.wait(c.root+"/P1", dbusDeviceInterface+"."+signalDeviceCompleted)
+	if err := dbus.Store(s.Body, &completed.Address, &completed.TypeID, &completed.TypeVersion, &completed.Options); err != nil {
+		t.Fatal(err)
+	}
+	if completed.Address != "C2" || completed.TypeID != "T" || completed.TypeVersion != "4" || string(completed.Options) != `{}` {
+		t.Errorf("DeviceCompleted decoded as %+v", completed)
+	}
+
+	if err := d.SetComID("C3"); err != nil {
+		t.Fatal(err)
+	}
+	var comIDChanged ComIDChangedPayload
+	s = c.wait(c.root+"/D1", dbusDeviceInterface+"."+signalComIDChanged)
+	if err := dbus.Store(s.Body, &comIDChanged.OldComID, &comIDChanged.ComID); err != nil {
+		t.Fatal(err)
+	}
+	if comIDChanged.OldComID != "C1" || comIDChanged.ComID != "C3" {
+		t.Errorf("ComIDChanged decoded as %+v", comIDChanged)
+	}
+
+	d.SetError("timeout")
+	var deviceError DeviceErrorPayload
+	s = c.wait(c.root+"/D1", dbusDeviceInterface+"."+signalDeviceError)
+	if err := dbus.Store(s.Body, &deviceError.Error); err != nil || deviceError.Error != "timeout" {
+		t.Errorf("DeviceError decoded as %+v %v", deviceError, err)
+	}
+
+	if err := p.SetReachability([]string{"D1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	var reachability ReachabilityChangedPayload
+	s = c.wait(c.root, dbusProtocolInterface+"."+signalReachabilityChanged)
+	if err := dbus.Store(s.Body, &reachability.DevIDs, &reachability.Reachable); err != nil {
+		t.Fatal(err)
+	}
+	if len(reachability.DevIDs) != 1 || reachability.DevIDs[0] != "D1" || reachability.Reachable {
+		t.Errorf("ReachabilityChanged decoded as %+v", reachability)
+	}
+}
+
+func TestSignalArgsFollowTheFields(t *testing.T) {
+	args := signalArgs(DeviceAddedPayload{Address: "a", TypeID: "t", TypeVersion: "v", Options: []byte("o")})
+	if len(args) != 4 || args[0] != "a" || args[1] != "t" || args[2] != "v" || string(args[3].([]byte)) != "o" {
+		t.Errorf("signalArgs: %v", args)
+	}
+}
+
+func TestEmitToASingleDestination(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	addressee := newTestClient(t, dc)
+	other := newTestClient(t, dc)
+	path := dbus.ObjectPath(addressee.root + "/D1")
+
+	if err := dc.EmitTo(addressee.conn.Names()[0], path, "com.ubiant.Test.Ping", "x", int32(1)); err != nil {
+		t.Fatal(err)
+	}
+	signals := addressee.flush()
+	if len(signals) != 1 || signals[0].Path != path || signals[0].Name != "com.ubiant.Test.Ping" {
+		t.Fatalf("signals of the destination: %v", names(signals))
+	}
+	var text string
+	var n int32
+	if err := dbus.Store(signals[0].Body, &text, &n); err != nil || text != "x" || n != 1 {
+		t.Errorf("body of the signal: %v %v", signals[0].Body, err)
+	}
+	if signals := other.flush(); len(signals) != 0 {
+		t.Errorf("signal received by another client: %v", names(signals))
+	}
+
+	if err := dc.EmitTo(addressee.conn.Names()[0], "D1", "com.ubiant.Test.Ping"); err == nil {
+		t.Error("signal emitted on an invalid path")
+	}
+	if err := dc.EmitTo(addressee.conn.Names()[0], path, "Ping"); err == nil {
+		t.Error("signal emitted without an interface")
+	}
+}
+
+func TestLifecycleSignalSequence(t *testing.T) {
+	dc := &Dbus{SignalSequence: true}
+	p := newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	c.flush()
+
+	d := addTestDevice(t, p, "D1", "T")
+	addTestItem(t, d, "I1", "T")
+	if err := d.SetComID("C1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge := dc.Bridges["b"]
+	bridge.SetState(BridgeConnected)
+	bridge.Protocol.Ready()
+	addTestDevice(t, bridge.Protocol, "D2", "T")
+	// The changes of values are not lifecycle signals
+	testDevice(t, p, "D1").Items["I1"].SetValue([]byte("1"))
+	d.RemoveItem("I1")
+	p.RemoveDevice("D1")
+	bridge.Protocol.RemoveDevice("D2")
+	if err := dc.RootProtocol.RemoveBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	var lifecycle []string
+	var last uint64
+	for _, s := range c.flush() {
+		// The standard signals keep their signature
+		if strings.HasPrefix(s.Name, "org.freedesktop.DBus.") {
+			continue
+		}
+		sequence, ok := s.Body[len(s.Body)-1].(uint64)
+		if !ok {
+			t.Errorf("%s without a sequence number: %v", s.Name, s.Body)
+			continue
+		}
+		if sequence != last+1 {
+			t.Errorf("sequence of %s: %d after %d", s.Name, sequence, last)
+		}
+		last = sequence
+		lifecycle = append(lifecycle, s.Name[strings.LastIndex(s.Name, ".")+1:])
+	}
+	want := []string{signalDeviceAdded, signalItemAdded, signalComIDChanged, signalBridgeAdded, signalBridgeStateChanged,
+		signalAnyBridgeReadyChanged, signalDeviceAdded, signalItemRemoved, signalDeviceRemoved, signalDeviceRemoved, signalBridgeRemoved}
+	if strings.Join(lifecycle, ",") != strings.Join(want, ",") {
+		t.Errorf("lifecycle signals: %v", lifecycle)
+	}
+
+	var sequence uint64
+	if err := c.call(c.root, dbusProtocolInterface+".GetSequence").Store(&sequence); err != nil || sequence != last {
+		t.Errorf("GetSequence: %d %v, want %d", sequence, err, last)
+	}
+}
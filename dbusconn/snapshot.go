@@ -0,0 +1,66 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Snapshot is a copy of the tree given by WithSnapshot, changing it does not change the tree
+type Snapshot struct {
+	// Protocols are the devices with their items by protocol name, in the format of ProtocolJson
+	Protocols map[string][]DeviceJson
+	// Bridges are the states of the bridges by bridge ID
+	Bridges map[string]BridgeState
+}
+
+// WithSnapshot calls fn with a consistent copy of the whole tree
+// The locks are taken in the order used by the adapter: the root protocol, the bridge protocols sorted by bridge ID,
+// then the devices of each protocol. They are all held while copying the tree, so no mutation is seen half done,
+// and released before calling fn, which can then take its time or call the adapter. ApplyDiff releases the locks
+// between its operations, a snapshot can see a part of a diff.
+func (dc *Dbus) WithSnapshot(fn func(Snapshot)) {
+	snapshot := Snapshot{Protocols: make(map[string][]DeviceJson), Bridges: make(map[string]BridgeState)}
+	root := dc.RootProtocol.Protocol
+	if root == nil {
+		fn(snapshot)
+		return
+	}
+
+	root.Lock()
+	bridges := make([]*BridgeProto, 0, len(dc.Bridges))
+	for _, bridge := range dc.Bridges {
+		bridges = append(bridges, bridge)
+	}
+	sort.Slice(bridges, func(i, j int) bool { return bridges[i].Protocol.BridgeID < bridges[j].Protocol.BridgeID })
+	for _, bridge := range bridges {
+		bridge.Protocol.Lock()
+	}
+
+	snapshot.Protocols[root.protocolName] = copyDevices(root.snapshot())
+	for _, bridge := range bridges {
+		snapshot.Protocols[bridge.Protocol.protocolName] = copyDevices(bridge.Protocol.snapshot())
+		snapshot.Bridges[bridge.Protocol.BridgeID] = bridge.State
+	}
+
+	for n := len(bridges) - 1; n >= 0; n-- {
+		bridges[n].Protocol.Unlock()
+	}
+	root.Unlock()
+
+	fn(snapshot)
+}
+
+// copyDevices copies the options and calibrations which the snapshots of the devices share with the tree
+func copyDevices(devices []DeviceJson) []DeviceJson {
+	for n := range devices {
+		devices[n].DevOptions = append(json.RawMessage{}, devices[n].DevOptions...)
+		for m := range devices[n].Items {
+			item := &devices[n].Items[m]
+			item.ItemOptions = append(json.RawMessage{}, item.ItemOptions...)
+			if item.ItemCalibration != nil {
+				item.ItemCalibration = append([]byte{}, item.ItemCalibration...)
+			}
+		}
+	}
+	return devices
+}
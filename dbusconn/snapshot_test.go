@@ -0,0 +1,150 @@
+package dbusconn
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestWithSnapshot(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D2", "T")
+	addTestItem(t, d, "I1", "T")
+	addTestDevice(t, p, "D1", "T")
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	bridge, _ := testBridge(dc, "b")
+	addTestDevice(t, bridge.Protocol, "D3", "T")
+
+	var snapshot Snapshot
+	dc.WithSnapshot(func(s Snapshot) {
+		// The locks are released, the callback can call the adapter
+		addTestDevice(t, p, "D4", "T")
+		snapshot = s
+	})
+	root, bridged := snapshot.Protocols[dc.ProtocolName], snapshot.Protocols[dc.ProtocolName+"_b"]
+	if len(snapshot.Protocols) != 2 || len(root) != 2 || root[0].DevID != "D1" || root[1].DevID != "D2" || len(bridged) != 1 || bridged[0].DevID != "D3" {
+		t.Fatalf("devices of the snapshot: %+v", snapshot.Protocols)
+	}
+	if len(root[1].Items) != 1 || root[1].Items[0].ItemID != "I1" {
+		t.Errorf("items of the snapshot: %+v", root[1].Items)
+	}
+	if state, present := snapshot.Bridges["b"]; len(snapshot.Bridges) != 1 || !present || state != bridge.State {
+		t.Errorf("bridges of the snapshot: %v", snapshot.Bridges)
+	}
+
+	// The snapshot is a copy
+	root[1].DevOptions[0] = 'x'
+	root[1].Items[0].ItemOptions[0] = 'x'
+	d.Lock()
+	options, itemOptions := string(d.Options), string(d.Items["I1"].Options)
+	d.Unlock()
+	if options != "{}" || itemOptions != "{}" {
+		t.Errorf("tree changed through the snapshot: %s %s", options, itemOptions)
+	}
+}
+
+func TestWithSnapshotOfAClosedAdapter(t *testing.T) {
+	dc := &Dbus{}
+	called := false
+	dc.WithSnapshot(func(s Snapshot) {
+		called = true
+		if len(s.Protocols) != 0 || len(s.Bridges) != 0 {
+			t.Errorf("snapshot before InitDbus: %+v", s)
+		}
+	})
+	if !called {
+		t.Error("callback not called before InitDbus")
+	}
+}
+
+func TestWithSnapshotUnderMutation(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// The devices are added with their options, removed, and the bridges come and go with their devices
+	for n := 0; n < 3; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for m := 0; m < 20; m++ {
+				devID := fmt.Sprintf("D%d_%d", n, m%4)
+				if _, err := p.AddDevice(devID, "", "T", "1", []byte(`{"id":"`+devID+`"}`)); err != nil {
+					t.Errorf("AddDevice %s: %v", devID, err)
+					return
+				}
+				d := testDevice(t, p, devID)
+				addTestItem(t, d, "I1", "T").SetValue([]byte(fmt.Sprint(m)))
+				if m%3 == 2 {
+					if err := p.RemoveDevice(devID); err != nil {
+						t.Errorf("RemoveDevice %s: %v", devID, err)
+						return
+					}
+				}
+			}
+		}(n)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for m := 0; m < 10; m++ {
+			bridgeID := fmt.Sprintf("b%d", m%3)
+			if _, err := dc.RootProtocol.AddBridge(bridgeID); err != nil {
+				t.Errorf("AddBridge %s: %v", bridgeID, err)
+				return
+			}
+			if bridge, present := testBridge(dc, bridgeID); present {
+				if _, err := bridge.Protocol.AddDevice("B1", "", "T", "1", []byte(`{"id":"B1"}`)); err != nil && err != ErrBridgeRemoved {
+					t.Errorf("AddDevice on %s: %v", bridgeID, err)
+				}
+			}
+			if m%2 == 1 {
+				if err := dc.RootProtocol.RemoveBridge(bridgeID); err != nil {
+					t.Errorf("RemoveBridge %s: %v", bridgeID, err)
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	walks := 0
+	for walking := true; walking; walks++ {
+		select {
+		case <-done:
+			walking = false
+		default:
+		}
+		dc.WithSnapshot(func(s Snapshot) {
+			if len(s.Protocols) != len(s.Bridges)+1 {
+				t.Fatalf("%d protocols for %d bridges", len(s.Protocols), len(s.Bridges))
+			}
+			for bridgeID := range s.Bridges {
+				if _, present := s.Protocols[dc.ProtocolName+"_"+bridgeID]; !present {
+					t.Fatalf("bridge %s without its protocol", bridgeID)
+				}
+			}
+			for name, devices := range s.Protocols {
+				if !sort.SliceIsSorted(devices, func(i, j int) bool { return devices[i].DevID < devices[j].DevID }) {
+					t.Fatalf("devices of %s not sorted", name)
+				}
+				for _, dev := range devices {
+					if string(dev.DevOptions) != `{"id":"`+dev.DevID+`"}` {
+						t.Fatalf("device %s of %s with the options %s", dev.DevID, name, dev.DevOptions)
+					}
+				}
+			}
+		})
+	}
+	if walks < 2 {
+		t.Errorf("tree walked %d times while it changed", walks)
+	}
+}
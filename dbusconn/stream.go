@@ -0,0 +1,94 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+const streamBufferSize = 64
+
+// Filter selects the changes written by StreamChanges, the empty fields match everything
+type Filter struct {
+	Protocol string
+	DevID    string
+	ItemID   string
+	Property string
+}
+
+// Change describes a change of a value or of a state in the tree
+type Change struct {
+	Protocol string      `json:"protocol"`
+	DevID    string      `json:"devID,omitempty"`
+	ItemID   string      `json:"itemID,omitempty"`
+	Property string      `json:"property"`
+	Value    interface{} `json:"value"`
+	Time     int64       `json:"time"`
+}
+
+type changeStream struct {
+	filter  Filter
+	changes chan Change
+	done    chan struct{}
+}
+
+func (f Filter) match(c Change) bool {
+	return (f.Protocol == "" || f.Protocol == c.Protocol) &&
+		(f.DevID == "" || f.DevID == c.DevID) &&
+		(f.ItemID == "" || f.ItemID == c.ItemID) &&
+		(f.Property == "" || f.Property == c.Property)
+}
+
+// StreamChanges writes a JSON line to w for every change matching the filter until stop is called
+func (dc *Dbus) StreamChanges(w io.Writer, filter Filter) (stop func()) {
+	s := &changeStream{
+		filter:  filter,
+		changes: make(chan Change, streamBufferSize),
+		done:    make(chan struct{}),
+	}
+
+	dc.streamsLock.Lock()
+	if dc.streams == nil {
+		dc.streams = make(map[*changeStream]bool)
+	}
+	dc.streams[s] = true
+	dc.streamsLock.Unlock()
+
+	go func() {
+		encoder := json.NewEncoder(w)
+		for c := range s.changes {
+			if err := encoder.Encode(c); err != nil {
+				dc.Log.Warning("Unable to stream the change", c, err)
+			}
+		}
+		close(s.done)
+	}()
+
+	return func() {
+		dc.streamsLock.Lock()
+		_, present := dc.streams[s]
+		if present {
+			delete(dc.streams, s)
+			close(s.changes)
+		}
+		dc.streamsLock.Unlock()
+		<-s.done
+	}
+}
+
+func (dc *Dbus) notifyChange(c Change) {
+	c.Time = time.Now().UnixNano() / int64(time.Millisecond)
+
+	dc.streamsLock.Lock()
+	for s := range dc.streams {
+		if !s.filter.match(c) {
+			continue
+		}
+		select {
+		case s.changes <- c:
+		default:
+			dc.Log.Warning("Stream buffer full, change dropped", c)
+		}
+	}
+	dc.streamsLock.Unlock()
+}
@@ -0,0 +1,74 @@
+package dbusconn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a buffer written by the stream while the test reads it
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(data)
+}
+
+// changes decodes the JSON lines written so far
+func (b *lockedBuffer) changes(t *testing.T) []Change {
+	b.Lock()
+	defer b.Unlock()
+	var changes []Change
+	scanner := bufio.NewScanner(bytes.NewReader(b.Bytes()))
+	for scanner.Scan() {
+		var c Change
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+func TestStreamChanges(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	d := addTestDevice(t, p, "D1", "T")
+	i1 := addTestItem(t, d, "I1", "T")
+	i2 := addTestItem(t, d, "I2", "T")
+
+	var all, values lockedBuffer
+	stopAll := dc.StreamChanges(&all, Filter{})
+	stopValues := dc.StreamChanges(&values, Filter{DevID: "D1", ItemID: "I1", Property: propertyValue})
+	i1.SetValue([]byte("1"))
+	i2.SetValue([]byte("2"))
+	d.SetOperabilityState(OperabilityKo)
+	i1.SetValue([]byte("3"))
+	stopAll()
+	stopValues()
+	i1.SetValue([]byte("4"))
+
+	changes := all.changes(t)
+	if len(changes) != 4 {
+		t.Fatalf("all the changes: %+v", changes)
+	}
+	if c := changes[2]; c.DevID != "D1" || c.ItemID != "" || c.Property != propertyOperabilityState || c.Value != string(OperabilityKo) {
+		t.Errorf("change of the state: %+v", c)
+	}
+	for _, c := range changes {
+		if c.Protocol != p.protocolName || c.Time <= 0 {
+			t.Errorf("change %+v", c)
+		}
+	}
+
+	changes = values.changes(t)
+	if len(changes) != 2 || changes[0].Value != "1" || changes[1].Value != "3" {
+		t.Fatalf("filtered changes: %+v", changes)
+	}
+}
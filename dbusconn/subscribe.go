@@ -0,0 +1,142 @@
+package dbusconn
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// SubscriptionInfo describes a subscription made with Subscribe
+type SubscriptionInfo struct {
+	ID        int
+	Interface string
+	Member    string
+	Path      dbus.ObjectPath
+}
+
+type subscription struct {
+	info    SubscriptionInfo
+	rule    matchRule
+	handler func(*dbus.Signal)
+	signals chan *dbus.Signal
+	stop    chan struct{}
+	done    sync.Once
+}
+
+// Subscribe adds a match rule for the signals of the interface and calls the handler for each of them
+// The member and the path are ignored when empty, the returned function cancels the subscription
+func (dc *Dbus) Subscribe(iface string, member string, path dbus.ObjectPath, handler func(*dbus.Signal)) (func(), error) {
+	pairs := []string{"interface", iface}
+	if member != "" {
+		pairs = append(pairs, "member", member)
+	}
+	if path != "" {
+		pairs = append(pairs, "path", string(path))
+	}
+	rule := newMatchRule(pairs...)
+	if err := dc.addMatch(rule); err != nil {
+		dc.Log.Warning("Fail to subscribe to the signals of", iface, member, path, err)
+		return nil, err
+	}
+
+	s := &subscription{
+		info:    SubscriptionInfo{Interface: iface, Member: member, Path: path},
+		rule:    rule,
+		handler: handler,
+		stop:    make(chan struct{}),
+	}
+	dc.subscriptionsLock.Lock()
+	if dc.subscriptions == nil {
+		dc.subscriptions = make(map[int]*subscription)
+	}
+	dc.lastSubscriptionID++
+	s.info.ID = dc.lastSubscriptionID
+	dc.subscriptions[s.info.ID] = s
+	dc.subscriptionsLock.Unlock()
+
+	dc.listen(s)
+	return func() { dc.cancelSubscription(s) }, nil
+}
+
+// listen delivers the signals of the connection to the handler of the subscription until it is canceled
+// The connection closes the channel when it is lost, the subscription listens again once reconnected
+func (dc *Dbus) listen(s *subscription) {
+	signals := make(chan *dbus.Signal, 16)
+	dc.subscriptionsLock.Lock()
+	s.signals = signals
+	dc.subscriptionsLock.Unlock()
+
+	dc.connection().Signal(signals)
+	go func() {
+		for {
+			select {
+			case signal, ok := <-signals:
+				if !ok {
+					return
+				}
+				if s.matches(signal) {
+					s.handler(signal)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Subscriptions returns the active subscriptions sorted by ID
+func (dc *Dbus) Subscriptions() []SubscriptionInfo {
+	dc.subscriptionsLock.Lock()
+	infos := make([]SubscriptionInfo, 0, len(dc.subscriptions))
+	for _, s := range dc.subscriptions {
+		infos = append(infos, s.info)
+	}
+	dc.subscriptionsLock.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CancelAll cancels all the active subscriptions
+func (dc *Dbus) CancelAll() {
+	dc.subscriptionsLock.Lock()
+	subscriptions := make([]*subscription, 0, len(dc.subscriptions))
+	for _, s := range dc.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	dc.subscriptionsLock.Unlock()
+
+	for _, s := range subscriptions {
+		dc.cancelSubscription(s)
+	}
+}
+
+func (dc *Dbus) cancelSubscription(s *subscription) {
+	s.done.Do(func() {
+		dc.subscriptionsLock.Lock()
+		delete(dc.subscriptions, s.info.ID)
+		dc.subscriptionsLock.Unlock()
+
+		if err := dc.removeMatch(s.rule); err != nil {
+			dc.Log.Warning("Fail to remove the match rule of the subscription", s.info.ID, err)
+		}
+		dc.subscriptionsLock.Lock()
+		signals := s.signals
+		dc.subscriptionsLock.Unlock()
+		dc.connection().RemoveSignal(signals)
+		close(s.stop)
+	})
+}
+
+// matches checks the signal against the subscription, the connection delivers every signal to every channel
+func (s *subscription) matches(signal *dbus.Signal) bool {
+	dot := strings.LastIndex(signal.Name, ".")
+	if dot < 0 || signal.Name[:dot] != s.info.Interface {
+		return false
+	}
+	if s.info.Member != "" && signal.Name[dot+1:] != s.info.Member {
+		return false
+	}
+	return s.info.Path == "" || signal.Path == s.info.Path
+}
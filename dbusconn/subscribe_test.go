@@ -0,0 +1,67 @@
+package dbusconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestSubscriptionsAreListedAndCanceled(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	c := newTestClient(t, dc)
+	path := dbus.ObjectPath("/com/ubiant/Test/" + dc.ProtocolName)
+	pings := &recorder{}
+	all := &recorder{}
+
+	cancel, err := dc.Subscribe("com.ubiant.Test.Sub", "Ping", path, func(s *dbus.Signal) { pings.record(s.Body[0].(string)) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.Subscribe("com.ubiant.Test.Sub", "", "", func(s *dbus.Signal) { all.record(s.Body[0].(string)) }); err != nil {
+		t.Fatal(err)
+	}
+	subscriptions := dc.Subscriptions()
+	if len(subscriptions) != 2 || subscriptions[0].Member != "Ping" || subscriptions[0].Path != path || subscriptions[1].Member != "" ||
+		subscriptions[0].ID >= subscriptions[1].ID {
+		t.Fatalf("subscriptions: %+v", subscriptions)
+	}
+
+	c.conn.Emit(path, "com.ubiant.Test.Sub.Ping", "1")
+	c.conn.Emit(path, "com.ubiant.Test.Sub.Pong", "2")
+	c.conn.Emit(path+"/Other", "com.ubiant.Test.Sub.Ping", "3")
+	waitFor(t, "the signals", func() bool { return len(all.recorded()) == 3 })
+	if calls := pings.recorded(); len(calls) != 1 || calls[0] != "1" {
+		t.Errorf("signals of the Ping subscription: %v", calls)
+	}
+
+	cancel()
+	cancel()
+	if subscriptions := dc.Subscriptions(); len(subscriptions) != 1 || subscriptions[0].Member != "" {
+		t.Fatalf("subscriptions once one is canceled: %+v", subscriptions)
+	}
+	dc.CancelAll()
+	if subscriptions := dc.Subscriptions(); len(subscriptions) != 0 {
+		t.Fatalf("subscriptions once all are canceled: %+v", subscriptions)
+	}
+	c.conn.Emit(path, "com.ubiant.Test.Sub.Ping", "4")
+	time.Sleep(50 * time.Millisecond)
+	if len(pings.recorded()) != 1 || len(all.recorded()) != 3 {
+		t.Errorf("signals handled once canceled: %v %v", pings.recorded(), all.recorded())
+	}
+}
+
+func TestCloseCancelsTheSubscriptions(t *testing.T) {
+	dc := &Dbus{}
+	newTestAdapter(t, dc, nil)
+	if _, err := dc.Subscribe("com.ubiant.Test.Sub", "", "", func(*dbus.Signal) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions := dc.Subscriptions(); len(subscriptions) != 0 {
+		t.Errorf("subscriptions once closed: %+v", subscriptions)
+	}
+}
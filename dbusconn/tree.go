@@ -0,0 +1,285 @@
+package dbusconn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// ErrImportIncomplete is returned by ImportTree when some bridges or devices were rejected, the rest of the tree is
+// imported
+var ErrImportIncomplete = dbus.NewError(dbusProtocolInterface+".Error.ImportIncomplete", []interface{}{"Some bridges or devices of the tree were not imported"})
+
+// protocols returns the root protocol followed by the bridge protocols sorted by bridge ID
+func (dc *Dbus) protocols() []*Protocol {
+	root := dc.RootProtocol.Protocol
+	if root == nil {
+		return nil
+	}
+
+	root.Lock()
+	protocols := make([]*Protocol, 0, len(dc.Bridges)+1)
+	for _, bridge := range dc.Bridges {
+		protocols = append(protocols, bridge.Protocol)
+	}
+	root.Unlock()
+
+	sort.Slice(protocols, func(i, j int) bool { return protocols[i].BridgeID < protocols[j].BridgeID })
+	return append([]*Protocol{root}, protocols...)
+}
+
+// sortedDevices returns the devices of the protocol sorted by ID, p must be locked
+func (p *Protocol) sortedDevices() []*Device {
+	devices := make([]*Device, 0, len(p.Devices))
+	for _, d := range p.Devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DevID < devices[j].DevID })
+	return devices
+}
+
+// sortedItems returns the items of the device sorted by ID, d must be locked
+func (d *Device) sortedItems() []*Item {
+	items := make([]*Item, 0, len(d.Items))
+	for _, i := range d.Items {
+		items = append(items, i)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ItemID < items[j].ItemID })
+	return items
+}
+
+// snapshot returns the devices of the protocol with their items, p must be locked
+func (p *Protocol) snapshot() []DeviceJson {
+	devices := make([]DeviceJson, 0, len(p.Devices))
+	for _, d := range p.sortedDevices() {
+		d.Lock()
+		devices = append(devices, d.snapshot())
+		d.Unlock()
+	}
+	return devices
+}
+
+// snapshot returns the device with its items, d must be locked
+func (d *Device) snapshot() DeviceJson {
+	dev := DeviceJson{
+		DevID:          d.DevID,
+		ComID:          d.Address,
+		DevTypeID:      d.TypeID,
+		DevTypeVersion: d.TypeVersion,
+		DevOptions:     rawJson(d.Options),
+		Manufacturer:   d.Manufacturer,
+		Model:          d.Model,
+		SerialNumber:   d.SerialNumber,
+		HWVersion:      d.HWVersion,
+		Items:          make([]ItemJson, 0, len(d.Items)),
+	}
+	for _, i := range d.sortedItems() {
+		dev.Items = append(dev.Items, ItemJson{
+			ItemID:          i.ItemID,
+			ItemTypeID:      i.TypeID,
+			ItemTypeVersion: i.TypeVersion,
+			ItemOptions:     rawJson(i.Options),
+			ItemCalibration: i.Calibration,
+		})
+	}
+	return dev
+}
+
+// rawJson returns the options as a JSON value, null if they are empty and a string if they are not JSON
+func rawJson(options []byte) json.RawMessage {
+	if len(options) == 0 {
+		return json.RawMessage("null")
+	}
+	if !json.Valid(options) {
+		data, _ := json.Marshal(string(options))
+		return json.RawMessage(data)
+	}
+	return json.RawMessage(options)
+}
+
+// TreeDOT returns the tree of protocols, bridges, devices and items in the GraphViz DOT format
+func (dc *Dbus) TreeDOT() string {
+	var dot strings.Builder
+	fmt.Fprintf(&dot, "digraph %q {\n", dc.ProtocolName)
+	for _, p := range dc.protocols() {
+		protocolNode := p.protocolName
+		fmt.Fprintf(&dot, "\t%q [shape=box];\n", protocolNode)
+		if p.isBridged {
+			fmt.Fprintf(&dot, "\t%q -> %q;\n", dc.ProtocolName, protocolNode)
+		}
+
+		p.Lock()
+		for _, d := range p.sortedDevices() {
+			deviceNode := protocolNode + "/" + d.DevID
+			fmt.Fprintf(&dot, "\t%q -> %q;\n", protocolNode, deviceNode)
+
+			d.Lock()
+			for _, i := range d.sortedItems() {
+				fmt.Fprintf(&dot, "\t%q -> %q;\n", deviceNode, deviceNode+"/"+i.ItemID)
+			}
+			d.Unlock()
+		}
+		p.Unlock()
+	}
+	dot.WriteString("}\n")
+	return dot.String()
+}
+
+// StateChecksum is the dbus method to get a checksum of the tree, it changes when a protocol, a device or an item
+// is added or removed or when their states change but not when the values of the items change
+func (r *RootProto) StateChecksum() (string, *dbus.Error) {
+	h := sha256.New()
+	for _, p := range r.dc.protocols() {
+		p.Lock()
+		fmt.Fprintf(h, "P%q %t %s\n", p.protocolName, p.ready, p.Reachability)
+		for _, d := range p.sortedDevices() {
+			d.Lock()
+			fmt.Fprintf(h, "D%q %q %q %q %s %s\n", d.DevID, d.Address, d.TypeID, d.TypeVersion, d.Operability, d.PairingState)
+			for _, i := range d.sortedItems() {
+				fmt.Fprintf(h, "I%q %q %q\n", i.ItemID, i.TypeID, i.TypeVersion)
+			}
+			d.Unlock()
+		}
+		p.Unlock()
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ImportTree is the dbus method to add the bridges, devices and items of a JSON document in the format of ProtocolJson
+// The whole document is validated before applying anything. When replace is true the bridges, devices and items
+// missing from the document are removed, otherwise they are kept
+// A device or an item rejected by the protocol does not stop the import, ErrImportIncomplete is returned at the end.
+func (r *RootProto) ImportTree(tree string, replace bool) *dbus.Error {
+	r.dc.enterMutation()
+	defer r.dc.exitMutation()
+	r.log.Info("ImportTree called - replace:", replace)
+	var protocols ProtocolJson
+	if err := json.Unmarshal([]byte(tree), &protocols); err != nil {
+		return validateArgs(func() string { return "tree is not valid JSON: " + err.Error() })
+	}
+
+	bridgeIDs := make(map[string]string, len(protocols.Protocols))
+	newBridges := 0
+	for name, devices := range protocols.Protocols {
+		if name != r.dc.ProtocolName {
+			if !strings.HasPrefix(name, r.dc.ProtocolName+"_") {
+				return validateArgs(func() string {
+					return fmt.Sprintf("protocol %q is not %s or one of its bridges", name, r.dc.ProtocolName)
+				})
+			}
+			bridgeID := strings.TrimPrefix(name, r.dc.ProtocolName+"_")
+			if err := validateArgs(requireID("bridgeID", bridgeID)); err != nil {
+				return err
+			}
+			bridgeIDs[name] = bridgeID
+			r.Protocol.Lock()
+			if _, present := r.dc.Bridges[bridgeID]; !present {
+				newBridges++
+			}
+			r.Protocol.Unlock()
+		}
+		for _, dev := range devices {
+			if err := validateArgs(requireID("devID", dev.DevID), maxLength("comID", dev.ComID), maxLength("typeID", dev.DevTypeID),
+				maxLength("typeVersion", dev.DevTypeVersion), validOptions("options", dev.DevOptions)); err != nil {
+				return err
+			}
+			for _, item := range dev.Items {
+				if err := validateArgs(requireID("itemID", item.ItemID), maxLength("typeID", item.ItemTypeID),
+					maxLength("typeVersion", item.ItemTypeVersion), validOptions("options", item.ItemOptions)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	r.Protocol.Lock()
+	bridgesCount := len(r.dc.Bridges)
+	r.Protocol.Unlock()
+	if replace {
+		bridgesCount = 0
+	}
+	if r.dc.MaxBridges > 0 && bridgesCount+newBridges > r.dc.MaxBridges {
+		return ErrBridgeLimit
+	}
+
+	incomplete := false
+	if replace {
+		r.Protocol.Lock()
+		var removed []string
+		for bridgeID, bridge := range r.dc.Bridges {
+			if _, kept := protocols.Protocols[bridge.Protocol.protocolName]; !kept {
+				removed = append(removed, bridgeID)
+			}
+		}
+		r.Protocol.Unlock()
+		for _, bridgeID := range removed {
+			if err := r.RemoveBridge(bridgeID); err != nil {
+				r.log.Warning("Unable to remove the bridge", bridgeID, err)
+				incomplete = true
+			}
+		}
+	}
+
+	for name, devices := range protocols.Protocols {
+		protocol := r.Protocol
+		if bridgeID, bridged := bridgeIDs[name]; bridged {
+			if _, err := r.AddBridge(bridgeID); err != nil {
+				return err
+			}
+			r.Protocol.Lock()
+			protocol = r.dc.Bridges[bridgeID].Protocol
+			r.Protocol.Unlock()
+		}
+		if replace {
+			protocol.removeMissing(devices)
+		}
+		for _, dev := range devices {
+			if err := restoreDevice(protocol, dev); err != nil {
+				r.log.Warning("Unable to import the device", dev.DevID, err)
+				incomplete = true
+			}
+		}
+	}
+	if replace {
+		if _, present := protocols.Protocols[r.dc.ProtocolName]; !present {
+			r.Protocol.removeMissing(nil)
+		}
+	}
+	if incomplete {
+		return ErrImportIncomplete
+	}
+	return nil
+}
+
+// removeMissing removes the devices and the items of the protocol which are not in the list
+func (p *Protocol) removeMissing(devices []DeviceJson) {
+	kept := make(map[string]DeviceJson, len(devices))
+	for _, dev := range devices {
+		kept[dev.DevID] = dev
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for devID, d := range p.Devices {
+		dev, present := kept[devID]
+		if !present {
+			removeDevice(d)
+			continue
+		}
+		items := make(map[string]bool, len(dev.Items))
+		for _, item := range dev.Items {
+			items[item.ItemID] = true
+		}
+		d.Lock()
+		for itemID, i := range d.Items {
+			if !items[itemID] {
+				removeItem(i)
+			}
+		}
+		d.Unlock()
+	}
+}
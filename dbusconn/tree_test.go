@@ -0,0 +1,190 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestTreeDOT(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	if _, err := dc.RootProtocol.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	addTestDevice(t, dc.Bridges["b"].Protocol, "D2", "T")
+
+	root := dc.ProtocolName
+	bridge := root + "_b"
+	want := []string{
+		fmt.Sprintf("digraph %q {\n", root),
+		fmt.Sprintf("\t%q [shape=box];\n", root),
+		fmt.Sprintf("\t%q [shape=box];\n", bridge),
+		fmt.Sprintf("\t%q -> %q;\n", root, bridge),
+		fmt.Sprintf("\t%q -> %q;\n", root, root+"/D1"),
+		fmt.Sprintf("\t%q -> %q;\n", root+"/D1", root+"/D1/I1"),
+		fmt.Sprintf("\t%q -> %q;\n", bridge, bridge+"/D2"),
+	}
+	dot := dc.TreeDOT()
+	for _, line := range want {
+		if !strings.Contains(dot, line) {
+			t.Errorf("%q missing from\n%s", line, dot)
+		}
+	}
+	if edges := strings.Count(dot, "->"); edges != 4 {
+		t.Errorf("%d edges in\n%s", edges, dot)
+	}
+	if !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("graph not closed:\n%s", dot)
+	}
+}
+
+func TestStateChecksum(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	i := addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+	r := &dc.RootProtocol
+	checksum := func() string {
+		t.Helper()
+		sum, err := r.StateChecksum()
+		if err != nil || sum == "" {
+			t.Fatalf("StateChecksum: %q %v", sum, err)
+		}
+		return sum
+	}
+	initial := checksum()
+
+	var overDbus string
+	if err := c.call(c.root, dbusProtocolInterface+".StateChecksum").Store(&overDbus); err != nil || overDbus != initial {
+		t.Errorf("StateChecksum over Dbus: %q %v", overDbus, err)
+	}
+	i.SetValue([]byte("1"))
+	testDevice(t, p, "D1").SetModel("M1")
+	c.call(c.root+"/D1", dbusDeviceInterface+".GetItems")
+	if sum := checksum(); sum != initial {
+		t.Error("checksum changed by a value, the metadata or a read")
+	}
+
+	d2 := addTestDevice(t, p, "D2", "T")
+	withDevice := checksum()
+	if withDevice == initial {
+		t.Fatal("checksum unchanged by the add of a device")
+	}
+	addTestItem(t, d2, "I2", "T")
+	if sum := checksum(); sum == withDevice {
+		t.Fatal("checksum unchanged by the add of an item")
+	}
+	if err := d2.RemoveItem("I2"); err != nil {
+		t.Fatal(err)
+	}
+	if sum := checksum(); sum != withDevice {
+		t.Error("checksum once the item is removed differs from the one before its add")
+	}
+	if _, err := r.AddBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	withBridge := checksum()
+	if withBridge == withDevice {
+		t.Fatal("checksum unchanged by the add of a bridge")
+	}
+	p.Ready()
+	if sum := checksum(); sum == withBridge {
+		t.Error("checksum unchanged by the readiness")
+	}
+	p.SetReadyWithState(false)
+	if err := r.RemoveBridge("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveDevice("D2"); err != nil {
+		t.Fatal(err)
+	}
+	if sum := checksum(); sum != initial {
+		t.Error("checksum once back to the initial tree differs from the initial one")
+	}
+}
+
+// treeDocument returns the JSON document of the devices, each with its items, of the protocols
+func treeDocument(t *testing.T, protocols map[string]map[string][]string) string {
+	t.Helper()
+	tree := ProtocolJson{Protocols: map[string][]DeviceJson{}}
+	for name, devices := range protocols {
+		list := []DeviceJson{}
+		for devID, items := range devices {
+			dev := DeviceJson{DevID: devID, DevTypeID: "T", DevTypeVersion: "1", DevOptions: json.RawMessage("{}")}
+			for _, itemID := range items {
+				dev.Items = append(dev.Items, ItemJson{ItemID: itemID, ItemTypeID: "T", ItemTypeVersion: "1", ItemOptions: json.RawMessage("{}")})
+			}
+			list = append(list, dev)
+		}
+		tree.Protocols[name] = list
+	}
+	document, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(document)
+}
+
+func TestImportTree(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+	root := dc.ProtocolName
+	bridge := root + "_b"
+
+	merged := treeDocument(t, map[string]map[string][]string{
+		root:   {"D2": {"I2"}},
+		bridge: {"D3": {"I3"}},
+	})
+	if err := c.call(c.root, dbusProtocolInterface+".ImportTree", merged, false).Err; err != nil {
+		t.Fatal(err)
+	}
+	if !hasItem(testDevice(t, p, "D1"), "I1") || !hasItem(testDevice(t, p, "D2"), "I2") {
+		t.Error("devices missing once merged")
+	}
+	b, present := testBridge(dc, "b")
+	if !present || !hasItem(testDevice(t, b.Protocol, "D3"), "I3") {
+		t.Fatal("bridge missing once merged")
+	}
+	if !c.owns(dbus.ObjectPath(c.root + "/D2/I2")) {
+		t.Error("imported item not exported")
+	}
+
+	replaced := treeDocument(t, map[string]map[string][]string{
+		root: {"D1": {}, "D4": {"I4"}},
+	})
+	if err := c.call(c.root, dbusProtocolInterface+".ImportTree", replaced, true).Err; err != nil {
+		t.Fatal(err)
+	}
+	if hasDevice(p, "D2") || hasItem(testDevice(t, p, "D1"), "I1") || !hasItem(testDevice(t, p, "D4"), "I4") {
+		t.Error("tree not replaced")
+	}
+	if _, present := testBridge(dc, "b"); present {
+		t.Error("bridge kept once replaced")
+	}
+	if !c.unreachable(c.root+"/D2", dbusDeviceInterface+".GetItems") {
+		t.Error("removed device still exported")
+	}
+
+	for name, document := range map[string]string{
+		"invalid JSON":     "{",
+		"unknown protocol": treeDocument(t, map[string]map[string][]string{"other": {"D5": {}}}),
+		"invalid devID":    treeDocument(t, map[string]map[string][]string{root: {"D 5": {}}}),
+		"invalid itemID":   treeDocument(t, map[string]map[string][]string{root: {"D5": {"I/5"}}}),
+	} {
+		err := c.call(c.root, dbusProtocolInterface+".ImportTree", document, true).Err
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != "org.freedesktop.DBus.Error.InvalidArgs" {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	// Nothing is applied from a rejected document
+	if !hasDevice(p, "D1") || !hasDevice(p, "D4") || hasDevice(p, "D5") {
+		t.Error("tree changed by a rejected document")
+	}
+}
@@ -0,0 +1,103 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// maxIDLength is the maximum length of the IDs received by the dbus methods
+	maxIDLength = 255
+	// maxOptionsSize is the maximum size of the options received by the dbus methods
+	maxOptionsSize = 64 * 1024
+)
+
+// argCheck checks one argument of a dbus method, it returns the reason of the failure or ""
+type argCheck func() string
+
+// validateArgs runs the checks of the arguments of a dbus method and returns an InvalidArgs error on the first failure
+func validateArgs(checks ...argCheck) *dbus.Error {
+	if reason := firstFailure(checks...); reason != "" {
+		return dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs", []interface{}{reason})
+	}
+	return nil
+}
+
+// firstFailure runs the checks and returns the reason of the first failure or ""
+func firstFailure(checks ...argCheck) string {
+	for _, check := range checks {
+		if reason := check(); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// requireID checks that the ID is not empty and can be used as an element of an object path
+func requireID(name string, id string) argCheck {
+	return func() string {
+		if id == "" {
+			return fmt.Sprintf("%s must not be empty", name)
+		}
+		return checkID(name, id)
+	}
+}
+
+// optionalID checks that the ID is empty or can be used as an element of an object path
+func optionalID(name string, id string) argCheck {
+	return func() string {
+		if id == "" {
+			return ""
+		}
+		return checkID(name, id)
+	}
+}
+
+// requireMember checks that the name can be used as the name of a dbus method
+func requireMember(name string, member string) argCheck {
+	return func() string {
+		if reason := requireID(name, member)(); reason != "" {
+			return reason
+		}
+		if member[0] >= '0' && member[0] <= '9' {
+			return fmt.Sprintf("%s %q must not start with a digit", name, member)
+		}
+		return ""
+	}
+}
+
+// maxLength checks that the string is not longer than maxIDLength
+func maxLength(name string, value string) argCheck {
+	return func() string {
+		if len(value) > maxIDLength {
+			return fmt.Sprintf("%s is longer than %d characters", name, maxIDLength)
+		}
+		return ""
+	}
+}
+
+// validOptions checks that the options are empty or valid JSON not bigger than maxOptionsSize
+func validOptions(name string, options []byte) argCheck {
+	return func() string {
+		if len(options) > maxOptionsSize {
+			return fmt.Sprintf("%s is bigger than %d bytes", name, maxOptionsSize)
+		}
+		if len(options) > 0 && !json.Valid(options) {
+			return fmt.Sprintf("%s is not valid JSON", name)
+		}
+		return ""
+	}
+}
+
+func checkID(name string, id string) string {
+	if len(id) > maxIDLength {
+		return fmt.Sprintf("%s is longer than %d characters", name, maxIDLength)
+	}
+	if strings.Contains(id, "/") || !dbus.ObjectPath("/"+id).IsValid() {
+		return fmt.Sprintf("%s %q must only contain the characters [A-Za-z0-9_]", name, id)
+	}
+	return ""
+}
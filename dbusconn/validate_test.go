@@ -0,0 +1,69 @@
+package dbusconn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestInvalidArgsOfTheMethods(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "I1", "T")
+	c := newTestClient(t, dc)
+	long := strings.Repeat("a", maxIDLength+1)
+	big := []byte(`"` + strings.Repeat("a", maxOptionsSize) + `"`)
+	device := c.root + "/D1"
+	item := device + "/I1"
+
+	for _, call := range []struct {
+		path   string
+		method string
+		args   []interface{}
+		reason string
+	}{
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{"", "", "T", "1", []byte("{}")}, "devID must not be empty"},
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{"D-2", "", "T", "1", []byte("{}")}, "devID"},
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{long, "", "T", "1", []byte("{}")}, "devID is longer"},
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{"D2", long, "T", "1", []byte("{}")}, "comID is longer"},
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{"D2", "", long, "1", []byte("{}")}, "typeID is longer"},
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{"D2", "", "T", long, []byte("{}")}, "typeVersion is longer"},
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{"D2", "", "T", "1", []byte("{")}, "options is not valid JSON"},
+		{c.root, dbusProtocolInterface + ".AddDevice", []interface{}{"D2", "", "T", "1", big}, "options is bigger"},
+		{c.root, dbusProtocolInterface + ".RemoveDevice", []interface{}{"D/1"}, "devID"},
+		{c.root, dbusProtocolInterface + ".AddPlaceholderDevice", []interface{}{""}, "devID must not be empty"},
+		{c.root, dbusProtocolInterface + ".CancelAdd", []interface{}{"D-1"}, "devID"},
+		{c.root, dbusProtocolInterface + ".FindByComID", []interface{}{long}, "comID is longer"},
+		{c.root, dbusProtocolInterface + ".DeviceLineage", []interface{}{long}, "devID is longer"},
+		{c.root, dbusProtocolInterface + ".CloneDevice", []interface{}{"D1", ""}, "newID must not be empty"},
+		{c.root, dbusProtocolInterface + ".AddAlias", []interface{}{"D1", "L 1"}, "aliasID"},
+		{c.root, dbusProtocolInterface + ".AddBridge", []interface{}{""}, "bridgeID must not be empty"},
+		{c.root, dbusProtocolInterface + ".RemoveBridge", []interface{}{"b.1"}, "bridgeID"},
+		{device, dbusDeviceInterface + ".AddItem", []interface{}{"", "T", "1", []byte("{}")}, "itemID must not be empty"},
+		{device, dbusDeviceInterface + ".AddItem", []interface{}{"I2", "T", "1", []byte("[")}, "options is not valid JSON"},
+		{device, dbusDeviceInterface + ".RemoveItem", []interface{}{"I-1"}, "itemID"},
+		{device, dbusDeviceInterface + ".UpdateOptions", []interface{}{[]byte("{"), ""}, "options is not valid JSON"},
+		{device, dbusDeviceInterface + ".SetComID", []interface{}{long}, "comID is longer"},
+		{device, dbusDeviceInterface + ".Complete", []interface{}{"", long, "1", []byte("{}")}, "typeID is longer"},
+		{device, dbusPropertiesInterface + ".Set", []interface{}{dbusDeviceInterface, propertyOptions, dbus.MakeVariant([]byte("{"))}, "Options is not valid JSON"},
+		{item, dbusPropertiesInterface + ".Set", []interface{}{dbusItemInterface, propertyOptions, dbus.MakeVariant([]byte("{"))}, "Options is not valid JSON"},
+	} {
+		err := c.call(call.path, call.method, call.args...).Err
+		dbusErr, ok := err.(dbus.Error)
+		if !ok || dbusErr.Name != "org.freedesktop.DBus.Error.InvalidArgs" || !strings.Contains(dbusErr.Body[0].(string), call.reason) {
+			t.Errorf("%s %.40v: %v", call.method, call.args, err)
+		}
+	}
+
+	p.Lock()
+	devices := len(p.Devices)
+	p.Unlock()
+	d := testDevice(t, p, "D1")
+	if devices != 1 || len(dc.Bridges) != 0 || !hasItem(d, "I1") {
+		t.Errorf("tree changed by the invalid calls: %d devices, %d bridges", devices, len(dc.Bridges))
+	}
+	if err := d.AddCommand("1st", func([]byte) ([]byte, error) { return nil, nil }); err == nil || !strings.Contains(err.Body[0].(string), "must not start with a digit") {
+		t.Errorf("AddCommand 1st: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package dbusconn
+
+import (
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// virtualDeviceType is the type of the devices added by AddVirtualDevice
+const virtualDeviceType = "VIRTUAL"
+
+// virtualItem is an item of a virtual device with the last values of its sources, in the order of the sources
+type virtualItem struct {
+	item    *Item
+	sources []string
+	values  [][]byte
+}
+
+// AddVirtualDevice adds a device whose items aggregate the values of items of other devices of the protocol
+// sources maps each item of the virtual device to its sources given as devID/itemID. The value of a virtual item
+// is computed again whenever one of its sources changes, by the Aggregate function of the device if set or as
+// the value of the source which changed otherwise. The driver is not asked to add a virtual device.
+func (p *Protocol) AddVirtualDevice(devID string, sources map[string][]string) (*Device, *dbus.Error) {
+	p.dc.enterMutation()
+	defer p.dc.exitMutation()
+	p.log.Info("AddVirtualDevice called - devID:", devID, "items:", len(sources))
+	checks := []argCheck{requireID("devID", devID)}
+	for itemID, itemSources := range sources {
+		checks = append(checks, requireID("itemID", itemID), requireSources(itemID, itemSources))
+	}
+	if err := validateArgs(checks...); err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	if _, taken := p.Devices[devID]; taken {
+		p.Unlock()
+		return nil, ErrIDTaken
+	}
+	sourceItems := make(map[string][]*Item, len(sources))
+	for itemID, itemSources := range sources {
+		for _, source := range itemSources {
+			i := p.sourceItem(source)
+			if i == nil {
+				p.Unlock()
+				return nil, validateArgs(func() string { return "source " + source + " of the item " + itemID + " is unknown" })
+			}
+			sourceItems[itemID] = append(sourceItems[itemID], i)
+		}
+	}
+
+	if err := p.admitDevice(devID, virtualDeviceType); err != nil {
+		p.Unlock()
+		return nil, err
+	}
+	d := initDevice(devID, "", virtualDeviceType, "", []byte("{}"), false, false, p)
+	virtualItems := make([]*virtualItem, 0, len(sources))
+	d.Lock()
+	// The driver knows nothing of the virtual device, it is not told of its removal either
+	d.removalHandled = true
+	for itemID, items := range sourceItems {
+		vi := &virtualItem{
+			item:    newItem(itemID, items[0].TypeID, items[0].TypeVersion, []byte("{}"), d),
+			sources: sources[itemID],
+			values:  make([][]byte, len(items)),
+		}
+		vi.item.removalHandled = true
+		vi.item.export()
+		for n, i := range items {
+			vi.values[n] = i.currentValue()
+		}
+		virtualItems = append(virtualItems, vi)
+	}
+	d.Unlock()
+	p.Unlock()
+
+	p.virtualLock.Lock()
+	if p.virtualSources == nil {
+		p.virtualSources = make(map[string][]*virtualItem)
+	}
+	for _, vi := range virtualItems {
+		for _, source := range vi.sources {
+			p.virtualSources[source] = append(p.virtualSources[source], vi)
+		}
+	}
+	p.virtualLock.Unlock()
+
+	for _, vi := range virtualItems {
+		var last []byte
+		for _, value := range vi.values {
+			if value != nil {
+				last = value
+			}
+		}
+		if value := d.aggregate(vi.item.ItemID, vi.values, last); value != nil {
+			vi.item.SetValue(value)
+		}
+	}
+	return d, nil
+}
+
+// requireSources checks that the sources of a virtual item are not empty and given as devID/itemID
+func requireSources(itemID string, sources []string) argCheck {
+	return func() string {
+		if len(sources) == 0 {
+			return "item " + itemID + " has no source"
+		}
+		for _, source := range sources {
+			parts := strings.Split(source, "/")
+			if len(parts) != 2 || firstFailure(requireID("devID", parts[0]), requireID("itemID", parts[1])) != "" {
+				return "source " + source + " of the item " + itemID + " is not devID/itemID"
+			}
+		}
+		return ""
+	}
+}
+
+// sourceItem returns the item of a devID/itemID source, p must be locked
+func (p *Protocol) sourceItem(source string) *Item {
+	parts := strings.SplitN(source, "/", 2)
+	d, present := p.Devices[parts[0]]
+	if !present {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.Items[parts[1]]
+}
+
+// aggregate computes the value of a virtual item from the values of its sources
+func (d *Device) aggregate(itemID string, values [][]byte, changed []byte) []byte {
+	d.Lock()
+	aggregate := d.Aggregate
+	d.Unlock()
+	if aggregate == nil {
+		return changed
+	}
+	return aggregate(itemID, values)
+}
+
+// propagate computes again the virtual items using the item as source
+func (p *Protocol) propagate(source *Item, value []byte) {
+	key := source.Device.DevID + "/" + source.ItemID
+	type update struct {
+		vi     *virtualItem
+		values [][]byte
+	}
+
+	p.virtualLock.Lock()
+	updates := make([]update, 0, len(p.virtualSources[key]))
+	for _, vi := range p.virtualSources[key] {
+		for n, s := range vi.sources {
+			if s == key {
+				vi.values[n] = value
+			}
+		}
+		updates = append(updates, update{vi: vi, values: append([][]byte{}, vi.values...)})
+	}
+	p.virtualLock.Unlock()
+
+	for _, u := range updates {
+		if aggregated := u.vi.item.Device.aggregate(u.vi.item.ItemID, u.values, value); aggregated != nil {
+			u.vi.item.SetValue(aggregated)
+		}
+	}
+}
+
+// forgetVirtual stops computing the items of the device if it is virtual
+func (p *Protocol) forgetVirtual(d *Device) {
+	p.virtualLock.Lock()
+	defer p.virtualLock.Unlock()
+	for source, items := range p.virtualSources {
+		kept := items[:0]
+		for _, vi := range items {
+			if vi.item.Device != d {
+				kept = append(kept, vi)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.virtualSources, source)
+		} else {
+			p.virtualSources[source] = kept
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package dbusconn
+
+import (
+	"strconv"
+	"testing"
+)
+
+// maxOf returns the largest of the numeric values, nil while a source has no value
+func maxOf(itemID string, values [][]byte) []byte {
+	highest := 0
+	for n, value := range values {
+		v, err := strconv.Atoi(string(value))
+		if err != nil {
+			return nil
+		}
+		if n == 0 || v > highest {
+			highest = v
+		}
+	}
+	return []byte(strconv.Itoa(highest))
+}
+
+func TestVirtualItemsFollowTheirSources(t *testing.T) {
+	dc := &Dbus{}
+	p := newTestAdapter(t, dc, nil)
+	t1 := addTestItem(t, addTestDevice(t, p, "D1", "T"), "Temp", "T")
+	t2 := addTestItem(t, addTestDevice(t, p, "D2", "T"), "Temp", "T")
+	t1.SetValue([]byte("5"))
+	c := newTestClient(t, dc)
+	value := func(itemID string) string {
+		t.Helper()
+		v, err := c.property(c.root+"/V/"+itemID, dbusItemInterface, propertyValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(v.Value().([]byte))
+	}
+
+	v, err := p.AddVirtualDevice("V", map[string][]string{"Max": {"D1/Temp", "D2/Temp"}, "Mirror": {"D1/Temp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value("Max") != "5" || value("Mirror") != "5" {
+		t.Errorf("values from the sources at the add: %s %s", value("Max"), value("Mirror"))
+	}
+	v.Lock()
+	v.Aggregate = maxOf
+	v.Unlock()
+
+	t2.SetValue([]byte("7"))
+	if value("Max") != "7" || value("Mirror") != "5" {
+		t.Errorf("values once D2 changed: %s %s", value("Max"), value("Mirror"))
+	}
+	t1.SetValue([]byte("3"))
+	if value("Max") != "7" || value("Mirror") != "3" {
+		t.Errorf("values once D1 changed: %s %s", value("Max"), value("Mirror"))
+	}
+
+	if err := p.RemoveDevice("V"); err != nil {
+		t.Fatal(err)
+	}
+	t1.SetValue([]byte("9"))
+	p.virtualLock.Lock()
+	sources := len(p.virtualSources)
+	p.virtualLock.Unlock()
+	if sources != 0 {
+		t.Errorf("%d sources kept once the virtual device is removed", sources)
+	}
+}
+
+func TestInvalidVirtualDevices(t *testing.T) {
+	p := newTestAdapter(t, &Dbus{}, nil)
+	addTestItem(t, addTestDevice(t, p, "D1", "T"), "Temp", "T")
+
+	for name, sources := range map[string]map[string][]string{
+		"unknown device": {"Temp": {"D9/Temp"}},
+		"unknown item":   {"Temp": {"D1/Hum"}},
+		"no source":      {"Temp": {}},
+		"not devID/item": {"Temp": {"D1"}},
+	} {
+		if _, err := p.AddVirtualDevice("V", sources); err == nil || err.Name != "org.freedesktop.DBus.Error.InvalidArgs" {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := p.AddVirtualDevice("D1", map[string][]string{"Temp": {"D1/Temp"}}); err != ErrIDTaken {
+		t.Errorf("taken devID: %v", err)
+	}
+	if hasDevice(p, "V") {
+		t.Error("invalid virtual device added")
+	}
+}